@@ -2,20 +2,28 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	auth "github.com/ericvolp12/go-bsky-feed-generator/pkg/auth"
 	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/firehose"
 	ginendpoints "github.com/ericvolp12/go-bsky-feed-generator/pkg/gin"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/store"
 
 	staticfeed "github.com/ericvolp12/go-bsky-feed-generator/pkg/feeds/static"
 	ginprometheus "github.com/ericvolp12/go-gin-prometheus"
 	"github.com/gin-gonic/gin"
+	lru "github.com/hashicorp/golang-lru"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
@@ -23,10 +31,21 @@ import (
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+
+	// Feed types available to the feed config file
+	_ "github.com/ericvolp12/go-bsky-feed-generator/pkg/feeds/composite"
+	_ "github.com/ericvolp12/go-bsky-feed-generator/pkg/feeds/curated"
+	_ "github.com/ericvolp12/go-bsky-feed-generator/pkg/feeds/following"
+	_ "github.com/ericvolp12/go-bsky-feed-generator/pkg/feeds/hashtag"
+	_ "github.com/ericvolp12/go-bsky-feed-generator/pkg/feeds/hot"
+	_ "github.com/ericvolp12/go-bsky-feed-generator/pkg/feeds/keyword"
+	_ "github.com/ericvolp12/go-bsky-feed-generator/pkg/feeds/pinned"
 )
 
 func main() {
-	ctx := context.Background()
+	// Cancel the root context on SIGINT or SIGTERM so the server and firehose can shut down cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Configure feed generator from environment variables
 
@@ -38,58 +57,117 @@ func main() {
 			log.Fatal(err)
 		}
 		defer func() {
-			if err := shutdown(ctx); err != nil {
+			if err := shutdown(context.Background()); err != nil {
 				log.Fatal(err)
 			}
 		}()
 	}
 
-	feedActorDID := os.Getenv("FEED_ACTOR_DID")
-	if feedActorDID == "" {
-		log.Fatal("FEED_ACTOR_DID environment variable must be set")
+	// feedgen publish and feedgen unpublish manage the feeds' generator records instead of serving them
+	if len(os.Args) > 1 && (os.Args[1] == "publish" || os.Args[1] == "unpublish") {
+		if err := runPublish(ctx, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	// serviceEndpoint is a URL that the feed generator will be available at
-	serviceEndpoint := os.Getenv("SERVICE_ENDPOINT")
-	if serviceEndpoint == "" {
-		log.Fatal("SERVICE_ENDPOINT environment variable must be set")
+	// Create a new feed router instance
+	feedRouter, err := newFeedRouter(ctx)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// Set the acceptable DIDs for the feed generator to respond to
-	// We'll default to the feedActorDID and the Service Endpoint as a did:web
-	serviceURL, err := url.Parse(serviceEndpoint)
+	feedActorDID := feedRouter.FeedActorDID.String()
+	serviceWebDID := feedRouter.ServiceDID.String()
+
+	log.Printf("service DID Web: %s", serviceWebDID)
+
+	// Open the post store that feeds index posts into and run its migrations
+	postStore, err := newPostStore(ctx)
 	if err != nil {
-		log.Fatal(fmt.Errorf("error parsing service endpoint: %w", err))
+		log.Fatal(fmt.Errorf("error creating post store: %w", err))
 	}
+	defer postStore.Close()
 
-	serviceWebDID := "did:web:" + serviceURL.Hostname()
+	if err := postStore.Migrate(ctx); err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("service DID Web: %s", serviceWebDID)
+	// Consume the firehose from a relay if one is configured
+	// Feeds that index posts as they're created register themselves as handlers on the firehose
+	var fh *firehose.Firehose
+	relayURL := os.Getenv("FIREHOSE_RELAY_URL")
+	if relayURL != "" {
+		fh, err = firehose.NewFirehose(ctx, relayURL)
+		if err != nil {
+			log.Fatal(fmt.Errorf("error creating firehose consumer: %w", err))
+		}
 
-	acceptableDIDs := []string{feedActorDID, serviceWebDID}
+		// Checkpoint our place in the stream so we can resume after a restart
+		fh.CursorStore, err = newCursorStore(ctx, postStore)
+		if err != nil {
+			log.Fatal(fmt.Errorf("error creating firehose cursor store: %w", err))
+		}
 
-	// Create a new feed router instance
-	feedRouter, err := feedrouter.NewFeedRouter(ctx, feedActorDID, serviceWebDID, acceptableDIDs, serviceEndpoint)
-	if err != nil {
-		log.Fatal(fmt.Errorf("error creating feed router: %w", err))
+		if rewind := os.Getenv("FIREHOSE_CURSOR_REWIND"); rewind != "" {
+			fh.Rewind, err = strconv.ParseInt(rewind, 10, 64)
+			if err != nil {
+				log.Fatal(fmt.Errorf("error parsing FIREHOSE_CURSOR_REWIND: %w", err))
+			}
+		}
+
+		// Remove deleted posts from the post store once, for every feed that indexes into it
+		fh.AddHandler(store.NewDeleteHandler(postStore))
 	}
 
-	// Here we can add feeds to the Feed Router instance
-	// Feeds conform to the Feed interface, which is defined in
-	// pkg/feedrouter/feedrouter.go
+	env := &feedrouter.FeedEnv{
+		FeedActorDID: feedActorDID,
+		Router:       feedRouter,
+		PostStore:    postStore,
+		FollowStore:  postStore,
+		Firehose:     fh,
+	}
 
-	// For demonstration purposes, we'll use a static feed generator
-	// that will always return the same feed skeleton (one post)
-	staticFeed, staticFeedAliases, err := staticfeed.NewStaticFeed(
-		ctx,
-		feedActorDID,
-		"static",
-		// This static post is the conversation that sparked this demo repo
-		[]string{"at://did:plc:q6gjnaw2blty4crticxkmujt/app.bsky.feed.post/3jx7msc4ive26"},
-	)
+	if err := registerFeeds(ctx, env); err != nil {
+		log.Fatal(err)
+	}
 
-	// Add the static feed to the feed generator
-	feedRouter.AddFeed(staticFeedAliases, staticFeed)
+	if configPath := os.Getenv("FEEDS_CONFIG"); configPath != "" {
+		// Reload the feed config on SIGHUP, and when the file changes if FEEDS_CONFIG_WATCH_INTERVAL is set
+		// A config that fails to load is logged and the running feeds are left as they were
+		watchInterval := time.Duration(0)
+		if interval := os.Getenv("FEEDS_CONFIG_WATCH_INTERVAL"); interval != "" {
+			watchInterval, err = time.ParseDuration(interval)
+			if err != nil {
+				log.Fatal(fmt.Errorf("error parsing FEEDS_CONFIG_WATCH_INTERVAL: %w", err))
+			}
+		}
+
+		go watchFeedConfig(ctx, configPath, watchInterval, func() {
+			feedConfig, err := feedrouter.LoadConfig(configPath)
+			if err != nil {
+				log.Printf("error reloading feed config %s: %v", configPath, err)
+				return
+			}
+
+			if err := feedRouter.LoadFeeds(ctx, env, feedConfig); err != nil {
+				log.Printf("error reloading feeds from %s, keeping the running feeds: %v", configPath, err)
+			}
+		})
+	}
+
+	// Start the firehose once every feed has registered its handlers
+	firehoseDone := make(chan struct{})
+	if fh != nil {
+		go func() {
+			defer close(firehoseDone)
+			if err := fh.Run(ctx, -1); err != nil {
+				log.Printf("firehose consumer stopped: %v", err)
+			}
+		}()
+	} else {
+		close(firehoseDone)
+	}
 
 	// Create a gin router with default middleware for logging and recovery
 	router := gin.Default()
@@ -110,33 +188,282 @@ func main() {
 
 	// Add unauthenticated routes for feed generator
 	ep := ginendpoints.NewEndpoints(feedRouter)
+	ep.InteractionStore = postStore
 	router.GET("/.well-known/did.json", ep.GetWellKnownDID)
 	router.GET("/xrpc/app.bsky.feed.describeFeedGenerator", ep.DescribeFeeds)
 
 	// Plug in Authentication Middleware
+	// PERSIST_KEY_CACHE keeps signing keys in the post store's database so they survive restarts
+	authOpts := []auth.Option{}
+	if persist, _ := strconv.ParseBool(os.Getenv("PERSIST_KEY_CACHE")); persist {
+		keyStore, err := auth.NewSQLKeyStore(ctx, postStore.DB)
+		if err != nil {
+			log.Fatal(fmt.Errorf("error creating key store: %w", err))
+		}
+		authOpts = append(authOpts, auth.WithKeyStore(keyStore))
+	}
+
 	auther, err := auth.NewAuth(
 		10000,
 		time.Hour*1,
 		"https://plc.directory",
 		5,
 		serviceWebDID,
+		authOpts...,
 	)
 	if err != nil {
 		log.Fatalf("Failed to create Auth: %v", err)
 	}
 
+	// REQUIRE_AUTH rejects anonymous viewers for every feed, otherwise each feed decides whether it serves them
+	auther.RequireAuth, _ = strconv.ParseBool(os.Getenv("REQUIRE_AUTH"))
+
+	if loaded, err := auther.WarmKeyCache(ctx); err != nil {
+		log.Printf("error warming key cache: %v", err)
+	} else if loaded > 0 {
+		log.Printf("warmed key cache with %d stored keys", loaded)
+	}
+
+	// Tune service JWT validation, tokens are accepted JWT_CLOCK_SKEW either side of their exp and iat
+	// and JWT_REPLAY_CACHE_SIZE remembers that many token IDs (jti) to reject replayed tokens
+	if skew := os.Getenv("JWT_CLOCK_SKEW"); skew != "" {
+		auther.ClockSkew, err = time.ParseDuration(skew)
+		if err != nil {
+			log.Fatal(fmt.Errorf("error parsing JWT_CLOCK_SKEW: %w", err))
+		}
+	}
+
+	if size := os.Getenv("JWT_REPLAY_CACHE_SIZE"); size != "" {
+		cacheSize, err := strconv.Atoi(size)
+		if err != nil {
+			log.Fatal(fmt.Errorf("error parsing JWT_REPLAY_CACHE_SIZE: %w", err))
+		}
+
+		auther.JTICache, err = lru.New(cacheSize)
+		if err != nil {
+			log.Fatal(fmt.Errorf("error creating JWT replay cache: %w", err))
+		}
+	}
+
+	// Add the admin API if an admin credential is configured, ahead of the viewer JWT middleware
+	// Admins authenticate with ADMIN_TOKEN as a bearer token, or a JWT from one of the DIDs in ADMIN_DIDS
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	adminDIDs := []string{}
+	for _, did := range strings.Split(os.Getenv("ADMIN_DIDS"), ",") {
+		if did = strings.TrimSpace(did); did != "" {
+			adminDIDs = append(adminDIDs, did)
+		}
+	}
+
+	if adminToken != "" || len(adminDIDs) > 0 {
+		adminAuth, err := auth.NewAdminAuth(adminToken, adminDIDs, auther)
+		if err != nil {
+			log.Fatalf("Failed to create AdminAuth: %v", err)
+		}
+
+		admin := router.Group("/admin", adminAuth.AuthenticateGinRequest)
+		admin.GET("/feeds", ep.ListFeeds)
+		admin.GET("/feeds/:name", ep.GetFeed)
+		admin.PUT("/feeds/:name/aliases", ep.SetFeedAliases)
+		admin.POST("/feeds/:name/aliases", ep.AddFeedAlias)
+		admin.DELETE("/feeds/:name/aliases/:alias", ep.RemoveFeedAlias)
+		admin.POST("/feeds/:name/pinned", ep.PinFeedPost)
+		admin.DELETE("/feeds/:name/pinned", ep.UnpinFeedPost)
+		admin.POST("/feeds/:name/removed", ep.RemoveFeedPost)
+		admin.DELETE("/feeds/:name/removed", ep.RestoreFeedPost)
+		admin.POST("/feeds/:name/reindex", ep.ReindexFeed)
+	}
+
 	router.Use(auther.AuthenticateGinRequestViaJWT)
 
 	// Add authenticated routes for feed generator
 	router.GET("/xrpc/app.bsky.feed.getFeedSkeleton", ep.GetFeedSkeleton)
+	router.POST("/xrpc/app.bsky.feed.sendInteractions", ep.SendInteractions)
+
+	// Answer unknown routes with XRPC errors too
+	router.NoRoute(ep.NoRoute)
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	log.Printf("Starting server on port %s", port)
-	router.Run(fmt.Sprintf(":%s", port))
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%s", port),
+		Handler: router,
+	}
+
+	go func() {
+		log.Printf("Starting server on port %s", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("error shutting down server: %v", err)
+	}
+
+	// Wait for the firehose to write its final checkpoint
+	<-firehoseDone
+}
+
+// newFeedRouter returns a FeedRouter for the FEED_ACTOR_DID and SERVICE_ENDPOINT environment variables
+func newFeedRouter(ctx context.Context) (*feedrouter.FeedRouter, error) {
+	feedActorDID := os.Getenv("FEED_ACTOR_DID")
+	if feedActorDID == "" {
+		return nil, fmt.Errorf("FEED_ACTOR_DID environment variable must be set")
+	}
+
+	// serviceEndpoint is a URL that the feed generator will be available at
+	serviceEndpoint := os.Getenv("SERVICE_ENDPOINT")
+	if serviceEndpoint == "" {
+		return nil, fmt.Errorf("SERVICE_ENDPOINT environment variable must be set")
+	}
+
+	// Set the acceptable DIDs for the feed generator to respond to
+	// We'll default to the feedActorDID and the Service Endpoint as a did:web
+	serviceURL, err := url.Parse(serviceEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing service endpoint: %w", err)
+	}
+
+	serviceWebDID := "did:web:" + serviceURL.Hostname()
+
+	acceptableDIDs := []string{feedActorDID, serviceWebDID}
+
+	feedRouter, err := feedrouter.NewFeedRouter(ctx, feedActorDID, serviceWebDID, acceptableDIDs, serviceEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error creating feed router: %w", err)
+	}
+
+	return feedRouter, nil
+}
+
+// registerFeeds adds the demo static feed and the feeds declared in FEEDS_CONFIG to the router in env
+func registerFeeds(ctx context.Context, env *feedrouter.FeedEnv) error {
+	// Here we can add feeds to the Feed Router instance
+	// Feeds conform to the Feed interface, which is defined in
+	// pkg/feedrouter/feedrouter.go
+
+	// For demonstration purposes, we'll use a static feed generator
+	// that will always return the same feed skeleton (one post)
+	staticFeed, staticFeedAliases, err := staticfeed.NewStaticFeed(
+		ctx,
+		env.FeedActorDID,
+		"static",
+		// This static post is the conversation that sparked this demo repo
+		[]string{"at://did:plc:q6gjnaw2blty4crticxkmujt/app.bsky.feed.post/3jx7msc4ive26"},
+	)
+	if err != nil {
+		return fmt.Errorf("error creating static feed: %w", err)
+	}
+
+	// Add the static feed to the feed generator
+	env.Router.AddFeed(staticFeedAliases, staticFeed)
+
+	// Feeds added in code declare how they're published here, config feeds declare it in the config
+	err = env.Router.SetFeedMetadata("static", feedrouter.FeedMetadata{
+		DisplayName: "Static",
+		Description: "The conversation that sparked this demo repo",
+	})
+	if err != nil {
+		return err
+	}
+
+	// Load the feeds declared in the feed config file, if there is one
+	// Feed types are registered by importing their packages, see the imports above
+	configPath := os.Getenv("FEEDS_CONFIG")
+	if configPath == "" {
+		return nil
+	}
+
+	feedConfig, err := feedrouter.LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("error loading feed config %s: %w", configPath, err)
+	}
+
+	if err := env.Router.LoadFeeds(ctx, env, feedConfig); err != nil {
+		return fmt.Errorf("error loading feeds from %s: %w", configPath, err)
+	}
+
+	log.Printf("loaded %d feeds from %s", len(feedConfig.Feeds), configPath)
+
+	return nil
+}
+
+// newPostStore returns the PostStore configured by DATABASE_URL, which is either a
+// postgres:// URL or a sqlite:// path, defaulting to an embedded SQLite database
+func newPostStore(ctx context.Context) (*store.SQLStore, error) {
+	databaseURL := os.Getenv("DATABASE_URL")
+	if databaseURL == "" {
+		databaseURL = "sqlite://feedgen.db"
+	}
+
+	switch {
+	case strings.HasPrefix(databaseURL, "postgres://"), strings.HasPrefix(databaseURL, "postgresql://"):
+		return store.NewPostgresStore(ctx, databaseURL)
+	case strings.HasPrefix(databaseURL, "sqlite://"):
+		return store.NewSQLiteStore(ctx, strings.TrimPrefix(databaseURL, "sqlite://"))
+	default:
+		return nil, fmt.Errorf("unsupported DATABASE_URL (expected postgres:// or sqlite://)")
+	}
+}
+
+// newCursorStore returns the firehose CursorStore configured by the environment
+// FIREHOSE_CURSOR_FILE selects a file-backed store, otherwise the cursor is kept in the post store's database
+func newCursorStore(ctx context.Context, postStore *store.SQLStore) (firehose.CursorStore, error) {
+	if cursorFile := os.Getenv("FIREHOSE_CURSOR_FILE"); cursorFile != "" {
+		return firehose.NewFileCursorStore(cursorFile)
+	}
+
+	return firehose.NewSQLCursorStore(ctx, postStore.DB, "firehose")
+}
+
+// watchFeedConfig calls reload whenever the process gets a SIGHUP, and when the config file's
+// modification time or size changes if interval is positive, until the context is cancelled
+func watchFeedConfig(ctx context.Context, path string, interval time.Duration, reload func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var poll <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	lastStat, _ := os.Stat(path)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("got SIGHUP, reloading feed config %s", path)
+			lastStat, _ = os.Stat(path)
+			reload()
+		case <-poll:
+			stat, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if lastStat != nil && stat.ModTime().Equal(lastStat.ModTime()) && stat.Size() == lastStat.Size() {
+				continue
+			}
+			lastStat = stat
+
+			log.Printf("feed config %s changed, reloading", path)
+			reload()
+		}
+	}
 }
 
 // installExportPipeline registers a trace provider instance as a global trace provider,
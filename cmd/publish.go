@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/publish"
+)
+
+// runPublish publishes or unpublishes the generator records of every feed registered in the router
+// It logs into the PDS of FEED_ACTOR_DID with the app password in PUBLISH_APP_PASSWORD
+func runPublish(ctx context.Context, command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+
+	pdsHost := os.Getenv("PUBLISH_PDS_HOST")
+	if pdsHost == "" {
+		pdsHost = "https://bsky.social"
+	}
+
+	pds := flags.String("pds", pdsHost, "PDS to write the generator records to")
+	handle := flags.String("handle", os.Getenv("PUBLISH_HANDLE"), "handle or DID to log in as, defaults to FEED_ACTOR_DID")
+	only := flags.String("feeds", "", "comma separated record keys to "+command+", defaults to every feed")
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	password := os.Getenv("PUBLISH_APP_PASSWORD")
+	if password == "" {
+		return fmt.Errorf("PUBLISH_APP_PASSWORD environment variable must be set")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	feedRouter, err := newFeedRouter(ctx)
+	if err != nil {
+		return err
+	}
+
+	feedActorDID := feedRouter.FeedActorDID.String()
+
+	// Config feeds may read from the post store while they're built, but nothing is indexed while publishing
+	postStore, err := newPostStore(ctx)
+	if err != nil {
+		return fmt.Errorf("error creating post store: %w", err)
+	}
+	defer postStore.Close()
+
+	if err := postStore.Migrate(ctx); err != nil {
+		return err
+	}
+
+	env := &feedrouter.FeedEnv{
+		FeedActorDID: feedActorDID,
+		Router:       feedRouter,
+		PostStore:    postStore,
+		FollowStore:  postStore,
+	}
+
+	if err := registerFeeds(ctx, env); err != nil {
+		return err
+	}
+
+	feeds := publish.FeedsFromRouter(feedRouter)
+	if *only != "" {
+		selected := map[string]bool{}
+		for _, rkey := range strings.Split(*only, ",") {
+			selected[strings.TrimSpace(rkey)] = true
+		}
+
+		filtered := []publish.Feed{}
+		for _, feed := range feeds {
+			if selected[feed.RecordKey] {
+				filtered = append(filtered, feed)
+				delete(selected, feed.RecordKey)
+			}
+		}
+
+		// Record keys of feeds that aren't registered can still be unpublished, i.e. after removing a feed from the config
+		for rkey := range selected {
+			if command == "publish" {
+				return fmt.Errorf("feed %s is not registered", rkey)
+			}
+			filtered = append(filtered, publish.Feed{RecordKey: rkey})
+		}
+
+		feeds = filtered
+	}
+
+	identifier := *handle
+	if identifier == "" {
+		identifier = feedActorDID
+	}
+
+	publisher := publish.NewPublisher(*pds, feedRouter.ServiceDID.String())
+	if err := publisher.Login(ctx, identifier, password); err != nil {
+		return err
+	}
+
+	// Feed URIs are built from FEED_ACTOR_DID, so records in any other repo wouldn't be served
+	if publisher.DID != feedActorDID {
+		return fmt.Errorf("logged in as %s but FEED_ACTOR_DID is %s", publisher.DID, feedActorDID)
+	}
+
+	for _, feed := range feeds {
+		if command == "unpublish" {
+			deleted, err := publisher.Unpublish(ctx, feed.RecordKey)
+			if err != nil {
+				return err
+			}
+			if !deleted {
+				log.Printf("feed %s is not published, skipping", feed.RecordKey)
+				continue
+			}
+			log.Printf("unpublished %s", publisher.URI(feed.RecordKey))
+			continue
+		}
+
+		uri, err := publisher.Publish(ctx, feed)
+		if err != nil {
+			return err
+		}
+		log.Printf("published %s", uri)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/xrpc"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// AdminLexiconMethod is the lxm admin JWTs are scoped to by default
+const AdminLexiconMethod = "io.github.ericvolp12.feedgen.admin"
+
+// AdminAuth authenticates requests to the admin API, separately from the feed viewers' JWTs
+// A request is an admin if it carries the static bearer Token, or a JWT issued by one of the
+// allowlisted DIDs for the service, verified the same way as viewers' JWTs
+// JWTs must be scoped to LexiconMethod, so the getFeedSkeleton tokens an admin's AppView
+// forwards when they read a feed can't be replayed against the admin API
+type AdminAuth struct {
+	Token         string          // Static bearer token, disabled if empty
+	DIDs          map[string]bool // DIDs allowed to authenticate with a JWT
+	Auth          *Auth           // Verifies JWTs, required if DIDs is set
+	LexiconMethod string          // lxm admin JWTs must carry, defaults to AdminLexiconMethod
+}
+
+// NewAdminAuth returns a new AdminAuth for the given token and DIDs
+// At least one of them must be set so the admin API can't be left open
+func NewAdminAuth(token string, dids []string, auth *Auth) (*AdminAuth, error) {
+	if token == "" && len(dids) == 0 {
+		return nil, fmt.Errorf("an admin token or at least one admin DID is required")
+	}
+
+	if len(dids) > 0 && auth == nil {
+		return nil, fmt.Errorf("admin DIDs need an Auth to verify their JWTs")
+	}
+
+	allowed := map[string]bool{}
+	for _, did := range dids {
+		allowed[did] = true
+	}
+
+	return &AdminAuth{
+		Token:         token,
+		DIDs:          allowed,
+		Auth:          auth,
+		LexiconMethod: AdminLexiconMethod,
+	}, nil
+}
+
+// AuthenticateGinRequest aborts requests that aren't from an admin
+// The admin is set on the context as admin_actor, either "token" or their DID, for audit logs
+func (aa *AdminAuth) AuthenticateGinRequest(c *gin.Context) {
+	tracer := otel.Tracer("auth")
+	ctx, span := tracer.Start(c.Request.Context(), "AdminAuth:AuthenticateGinRequest")
+	defer span.End()
+
+	authHeader := c.GetHeader("Authorization")
+	accessToken, ok := strings.CutPrefix(authHeader, "Bearer ")
+	if !ok || accessToken == "" {
+		xrpc.AbortWithError(c, http.StatusUnauthorized, xrpc.AuthRequired, "Invalid Authorization header (expected Bearer)")
+		return
+	}
+
+	if aa.Token != "" && subtle.ConstantTimeCompare([]byte(accessToken), []byte(aa.Token)) == 1 {
+		c.Set("admin_actor", "token")
+		span.SetAttributes(attribute.String("admin.actor", "token"))
+		c.Next()
+		return
+	}
+
+	if len(aa.DIDs) == 0 {
+		xrpc.AbortWithError(c, http.StatusUnauthorized, xrpc.AuthRequired, "Invalid admin token")
+		return
+	}
+
+	claims := ServiceAuthClaims{}
+	if err := aa.Auth.GetClaimsFromAuthHeader(ctx, authHeader, &claims); err != nil {
+		xrpc.AbortWithError(c, http.StatusUnauthorized, xrpc.AuthRequired, fmt.Sprintf("Failed to get claims from auth header: %v", err))
+		return
+	}
+
+	// The admin API isn't XRPC, so tokens are held to a method of its own rather than the request path
+	lxm := aa.LexiconMethod
+	if lxm == "" {
+		lxm = AdminLexiconMethod
+	}
+
+	if err := aa.Auth.ValidateServiceAuth(&claims, lxm); err != nil {
+		xrpc.AbortWithError(c, http.StatusUnauthorized, xrpc.AuthRequired, err.Error())
+		return
+	}
+
+	if !aa.DIDs[claims.Issuer] {
+		xrpc.AbortWithError(c, http.StatusForbidden, xrpc.Forbidden, fmt.Sprintf("%s is not an admin", claims.Issuer))
+		return
+	}
+
+	c.Set("admin_actor", claims.Issuer)
+	span.SetAttributes(attribute.String("admin.actor", claims.Issuer))
+	c.Next()
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"crypto/elliptic"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+)
+
+func TestAdminAuthRequiresAdminLexiconMethod(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	signingKey := generateKey(t, elliptic.P256())
+	multibaseKey := encodeMultibase(t, multicodecP256Pub, elliptic.MarshalCompressed(elliptic.P256(), signingKey.X, signingKey.Y))
+
+	server, admin := newDIDWebHost(t, map[string]func(string) string{
+		"/.well-known/did.json": func(hostDID string) string {
+			return fmt.Sprintf(`{"id": %q, "verificationMethod": [{"id": "#atproto", "type": "Multikey", "publicKeyMultibase": %q}]}`, hostDID, multibaseKey)
+		},
+	})
+
+	serviceDID := "did:web:feedsky.jazco.io"
+	auth, err := NewAuth(10, time.Hour, "https://plc.directory", 100, serviceDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.Resolver = newLocalMethodResolver(auth.PLCDirectory, server.Client())
+
+	adminAuth, err := NewAdminAuth("", []string{admin}, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.GET("/admin/feeds", adminAuth.AuthenticateGinRequest, func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("admin_actor"))
+	})
+
+	sign := func(lxm string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, &ServiceAuthClaims{
+			StandardClaims: jwt.StandardClaims{
+				Issuer:    admin,
+				Audience:  serviceDID,
+				ExpiresAt: time.Now().Add(time.Minute).Unix(),
+			},
+			LexiconMethod: lxm,
+		})
+		signed, err := token.SignedString(signingKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + signed
+	}
+
+	tests := []struct {
+		name string
+		lxm  string
+		want int
+	}{
+		{name: "admin lxm", lxm: AdminLexiconMethod, want: http.StatusOK},
+		{name: "getFeedSkeleton lxm", lxm: "app.bsky.feed.getFeedSkeleton", want: http.StatusUnauthorized},
+		{name: "missing lxm", lxm: "", want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/admin/feeds", nil)
+		req.Header.Set("Authorization", sign(tt.lxm))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body.String())
+		}
+		if tt.want == http.StatusOK && w.Body.String() != admin {
+			t.Errorf("%s: got admin actor %q, want %q", tt.name, w.Body.String(), admin)
+		}
+	}
+}
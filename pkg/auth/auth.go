@@ -3,44 +3,28 @@ package auth
 import (
 	"context"
 	"crypto/ecdsa"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/decred/dcrd/dcrec/secp256k1"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/xrpc"
 	es256k "github.com/ericvolp12/jwt-go-secp256k1"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt"
 	lru "github.com/hashicorp/golang-lru"
-	"github.com/multiformats/go-multibase"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 )
 
-type PLCEntry struct {
-	Context            []string `json:"@context"`
-	ID                 string   `json:"id"`
-	AlsoKnownAs        []string `json:"alsoKnownAs"`
-	VerificationMethod []struct {
-		ID                 string `json:"id"`
-		Type               string `json:"type"`
-		Controller         string `json:"controller"`
-		PublicKeyMultibase string `json:"publicKeyMultibase"`
-	} `json:"verificationMethod"`
-	Service []struct {
-		ID              string `json:"id"`
-		Type            string `json:"type"`
-		ServiceEndpoint string `json:"serviceEndpoint"`
-	} `json:"service"`
-}
-
 type KeyCacheEntry struct {
 	UserDID   string
 	Key       *ecdsa.PublicKey
@@ -63,6 +47,11 @@ var cacheSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Help: "The size of the cache in bytes",
 }, []string{"cache_type"})
 
+var forcedKeyRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "bsky_forced_key_refreshes_total",
+	Help: "The total number of signing key refreshes forced by a signature mismatch against a cached key, by result",
+}, []string{"result"})
+
 type Auth struct {
 	KeyCache     *lru.ARCCache
 	KeyCacheTTL  time.Duration
@@ -70,6 +59,35 @@ type Auth struct {
 	Limiter      *rate.Limiter
 	ServiceDID   string
 	PLCDirectory string
+	Resolver     DIDResolver // Resolves JWT issuers to their DID documents
+
+	// KeyRefreshCooldown is how long a DID has to wait between forced key refreshes
+	KeyRefreshCooldown time.Duration
+
+	ClockSkew time.Duration // Leeway for the exp and iat claims of tokens from hosts with drifting clocks
+	JTICache  *lru.Cache    // Remembers the jti of seen tokens to reject replays, nil allows replays
+
+	// KeyStore persists keys behind the KeyCache so they survive restarts, nil to only cache keys in memory
+	KeyStore KeyStore
+
+	// RequireAuth rejects requests without an Authorization header, otherwise they're let through
+	// without a user_did and each feed decides whether to serve anonymous viewers
+	RequireAuth bool
+
+	keyCacheSize  int
+	refreshLk     sync.Mutex
+	lastRefreshes *lru.Cache // DID -> time of its last forced key refresh
+}
+
+// Option configures an Auth in NewAuth
+type Option func(*Auth) error
+
+// WithKeyStore adds a KeyStore behind the in-memory key cache, see Auth.WarmKeyCache to load it at startup
+func WithKeyStore(keyStore KeyStore) Option {
+	return func(auth *Auth) error {
+		auth.KeyStore = keyStore
+		return nil
+	}
 }
 
 // NewAuth creates a new Auth instance with the given key cache size and TTL
@@ -78,20 +96,31 @@ type Auth struct {
 // The key cache is used to cache the public keys of users for a given TTL
 // The PLC Directory URL is used to fetch the public keys of users
 // The service DID is used to validate the audience of JWTs
-// The HTTP client is used to make requests to the PLC Directory
-// A rate limiter is used to limit the number of requests to the PLC Directory
+// The HTTP client is used to make requests to the PLC Directory and did:web hosts
+// A rate limiter is used to limit the number of DID resolution requests
+// JWT issuers are resolved with a MethodResolver, supporting did:plc and did:web,
+// behind a CoalescingResolver so a burst of requests from one DID only resolves it once
+// A token that fails to verify against a cached key forces one refresh of the issuer's key,
+// at most once per KeyRefreshCooldown per DID, in case the issuer has rotated their key
+// Options configure the rest, i.e. WithKeyStore to keep keys across restarts
 func NewAuth(
 	keyCacheSize int,
 	keyCacheTTL time.Duration,
 	plcDirectory string,
 	requestsPerSecond int,
 	serviceDID string,
+	opts ...Option,
 ) (*Auth, error) {
 	keyCache, err := lru.NewARC(keyCacheSize)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create key cache: %v", err)
 	}
 
+	lastRefreshes, err := lru.New(keyCacheSize)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create key refresh cache: %v", err)
+	}
+
 	// Initialize the HTTP client with OpenTelemetry instrumentation
 	client := http.Client{
 		Transport: otelhttp.NewTransport(http.DefaultTransport),
@@ -99,17 +128,44 @@ func NewAuth(
 
 	timeBetweenRequests := time.Duration(float64(time.Second) / float64(requestsPerSecond))
 
-	// Initialize the rate limiter for PLC Directory requests
+	// Initialize the rate limiter for DID resolution requests
 	limiter := rate.NewLimiter(rate.Every(timeBetweenRequests), 1)
 
-	return &Auth{
+	// did:web hosts come from unauthenticated tokens, so they're only dialed on public addresses
+	methods := NewMethodResolver(plcDirectory, &client, limiter)
+	methods.Methods["web"] = &WebResolver{
+		HTTPClient: &http.Client{Transport: otelhttp.NewTransport(PublicTransport())},
+		Limiter:    limiter,
+	}
+
+	// Concurrent resolutions of a DID share one fetch, and DIDs that fail to resolve are left alone for a bit
+	resolver, err := NewCoalescingResolver(methods, keyCacheSize, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &Auth{
 		KeyCache:     keyCache,
 		KeyCacheTTL:  keyCacheTTL,
 		PLCDirectory: plcDirectory,
 		HTTPClient:   &client,
 		ServiceDID:   serviceDID,
 		Limiter:      limiter,
-	}, nil
+		Resolver:     resolver,
+
+		KeyRefreshCooldown: time.Minute,
+		ClockSkew:          30 * time.Second,
+		keyCacheSize:       keyCacheSize,
+		lastRefreshes:      lastRefreshes,
+	}
+
+	for _, opt := range opts {
+		if err := opt(auth); err != nil {
+			return nil, err
+		}
+	}
+
+	return auth, nil
 }
 
 func (auth *Auth) GetClaimsFromAuthHeader(ctx context.Context, authHeader string, claims jwt.Claims) error {
@@ -133,119 +189,284 @@ func (auth *Auth) GetClaimsFromAuthHeader(ctx context.Context, authHeader string
 
 	accessToken := authHeaderParts[1]
 
-	parser := jwt.Parser{
-		ValidMethods: []string{es256k.SigningMethodES256K.Alg()},
+	token, issuer, cached, err := auth.parseToken(ctx, accessToken, claims, false)
+	if err != nil && cached && isKeyMismatch(err) {
+		// The issuer may have rotated their key since we cached it, check their DID document once more
+		if !auth.allowKeyRefresh(issuer) {
+			forcedKeyRefreshes.WithLabelValues("throttled").Inc()
+		} else {
+			span.SetAttributes(attribute.Bool("caches.keys.forced_refresh", true))
+			token, _, _, err = auth.parseToken(ctx, accessToken, claims, true)
+			switch {
+			case err == nil:
+				forcedKeyRefreshes.WithLabelValues("verified").Inc()
+			case isKeyMismatch(err):
+				forcedKeyRefreshes.WithLabelValues("rejected").Inc()
+			default:
+				forcedKeyRefreshes.WithLabelValues("error").Inc()
+			}
+		}
 	}
 
-	token, err := parser.ParseWithClaims(accessToken, claims, func(token *jwt.Token) (interface{}, error) {
-		if claims, ok := token.Claims.(*jwt.StandardClaims); ok {
-			// Get the user's key from PLC Directory
-			userDID := claims.Issuer
-			entry, ok := auth.KeyCache.Get(userDID)
-			if ok {
-				cacheEntry := entry.(KeyCacheEntry)
-				if cacheEntry.ExpiresAt.After(time.Now()) {
-					if cacheEntry.ExpiresAt.After(time.Now()) {
-						cacheHits.WithLabelValues("key").Inc()
-						span.SetAttributes(attribute.Bool("caches.keys.hit", true))
-						return cacheEntry.Key, nil
-					}
-				}
-			}
+	if err != nil {
+		return fmt.Errorf("Failed to parse authorization token: %v", err)
+	}
 
-			cacheMisses.WithLabelValues("key").Inc()
-			span.SetAttributes(attribute.Bool("caches.keys.hit", false))
+	if !token.Valid {
+		return fmt.Errorf("Invalid authorization token")
+	}
 
-			// Get the user's key from PLC Directory
-			plcEntry, err := auth.GetPLCEntry(ctx, userDID)
-			if err != nil {
-				return nil, fmt.Errorf("Failed to get PLC Entry: %v", err)
-			}
+	return nil
+}
 
-			// Check if the PLC Entry has a verification method
-			if len(plcEntry.VerificationMethod) == 0 {
-				return nil, fmt.Errorf("No verification method found in PLC Entry")
-			}
+// parseToken parses and verifies a JWT with its issuer's signing key, skipping the key cache if forceRefresh is set
+// It returns the issuer and whether the key came from the cache, so a failure against a cached key can be retried
+func (auth *Auth) parseToken(ctx context.Context, accessToken string, claims jwt.Claims, forceRefresh bool) (token *jwt.Token, issuer string, cached bool, err error) {
+	parser := jwt.Parser{
+		ValidMethods: []string{es256k.SigningMethodES256K.Alg(), jwt.SigningMethodES256.Alg()},
+	}
 
-			// Get the multibase key from the PLC Entry's first verification method
-			// TODO: Support multiple verification methods
-			multibaseKey := plcEntry.VerificationMethod[0].PublicKeyMultibase
+	token, err = parser.ParseWithClaims(accessToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if tokenIssuer, ok := claimsIssuer(token.Claims); ok {
+			issuer = tokenIssuer
 
-			// Decode the multibase key
-			_, decodedMultibaseKey, err := multibase.Decode(multibaseKey)
+			key, fromCache, err := auth.getSigningKey(ctx, issuer, forceRefresh)
 			if err != nil {
-				return nil, fmt.Errorf("Failed to decode multibase key: %v", err)
+				return nil, err
 			}
+			cached = fromCache
 
-			// Parse the public key from the decoded multibase key
-			pub, err := secp256k1.ParsePubKey(decodedMultibaseKey)
+			// Make sure the token is signed with the algorithm for the issuer's key type
+			// so a key can't be used to verify a signature made for another curve
+			method, err := signingMethodForKey(key)
 			if err != nil {
-				return nil, fmt.Errorf("Failed to parse public key from decoded multibase key: %v", err)
+				return nil, err
+			}
+			if token.Method.Alg() != method.Alg() {
+				return nil, errKeyAlgMismatch{tokenAlg: token.Method.Alg(), keyAlg: method.Alg()}
 			}
 
-			// Convert the public key to an ECDSA public key
-			ecdsaPubKey := pub.ToECDSA()
-
-			// Add the ECDSA key to the cache
-			auth.KeyCache.Add(userDID, KeyCacheEntry{
-				Key:       ecdsaPubKey,
-				ExpiresAt: time.Now().Add(auth.KeyCacheTTL),
-			})
-
-			return ecdsaPubKey, nil
+			return key, nil
 		}
 
 		return nil, fmt.Errorf("Invalid authorization token (failed to parse claims)")
 	})
 
-	if err != nil {
-		return fmt.Errorf("Failed to parse authorization token: %v", err)
+	return token, issuer, cached, err
+}
+
+// claimsIssuer returns the issuer of the claims types GetClaimsFromAuthHeader supports
+func claimsIssuer(claims jwt.Claims) (string, bool) {
+	switch claims := claims.(type) {
+	case *jwt.StandardClaims:
+		return claims.Issuer, true
+	case *ServiceAuthClaims:
+		return claims.Issuer, true
+	default:
+		return "", false
 	}
+}
 
-	if !token.Valid {
-		return fmt.Errorf("Invalid authorization token")
+// errKeyAlgMismatch is returned when a token is signed with an algorithm the issuer's key can't verify
+type errKeyAlgMismatch struct {
+	tokenAlg string
+	keyAlg   string
+}
+
+func (e errKeyAlgMismatch) Error() string {
+	return fmt.Sprintf("Token is signed with %s but the issuer's key needs %s", e.tokenAlg, e.keyAlg)
+}
+
+// isKeyMismatch reports whether a token failed to verify because of the key it was checked against,
+// either a bad signature or a key for another curve, as opposed to a malformed or expired token
+func isKeyMismatch(err error) bool {
+	var validationErr *jwt.ValidationError
+	if !errors.As(err, &validationErr) {
+		return false
 	}
 
-	return nil
+	if validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
+		return true
+	}
+
+	var algErr errKeyAlgMismatch
+	return errors.As(validationErr.Inner, &algErr)
 }
 
-func (auth *Auth) GetPLCEntry(ctx context.Context, did string) (*PLCEntry, error) {
-	tracer := otel.Tracer("auth")
-	ctx, span := tracer.Start(ctx, "Auth:GetPLCEntry")
-	defer span.End()
+// allowKeyRefresh reports whether a DID's key can be force refreshed, recording the refresh if so
+// Each DID gets one forced refresh per KeyRefreshCooldown so bad tokens can't be used to hammer DID resolution
+func (auth *Auth) allowKeyRefresh(did string) bool {
+	if auth.lastRefreshes == nil {
+		return false
+	}
+
+	auth.refreshLk.Lock()
+	defer auth.refreshLk.Unlock()
+
+	now := time.Now()
+	if last, ok := auth.lastRefreshes.Get(did); ok && now.Sub(last.(time.Time)) < auth.KeyRefreshCooldown {
+		return false
+	}
+
+	auth.lastRefreshes.Add(did, now)
+	return true
+}
+
+// getSigningKey returns the atproto signing key of a DID, from the key cache, the KeyStore, or its DID document
+// forceRefresh skips the caches and replaces the cached key with the one in the DID document
+// The returned bool is whether the key came from a cache
+func (auth *Auth) getSigningKey(ctx context.Context, userDID string, forceRefresh bool) (*ecdsa.PublicKey, bool, error) {
+	span := trace.SpanFromContext(ctx)
+
+	if !forceRefresh {
+		entry, ok := auth.KeyCache.Get(userDID)
+		if ok {
+			cacheEntry := entry.(KeyCacheEntry)
+			if cacheEntry.ExpiresAt.After(time.Now()) {
+				cacheHits.WithLabelValues("key").Inc()
+				span.SetAttributes(attribute.Bool("caches.keys.hit", true))
+				return cacheEntry.Key, true, nil
+			}
+		}
 
-	// Wait for the rate limiter
-	auth.Limiter.Wait(ctx)
+		cacheMisses.WithLabelValues("key").Inc()
+		span.SetAttributes(attribute.Bool("caches.keys.hit", false))
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s", auth.PLCDirectory, did), nil)
+		if auth.KeyStore != nil {
+			key, ok := auth.getStoredKey(ctx, userDID)
+			if ok {
+				cacheHits.WithLabelValues("key_store").Inc()
+				span.SetAttributes(attribute.Bool("caches.key_store.hit", true))
+				return key, true, nil
+			}
+
+			cacheMisses.WithLabelValues("key_store").Inc()
+			span.SetAttributes(attribute.Bool("caches.key_store.hit", false))
+		}
+	}
+
+	// Get the user's key from their DID document
+	didDoc, err := auth.ResolveDID(ctx, userDID)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to resolve DID: %v", err)
+	}
+
+	// Use the key from the #atproto verification method, decoded for its curve
+	vm, err := atprotoVerificationMethod(didDoc)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create PLC Directory request: %v", err)
+		return nil, false, err
 	}
 
-	// Execute the request with the auth's instrumented HTTP client
-	resp, err := auth.HTTPClient.Do(req)
+	key, err := ParseMultibaseKey(vm.Type, vm.PublicKeyMultibase)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get user's entry from PLC Directory: %v", err)
+		return nil, false, fmt.Errorf("Failed to parse #atproto verification method: %v", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Failed to get user's entry from PLC Directory: %v", resp.Status)
+	// Add the ECDSA key to the cache
+	expiresAt := time.Now().Add(auth.KeyCacheTTL)
+	auth.KeyCache.Add(userDID, KeyCacheEntry{
+		UserDID:   userDID,
+		Key:       key,
+		ExpiresAt: expiresAt,
+	})
+
+	// The key is good without the KeyStore, so failing to store it only costs us a lookup after a restart
+	if auth.KeyStore != nil {
+		err := auth.KeyStore.PutKey(ctx, &StoredKey{
+			DID:                userDID,
+			Type:               vm.Type,
+			PublicKeyMultibase: vm.PublicKeyMultibase,
+			ExpiresAt:          expiresAt,
+		})
+		if err != nil {
+			span.RecordError(err)
+			log.Printf("failed to store key for %s: %v", userDID, err)
+		}
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	return key, false, nil
+}
+
+// getStoredKey returns an unexpired key from the KeyStore, promoting it to the in-memory key cache
+func (auth *Auth) getStoredKey(ctx context.Context, userDID string) (*ecdsa.PublicKey, bool) {
+	stored, err := auth.KeyStore.GetKey(ctx, userDID)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to read PLC Directory response: %v", err)
+		trace.SpanFromContext(ctx).RecordError(err)
+		log.Printf("failed to get stored key for %s: %v", userDID, err)
+		return nil, false
 	}
 
-	// Unmarshal into a PLC Entry
-	plcEntry := &PLCEntry{}
-	err = json.Unmarshal(body, plcEntry)
+	if stored == nil || !stored.ExpiresAt.After(time.Now()) {
+		return nil, false
+	}
+
+	key, err := stored.PublicKey()
+	if err != nil {
+		return nil, false
+	}
+
+	// Keep the stored expiry so a restart doesn't extend how long a key is trusted for
+	auth.KeyCache.Add(userDID, KeyCacheEntry{
+		UserDID:   userDID,
+		Key:       key,
+		ExpiresAt: stored.ExpiresAt,
+	})
+
+	return key, true
+}
+
+// WarmKeyCache fills the in-memory key cache with unexpired keys from the KeyStore, returning how many it loaded
+// Call it at startup so the first requests after a restart don't all have to resolve their DIDs
+func (auth *Auth) WarmKeyCache(ctx context.Context) (int, error) {
+	if auth.KeyStore == nil {
+		return 0, nil
+	}
+
+	tracer := otel.Tracer("auth")
+	ctx, span := tracer.Start(ctx, "Auth:WarmKeyCache")
+	defer span.End()
+
+	stored, err := auth.KeyStore.LoadKeys(ctx, auth.keyCacheSize)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to unmarshal PLC Entry: %v", err)
+		return 0, fmt.Errorf("Failed to load stored keys: %v", err)
 	}
 
-	return plcEntry, nil
+	// Add the oldest first so the most recently used keys are the last to be evicted
+	loaded := 0
+	for i := len(stored) - 1; i >= 0; i-- {
+		key, err := stored[i].PublicKey()
+		if err != nil {
+			continue
+		}
+
+		auth.KeyCache.Add(stored[i].DID, KeyCacheEntry{
+			UserDID:   stored[i].DID,
+			Key:       key,
+			ExpiresAt: stored[i].ExpiresAt,
+		})
+		loaded++
+	}
+
+	span.SetAttributes(attribute.Int("keys.loaded", loaded))
+
+	return loaded, nil
+}
+
+// ResolveDID resolves a DID to its DID document with the Auth's Resolver
+// Auths built without a Resolver fall back to resolving did:plc and did:web
+func (auth *Auth) ResolveDID(ctx context.Context, did string) (*DIDDocument, error) {
+	resolver := auth.Resolver
+	if resolver == nil {
+		resolver = NewMethodResolver(auth.PLCDirectory, auth.HTTPClient, auth.Limiter)
+	}
+
+	return resolver.ResolveDID(ctx, did)
+}
+
+// GetPLCEntry gets the DID document of a did:plc from the PLC Directory
+func (auth *Auth) GetPLCEntry(ctx context.Context, did string) (*PLCEntry, error) {
+	resolver := &PLCResolver{Directory: auth.PLCDirectory, HTTPClient: auth.HTTPClient, Limiter: auth.Limiter}
+	return resolver.ResolveDID(ctx, did)
 }
 
 func (auth *Auth) AuthenticateGinRequestViaJWT(c *gin.Context) {
@@ -255,23 +476,27 @@ func (auth *Auth) AuthenticateGinRequestViaJWT(c *gin.Context) {
 	authHeader := c.GetHeader("Authorization")
 	if authHeader == "" {
 		span.End()
+		if auth.RequireAuth {
+			xrpc.AbortWithError(c, http.StatusUnauthorized, xrpc.AuthRequired, "this feed generator requires an authenticated viewer")
+			return
+		}
 		c.Next()
 		return
 	}
 
-	claims := jwt.StandardClaims{}
+	claims := ServiceAuthClaims{}
 
 	err := auth.GetClaimsFromAuthHeader(ctx, authHeader, &claims)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": fmt.Errorf("Failed to get claims from auth header: %v", err).Error()})
+		xrpc.AbortWithError(c, http.StatusUnauthorized, xrpc.AuthRequired, fmt.Sprintf("Failed to get claims from auth header: %v", err))
 		span.End()
-		c.Abort()
 		return
 	}
 
-	if claims.Audience != auth.ServiceDID {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("Invalid audience (expected %s)", auth.ServiceDID)})
-		c.Abort()
+	// Tokens must be for this service and the XRPC method being called
+	if err := auth.ValidateServiceAuth(&claims, LexiconMethodForPath(c.Request.URL.Path)); err != nil {
+		xrpc.AbortWithError(c, http.StatusUnauthorized, xrpc.AuthRequired, err.Error())
+		span.End()
 		return
 	}
 
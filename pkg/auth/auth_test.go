@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+func TestGetClaimsFromAuthHeaderKeyRotation(t *testing.T) {
+	oldKey := generateKey(t, elliptic.P256())
+	newKey := generateKey(t, elliptic.P256())
+
+	currentKey := atomic.Pointer[ecdsa.PrivateKey]{}
+	currentKey.Store(oldKey)
+	requests := atomic.Int64{}
+
+	server, issuer := newDIDWebHost(t, map[string]func(string) string{
+		"/.well-known/did.json": func(hostDID string) string {
+			requests.Add(1)
+			key := currentKey.Load()
+			multibaseKey := encodeMultibase(t, multicodecP256Pub, elliptic.MarshalCompressed(elliptic.P256(), key.X, key.Y))
+			return fmt.Sprintf(`{"id": %q, "verificationMethod": [{"id": "#atproto", "type": "Multikey", "publicKeyMultibase": %q}]}`, hostDID, multibaseKey)
+		},
+	})
+
+	serviceDID := "did:web:feedsky.jazco.io"
+	auth, err := NewAuth(10, time.Hour, "https://plc.directory", 100, serviceDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.Resolver = newLocalMethodResolver(auth.PLCDirectory, server.Client())
+
+	sign := func(key *ecdsa.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, &jwt.StandardClaims{
+			Issuer:    issuer,
+			Audience:  serviceDID,
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		})
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + signed
+	}
+
+	ctx := context.Background()
+	verify := func(key *ecdsa.PrivateKey) error {
+		claims := jwt.StandardClaims{}
+		return auth.GetClaimsFromAuthHeader(ctx, sign(key), &claims)
+	}
+
+	// Cache the old key
+	if err := verify(oldKey); err != nil {
+		t.Fatalf("GetClaimsFromAuthHeader returned error: %v", err)
+	}
+
+	// After a rotation, the first token signed with the new key forces a refresh of the cached key
+	currentKey.Store(newKey)
+	if err := verify(newKey); err != nil {
+		t.Fatalf("GetClaimsFromAuthHeader returned error after a key rotation: %v", err)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("DID document was fetched %d times, want 2", requests.Load())
+	}
+
+	// The refreshed key is cached
+	if err := verify(newKey); err != nil {
+		t.Fatalf("GetClaimsFromAuthHeader returned error: %v", err)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("DID document was fetched %d times, want 2 with the new key cached", requests.Load())
+	}
+
+	// Tokens signed with a stale key are rejected, and only refresh once per cooldown
+	auth.KeyRefreshCooldown = 0
+	if err := verify(oldKey); err == nil {
+		t.Error("GetClaimsFromAuthHeader accepted a token signed with a rotated key")
+	}
+	if requests.Load() != 3 {
+		t.Errorf("DID document was fetched %d times, want 3", requests.Load())
+	}
+
+	auth.KeyRefreshCooldown = time.Hour
+	for i := 0; i < 3; i++ {
+		if err := verify(oldKey); err == nil {
+			t.Error("GetClaimsFromAuthHeader accepted a token signed with a rotated key")
+		}
+	}
+	if requests.Load() != 3 {
+		t.Errorf("DID document was fetched %d times, want 3 with refreshes in cooldown", requests.Load())
+	}
+}
+
+func TestValidateServiceAuth(t *testing.T) {
+	serviceDID := "did:web:feedsky.jazco.io"
+	lxm := "app.bsky.feed.getFeedSkeleton"
+	now := time.Now()
+
+	valid := func() *ServiceAuthClaims {
+		return &ServiceAuthClaims{
+			StandardClaims: jwt.StandardClaims{
+				Issuer:    "did:plc:q6gjnaw2blty4crticxkmujt",
+				Audience:  serviceDID,
+				IssuedAt:  now.Unix(),
+				ExpiresAt: now.Add(time.Minute).Unix(),
+			},
+			LexiconMethod: lxm,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(*ServiceAuthClaims)
+		lxm     string
+		wantErr bool
+	}{
+		{name: "valid", modify: func(*ServiceAuthClaims) {}, lxm: lxm},
+		{name: "wrong audience", modify: func(c *ServiceAuthClaims) { c.Audience = "did:web:example.com" }, lxm: lxm, wantErr: true},
+		{name: "expired", modify: func(c *ServiceAuthClaims) { c.ExpiresAt = now.Add(-time.Minute).Unix() }, lxm: lxm, wantErr: true},
+		{name: "expired within skew", modify: func(c *ServiceAuthClaims) { c.ExpiresAt = now.Add(-10 * time.Second).Unix() }, lxm: lxm},
+		{name: "issued in the future", modify: func(c *ServiceAuthClaims) { c.IssuedAt = now.Add(time.Minute).Unix() }, lxm: lxm, wantErr: true},
+		{name: "issued in the future within skew", modify: func(c *ServiceAuthClaims) { c.IssuedAt = now.Add(10 * time.Second).Unix() }, lxm: lxm},
+		{name: "wrong lxm", modify: func(c *ServiceAuthClaims) { c.LexiconMethod = "app.bsky.feed.getTimeline" }, lxm: lxm, wantErr: true},
+		{name: "missing lxm", modify: func(c *ServiceAuthClaims) { c.LexiconMethod = "" }, lxm: lxm, wantErr: true},
+		{name: "missing lxm outside XRPC", modify: func(c *ServiceAuthClaims) { c.LexiconMethod = "" }},
+	}
+
+	auth, err := NewAuth(10, time.Hour, "https://plc.directory", 100, serviceDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid()
+			tt.modify(claims)
+
+			err := auth.ValidateServiceAuth(claims, tt.lxm)
+			if tt.wantErr && err == nil {
+				t.Error("ValidateServiceAuth accepted invalid claims")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("ValidateServiceAuth returned error: %v", err)
+			}
+		})
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		auth.JTICache, err = lru.New(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		claims := valid()
+		claims.Id = "3kj2lfe5x2s2a"
+		if err := auth.ValidateServiceAuth(claims, lxm); err != nil {
+			t.Fatalf("ValidateServiceAuth returned error: %v", err)
+		}
+		if err := auth.ValidateServiceAuth(claims, lxm); err == nil {
+			t.Error("ValidateServiceAuth accepted a replayed token")
+		}
+
+		// jtis are only unique per issuer
+		claims.Issuer = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+		if err := auth.ValidateServiceAuth(claims, lxm); err != nil {
+			t.Errorf("ValidateServiceAuth rejected another issuer's token with the same jti: %v", err)
+		}
+	})
+}
+
+func TestLexiconMethodForPath(t *testing.T) {
+	tests := map[string]string{
+		"/xrpc/app.bsky.feed.getFeedSkeleton":       "app.bsky.feed.getFeedSkeleton",
+		"/xrpc/":                                    "",
+		"/xrpc/app.bsky.feed.getFeedSkeleton/extra": "",
+		"/admin/feeds":                              "",
+	}
+
+	for path, want := range tests {
+		if got := LexiconMethodForPath(path); got != want {
+			t.Errorf("LexiconMethodForPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// ServiceAuthClaims are the claims of an atproto inter-service JWT, i.e. the token an AppView
+// sends with getFeedSkeleton on behalf of a viewer
+type ServiceAuthClaims struct {
+	jwt.StandardClaims
+	LexiconMethod string `json:"lxm,omitempty"` // The XRPC method the token may be used for
+}
+
+// Valid checks the token has the claims atproto requires of service auth tokens
+// Expiry and issue time are checked with clock skew by Auth.ValidateServiceAuth instead,
+// jwt.StandardClaims.Valid doesn't allow for any
+func (c ServiceAuthClaims) Valid() error {
+	if c.Issuer == "" {
+		return fmt.Errorf("Token is missing an issuer (iss)")
+	}
+
+	if c.ExpiresAt == 0 {
+		return fmt.Errorf("Token is missing an expiry (exp)")
+	}
+
+	return nil
+}
+
+// ValidateServiceAuth checks the claims of a verified service auth token are for this service and this request
+// Tokens must be unexpired and not issued in the future, give or take ClockSkew,
+// and when lxm is set, their lxm claim has to match it
+// If a JTICache is configured, a token's jti can only be used once
+func (auth *Auth) ValidateServiceAuth(claims *ServiceAuthClaims, lxm string) error {
+	if claims.Audience != auth.ServiceDID {
+		return fmt.Errorf("Invalid audience (expected %s)", auth.ServiceDID)
+	}
+
+	now := time.Now()
+
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	if now.After(expiresAt.Add(auth.ClockSkew)) {
+		return fmt.Errorf("Token expired at %s", expiresAt.UTC().Format(time.RFC3339))
+	}
+
+	if claims.IssuedAt != 0 {
+		issuedAt := time.Unix(claims.IssuedAt, 0)
+		if issuedAt.After(now.Add(auth.ClockSkew)) {
+			return fmt.Errorf("Token issued in the future at %s", issuedAt.UTC().Format(time.RFC3339))
+		}
+	}
+
+	if lxm != "" && claims.LexiconMethod != lxm {
+		if claims.LexiconMethod == "" {
+			return fmt.Errorf("Token is missing a lexicon method (expected lxm %s)", lxm)
+		}
+		return fmt.Errorf("Token is for %s (expected lxm %s)", claims.LexiconMethod, lxm)
+	}
+
+	if auth.JTICache != nil && claims.Id != "" {
+		// Scope the jti by issuer, it's only unique among the issuer's tokens
+		if seen, _ := auth.JTICache.ContainsOrAdd(claims.Issuer+" "+claims.Id, claims.ExpiresAt); seen {
+			return fmt.Errorf("Token has already been used (jti %s)", claims.Id)
+		}
+	}
+
+	return nil
+}
+
+// LexiconMethodForPath returns the XRPC method a request path calls, i.e. app.bsky.feed.getFeedSkeleton
+// for /xrpc/app.bsky.feed.getFeedSkeleton, or "" if it isn't an XRPC path
+func LexiconMethodForPath(path string) string {
+	method, ok := strings.CutPrefix(path, "/xrpc/")
+	if !ok || strings.Contains(method, "/") {
+		return ""
+	}
+
+	return method
+}
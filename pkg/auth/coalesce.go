@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var didResolutions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "bsky_did_resolutions_total",
+	Help: "The total number of DID resolutions, by whether they were fetched, joined an in-flight fetch, or hit the negative cache",
+}, []string{"source"})
+
+var didResolutionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "bsky_did_resolution_duration_seconds",
+	Help:    "The time it takes to fetch a DID document, including waiting for the rate limiter",
+	Buckets: prometheus.DefBuckets,
+}, []string{"method", "result"})
+
+// CoalescingResolver wraps a DIDResolver so concurrent resolutions of a DID share a single fetch,
+// and DIDs that fail to resolve with an InvalidDIDError aren't fetched again until NegativeTTL has passed
+// Callers of a shared fetch get the same DIDDocument, which they mustn't modify
+type CoalescingResolver struct {
+	Resolver    DIDResolver
+	NegativeTTL time.Duration // How long an invalid DID is remembered, 0 to not remember failures
+	Timeout     time.Duration // Limits a shared fetch, which outlives the callers that give up on it
+
+	lk       sync.Mutex
+	inflight map[string]*resolution
+	failures *lru.Cache // DID -> failedResolution
+}
+
+// resolution is a fetch of a DID document that callers wait on, done is closed once doc or err is set
+type resolution struct {
+	done chan struct{}
+	doc  *DIDDocument
+	err  error
+}
+
+type failedResolution struct {
+	err       error
+	expiresAt time.Time
+}
+
+// NewCoalescingResolver wraps a DIDResolver, remembering up to negativeCacheSize failed DIDs for negativeTTL
+func NewCoalescingResolver(resolver DIDResolver, negativeCacheSize int, negativeTTL time.Duration) (*CoalescingResolver, error) {
+	failures, err := lru.New(negativeCacheSize)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create negative DID cache: %v", err)
+	}
+
+	return &CoalescingResolver{
+		Resolver:    resolver,
+		NegativeTTL: negativeTTL,
+		Timeout:     10 * time.Second,
+		inflight:    map[string]*resolution{},
+		failures:    failures,
+	}, nil
+}
+
+// ResolveDID resolves a DID, joining an in-flight fetch of the same DID if there is one
+// A caller whose context is cancelled stops waiting without cancelling the fetch for everyone else
+func (cr *CoalescingResolver) ResolveDID(ctx context.Context, did string) (*DIDDocument, error) {
+	tracer := otel.Tracer("auth")
+	ctx, span := tracer.Start(ctx, "CoalescingResolver:ResolveDID")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("did", did))
+
+	cr.lk.Lock()
+	if entry, ok := cr.failures.Get(did); ok {
+		failure := entry.(failedResolution)
+		if time.Now().Before(failure.expiresAt) {
+			cr.lk.Unlock()
+			didResolutions.WithLabelValues("negative_cache").Inc()
+			span.SetAttributes(attribute.String("resolution.source", "negative_cache"))
+			return nil, failure.err
+		}
+		cr.failures.Remove(did)
+	}
+
+	source := "coalesced"
+	res, ok := cr.inflight[did]
+	if !ok {
+		source = "fetch"
+		res = &resolution{done: make(chan struct{})}
+		cr.inflight[did] = res
+		go cr.fetch(ctx, did, res)
+	}
+	cr.lk.Unlock()
+
+	didResolutions.WithLabelValues(source).Inc()
+	span.SetAttributes(attribute.String("resolution.source", source))
+
+	select {
+	case <-res.done:
+		return res.doc, res.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("Gave up waiting for DID resolution: %w", ctx.Err())
+	}
+}
+
+// fetch resolves a DID for everyone waiting on res, then remembers the DID if it turned out to be invalid
+func (cr *CoalescingResolver) fetch(ctx context.Context, did string, res *resolution) {
+	// Keep the caller's trace, but not their cancellation
+	ctx, cancel := context.WithTimeout(detachedContext{ctx}, cr.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	res.doc, res.err = cr.Resolver.ResolveDID(ctx, did)
+
+	result := "ok"
+	if res.err != nil {
+		result = "error"
+	}
+	didResolutionDuration.WithLabelValues(methodLabel(did), result).Observe(time.Since(start).Seconds())
+
+	cr.lk.Lock()
+	delete(cr.inflight, did)
+	// Only the DID's own failures are remembered, rate limiting, timeouts, and server errors are retried straight away
+	var invalidDID *InvalidDIDError
+	if cr.NegativeTTL > 0 && errors.As(res.err, &invalidDID) {
+		cr.failures.Add(did, failedResolution{err: res.err, expiresAt: time.Now().Add(cr.NegativeTTL)})
+	}
+	cr.lk.Unlock()
+
+	close(res.done)
+}
+
+// methodLabel returns the DID method for metrics, DIDs come from untrusted tokens so unknown methods are lumped together
+func methodLabel(did string) string {
+	switch method, _, _ := splitDID(did); method {
+	case "plc", "web":
+		return method
+	default:
+		return "other"
+	}
+}
+
+// detachedContext carries the values of its parent, like its trace span, without its deadline or cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (dc detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (dc detachedContext) Done() <-chan struct{}             { return nil }
+func (dc detachedContext) Err() error                        { return nil }
+func (dc detachedContext) Value(key interface{}) interface{} { return dc.parent.Value(key) }
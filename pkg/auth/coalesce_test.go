@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// blockingResolver resolves DIDs once release is closed, counting how many times it's called
+type blockingResolver struct {
+	calls   atomic.Int64
+	release chan struct{}
+	err     error
+}
+
+func (br *blockingResolver) ResolveDID(ctx context.Context, did string) (*DIDDocument, error) {
+	br.calls.Add(1)
+
+	select {
+	case <-br.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if br.err != nil {
+		return nil, br.err
+	}
+
+	return &DIDDocument{ID: did}, nil
+}
+
+func TestCoalescingResolver(t *testing.T) {
+	inner := &blockingResolver{release: make(chan struct{})}
+	resolver, err := NewCoalescingResolver(inner, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	did := "did:plc:q6gjnaw2blty4crticxkmujt"
+	ctx := context.Background()
+
+	// A caller that gives up doesn't cancel the fetch for everyone else
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancelled := make(chan error)
+	go func() {
+		_, err := resolver.ResolveDID(cancelledCtx, did)
+		cancelled <- err
+	}()
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doc, err := resolver.ResolveDID(ctx, did)
+			if err == nil && doc.ID != did {
+				err = fmt.Errorf("resolved document for %s", doc.ID)
+			}
+			errs <- err
+		}()
+	}
+
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled ResolveDID returned %v, want context.Canceled", err)
+	}
+
+	// Let the callers pile up on the in-flight fetch before it finishes
+	time.Sleep(50 * time.Millisecond)
+	close(inner.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("ResolveDID returned error: %v", err)
+		}
+	}
+
+	if inner.calls.Load() != 1 {
+		t.Errorf("DID was fetched %d times, want 1", inner.calls.Load())
+	}
+}
+
+func TestCoalescingResolverNegativeCache(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+
+	inner := &blockingResolver{release: release, err: &InvalidDIDError{Err: errors.New("Failed to get DID document: 404 Not Found")}}
+	resolver, err := NewCoalescingResolver(inner, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	did := "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := resolver.ResolveDID(ctx, did); err == nil {
+			t.Fatal("ResolveDID succeeded for a DID that fails to resolve")
+		}
+	}
+
+	if inner.calls.Load() != 1 {
+		t.Errorf("DID was fetched %d times, want 1 with the failure cached", inner.calls.Load())
+	}
+
+	// Once the failure expires the DID is fetched again
+	resolver.NegativeTTL = 0
+	resolver.failures.Purge()
+	inner.err = nil
+	if _, err := resolver.ResolveDID(ctx, did); err != nil {
+		t.Errorf("ResolveDID returned error: %v", err)
+	}
+	if inner.calls.Load() != 2 {
+		t.Errorf("DID was fetched %d times, want 2", inner.calls.Load())
+	}
+}
+
+func TestCoalescingResolverDoesNotCacheTransientFailures(t *testing.T) {
+	status := atomic.Int64{}
+	plcServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := int(status.Load()); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		fmt.Fprint(w, didDoc(strings.TrimPrefix(r.URL.Path, "/")))
+	}))
+	t.Cleanup(plcServer.Close)
+
+	// A limiter with its only token spent, so waiting for it would outlast the fetch timeout
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	limiter.Allow()
+
+	resolver, err := NewCoalescingResolver(NewMethodResolver(plcServer.URL, plcServer.Client(), limiter), 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.Timeout = 100 * time.Millisecond
+
+	did := "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	ctx := context.Background()
+
+	if _, err := resolver.ResolveDID(ctx, did); err == nil || !strings.Contains(err.Error(), "rate limiter") {
+		t.Fatalf("ResolveDID returned %v, want a rate limiter error", err)
+	}
+	if _, ok := resolver.failures.Get(did); ok {
+		t.Fatal("a rate limiter rejection was negatively cached")
+	}
+
+	limiter.SetLimit(rate.Inf)
+
+	// Server errors and rate limiting by the host aren't the DID's fault either
+	for _, code := range []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusTooManyRequests} {
+		status.Store(int64(code))
+		if _, err := resolver.ResolveDID(ctx, did); err == nil {
+			t.Fatalf("ResolveDID succeeded with status %d", code)
+		}
+		if _, ok := resolver.failures.Get(did); ok {
+			t.Fatalf("a %d response was negatively cached", code)
+		}
+	}
+
+	status.Store(http.StatusOK)
+	if _, err := resolver.ResolveDID(ctx, did); err != nil {
+		t.Fatalf("ResolveDID returned error once the DID could be fetched: %v", err)
+	}
+
+	// A DID that doesn't exist is remembered
+	missing := "did:plc:doesnotexist"
+	status.Store(http.StatusNotFound)
+	if _, err := resolver.ResolveDID(ctx, missing); err == nil {
+		t.Fatal("ResolveDID succeeded for a missing DID")
+	}
+	if _, ok := resolver.failures.Get(missing); !ok {
+		t.Error("a 404 wasn't negatively cached")
+	}
+}
@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"fmt"
+	"strings"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+	es256k "github.com/ericvolp12/jwt-go-secp256k1"
+	"github.com/golang-jwt/jwt"
+	"github.com/multiformats/go-multibase"
+)
+
+// Multicodec prefixes of the public key types atproto signing keys use, as unsigned varints
+var (
+	multicodecSecp256k1Pub = []byte{0xe7, 0x01} // secp256k1-pub (0xe7)
+	multicodecP256Pub      = []byte{0x80, 0x24} // p256-pub (0x1200)
+)
+
+// Legacy verification method types that carry a key without a multicodec prefix
+const (
+	verificationMethodSecp256k1 = "EcdsaSecp256k1VerificationKey2019"
+	verificationMethodP256      = "EcdsaSecp256r1VerificationKey2019"
+)
+
+// AtprotoSigningKey returns the public key of the DID document's #atproto verification method,
+// which is the key atproto services sign JWTs with
+func AtprotoSigningKey(doc *DIDDocument) (*ecdsa.PublicKey, error) {
+	vm, err := atprotoVerificationMethod(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ParseMultibaseKey(vm.Type, vm.PublicKeyMultibase)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse #atproto verification method: %v", err)
+	}
+
+	return key, nil
+}
+
+// atprotoVerificationMethod returns the DID document's #atproto verification method
+func atprotoVerificationMethod(doc *DIDDocument) (*VerificationMethod, error) {
+	for i, vm := range doc.VerificationMethod {
+		// The ID is either absolute (did:plc:abc#atproto) or relative to the document (#atproto)
+		if strings.HasSuffix(vm.ID, "#atproto") {
+			return &doc.VerificationMethod[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("No #atproto verification method found in DID document")
+}
+
+// ParseMultibaseKey parses a multibase-encoded public key into an ECDSA public key on its curve
+// Multikey keys name their curve with a multicodec prefix, legacy keys name it with the verification method type
+func ParseMultibaseKey(vmType string, multibaseKey string) (*ecdsa.PublicKey, error) {
+	_, decoded, err := multibase.Decode(multibaseKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode multibase key: %v", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(decoded, multicodecSecp256k1Pub):
+		return parseSecp256k1Key(decoded[len(multicodecSecp256k1Pub):])
+	case bytes.HasPrefix(decoded, multicodecP256Pub):
+		return parseP256Key(decoded[len(multicodecP256Pub):])
+	case vmType == verificationMethodSecp256k1:
+		return parseSecp256k1Key(decoded)
+	case vmType == verificationMethodP256:
+		return parseP256Key(decoded)
+	default:
+		return nil, fmt.Errorf("Unsupported key type (verification method type %q)", vmType)
+	}
+}
+
+func parseSecp256k1Key(raw []byte) (*ecdsa.PublicKey, error) {
+	pub, err := secp256k1.ParsePubKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse secp256k1 public key: %v", err)
+	}
+
+	return pub.ToECDSA(), nil
+}
+
+func parseP256Key(raw []byte) (*ecdsa.PublicKey, error) {
+	curve := elliptic.P256()
+
+	x, y := elliptic.UnmarshalCompressed(curve, raw)
+	if x == nil && len(raw) == 65 {
+		// Uncompressed keys predate Multikey, elliptic.Unmarshal is the only stdlib parser for them
+		x, y = elliptic.Unmarshal(curve, raw)
+	}
+	if x == nil {
+		return nil, fmt.Errorf("Failed to parse P-256 public key")
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// signingMethodForKey returns the JWT signing method that verifies signatures made by the key
+func signingMethodForKey(key *ecdsa.PublicKey) (jwt.SigningMethod, error) {
+	// Compare curve parameters rather than instances, the secp256k1 package wraps a curve from its v2 module
+	switch params := key.Curve.Params(); {
+	case params.P.Cmp(elliptic.P256().Params().P) == 0:
+		return jwt.SigningMethodES256, nil
+	case params.P.Cmp(secp256k1.S256().Params().P) == 0:
+		return es256k.SigningMethodES256K, nil
+	default:
+		return nil, fmt.Errorf("Unsupported key curve %s", params.Name)
+	}
+}
@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+	"github.com/golang-jwt/jwt"
+	"github.com/multiformats/go-multibase"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func generateKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// compressPoint serializes a public key as a compressed point, for curves elliptic.MarshalCompressed can't handle
+func compressPoint(pub *ecdsa.PublicKey) []byte {
+	out := make([]byte, 33)
+	out[0] = 0x02 | byte(pub.Y.Bit(0))
+	pub.X.FillBytes(out[1:])
+	return out
+}
+
+func encodeMultibase(t *testing.T, prefix []byte, raw []byte) string {
+	t.Helper()
+
+	encoded, err := multibase.Encode(multibase.Base58BTC, append(append([]byte{}, prefix...), raw...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encoded
+}
+
+func TestParseMultibaseKey(t *testing.T) {
+	p256Key := generateKey(t, elliptic.P256())
+	k256Key := generateKey(t, secp256k1.S256())
+
+	tests := []struct {
+		name   string
+		vmType string
+		key    string
+		want   *ecdsa.PublicKey
+	}{
+		{
+			name:   "multikey p256",
+			vmType: "Multikey",
+			key:    encodeMultibase(t, multicodecP256Pub, elliptic.MarshalCompressed(elliptic.P256(), p256Key.X, p256Key.Y)),
+			want:   &p256Key.PublicKey,
+		},
+		{
+			name:   "multikey secp256k1",
+			vmType: "Multikey",
+			key:    encodeMultibase(t, multicodecSecp256k1Pub, compressPoint(&k256Key.PublicKey)),
+			want:   &k256Key.PublicKey,
+		},
+		{
+			name:   "legacy secp256k1",
+			vmType: verificationMethodSecp256k1,
+			key:    encodeMultibase(t, nil, compressPoint(&k256Key.PublicKey)),
+			want:   &k256Key.PublicKey,
+		},
+		{
+			name:   "legacy p256",
+			vmType: verificationMethodP256,
+			key:    encodeMultibase(t, nil, elliptic.MarshalCompressed(elliptic.P256(), p256Key.X, p256Key.Y)),
+			want:   &p256Key.PublicKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMultibaseKey(tt.vmType, tt.key)
+			if err != nil {
+				t.Fatalf("ParseMultibaseKey returned error: %v", err)
+			}
+			if got.X.Cmp(tt.want.X) != 0 || got.Y.Cmp(tt.want.Y) != 0 {
+				t.Errorf("ParseMultibaseKey returned a different key")
+			}
+
+			method, err := signingMethodForKey(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantAlg := "ES256K"
+			if tt.want.Curve == elliptic.P256() {
+				wantAlg = "ES256"
+			}
+			if method.Alg() != wantAlg {
+				t.Errorf("signingMethodForKey = %s, want %s", method.Alg(), wantAlg)
+			}
+		})
+	}
+
+	if _, err := ParseMultibaseKey("Multikey", encodeMultibase(t, []byte{0xed, 0x01}, make([]byte, 32))); err == nil {
+		t.Error("ParseMultibaseKey accepted an ed25519 key")
+	}
+}
+
+func TestAtprotoSigningKey(t *testing.T) {
+	p256Key := generateKey(t, elliptic.P256())
+	did := "did:plc:q6gjnaw2blty4crticxkmujt"
+
+	doc := &DIDDocument{ID: did}
+	doc.VerificationMethod = []VerificationMethod{
+		{ID: did + "#other", Type: "Multikey", PublicKeyMultibase: "zNotAKey"},
+		{ID: did + "#atproto", Type: "Multikey", PublicKeyMultibase: encodeMultibase(t, multicodecP256Pub, elliptic.MarshalCompressed(elliptic.P256(), p256Key.X, p256Key.Y))},
+	}
+
+	key, err := AtprotoSigningKey(doc)
+	if err != nil {
+		t.Fatalf("AtprotoSigningKey returned error: %v", err)
+	}
+	if key.X.Cmp(p256Key.X) != 0 {
+		t.Error("AtprotoSigningKey didn't pick the #atproto verification method")
+	}
+
+	doc.VerificationMethod = doc.VerificationMethod[:1]
+	if _, err := AtprotoSigningKey(doc); err == nil {
+		t.Error("AtprotoSigningKey succeeded without an #atproto verification method")
+	}
+}
+
+func TestGetClaimsFromAuthHeaderES256(t *testing.T) {
+	signingKey := generateKey(t, elliptic.P256())
+	otherKey := generateKey(t, elliptic.P256())
+	multibaseKey := encodeMultibase(t, multicodecP256Pub, elliptic.MarshalCompressed(elliptic.P256(), signingKey.X, signingKey.Y))
+
+	requests := atomic.Int64{}
+	server, issuer := newDIDWebHost(t, map[string]func(string) string{
+		"/.well-known/did.json": func(hostDID string) string {
+			requests.Add(1)
+			return fmt.Sprintf(`{"id": %q, "verificationMethod": [{"id": "#atproto", "type": "Multikey", "publicKeyMultibase": %q}]}`, hostDID, multibaseKey)
+		},
+	})
+
+	serviceDID := "did:web:feedsky.jazco.io"
+	auth, err := NewAuth(10, time.Hour, "https://plc.directory", 100, serviceDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.Resolver = newLocalMethodResolver(auth.PLCDirectory, server.Client())
+
+	sign := func(key *ecdsa.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, &jwt.StandardClaims{
+			Issuer:    issuer,
+			Audience:  serviceDID,
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		})
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + signed
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		claims := jwt.StandardClaims{}
+		if err := auth.GetClaimsFromAuthHeader(ctx, sign(signingKey), &claims); err != nil {
+			t.Fatalf("GetClaimsFromAuthHeader returned error: %v", err)
+		}
+		if claims.Issuer != issuer {
+			t.Errorf("claims.Issuer = %q, want %q", claims.Issuer, issuer)
+		}
+	}
+
+	if requests.Load() != 1 {
+		t.Errorf("DID document was fetched %d times, want 1 with the key cached", requests.Load())
+	}
+
+	claims := jwt.StandardClaims{}
+	if err := auth.GetClaimsFromAuthHeader(ctx, sign(otherKey), &claims); err == nil {
+		t.Error("GetClaimsFromAuthHeader accepted a token signed with another key")
+	}
+}
+
+func TestSQLKeyStoreWarmsKeyCache(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "keys.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	keyStore, err := NewSQLKeyStore(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingKey := generateKey(t, elliptic.P256())
+	multibaseKey := encodeMultibase(t, multicodecP256Pub, elliptic.MarshalCompressed(elliptic.P256(), signingKey.X, signingKey.Y))
+
+	requests := atomic.Int64{}
+	server, issuer := newDIDWebHost(t, map[string]func(string) string{
+		"/.well-known/did.json": func(hostDID string) string {
+			requests.Add(1)
+			return fmt.Sprintf(`{"id": %q, "verificationMethod": [{"id": "#atproto", "type": "Multikey", "publicKeyMultibase": %q}]}`, hostDID, multibaseKey)
+		},
+	})
+
+	newAuth := func() *Auth {
+		auth, err := NewAuth(10, time.Hour, "https://plc.directory", 100, "did:web:feedsky.jazco.io", WithKeyStore(keyStore))
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth.Resolver = newLocalMethodResolver(auth.PLCDirectory, server.Client())
+		return auth
+	}
+
+	// Resolving a key stores it
+	auth := newAuth()
+	if _, _, err := auth.getSigningKey(ctx, issuer, false); err != nil {
+		t.Fatalf("getSigningKey returned error: %v", err)
+	}
+
+	stored, err := keyStore.GetKey(ctx, issuer)
+	if err != nil || stored == nil {
+		t.Fatalf("GetKey = %v, %v, want the resolved key", stored, err)
+	}
+
+	// An expired key isn't loaded, and an unexpired one survives a "restart" with its expiry intact
+	expired := &StoredKey{DID: "did:plc:ewvi7nxzyoun6zhxrhs64oiz", Type: stored.Type, PublicKeyMultibase: stored.PublicKeyMultibase, ExpiresAt: time.Now().Add(-time.Minute)}
+	if err := keyStore.PutKey(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	auth = newAuth()
+	loaded, err := auth.WarmKeyCache(ctx)
+	if err != nil {
+		t.Fatalf("WarmKeyCache returned error: %v", err)
+	}
+	if loaded != 1 {
+		t.Errorf("WarmKeyCache loaded %d keys, want 1", loaded)
+	}
+
+	entry, ok := auth.KeyCache.Get(issuer)
+	if !ok {
+		t.Fatal("WarmKeyCache didn't cache the stored key")
+	}
+	if !entry.(KeyCacheEntry).ExpiresAt.Equal(stored.ExpiresAt) {
+		t.Errorf("warmed key expires at %s, want %s", entry.(KeyCacheEntry).ExpiresAt, stored.ExpiresAt)
+	}
+
+	// A key evicted from memory is read back from the store without resolving the DID
+	auth.KeyCache.Remove(issuer)
+	key, cached, err := auth.getSigningKey(ctx, issuer, false)
+	if err != nil {
+		t.Fatalf("getSigningKey returned error: %v", err)
+	}
+	if !cached || key.X.Cmp(signingKey.X) != 0 {
+		t.Error("getSigningKey didn't return the stored key")
+	}
+
+	if requests.Load() != 1 {
+		t.Errorf("DID document was fetched %d times, want 1", requests.Load())
+	}
+}
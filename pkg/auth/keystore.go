@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// KeyStore persists signing keys behind the in-memory KeyCache so they survive restarts
+// Keys are stored as they appear in the DID document, along with when they expire from the cache
+type KeyStore interface {
+	// GetKey returns the stored key of a DID, or nil if there isn't one
+	GetKey(ctx context.Context, did string) (*StoredKey, error)
+	PutKey(ctx context.Context, key *StoredKey) error
+	// LoadKeys returns up to limit unexpired keys, most recently stored first, to warm the KeyCache with
+	LoadKeys(ctx context.Context, limit int) ([]*StoredKey, error)
+}
+
+// StoredKey is the #atproto verification method of a DID as kept in a KeyStore
+type StoredKey struct {
+	DID                string `gorm:"primaryKey;column:did"`
+	Type               string
+	PublicKeyMultibase string
+	ExpiresAt          time.Time `gorm:"index"`
+	UpdatedAt          time.Time
+}
+
+// PublicKey parses the stored key
+func (sk *StoredKey) PublicKey() (*ecdsa.PublicKey, error) {
+	return ParseMultibaseKey(sk.Type, sk.PublicKeyMultibase)
+}
+
+// SQLKeyStore stores keys in a SQL database, i.e. the post store's
+type SQLKeyStore struct {
+	DB *gorm.DB
+}
+
+// NewSQLKeyStore returns a new SQLKeyStore, migrating the key table if needed
+func NewSQLKeyStore(ctx context.Context, db *gorm.DB) (*SQLKeyStore, error) {
+	if err := db.WithContext(ctx).AutoMigrate(&StoredKey{}); err != nil {
+		return nil, fmt.Errorf("error migrating key table: %w", err)
+	}
+
+	return &SQLKeyStore{DB: db}, nil
+}
+
+// GetKey reads the key of a DID, returning nil if it hasn't been stored
+func (sks *SQLKeyStore) GetKey(ctx context.Context, did string) (*StoredKey, error) {
+	key := &StoredKey{}
+	err := sks.DB.WithContext(ctx).Where("did = ?", did).Take(key).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading key: %w", err)
+	}
+
+	return key, nil
+}
+
+// PutKey upserts the key of a DID
+func (sks *SQLKeyStore) PutKey(ctx context.Context, key *StoredKey) error {
+	key.UpdatedAt = time.Now()
+
+	err := sks.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "did"}},
+		DoUpdates: clause.AssignmentColumns([]string{"type", "public_key_multibase", "expires_at", "updated_at"}),
+	}).Create(key).Error
+	if err != nil {
+		return fmt.Errorf("error writing key: %w", err)
+	}
+
+	return nil
+}
+
+// LoadKeys deletes expired keys and returns up to limit of the rest, most recently stored first
+func (sks *SQLKeyStore) LoadKeys(ctx context.Context, limit int) ([]*StoredKey, error) {
+	now := time.Now()
+
+	if err := sks.DB.WithContext(ctx).Where("expires_at <= ?", now).Delete(&StoredKey{}).Error; err != nil {
+		return nil, fmt.Errorf("error deleting expired keys: %w", err)
+	}
+
+	keys := []*StoredKey{}
+	err := sks.DB.WithContext(ctx).Where("expires_at > ?", now).Order("updated_at DESC").Limit(limit).Find(&keys).Error
+	if err != nil {
+		return nil, fmt.Errorf("error reading keys: %w", err)
+	}
+
+	return keys, nil
+}
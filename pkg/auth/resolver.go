@@ -0,0 +1,353 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
+)
+
+// DIDDocument is the subset of a DID document needed to verify a JWT issued by the DID
+type DIDDocument struct {
+	Context            []string             `json:"@context"`
+	ID                 string               `json:"id"`
+	AlsoKnownAs        []string             `json:"alsoKnownAs"`
+	VerificationMethod []VerificationMethod `json:"verificationMethod"`
+	Service            []struct {
+		ID              string `json:"id"`
+		Type            string `json:"type"`
+		ServiceEndpoint string `json:"serviceEndpoint"`
+	} `json:"service"`
+}
+
+// VerificationMethod is a public key listed in a DID document
+type VerificationMethod struct {
+	ID                 string `json:"id"`
+	Type               string `json:"type"`
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase"`
+}
+
+// InvalidDIDError is returned when a DID fails to resolve because of the DID itself, its document
+// doesn't exist or isn't valid, rather than because of us, the network, or the host having trouble
+type InvalidDIDError struct {
+	DID string
+	Err error
+}
+
+func (e *InvalidDIDError) Error() string { return e.Err.Error() }
+func (e *InvalidDIDError) Unwrap() error { return e.Err }
+
+// PLCEntry is the DID document of a did:plc as served by the PLC Directory
+type PLCEntry = DIDDocument
+
+// DIDResolver resolves a DID to its DID document
+type DIDResolver interface {
+	ResolveDID(ctx context.Context, did string) (*DIDDocument, error)
+}
+
+// MethodResolver dispatches DIDs to a resolver by their method, i.e. plc for did:plc
+type MethodResolver struct {
+	Methods map[string]DIDResolver
+}
+
+// NewMethodResolver returns a MethodResolver for did:plc, resolved through the PLC Directory,
+// and did:web, resolved from the DID's host
+// Both resolvers share the HTTP client and rate limiter
+func NewMethodResolver(plcDirectory string, client *http.Client, limiter *rate.Limiter) *MethodResolver {
+	return &MethodResolver{
+		Methods: map[string]DIDResolver{
+			"plc": &PLCResolver{Directory: plcDirectory, HTTPClient: client, Limiter: limiter},
+			"web": &WebResolver{HTTPClient: client, Limiter: limiter},
+		},
+	}
+}
+
+// ResolveDID resolves the DID with the resolver for its method
+func (mr *MethodResolver) ResolveDID(ctx context.Context, did string) (*DIDDocument, error) {
+	method, _, ok := splitDID(did)
+	if !ok {
+		return nil, fmt.Errorf("Invalid DID %q", did)
+	}
+
+	resolver, ok := mr.Methods[method]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported DID method %q", method)
+	}
+
+	return resolver.ResolveDID(ctx, did)
+}
+
+// PLCResolver resolves did:plc DIDs through a PLC Directory
+type PLCResolver struct {
+	Directory  string // URL of the PLC Directory, i.e. https://plc.directory
+	HTTPClient *http.Client
+	Limiter    *rate.Limiter // Limits requests to the PLC Directory, may be nil
+}
+
+// ResolveDID gets the DID document of a did:plc from the PLC Directory
+func (pr *PLCResolver) ResolveDID(ctx context.Context, did string) (*DIDDocument, error) {
+	tracer := otel.Tracer("auth")
+	ctx, span := tracer.Start(ctx, "PLCResolver:ResolveDID")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("did", did))
+
+	return fetchDIDDocument(ctx, pr.HTTPClient, pr.Limiter, fmt.Sprintf("%s/%s", pr.Directory, did), did)
+}
+
+// WebResolver resolves did:web DIDs from the well-known DID document on their host
+// did:webs come from unauthenticated tokens, so unless AllowPrivateHosts is set only public hostnames
+// without a port are resolved, and only public addresses are dialed, including after DNS and redirects
+type WebResolver struct {
+	HTTPClient *http.Client
+	Limiter    *rate.Limiter // Limits requests to did:web hosts, may be nil
+
+	AllowPrivateHosts bool // Resolve did:webs on ports, IP literals, and private addresses, for local development
+
+	publicClientOnce sync.Once
+	publicClient     *http.Client
+}
+
+// ResolveDID gets the DID document of a did:web from https://<host>/.well-known/did.json,
+// or https://<host>/<path>/did.json for DIDs with a path, i.e. did:web:example.com:user:alice
+func (wr *WebResolver) ResolveDID(ctx context.Context, did string) (*DIDDocument, error) {
+	tracer := otel.Tracer("auth")
+	ctx, span := tracer.Start(ctx, "WebResolver:ResolveDID")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("did", did))
+
+	docURL, err := WebDIDDocumentURL(did)
+	if err != nil {
+		return nil, err
+	}
+
+	if wr.AllowPrivateHosts {
+		return fetchDIDDocument(ctx, wr.HTTPClient, wr.Limiter, docURL, did)
+	}
+
+	u, err := url.Parse(docURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid did:web %q", did)
+	}
+
+	if err := checkPublicHost(u.Host); err != nil {
+		return nil, err
+	}
+
+	return fetchDIDDocument(ctx, wr.client(), wr.Limiter, docURL, did)
+}
+
+// client returns HTTPClient with a transport that only dials public addresses
+// Clients with a custom RoundTripper are used as they are, wrap a PublicTransport in them to restrict dialing
+func (wr *WebResolver) client() *http.Client {
+	wr.publicClientOnce.Do(func() {
+		client := *wr.HTTPClient
+
+		transport, ok := client.Transport.(*http.Transport)
+		if client.Transport == nil {
+			transport, ok = http.DefaultTransport.(*http.Transport)
+		}
+
+		if ok {
+			client.Transport = restrictTransport(transport)
+		}
+
+		wr.publicClient = &client
+	})
+
+	return wr.publicClient
+}
+
+// PublicTransport returns a copy of http.DefaultTransport that only dials public addresses
+func PublicTransport() *http.Transport {
+	return restrictTransport(http.DefaultTransport.(*http.Transport))
+}
+
+// restrictTransport returns a copy of the transport that only dials public addresses
+func restrictTransport(transport *http.Transport) *http.Transport {
+	transport = transport.Clone()
+	// A proxy would be dialed instead of the host, so we couldn't check where requests end up
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Timeout: 30 * time.Second, Control: dialPublicOnly}).DialContext
+	return transport
+}
+
+// nonPublicPrefixes are address ranges that aren't reachable on the internet, on top of the ones net.IP knows about
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("fc00::/7"),
+}
+
+// isPublicIP returns true if the address is routable on the internet
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dialPublicOnly refuses connections to non-public addresses, after the host has been resolved
+func dialPublicOnly(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("Invalid address %q: %v", address, err)
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("Refusing to dial non-public address %s", host)
+	}
+
+	return nil
+}
+
+// checkPublicHost rejects did:web hosts that aren't public hostnames on the default port
+func checkPublicHost(host string) error {
+	if strings.Contains(host, ":") {
+		return fmt.Errorf("Refusing to resolve did:web on a port or IP literal %q", host)
+	}
+
+	if net.ParseIP(host) != nil {
+		return fmt.Errorf("Refusing to resolve did:web on an IP literal %q", host)
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if !strings.Contains(name, ".") || name == "localhost" {
+		return fmt.Errorf("Refusing to resolve did:web on non-public host %q", host)
+	}
+
+	for _, suffix := range []string{".localhost", ".local", ".internal", ".home.arpa"} {
+		if strings.HasSuffix(name, suffix) {
+			return fmt.Errorf("Refusing to resolve did:web on non-public host %q", host)
+		}
+	}
+
+	return nil
+}
+
+// WebDIDDocumentURL returns the URL the DID document of a did:web is served at
+// Per the did:web spec, colons separate path segments and a port is percent-encoded as %3A
+func WebDIDDocumentURL(did string) (string, error) {
+	method, id, ok := splitDID(did)
+	if !ok || method != "web" || id == "" {
+		return "", fmt.Errorf("Invalid did:web %q", did)
+	}
+
+	segments := strings.Split(id, ":")
+	for i, segment := range segments {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil || decoded == "" {
+			return "", fmt.Errorf("Invalid did:web %q", did)
+		}
+		segments[i] = decoded
+	}
+
+	host := segments[0]
+	if strings.ContainsAny(host, "/?#@") {
+		return "", fmt.Errorf("Invalid did:web host %q", host)
+	}
+
+	if len(segments) == 1 {
+		return "https://" + host + "/.well-known/did.json", nil
+	}
+
+	path := make([]string, 0, len(segments)-1)
+	for _, segment := range segments[1:] {
+		path = append(path, url.PathEscape(segment))
+	}
+
+	return "https://" + host + "/" + strings.Join(path, "/") + "/did.json", nil
+}
+
+// splitDID splits a DID into its method and method-specific ID
+func splitDID(did string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(did, "did:")
+	if !ok {
+		return "", "", false
+	}
+
+	method, id, ok := strings.Cut(rest, ":")
+	if !ok || method == "" {
+		return "", "", false
+	}
+
+	return method, id, true
+}
+
+// fetchDIDDocument gets and decodes a DID document, checking it's the document of the DID we asked for
+func fetchDIDDocument(ctx context.Context, client *http.Client, limiter *rate.Limiter, docURL string, did string) (*DIDDocument, error) {
+	// Wait for the rate limiter
+	if limiter != nil {
+		if err := limiter.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("Failed to wait for rate limiter: %w", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, docURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create DID document request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get DID document for %s: %w", did, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("Failed to get DID document for %s: %v", did, resp.Status)
+		// Hosts that are rate limiting us or timing out say nothing about the DID
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout {
+			return nil, &InvalidDIDError{DID: did, Err: err}
+		}
+		return nil, err
+	}
+
+	// DID documents are small, don't let a misbehaving host send us an unbounded body
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read DID document: %v", err)
+	}
+
+	doc := &DIDDocument{}
+	if err := json.Unmarshal(body, doc); err != nil {
+		return nil, &InvalidDIDError{DID: did, Err: fmt.Errorf("Failed to unmarshal DID document: %v", err)}
+	}
+
+	if doc.ID != did {
+		return nil, &InvalidDIDError{DID: did, Err: fmt.Errorf("DID document is for %s, expected %s", doc.ID, did)}
+	}
+
+	return doc, nil
+}
@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newDIDWebHost starts a did:web host and returns it with the did:web of its host
+// docs maps request paths to the DID document served there, given the did:web of the host
+func newDIDWebHost(t *testing.T, docs map[string]func(hostDID string) string) (*httptest.Server, string) {
+	t.Helper()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc, ok := docs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, doc(hostDIDFor(r.Host)))
+	}))
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, hostDIDFor(u.Host)
+}
+
+// hostDIDFor returns the did:web of a host, percent-encoding its port
+func hostDIDFor(host string) string {
+	return "did:web:" + strings.ReplaceAll(host, ":", "%3A")
+}
+
+// newLocalMethodResolver returns a MethodResolver that resolves did:webs on local test servers
+func newLocalMethodResolver(plcDirectory string, client *http.Client) *MethodResolver {
+	resolver := NewMethodResolver(plcDirectory, client, nil)
+	resolver.Methods["web"].(*WebResolver).AllowPrivateHosts = true
+	return resolver
+}
+
+func didDoc(did string) string {
+	return fmt.Sprintf(`{"id": %q, "verificationMethod": [{"id": "%s#atproto", "publicKeyMultibase": "zKey"}]}`, did, did)
+}
+
+func TestWebDIDDocumentURL(t *testing.T) {
+	tests := []struct {
+		did     string
+		want    string
+		wantErr bool
+	}{
+		{did: "did:web:example.com", want: "https://example.com/.well-known/did.json"},
+		{did: "did:web:localhost%3A8443", want: "https://localhost:8443/.well-known/did.json"},
+		{did: "did:web:example.com:user:alice", want: "https://example.com/user/alice/did.json"},
+		{did: "did:web:", wantErr: true},
+		{did: "did:web:example.com::alice", wantErr: true},
+		{did: "did:web:example.com%2Fevil", wantErr: true},
+		{did: "did:plc:abc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := WebDIDDocumentURL(tt.did)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("WebDIDDocumentURL(%q) = %q, want an error", tt.did, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("WebDIDDocumentURL(%q) returned error: %v", tt.did, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("WebDIDDocumentURL(%q) = %q, want %q", tt.did, got, tt.want)
+		}
+	}
+}
+
+func TestWebResolver(t *testing.T) {
+	server, hostDID := newDIDWebHost(t, map[string]func(string) string{
+		"/.well-known/did.json":  didDoc,
+		"/user/alice/did.json":   func(hostDID string) string { return didDoc(hostDID + ":user:alice") },
+		"/user/mallory/did.json": didDoc,
+	})
+	pathDID := hostDID + ":user:alice"
+
+	resolver := &WebResolver{HTTPClient: server.Client(), AllowPrivateHosts: true}
+	ctx := context.Background()
+
+	for _, did := range []string{hostDID, pathDID} {
+		doc, err := resolver.ResolveDID(ctx, did)
+		if err != nil {
+			t.Fatalf("ResolveDID(%q) returned error: %v", did, err)
+		}
+		if doc.ID != did {
+			t.Errorf("ResolveDID(%q) returned document for %q", did, doc.ID)
+		}
+		if len(doc.VerificationMethod) != 1 || doc.VerificationMethod[0].PublicKeyMultibase != "zKey" {
+			t.Errorf("ResolveDID(%q) returned unexpected verification methods: %+v", did, doc.VerificationMethod)
+		}
+	}
+
+	// A host serving another DID's document must not be trusted for this DID
+	if _, err := resolver.ResolveDID(ctx, hostDID+":user:mallory"); err == nil {
+		t.Error("ResolveDID accepted a document for a different DID")
+	}
+
+	if _, err := resolver.ResolveDID(ctx, hostDID+":user:nobody"); err == nil {
+		t.Error("ResolveDID succeeded for a DID with no document")
+	}
+}
+
+func TestMethodResolver(t *testing.T) {
+	webServer, webDID := newDIDWebHost(t, map[string]func(string) string{
+		"/.well-known/did.json": didDoc,
+	})
+
+	plcDID := "did:plc:q6gjnaw2blty4crticxkmujt"
+	plcServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+plcDID {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, didDoc(plcDID))
+	}))
+	t.Cleanup(plcServer.Close)
+
+	// The TLS client trusts the did:web host and can still reach the plain HTTP PLC Directory
+	resolver := newLocalMethodResolver(plcServer.URL, webServer.Client())
+	ctx := context.Background()
+
+	for _, did := range []string{plcDID, webDID} {
+		doc, err := resolver.ResolveDID(ctx, did)
+		if err != nil {
+			t.Fatalf("ResolveDID(%q) returned error: %v", did, err)
+		}
+		if doc.ID != did {
+			t.Errorf("ResolveDID(%q) returned document for %q", did, doc.ID)
+		}
+	}
+
+	for _, did := range []string{"did:key:zQ3sh", "not-a-did"} {
+		if _, err := resolver.ResolveDID(ctx, did); err == nil {
+			t.Errorf("ResolveDID(%q) succeeded, want an error", did)
+		}
+	}
+}
+
+func TestWebResolverRejectsNonPublicHosts(t *testing.T) {
+	server, hostDID := newDIDWebHost(t, map[string]func(string) string{
+		"/.well-known/did.json": didDoc,
+	})
+
+	resolver := &WebResolver{HTTPClient: server.Client()}
+	ctx := context.Background()
+
+	for _, did := range []string{
+		hostDID, // a port on an IP literal
+		"did:web:127.0.0.1",
+		"did:web:10.0.0.1",
+		"did:web:%5B%3A%3A1%5D",
+		"did:web:localhost",
+		"did:web:metadata",
+		"did:web:metadata.google.internal",
+		"did:web:printer.local",
+		"did:web:example.com%3A8443",
+	} {
+		if _, err := resolver.ResolveDID(ctx, did); err == nil {
+			t.Errorf("ResolveDID(%q) succeeded, want an error", did)
+		}
+	}
+}
+
+func TestDialPublicOnly(t *testing.T) {
+	for address, public := range map[string]bool{
+		"93.184.216.34:443":       true,
+		"[2606:2800:220:1::]:443": true,
+		"127.0.0.1:443":           false,
+		"10.1.2.3:443":            false,
+		"172.16.0.1:443":          false,
+		"192.168.1.1:443":         false,
+		"169.254.169.254:80":      false,
+		"100.64.0.1:443":          false,
+		"0.0.0.0:443":             false,
+		"[::1]:443":               false,
+		"[fd00::1]:443":           false,
+		"[fe80::1]:443":           false,
+		"[::ffff:127.0.0.1]:443":  false,
+	} {
+		err := dialPublicOnly("tcp", address, nil)
+		if public && err != nil {
+			t.Errorf("dialPublicOnly(%q) returned error: %v", address, err)
+		}
+		if !public && err == nil {
+			t.Errorf("dialPublicOnly(%q) succeeded, want an error", address)
+		}
+	}
+
+	// Hosts that pass the checks still can't be reached on private addresses, i.e. through DNS or a redirect
+	resolver := &WebResolver{HTTPClient: &http.Client{}}
+	if _, err := resolver.client().Get("http://127.0.0.1:1/.well-known/did.json"); err == nil || !strings.Contains(err.Error(), "non-public") {
+		t.Errorf("restricted client dialed a loopback address: %v", err)
+	}
+}
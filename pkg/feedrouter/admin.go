@@ -0,0 +1,399 @@
+package feedrouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Reindexer is implemented by feeds that can rebuild the state they index from, i.e. a curated feed
+// reloading its list's items, so operators can recover a feed that missed events
+type Reindexer interface {
+	Reindex(ctx context.Context) error
+}
+
+// feedStats counts the requests served by a registered feed
+type feedStats struct {
+	requests    atomic.Int64
+	errors      atomic.Int64
+	posts       atomic.Int64
+	inflight    atomic.Int64
+	lastRequest atomic.Int64 // unix micros
+}
+
+// FeedStats is a snapshot of the requests served by a feed since it was registered
+type FeedStats struct {
+	Requests    int64      `json:"requests"`
+	Errors      int64      `json:"errors"`
+	PostsServed int64      `json:"posts_served"`
+	InFlight    int64      `json:"in_flight"`
+	LastRequest *time.Time `json:"last_request,omitempty"`
+}
+
+// FeedInfo describes a registered feed for the admin API
+type FeedInfo struct {
+	Name          string       `json:"name"`
+	Type          string       `json:"type"`           // Go type of the feed, i.e. *keyword.KeywordFeed
+	Aliases       []string     `json:"aliases"`        // Aliases the feed claims, in order
+	ServedAliases []string     `json:"served_aliases"` // Aliases the feed actually serves, the rest are claimed by earlier feeds
+	FromConfig    bool         `json:"from_config"`    // Whether the feed was loaded from the feed config
+	Auth          AuthMode     `json:"auth"`           // How the feed treats viewer authentication
+	Metadata      FeedMetadata `json:"metadata"`
+	Reindexable   bool         `json:"reindexable"`
+	RegisteredAt  time.Time    `json:"registered_at"`
+	PinnedPosts   []string     `json:"pinned_posts"`
+	RemovedPosts  []string     `json:"removed_posts"`
+	Stats         FeedStats    `json:"stats"`
+}
+
+// feedOverrides are the posts operators have pinned to or removed from a feed
+// They're kept by feed name so they survive the feed being reloaded
+type feedOverrides struct {
+	pinned  []string            // AT-URIs served at the top of the first page, in order
+	removed map[string]struct{} // AT-URIs never served
+}
+
+// ListFeedInfo describes every registered feed in the order they were added
+func (fg *FeedRouter) ListFeedInfo() []FeedInfo {
+	fg.lk.RLock()
+	defer fg.lk.RUnlock()
+
+	infos := make([]FeedInfo, 0, len(fg.feeds))
+	for _, rf := range fg.feeds {
+		infos = append(infos, fg.feedInfo(rf))
+	}
+
+	return infos
+}
+
+// GetFeedInfo describes the feed registered under the given name
+func (fg *FeedRouter) GetFeedInfo(name string) (FeedInfo, error) {
+	fg.lk.RLock()
+	defer fg.lk.RUnlock()
+
+	rf := fg.findFeed(name)
+	if rf == nil {
+		return FeedInfo{}, feedNotFound(name)
+	}
+
+	return fg.feedInfo(rf), nil
+}
+
+// feedInfo describes a registered feed, fg.lk must be held
+func (fg *FeedRouter) feedInfo(rf *registeredFeed) FeedInfo {
+	_, reindexable := rf.feed.(Reindexer)
+
+	info := FeedInfo{
+		Name:          rf.name,
+		Type:          fmt.Sprintf("%T", rf.feed),
+		Aliases:       append([]string{}, rf.aliases...),
+		ServedAliases: []string{},
+		FromConfig:    rf.def != "",
+		Auth:          rf.authMode,
+		Metadata:      feedMetadata(rf),
+		Reindexable:   reindexable,
+		RegisteredAt:  rf.registeredAt,
+		PinnedPosts:   []string{},
+		RemovedPosts:  []string{},
+		Stats: FeedStats{
+			Requests:    rf.stats.requests.Load(),
+			Errors:      rf.stats.errors.Load(),
+			PostsServed: rf.stats.posts.Load(),
+			InFlight:    rf.stats.inflight.Load(),
+		},
+	}
+
+	if last := rf.stats.lastRequest.Load(); last > 0 {
+		lastRequest := time.UnixMicro(last)
+		info.Stats.LastRequest = &lastRequest
+	}
+
+	for _, alias := range rf.aliases {
+		if fg.feedMap[alias] == rf {
+			info.ServedAliases = append(info.ServedAliases, alias)
+		}
+	}
+
+	if overrides, ok := fg.overrides[rf.name]; ok {
+		info.PinnedPosts = append(info.PinnedPosts, overrides.pinned...)
+		for uri := range overrides.removed {
+			info.RemovedPosts = append(info.RemovedPosts, uri)
+		}
+	}
+
+	return info
+}
+
+// findFeed returns the feed registered under the given name, fg.lk must be held
+func (fg *FeedRouter) findFeed(name string) *registeredFeed {
+	for _, rf := range fg.feeds {
+		if rf.name == name {
+			return rf
+		}
+	}
+	return nil
+}
+
+func feedNotFound(name string) error {
+	return NotFoundError{fmt.Errorf("no feed is registered as %s", name)}
+}
+
+// SetAliases replaces the aliases of a registered feed, which also sets their order
+// Aliases set at runtime last until the feed is reloaded from a changed definition
+func (fg *FeedRouter) SetAliases(name string, aliases []string) error {
+	seen := map[string]bool{}
+	for _, alias := range aliases {
+		if alias == "" {
+			return errors.New("aliases must not be empty")
+		}
+		if seen[alias] {
+			return fmt.Errorf("alias %s is listed more than once", alias)
+		}
+		seen[alias] = true
+	}
+
+	fg.lk.Lock()
+	defer fg.lk.Unlock()
+
+	rf := fg.findFeed(name)
+	if rf == nil {
+		return feedNotFound(name)
+	}
+
+	rf.aliases = append([]string{}, aliases...)
+	fg.rebuildFeedMap()
+
+	return nil
+}
+
+// AddAlias adds an alias to a registered feed, it's a no-op if the feed already has the alias
+func (fg *FeedRouter) AddAlias(name string, alias string) error {
+	if alias == "" {
+		return errors.New("alias must not be empty")
+	}
+
+	fg.lk.Lock()
+	defer fg.lk.Unlock()
+
+	rf := fg.findFeed(name)
+	if rf == nil {
+		return feedNotFound(name)
+	}
+
+	for _, existing := range rf.aliases {
+		if existing == alias {
+			return nil
+		}
+	}
+
+	rf.aliases = append(append([]string{}, rf.aliases...), alias)
+	fg.rebuildFeedMap()
+
+	return nil
+}
+
+// RemoveAlias removes an alias from a registered feed, it's a no-op if the feed doesn't have the alias
+func (fg *FeedRouter) RemoveAlias(name string, alias string) error {
+	fg.lk.Lock()
+	defer fg.lk.Unlock()
+
+	rf := fg.findFeed(name)
+	if rf == nil {
+		return feedNotFound(name)
+	}
+
+	aliases := []string{}
+	for _, existing := range rf.aliases {
+		if existing != alias {
+			aliases = append(aliases, existing)
+		}
+	}
+
+	rf.aliases = aliases
+	fg.rebuildFeedMap()
+
+	return nil
+}
+
+// PinPost serves a post at the top of the first page of a feed, after any posts that are already pinned
+func (fg *FeedRouter) PinPost(name string, uri string) error {
+	fg.lk.Lock()
+	defer fg.lk.Unlock()
+
+	if fg.findFeed(name) == nil {
+		return feedNotFound(name)
+	}
+
+	overrides := fg.feedOverrides(name)
+	for _, pinned := range overrides.pinned {
+		if pinned == uri {
+			return nil
+		}
+	}
+	overrides.pinned = append(overrides.pinned, uri)
+
+	return nil
+}
+
+// UnpinPost stops pinning a post to a feed, it's a no-op if the post isn't pinned
+func (fg *FeedRouter) UnpinPost(name string, uri string) error {
+	fg.lk.Lock()
+	defer fg.lk.Unlock()
+
+	if fg.findFeed(name) == nil {
+		return feedNotFound(name)
+	}
+
+	overrides := fg.feedOverrides(name)
+	pinned := []string{}
+	for _, existing := range overrides.pinned {
+		if existing != uri {
+			pinned = append(pinned, existing)
+		}
+	}
+	overrides.pinned = pinned
+
+	return nil
+}
+
+// RemovePost stops a feed from serving a post, whether or not the feed has indexed it
+func (fg *FeedRouter) RemovePost(name string, uri string) error {
+	fg.lk.Lock()
+	defer fg.lk.Unlock()
+
+	if fg.findFeed(name) == nil {
+		return feedNotFound(name)
+	}
+
+	fg.feedOverrides(name).removed[uri] = struct{}{}
+
+	return nil
+}
+
+// RestorePost undoes RemovePost
+func (fg *FeedRouter) RestorePost(name string, uri string) error {
+	fg.lk.Lock()
+	defer fg.lk.Unlock()
+
+	if fg.findFeed(name) == nil {
+		return feedNotFound(name)
+	}
+
+	delete(fg.feedOverrides(name).removed, uri)
+
+	return nil
+}
+
+// feedOverrides returns the overrides of a feed, creating them if needed, fg.lk must be held
+func (fg *FeedRouter) feedOverrides(name string) *feedOverrides {
+	if fg.overrides == nil {
+		fg.overrides = map[string]*feedOverrides{}
+	}
+
+	overrides, ok := fg.overrides[name]
+	if !ok {
+		overrides = &feedOverrides{removed: map[string]struct{}{}}
+		fg.overrides[name] = overrides
+	}
+
+	return overrides
+}
+
+// Reindex asks a registered feed to rebuild its index
+// Returns an error if the feed doesn't implement Reindexer
+func (fg *FeedRouter) Reindex(ctx context.Context, name string) error {
+	fg.lk.RLock()
+	rf := fg.findFeed(name)
+	fg.lk.RUnlock()
+
+	if rf == nil {
+		return feedNotFound(name)
+	}
+
+	reindexer, ok := rf.feed.(Reindexer)
+	if !ok {
+		return fmt.Errorf("feed %s doesn't support reindexing", name)
+	}
+
+	return reindexer.Reindex(ctx)
+}
+
+// Overlay pins posts to the top of the first page of a feed and hides removed posts from every page
+// The FeedRouter overlays the posts operators pinned and removed, feeds built on other feeds can overlay their own
+type Overlay struct {
+	Pinned  []string            // AT-URIs served on top of the first page with a pin reason, in order
+	Removed map[string]struct{} // AT-URIs that are never served
+}
+
+// pins returns the pinned posts that haven't been removed
+func (o Overlay) pins() []string {
+	pins := make([]string, 0, len(o.Pinned))
+	for _, uri := range o.Pinned {
+		if _, ok := o.Removed[uri]; !ok {
+			pins = append(pins, uri)
+		}
+	}
+
+	return pins
+}
+
+// Limit returns how many posts to ask the feed for, leaving room for the pinned posts on the first page
+// At least one post is asked for so the first page still has a cursor to carry on from when the pins fill it
+func (o Overlay) Limit(limit int64, cursor string) int64 {
+	pins := int64(len(o.pins()))
+	if cursor != "" || pins == 0 {
+		return limit
+	}
+
+	if limit-pins < 1 {
+		return 1
+	}
+
+	return limit - pins
+}
+
+// Apply drops removed and pinned posts from a page, and puts the pinned posts on top of the first page with a pin reason
+// Pins that don't fit in limit alongside the feed's posts are left out, dropping the feed's posts would lose them from the cursor
+func (o Overlay) Apply(posts []*SkeletonPost, limit int64, cursor string) []*SkeletonPost {
+	if len(o.Pinned) == 0 && len(o.Removed) == 0 {
+		return posts
+	}
+
+	skip := make(map[string]struct{}, len(o.Pinned)+len(o.Removed))
+	for uri := range o.Removed {
+		skip[uri] = struct{}{}
+	}
+	for _, uri := range o.Pinned {
+		skip[uri] = struct{}{}
+	}
+
+	kept := make([]*SkeletonPost, 0, len(posts))
+	for _, post := range posts {
+		if _, ok := skip[post.Post]; ok {
+			continue
+		}
+		kept = append(kept, post)
+	}
+
+	if cursor != "" {
+		return kept
+	}
+
+	pins := o.pins()
+	room := limit - int64(len(kept))
+	if room < 0 {
+		room = 0
+	}
+	if room < int64(len(pins)) {
+		pins = pins[:room]
+	}
+
+	filtered := make([]*SkeletonPost, 0, len(pins)+len(kept))
+	for _, uri := range pins {
+		filtered = append(filtered, &SkeletonPost{Post: uri, Reason: NewPinReason()})
+	}
+
+	return append(filtered, kept...)
+}
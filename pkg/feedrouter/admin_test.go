@@ -0,0 +1,120 @@
+package feedrouter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func page(uris ...string) []*SkeletonPost {
+	posts := make([]*SkeletonPost, 0, len(uris))
+	for _, uri := range uris {
+		posts = append(posts, &SkeletonPost{Post: uri})
+	}
+	return posts
+}
+
+// served returns the URIs of a page, with pinned posts prefixed by "pin:"
+func served(posts []*SkeletonPost) []string {
+	uris := []string{}
+	for _, post := range posts {
+		if post.Reason != nil && post.Reason.Pin {
+			uris = append(uris, "pin:"+post.Post)
+			continue
+		}
+		uris = append(uris, post.Post)
+	}
+	return uris
+}
+
+func TestOverlay(t *testing.T) {
+	tests := []struct {
+		name      string
+		overlay   Overlay
+		limit     int64
+		cursor    string
+		feedLimit int64
+		feed      []*SkeletonPost
+		expected  []string
+	}{
+		{
+			name:      "no overrides",
+			limit:     3,
+			feedLimit: 3,
+			feed:      page("a", "b", "c"),
+			expected:  []string{"a", "b", "c"},
+		},
+		{
+			name:      "pins on top of the first page",
+			overlay:   Overlay{Pinned: []string{"p1", "p2"}},
+			limit:     4,
+			feedLimit: 2,
+			feed:      page("a", "b"),
+			expected:  []string{"pin:p1", "pin:p2", "a", "b"},
+		},
+		{
+			name:      "pins served again by the feed are skipped",
+			overlay:   Overlay{Pinned: []string{"p1"}},
+			limit:     3,
+			feedLimit: 2,
+			feed:      page("a", "p1"),
+			expected:  []string{"pin:p1", "a"},
+		},
+		{
+			name:      "later pages skip pins",
+			overlay:   Overlay{Pinned: []string{"p1"}},
+			limit:     3,
+			cursor:    "next",
+			feedLimit: 3,
+			feed:      page("p1", "a", "b"),
+			expected:  []string{"a", "b"},
+		},
+		{
+			name:      "removed posts are never served",
+			overlay:   Overlay{Pinned: []string{"p1", "r"}, Removed: map[string]struct{}{"r": {}, "b": {}}},
+			limit:     3,
+			feedLimit: 2,
+			feed:      page("a", "b"),
+			expected:  []string{"pin:p1", "a"},
+		},
+		{
+			name:      "pins that fill the page leave room for one post",
+			overlay:   Overlay{Pinned: []string{"p1", "p2", "p3"}},
+			limit:     3,
+			feedLimit: 1,
+			feed:      page("a"),
+			expected:  []string{"pin:p1", "pin:p2", "a"},
+		},
+		{
+			name:      "pins are cut to the limit",
+			overlay:   Overlay{Pinned: []string{"p1", "p2"}},
+			limit:     1,
+			feedLimit: 1,
+			feed:      page("a"),
+			expected:  []string{"a"},
+		},
+		{
+			name:      "pins fill a short page",
+			overlay:   Overlay{Pinned: []string{"p1", "p2"}},
+			limit:     2,
+			feedLimit: 1,
+			feed:      page(),
+			expected:  []string{"pin:p1", "pin:p2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if feedLimit := test.overlay.Limit(test.limit, test.cursor); feedLimit != test.feedLimit {
+				t.Errorf("got feed limit %d, expected %d", feedLimit, test.feedLimit)
+			}
+
+			got := served(test.overlay.Apply(test.feed, test.limit, test.cursor))
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("got page %v, expected %v", got, test.expected)
+			}
+			if int64(len(got)) > test.limit {
+				t.Errorf("got %d posts, more than the limit of %d", len(got), test.limit)
+			}
+		})
+	}
+}
@@ -0,0 +1,520 @@
+package feedrouter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/firehose"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/store"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a declarative list of feeds, loaded from a YAML (or JSON) file
+type Config struct {
+	Links Links            `yaml:"links"` // Policies advertised by describeFeedGenerator
+	Feeds []FeedDefinition `yaml:"feeds"`
+}
+
+// FeedDefinition declares a single feed in a Config
+type FeedDefinition struct {
+	Type        string      `yaml:"type"`         // Feed type, as registered with RegisterFeedType
+	Name        string      `yaml:"name"`         // Name of the feed, and its first alias for most feed types
+	Aliases     []string    `yaml:"aliases"`      // Extra aliases the feed is served under
+	DisplayName string      `yaml:"display_name"` // Display name of the feed when it's published
+	Description string      `yaml:"description"`  // Description of the feed when it's published
+	Avatar      string      `yaml:"avatar"`       // Path to the avatar image of the feed when it's published
+	ContentMode ContentMode `yaml:"content_mode"` // Kind of posts the feed serves, unspecified or video
+	Auth        AuthMode    `yaml:"auth"`         // Overrides how the feed treats viewer authentication
+	Params      yaml.Node   `yaml:"params"`       // Type-specific parameters, decoded by the feed's constructor
+
+	index int // position of the feed in the Config, for error messages
+}
+
+// FeedEnv is the shared state feed constructors can build feeds from
+type FeedEnv struct {
+	FeedActorDID string
+	Router       *FeedRouter
+	PostStore    store.PostStore
+	FollowStore  store.FollowStore
+	Firehose     *firehose.Firehose // nil if the service isn't consuming the firehose
+
+	aliases map[string]bool // aliases defined so far while loading a config
+}
+
+// HasFeed returns whether a feed is served under the given alias, counting feeds defined
+// earlier in the config that's being loaded rather than the feeds that are running
+func (env *FeedEnv) HasFeed(alias string) bool {
+	if env.aliases != nil {
+		return env.aliases[alias]
+	}
+
+	_, ok := env.Router.GetFeed(alias)
+	return ok
+}
+
+// FeedConstructor builds a Feed from its definition and returns it along with the aliases it serves
+type FeedConstructor func(ctx context.Context, env *FeedEnv, def *FeedDefinition) (Feed, []string, error)
+
+var feedTypesLk sync.RWMutex
+var feedTypes = map[string]FeedConstructor{}
+
+// RegisterFeedType makes a feed type available to configs under the given name
+// Feed packages call it from init, so importing a feed package is enough to make its type available
+func RegisterFeedType(name string, constructor FeedConstructor) {
+	feedTypesLk.Lock()
+	defer feedTypesLk.Unlock()
+
+	if _, ok := feedTypes[name]; ok {
+		panic(fmt.Sprintf("feed type %s is registered more than once", name))
+	}
+
+	feedTypes[name] = constructor
+}
+
+// FeedTypes returns the names of the registered feed types, sorted
+func FeedTypes() []string {
+	feedTypesLk.RLock()
+	defer feedTypesLk.RUnlock()
+
+	names := make([]string, 0, len(feedTypes))
+	for name := range feedTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func getFeedType(name string) (FeedConstructor, bool) {
+	feedTypesLk.RLock()
+	defer feedTypesLk.RUnlock()
+
+	constructor, ok := feedTypes[name]
+	return constructor, ok
+}
+
+// ConfigError is returned for an invalid feed definition, naming the feed and the offending field
+type ConfigError struct {
+	Index int    // Position of the feed in the config
+	Feed  string // Name of the feed, if it has one
+	Field string // Offending field, i.e. params.include
+	Line  int    // Line of the offending field in the config file, if known
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "feeds[%d]", e.Index)
+	if e.Feed != "" {
+		fmt.Fprintf(&sb, " (%s)", e.Feed)
+	}
+	if e.Field != "" {
+		fmt.Fprintf(&sb, ": %s", e.Field)
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&sb, " (line %d)", e.Line)
+	}
+	fmt.Fprintf(&sb, ": %s", e.Err)
+
+	return sb.String()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// FieldError is returned by feed constructors for an invalid parameter
+// The FeedRouter turns it into a ConfigError naming the feed
+type FieldError struct {
+	Field string // Offending field, relative to the feed definition, i.e. params.include
+	Line  int
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// NewFieldError returns a FieldError for the given field and message
+func NewFieldError(field string, format string, args ...any) *FieldError {
+	return &FieldError{Field: field, Err: fmt.Errorf(format, args...)}
+}
+
+// LoadConfig reads a feed config file, expanding ${VAR} references to environment variables
+// JSON configs work too since YAML is a superset of JSON
+func LoadConfig(path string) (*Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading feed config: %w", err)
+	}
+
+	return ParseConfig([]byte(os.ExpandEnv(string(raw))))
+}
+
+// ParseConfig parses and validates a feed config
+// Validation covers the fields every feed has, type-specific params are checked when the feeds are built
+func ParseConfig(raw []byte) (*Config, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+
+	config := &Config{}
+	if err := dec.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error parsing feed config: %w", err)
+	}
+
+	if err := config.Links.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid feed config: %w", err)
+	}
+
+	// Names are the first alias of most feed types, so names and aliases share one namespace
+	names := map[string]int{}
+	aliases := map[string]int{}
+	for i := range config.Feeds {
+		def := &config.Feeds[i]
+		def.index = i
+
+		if def.Name == "" {
+			return nil, &ConfigError{Index: i, Field: "name", Err: errors.New("is required")}
+		}
+
+		if def.Type == "" {
+			return nil, def.fieldError("type", 0, errors.New("is required"))
+		}
+
+		if _, ok := getFeedType(def.Type); !ok {
+			return nil, def.fieldError("type", 0, fmt.Errorf("unknown feed type %q, expected one of %s", def.Type, strings.Join(FeedTypes(), ", ")))
+		}
+
+		metadata := def.Metadata()
+		if err := metadata.Validate(); err != nil {
+			var fieldErr *FieldError
+			if errors.As(err, &fieldErr) {
+				return nil, def.fieldError(fieldErr.Field, fieldErr.Line, fieldErr.Err)
+			}
+			return nil, &ConfigError{Index: i, Feed: def.Name, Err: err}
+		}
+
+		if def.Auth != "" && !validAuthMode(def.Auth) {
+			return nil, def.fieldError("auth", 0, fmt.Errorf("unknown auth mode %q, expected one of %s", def.Auth, joinAuthModes()))
+		}
+
+		if other, ok := names[def.Name]; ok {
+			return nil, def.fieldError("name", 0, fmt.Errorf("is already used by feeds[%d]", other))
+		}
+		if other, ok := aliases[def.Name]; ok {
+			return nil, def.fieldError("name", 0, fmt.Errorf("is already an alias of feeds[%d]", other))
+		}
+		names[def.Name] = i
+
+		own := map[string]bool{}
+		for j, alias := range def.Aliases {
+			field := fmt.Sprintf("aliases[%d]", j)
+			if alias == "" {
+				return nil, def.fieldError(field, 0, errors.New("must not be empty"))
+			}
+			if own[alias] {
+				return nil, def.fieldError(field, 0, fmt.Errorf("%q is listed more than once", alias))
+			}
+			if other, ok := names[alias]; ok && other != i {
+				return nil, def.fieldError(field, 0, fmt.Errorf("%q is already the name of feeds[%d]", alias, other))
+			}
+			if other, ok := aliases[alias]; ok && other != i {
+				return nil, def.fieldError(field, 0, fmt.Errorf("%q is already an alias of feeds[%d]", alias, other))
+			}
+			own[alias] = true
+			aliases[alias] = i
+		}
+	}
+
+	return config, nil
+}
+
+// validAuthMode returns whether mode is one of the AuthModes
+func validAuthMode(mode AuthMode) bool {
+	for _, valid := range AuthModes {
+		if mode == valid {
+			return true
+		}
+	}
+	return false
+}
+
+func joinAuthModes() string {
+	modes := make([]string, 0, len(AuthModes))
+	for _, mode := range AuthModes {
+		modes = append(modes, string(mode))
+	}
+	return strings.Join(modes, ", ")
+}
+
+// Metadata returns how the feed is presented to clients
+func (def *FeedDefinition) Metadata() FeedMetadata {
+	return FeedMetadata{
+		DisplayName: def.DisplayName,
+		Description: def.Description,
+		Avatar:      def.Avatar,
+		ContentMode: def.ContentMode,
+	}
+}
+
+// fieldError returns a ConfigError for a field of the feed definition
+func (def *FeedDefinition) fieldError(field string, line int, err error) *ConfigError {
+	return &ConfigError{Index: def.index, Feed: def.Name, Field: field, Line: line, Err: err}
+}
+
+// DecodeParams decodes the feed's params into v, a pointer to a struct with yaml tags
+// Unknown params are rejected so typos don't silently fall back to defaults
+func (def *FeedDefinition) DecodeParams(v any) error {
+	if def.Params.Kind == 0 {
+		return nil
+	}
+
+	if def.Params.Kind != yaml.MappingNode {
+		return &FieldError{Field: "params", Line: def.Params.Line, Err: errors.New("must be a mapping")}
+	}
+
+	if err := checkKnownFields(&def.Params, reflect.TypeOf(v), "params"); err != nil {
+		return err
+	}
+
+	if err := def.Params.Decode(v); err != nil {
+		return &FieldError{Field: "params", Line: def.Params.Line, Err: err}
+	}
+
+	return nil
+}
+
+// checkKnownFields walks a mapping node and returns a FieldError for the first key with no matching yaml tag in t
+func checkKnownFields(node *yaml.Node, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		t = t.Elem()
+		if node.Kind == yaml.SequenceNode {
+			for i, item := range node.Content {
+				if err := checkKnownFields(item, t, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	if t.Kind() != reflect.Struct || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = field.Type
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		fieldType, ok := fields[key.Value]
+		if !ok {
+			return &FieldError{Field: path + "." + key.Value, Line: key.Line, Err: errors.New("unknown field")}
+		}
+
+		if err := checkKnownFields(value, fieldType, path+"."+key.Value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadFeeds builds the feeds in the config and registers them with the FeedRouter
+// It can be called again with an updated config to reload feeds at runtime: feeds whose definition
+// didn't change keep running, changed feeds are rebuilt and replaced, and feeds that are no longer
+// in the config are removed. Every feed is built before any is registered, so an invalid config
+// leaves the running feeds untouched. Replaced and removed feeds are stopped once they're drained
+// Feeds that implement firehose.Handler are added to env.Firehose if it's set
+func (fg *FeedRouter) LoadFeeds(ctx context.Context, env *FeedEnv, config *Config) error {
+	fg.loadLk.Lock()
+	defer fg.loadLk.Unlock()
+
+	// Feeds added in code rather than from a config stay registered, so composites can reference them
+	running := map[string]*registeredFeed{}
+	loadEnv := *env
+	loadEnv.aliases = map[string]bool{}
+
+	fg.lk.RLock()
+	for _, rf := range fg.feeds {
+		if rf.def == "" {
+			for _, alias := range rf.aliases {
+				loadEnv.aliases[alias] = true
+			}
+			continue
+		}
+		running[rf.name] = rf
+	}
+	fg.lk.RUnlock()
+
+	// Build every new or changed feed, in order so composites can check their children are defined
+	built := []*registeredFeed{}
+	abort := func() {
+		for _, rf := range built {
+			rf.stop()
+		}
+	}
+
+	kept := map[string]bool{}
+	for i := range config.Feeds {
+		def := &config.Feeds[i]
+
+		fingerprint, err := yaml.Marshal(def)
+		if err != nil {
+			abort()
+			return &ConfigError{Index: def.index, Feed: def.Name, Err: err}
+		}
+
+		if rf, ok := running[def.Name]; ok && rf.def == string(fingerprint) {
+			kept[def.Name] = true
+			for _, alias := range rf.aliases {
+				loadEnv.aliases[alias] = true
+			}
+			continue
+		}
+
+		rf, err := fg.buildRegisteredFeed(ctx, &loadEnv, def)
+		if err != nil {
+			abort()
+			return err
+		}
+		rf.def = string(fingerprint)
+
+		built = append(built, rf)
+		for _, alias := range rf.aliases {
+			loadEnv.aliases[alias] = true
+		}
+	}
+
+	// Swap the new feeds in, then remove the feeds that aren't in the config anymore
+	replaced := []*registeredFeed{}
+	for _, rf := range built {
+		if handler, ok := rf.feed.(firehose.Handler); ok && env.Firehose != nil {
+			env.Firehose.AddHandler(handler)
+		}
+
+		if old := fg.swapFeed(rf); old != nil {
+			replaced = append(replaced, old)
+		}
+	}
+
+	inConfig := map[string]bool{}
+	for i := range config.Feeds {
+		inConfig[config.Feeds[i].Name] = true
+	}
+
+	removed := 0
+	for name := range running {
+		if inConfig[name] {
+			continue
+		}
+		if old := fg.removeFeed(name); old != nil {
+			replaced = append(replaced, old)
+			removed++
+		}
+	}
+
+	fg.SetLinks(config.Links)
+
+	if len(running) > 0 {
+		log.Printf("reloaded feeds: %d unchanged, %d added or changed, %d removed", len(kept), len(built), removed)
+	}
+
+	// Drain the old feeds together so one slow request doesn't hold up the rest
+	wg := sync.WaitGroup{}
+	for _, old := range replaced {
+		wg.Add(1)
+		go func(old *registeredFeed) {
+			defer wg.Done()
+			fg.drain(ctx, old)
+		}(old)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// buildRegisteredFeed builds a feed from its definition with its own context,
+// so stopping the feed cancels its background work and unhooks it from the firehose
+func (fg *FeedRouter) buildRegisteredFeed(ctx context.Context, env *FeedEnv, def *FeedDefinition) (*registeredFeed, error) {
+	feedCtx, cancel := context.WithCancel(ctx)
+
+	feed, aliases, err := fg.BuildFeed(feedCtx, env, def)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	handler, isHandler := feed.(firehose.Handler)
+	if isHandler && env.Firehose == nil {
+		log.Printf("feed %s indexes the firehose but no relay is configured, it will only serve posts that are already stored", def.Name)
+	}
+
+	return &registeredFeed{
+		name:     def.Name,
+		aliases:  aliases,
+		feed:     feed,
+		authMode: feedAuthMode(feed, def.Auth),
+		metadata: def.Metadata(),
+		stop: func() {
+			if isHandler && env.Firehose != nil {
+				env.Firehose.RemoveHandler(handler)
+			}
+			cancel()
+		},
+	}, nil
+}
+
+// BuildFeed builds a single feed from its definition and returns it with every alias it should be served under
+func (fg *FeedRouter) BuildFeed(ctx context.Context, env *FeedEnv, def *FeedDefinition) (Feed, []string, error) {
+	constructor, ok := getFeedType(def.Type)
+	if !ok {
+		return nil, nil, def.fieldError("type", 0, fmt.Errorf("unknown feed type %q", def.Type))
+	}
+
+	feed, aliases, err := constructor(ctx, env, def)
+	if err != nil {
+		var fieldErr *FieldError
+		if errors.As(err, &fieldErr) {
+			return nil, nil, def.fieldError(fieldErr.Field, fieldErr.Line, fieldErr.Err)
+		}
+		return nil, nil, &ConfigError{Index: def.index, Feed: def.Name, Err: err}
+	}
+
+	for _, alias := range def.Aliases {
+		found := false
+		for _, existing := range aliases {
+			if existing == alias {
+				found = true
+				break
+			}
+		}
+		if !found {
+			aliases = append(aliases, alias)
+		}
+	}
+
+	return feed, aliases, nil
+}
@@ -0,0 +1,570 @@
+package feedrouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+links:
+  privacy_policy: https://example.com/privacy
+feeds:
+  - type: test
+    name: first
+    aliases: [one, uno]
+    display_name: First
+    auth: required
+    params:
+      posts: [at://did:plc:author/app.bsky.feed.post/1]
+  - type: test
+    name: second
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Links.PrivacyPolicy != "https://example.com/privacy" {
+		t.Errorf("got privacy policy %q", config.Links.PrivacyPolicy)
+	}
+	if len(config.Feeds) != 2 {
+		t.Fatalf("got %d feeds, expected 2", len(config.Feeds))
+	}
+
+	first := config.Feeds[0]
+	if first.Name != "first" || !reflect.DeepEqual(first.Aliases, []string{"one", "uno"}) || first.Auth != AuthRequired || first.DisplayName != "First" {
+		t.Errorf("got feed %+v", first)
+	}
+	if config.Feeds[1].index != 1 {
+		t.Errorf("got index %d for the second feed", config.Feeds[1].index)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		index    int
+		feed     string
+		field    string
+		expected string
+	}{
+		{
+			name: "missing name",
+			config: `
+feeds:
+  - type: test`,
+			field:    "name",
+			expected: "feeds[0]: name: is required",
+		},
+		{
+			name: "missing type",
+			config: `
+feeds:
+  - name: first`,
+			feed:     "first",
+			field:    "type",
+			expected: "feeds[0] (first): type: is required",
+		},
+		{
+			name: "unknown type",
+			config: `
+feeds:
+  - name: first
+    type: nope`,
+			feed:     "first",
+			field:    "type",
+			expected: `feeds[0] (first): type: unknown feed type "nope", expected one of `,
+		},
+		{
+			name: "duplicate name",
+			config: `
+feeds:
+  - {type: test, name: first}
+  - {type: test, name: second}
+  - {type: test, name: first}`,
+			index:    2,
+			feed:     "first",
+			field:    "name",
+			expected: "feeds[2] (first): name: is already used by feeds[0]",
+		},
+		{
+			name: "name taken by an earlier alias",
+			config: `
+feeds:
+  - {type: test, name: first, aliases: [second]}
+  - {type: test, name: second}`,
+			index:    1,
+			feed:     "second",
+			field:    "name",
+			expected: "feeds[1] (second): name: is already an alias of feeds[0]",
+		},
+		{
+			name: "alias taken by a name",
+			config: `
+feeds:
+  - {type: test, name: first}
+  - {type: test, name: second, aliases: [other, first]}`,
+			index:    1,
+			feed:     "second",
+			field:    "aliases[1]",
+			expected: `feeds[1] (second): aliases[1]: "first" is already the name of feeds[0]`,
+		},
+		{
+			name: "alias taken by a later name",
+			config: `
+feeds:
+  - {type: test, name: first, aliases: [second]}
+  - {type: test, name: third}
+  - {type: test, name: second}`,
+			index:    2,
+			feed:     "second",
+			field:    "name",
+			expected: "feeds[2] (second): name: is already an alias of feeds[0]",
+		},
+		{
+			name: "alias taken by another alias",
+			config: `
+feeds:
+  - {type: test, name: first, aliases: [shared]}
+  - {type: test, name: second, aliases: [shared]}`,
+			index:    1,
+			feed:     "second",
+			field:    "aliases[0]",
+			expected: `feeds[1] (second): aliases[0]: "shared" is already an alias of feeds[0]`,
+		},
+		{
+			name: "alias listed twice",
+			config: `
+feeds:
+  - {type: test, name: first, aliases: [one, two, one]}`,
+			feed:     "first",
+			field:    "aliases[2]",
+			expected: `feeds[0] (first): aliases[2]: "one" is listed more than once`,
+		},
+		{
+			name: "empty alias",
+			config: `
+feeds:
+  - {type: test, name: first, aliases: [one, ""]}`,
+			feed:     "first",
+			field:    "aliases[1]",
+			expected: "feeds[0] (first): aliases[1]: must not be empty",
+		},
+		{
+			name: "unknown auth mode",
+			config: `
+feeds:
+  - {type: test, name: first, auth: sometimes}`,
+			feed:     "first",
+			field:    "auth",
+			expected: `feeds[0] (first): auth: unknown auth mode "sometimes", expected one of preferred, required, ignored`,
+		},
+		{
+			name: "display name too long",
+			config: `
+feeds:
+  - {type: test, name: first}
+  - {type: test, name: second, display_name: "` + strings.Repeat("x", MaxDisplayNameLength+1) + `"}`,
+			index:    1,
+			feed:     "second",
+			field:    "display_name",
+			expected: "feeds[1] (second): display_name: must be at most 24 characters, got 25",
+		},
+		{
+			name: "avatar not an image",
+			config: `
+feeds:
+  - {type: test, name: first, avatar: avatar.gif}`,
+			feed:     "first",
+			field:    "avatar",
+			expected: "feeds[0] (first): avatar: must be a .png or .jpeg image",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(test.config))
+
+			configErr := &ConfigError{}
+			if !errors.As(err, &configErr) {
+				t.Fatalf("got error %v, expected a ConfigError", err)
+			}
+
+			if configErr.Index != test.index || configErr.Feed != test.feed || configErr.Field != test.field {
+				t.Errorf("got feeds[%d] (%s) field %q, expected feeds[%d] (%s) field %q", configErr.Index, configErr.Feed, configErr.Field, test.index, test.feed, test.field)
+			}
+			if !strings.HasPrefix(err.Error(), test.expected) {
+				t.Errorf("got error %q, expected %q", err, test.expected)
+			}
+		})
+	}
+}
+
+func TestParseConfigInvalidDocument(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{
+			name:     "unknown top level field",
+			config:   "feedz: []",
+			expected: "error parsing feed config: yaml: unmarshal errors:\n  line 1: field feedz not found in type feedrouter.Config",
+		},
+		{
+			name:     "unknown feed field",
+			config:   "feeds:\n  - {type: test, name: first, alias: [one]}",
+			expected: "error parsing feed config: yaml: unmarshal errors:\n  line 2: field alias not found in type feedrouter.FeedDefinition",
+		},
+		{
+			name:     "invalid link",
+			config:   "links:\n  terms_of_service: ftp://example.com/tos",
+			expected: `invalid feed config: links.terms_of_service: "ftp://example.com/tos" is not an http(s) URL`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(test.config))
+			if err == nil || err.Error() != test.expected {
+				t.Errorf("got error %q, expected %q", err, test.expected)
+			}
+		})
+	}
+}
+
+func TestLoadConfigExpandsEnv(t *testing.T) {
+	t.Setenv("TEST_FEED_NAME", "expanded")
+	t.Setenv("TEST_PRIVACY_POLICY", "https://example.com/privacy")
+
+	path := filepath.Join(t.TempDir(), "feeds.yaml")
+	raw := `
+links:
+  privacy_policy: ${TEST_PRIVACY_POLICY}
+feeds:
+  - type: test
+    name: ${TEST_FEED_NAME}
+    aliases: [$TEST_FEED_NAME-alias]
+    description: "${TEST_UNSET_VARIABLE}"
+`
+	if err := os.WriteFile(path, []byte(raw), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Links.PrivacyPolicy != "https://example.com/privacy" {
+		t.Errorf("got privacy policy %q, expected it expanded from the environment", config.Links.PrivacyPolicy)
+	}
+
+	def := config.Feeds[0]
+	if def.Name != "expanded" || !reflect.DeepEqual(def.Aliases, []string{"expanded-alias"}) {
+		t.Errorf("got name %q and aliases %v, expected them expanded from the environment", def.Name, def.Aliases)
+	}
+	if def.Description != "" {
+		t.Errorf("got description %q for an unset variable, expected it to be empty", def.Description)
+	}
+
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil || !strings.HasPrefix(err.Error(), "error reading feed config: ") {
+		t.Errorf("got error %v for a missing file", err)
+	}
+}
+
+func TestLoadFeedsParamErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		field    string
+		line     int
+		expected string
+	}{
+		{
+			name: "unknown param",
+			config: `feeds:
+  - type: test
+    name: first
+  - type: test
+    name: second
+    params:
+      posts: []
+      post: x`,
+			field:    "params.post",
+			line:     8,
+			expected: "feeds[1] (second): params.post (line 8): unknown field",
+		},
+		{
+			name: "params not a mapping",
+			config: `feeds:
+  - type: test
+    name: first
+  - type: test
+    name: second
+    params: [posts]`,
+			field:    "params",
+			line:     6,
+			expected: "feeds[1] (second): params (line 6): must be a mapping",
+		},
+		{
+			name: "constructor field error",
+			config: `feeds:
+  - type: test
+    name: first
+  - type: test
+    name: second
+    params:
+      fail: must be better`,
+			field:    "params.fail",
+			expected: "feeds[1] (second): params.fail: must be better",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := ParseConfig([]byte(test.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			router := newTestRouter(t)
+			err = router.LoadFeeds(context.Background(), &FeedEnv{FeedActorDID: testFeedActorDID, Router: router}, config)
+
+			configErr := &ConfigError{}
+			if !errors.As(err, &configErr) {
+				t.Fatalf("got error %v, expected a ConfigError", err)
+			}
+
+			if configErr.Index != 1 || configErr.Feed != "second" || configErr.Field != test.field || configErr.Line != test.line {
+				t.Errorf("got feeds[%d] (%s) field %q line %d, expected feeds[1] (second) field %q line %d", configErr.Index, configErr.Feed, configErr.Field, configErr.Line, test.field, test.line)
+			}
+			if err.Error() != test.expected {
+				t.Errorf("got error %q, expected %q", err, test.expected)
+			}
+
+			// An invalid config leaves nothing registered, the first feed included
+			if _, ok := router.GetFeed("first"); ok {
+				t.Error("first feed was registered from an invalid config")
+			}
+			if first := latestTestFeed(t, router, "first"); !first.stopped() {
+				t.Error("first feed wasn't stopped after the config was rejected")
+			}
+		})
+	}
+}
+
+// reloadConfig returns a config with feed a at the given generation, feed b unchanged, and feed c on odd generations
+func reloadConfig(t *testing.T, generation int) *Config {
+	raw := fmt.Sprintf(`
+feeds:
+  - type: test
+    name: a
+    params:
+      generation: %d
+      posts: [%s]
+  - type: test
+    name: b
+    params:
+      posts: [%s]
+`, generation, strings.Join(testPosts(fmt.Sprintf("a%d-", generation), 3), ", "), strings.Join(testPosts("b-", 3), ", "))
+
+	if generation%2 == 1 {
+		raw += "  - {type: test, name: c}\n"
+	}
+
+	config, err := ParseConfig([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return config
+}
+
+func TestLoadFeedsDuringRequests(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(t)
+	env := &FeedEnv{FeedActorDID: testFeedActorDID, Router: router}
+
+	if err := router.LoadFeeds(ctx, env, reloadConfig(t, 0)); err != nil {
+		t.Fatal(err)
+	}
+	b := latestTestFeed(t, router, "b")
+
+	const generations = 20
+
+	done := make(chan struct{})
+	errs := make(chan error, 100)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				for _, alias := range []string{"a", "b", "c"} {
+					skeleton, err := router.GetSkeleton(ctx, alias, "", 10, "")
+					if err != nil {
+						// c comes and goes, a and b are always served
+						if alias == "c" && errors.As(err, &NotFoundError{}) {
+							continue
+						}
+						errs <- fmt.Errorf("feed %s: %w", alias, err)
+						return
+					}
+
+					if alias == "c" {
+						continue
+					}
+
+					if len(skeleton.Feed) != 3 {
+						errs <- fmt.Errorf("feed %s: got %d posts, expected 3", alias, len(skeleton.Feed))
+						return
+					}
+
+					// Every page comes from a single generation of the feed
+					generation, _, _ := strings.Cut(strings.TrimPrefix(skeleton.Feed[0].Post, "at://did:plc:author/app.bsky.feed.post/"), "-")
+					for _, post := range skeleton.Feed {
+						if !strings.HasPrefix(post.Post, "at://did:plc:author/app.bsky.feed.post/"+generation+"-") {
+							errs <- fmt.Errorf("feed %s: got posts %v from more than one generation", alias, served(skeleton.Feed))
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+
+	for generation := 1; generation <= generations; generation++ {
+		if err := router.LoadFeeds(ctx, env, reloadConfig(t, generation)); err != nil {
+			t.Fatal(err)
+		}
+
+		a := latestTestFeed(t, router, "a")
+		if a.generation != generation {
+			t.Fatalf("got feed a from generation %d after loading generation %d", a.generation, generation)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Replaced feeds are stopped, and feeds whose definition didn't change are never rebuilt
+	as := testFeedsBuilt(router, "a")
+	for _, a := range as[:len(as)-1] {
+		if !a.stopped() {
+			t.Errorf("feed a from generation %d wasn't stopped after it was replaced", a.generation)
+		}
+	}
+	if as[len(as)-1].stopped() {
+		t.Error("the running feed a was stopped")
+	}
+
+	if bs := testFeedsBuilt(router, "b"); len(bs) != 1 || bs[0] != b || b.stopped() {
+		t.Errorf("feed b was rebuilt or stopped by reloads that didn't change it")
+	}
+
+	if _, ok := router.GetFeed("c"); ok {
+		t.Errorf("feed c is served after loading generation %d, which doesn't define it", generations)
+	}
+}
+
+func TestLoadFeedsDrainsInFlightRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		reload  string // config loaded while a request to feed a is in flight
+		removed bool   // whether the reload removes feed a
+	}{
+		{name: "replaced", reload: "feeds:\n  - {type: test, name: a, params: {generation: 1}}\n  - {type: test, name: b}"},
+		{name: "removed", reload: "feeds:\n  - {type: test, name: b}", removed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			router := newTestRouter(t)
+			env := &FeedEnv{FeedActorDID: testFeedActorDID, Router: router}
+
+			initial, err := ParseConfig([]byte("feeds:\n  - {type: test, name: a, params: {posts: [old]}}\n  - {type: test, name: b}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := router.LoadFeeds(ctx, env, initial); err != nil {
+				t.Fatal(err)
+			}
+
+			// Hold a request to feed a until it's released
+			old := latestTestFeed(t, router, "a")
+			old.started = make(chan struct{}, 1)
+			old.release = make(chan struct{})
+
+			inFlight := make(chan error, 1)
+			go func() {
+				skeleton, err := router.GetSkeleton(ctx, "a", "", 10, "")
+				if err == nil && (len(skeleton.Feed) != 1 || skeleton.Feed[0].Post != "old") {
+					err = fmt.Errorf("got posts %v, expected the old feed's", served(skeleton.Feed))
+				}
+				inFlight <- err
+			}()
+			<-old.started
+
+			reload, err := ParseConfig([]byte(test.reload))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			loaded := make(chan error, 1)
+			go func() {
+				loaded <- router.LoadFeeds(ctx, env, reload)
+			}()
+
+			select {
+			case err := <-loaded:
+				t.Fatalf("LoadFeeds returned %v before the in-flight request finished", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			if old.stopped() {
+				t.Fatal("old feed a was stopped with a request in flight")
+			}
+
+			// New requests reach the new definition while the old feed drains
+			_, err = router.GetSkeleton(ctx, "a", "", 10, "")
+			if test.removed != errors.As(err, &NotFoundError{}) || (!test.removed && err != nil) {
+				t.Fatalf("got error %v for a new request while the old feed drains", err)
+			}
+			if !test.removed && latestTestFeed(t, router, "a").generation != 1 {
+				t.Fatal("feed a wasn't rebuilt from the reloaded config")
+			}
+
+			close(old.release)
+			if err := <-inFlight; err != nil {
+				t.Fatalf("in-flight request failed: %v", err)
+			}
+			if err := <-loaded; err != nil {
+				t.Fatal(err)
+			}
+			if !old.stopped() {
+				t.Error("old feed a wasn't stopped once it drained")
+			}
+		})
+	}
+}
@@ -4,9 +4,15 @@ package feedrouter
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
 
 	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	lru "github.com/hashicorp/golang-lru"
 	did "github.com/whyrusleeping/go-did"
 )
 
@@ -16,19 +22,103 @@ type Feed interface {
 }
 
 type FeedRouter struct {
-	FeedActorDID          did.DID         // DID of the Repo the Feed is published under
-	ServiceEndpoint       string          // URL of the FeedRouter service
-	ServiceDID            did.DID         // DID of the FeedRouter service
-	DIDDocument           did.Document    // DID Document of the FeedRouter service
-	AcceptableURIPrefixes []string        // URIs that the FeedRouter is allowed to generate feeds for
-	FeedMap               map[string]Feed // map of FeedName to Feed
-	Feeds                 []Feed
+	FeedActorDID          did.DID       // DID of the Repo the Feed is published under
+	ServiceEndpoint       string        // URL of the FeedRouter service
+	ServiceDID            did.DID       // DID of the FeedRouter service
+	DIDDocument           did.Document  // DID Document of the FeedRouter service
+	AcceptableURIPrefixes []string      // URIs that the FeedRouter is allowed to generate feeds for
+	DrainTimeout          time.Duration // How long a replaced or removed feed is given to finish in-flight requests
+
+	lk      sync.RWMutex
+	feeds   []*registeredFeed          // in the order they were added, which sets alias precedence
+	feedMap map[string]*registeredFeed // map of alias to the feed that serves it
+
+	overrides map[string]*feedOverrides // map of feed name to the posts pinned to or removed from it, guarded by lk
+
+	servedPosts *lru.Cache // map of viewer and post URI to the servedPost that served it, for routing interactions
+
+	links Links // policies advertised by describeFeedGenerator, guarded by lk
+
+	loadLk sync.Mutex // serializes LoadFeeds so reloads don't interleave
+}
+
+// registeredFeed is a Feed along with what the FeedRouter needs to serve, replace, and remove it
+type registeredFeed struct {
+	name    string
+	aliases []string
+	feed    Feed
+	stop    func() // called once the feed is drained after being replaced or removed, may be nil
+
+	def      string       // definition the feed was built from if it came from a Config
+	authMode AuthMode     // how the feed treats viewer authentication
+	metadata FeedMetadata // how the feed is presented to clients
+
+	registeredAt time.Time
+	stats        feedStats
+	inflight     sync.WaitGroup // GetPage calls in progress
 }
 
+// NotFoundError is returned for a feed alias that isn't served, by the FeedRouter or by a Feed serving several aliases
 type NotFoundError struct {
 	error
 }
 
+// NewNotFoundError returns a NotFoundError with the given message
+func NewNotFoundError(message string) NotFoundError {
+	return NotFoundError{errors.New(message)}
+}
+
+// InvalidRequestError is returned by a Feed for a request it can't serve as asked, i.e. one with a malformed cursor
+type InvalidRequestError struct {
+	error
+}
+
+// NewInvalidRequestError returns an InvalidRequestError, formatting its message like fmt.Errorf
+func NewInvalidRequestError(format string, args ...any) InvalidRequestError {
+	return InvalidRequestError{fmt.Errorf(format, args...)}
+}
+
+// AuthRequiredError is returned by a Feed that can't be served without knowing who the viewer is
+type AuthRequiredError struct {
+	error
+}
+
+// NewAuthRequiredError returns an AuthRequiredError with the given message
+func NewAuthRequiredError(message string) AuthRequiredError {
+	return AuthRequiredError{errors.New(message)}
+}
+
+// AuthMode is how a feed treats viewer authentication
+type AuthMode string
+
+const (
+	AuthPreferred AuthMode = "preferred" // Serves everyone, personalized for authenticated viewers, the default
+	AuthRequired  AuthMode = "required"  // Only serves authenticated viewers
+	AuthIgnored   AuthMode = "ignored"   // Serves everyone the same feed without being told who the viewer is
+)
+
+// AuthModes are the valid AuthModes
+var AuthModes = []AuthMode{AuthPreferred, AuthRequired, AuthIgnored}
+
+// AuthModer is implemented by feeds that declare how they treat viewer authentication
+// Feeds that don't are AuthPreferred, and a feed's config can override what it declares
+type AuthModer interface {
+	AuthMode() AuthMode
+}
+
+// feedAuthMode returns the AuthMode a feed is served with, the override if it's set or what the feed declares
+func feedAuthMode(feed Feed, override AuthMode) AuthMode {
+	if override != "" {
+		return override
+	}
+
+	if moder, ok := feed.(AuthModer); ok && moder.AuthMode() != "" {
+		return moder.AuthMode()
+	}
+
+	return AuthPreferred
+}
+
 // NewFeedRouter returns a new FeedRouter
 func NewFeedRouter(
 	ctx context.Context,
@@ -52,6 +142,11 @@ func NewFeedRouter(
 		return nil, fmt.Errorf("error parsing feedActorDID: %w", err)
 	}
 
+	servedPosts, err := lru.New(servedPostsSize)
+	if err != nil {
+		return nil, fmt.Errorf("error creating served posts cache: %w", err)
+	}
+
 	serviceID, err := did.ParseDID("#bsky_fg")
 	if err != nil {
 		panic(err)
@@ -70,7 +165,9 @@ func NewFeedRouter(
 	}
 
 	return &FeedRouter{
-		FeedMap:               map[string]Feed{},
+		DrainTimeout:          time.Second * 30,
+		feedMap:               map[string]*registeredFeed{},
+		servedPosts:           servedPosts,
 		FeedActorDID:          feedActorDID,
 		ServiceDID:            serviceDID,
 		DIDDocument:           doc,
@@ -82,20 +179,279 @@ func NewFeedRouter(
 // AddFeed adds a feed to the FeedRouter
 // Feed precedence for overlapping aliases is determined by the order in which
 // they are added (first added is highest precedence)
+// The feed is registered under its first alias, use SetFeed to control its name
 func (fg *FeedRouter) AddFeed(feedAliases []string, feed Feed) {
-	if fg.FeedMap == nil {
-		fg.FeedMap = map[string]Feed{}
+	name := ""
+	if len(feedAliases) > 0 {
+		name = feedAliases[0]
+	}
+
+	fg.lk.Lock()
+	defer fg.lk.Unlock()
+
+	fg.feeds = append(fg.feeds, &registeredFeed{name: name, aliases: feedAliases, feed: feed, authMode: feedAuthMode(feed, ""), registeredAt: time.Now()})
+	fg.rebuildFeedMap()
+}
+
+// SetFeed registers a feed under the given name, replacing the feed already registered under it
+// A replaced feed keeps its precedence, new feeds are added with the lowest precedence
+// Requests already being served by the replaced feed are drained before stop is called on it
+// stop may be nil, and is called once the feed is drained or the DrainTimeout passes
+func (fg *FeedRouter) SetFeed(ctx context.Context, name string, feedAliases []string, feed Feed, stop func()) {
+	if old := fg.swapFeed(&registeredFeed{name: name, aliases: feedAliases, feed: feed, authMode: feedAuthMode(feed, ""), stop: stop}); old != nil {
+		fg.drain(ctx, old)
+	}
+}
+
+// swapFeed registers a feed in place of the feed with the same name, returning the feed it replaced if any
+func (fg *FeedRouter) swapFeed(rf *registeredFeed) *registeredFeed {
+	rf.registeredAt = time.Now()
+
+	fg.lk.Lock()
+	defer fg.lk.Unlock()
+
+	var old *registeredFeed
+	for i, existing := range fg.feeds {
+		if existing.name == rf.name {
+			old = existing
+			fg.feeds[i] = rf
+			break
+		}
+	}
+	if old == nil {
+		fg.feeds = append(fg.feeds, rf)
+	}
+	fg.rebuildFeedMap()
+
+	return old
+}
+
+// RemoveFeed unregisters the feed with the given name and drains its in-flight requests
+// Returns false if no feed is registered under the name
+func (fg *FeedRouter) RemoveFeed(ctx context.Context, name string) bool {
+	old := fg.removeFeed(name)
+	if old == nil {
+		return false
+	}
+
+	fg.drain(ctx, old)
+	return true
+}
+
+// removeFeed unregisters the feed with the given name, returning it if there was one
+func (fg *FeedRouter) removeFeed(name string) *registeredFeed {
+	fg.lk.Lock()
+	defer fg.lk.Unlock()
+
+	for i, existing := range fg.feeds {
+		if existing.name == name {
+			fg.feeds = append(fg.feeds[:i], fg.feeds[i+1:]...)
+			fg.rebuildFeedMap()
+			return existing
+		}
+	}
+
+	return nil
+}
+
+// drain waits for the in-flight requests of a feed that's no longer registered, then stops it
+// No new requests can reach the feed once it's out of the feedMap, so the WaitGroup only counts down
+func (fg *FeedRouter) drain(ctx context.Context, rf *registeredFeed) {
+	drained := make(chan struct{})
+	go func() {
+		rf.inflight.Wait()
+		close(drained)
+	}()
+
+	timeout := fg.DrainTimeout
+	if timeout <= 0 {
+		timeout = time.Second * 30
+	}
+
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		log.Printf("feed %s still has requests in flight after %s, stopping it anyway", rf.name, timeout)
+	case <-ctx.Done():
 	}
 
-	for _, feedAlias := range feedAliases {
-		// Skip the feed if we already have the alias registered so we don't add it twice
-		// Feed precedence is determined by the order in which they are added
-		if _, ok := fg.FeedMap[feedAlias]; ok {
-			continue
+	if rf.stop != nil {
+		rf.stop()
+	}
+}
+
+// rebuildFeedMap maps every alias to the first feed that claims it, fg.lk must be held
+func (fg *FeedRouter) rebuildFeedMap() {
+	fg.feedMap = map[string]*registeredFeed{}
+
+	for _, rf := range fg.feeds {
+		for _, feedAlias := range rf.aliases {
+			// Skip the feed if we already have the alias registered so we don't add it twice
+			// Feed precedence is determined by the order in which they are added
+			if _, ok := fg.feedMap[feedAlias]; ok {
+				continue
+			}
+
+			fg.feedMap[feedAlias] = rf
 		}
+	}
+}
+
+// GetFeed returns the feed registered under the given alias
+func (fg *FeedRouter) GetFeed(feedAlias string) (Feed, bool) {
+	fg.lk.RLock()
+	defer fg.lk.RUnlock()
+
+	rf, ok := fg.feedMap[feedAlias]
+	if !ok {
+		return nil, false
+	}
+
+	return rf.feed, true
+}
+
+// ListFeeds returns every registered feed in the order they were added
+func (fg *FeedRouter) ListFeeds() []Feed {
+	fg.lk.RLock()
+	defer fg.lk.RUnlock()
+
+	feeds := make([]Feed, 0, len(fg.feeds))
+	for _, rf := range fg.feeds {
+		feeds = append(feeds, rf.feed)
+	}
+
+	return feeds
+}
 
-		fg.FeedMap[feedAlias] = feed
+// GetSkeleton gets a page from the feed registered under the given alias
+// The request is counted against the feed so replacing or removing it waits for the request to finish
+// Posts pinned to the feed are served on top of the first page, and removed posts are never served
+// Feeds that require auth get an AuthRequiredError for anonymous viewers, feeds that ignore it aren't given the viewer
+func (fg *FeedRouter) GetSkeleton(ctx context.Context, feedAlias string, userDID string, limit int64, cursor string) (*Skeleton, error) {
+	rf, overlay, err := fg.acquireFeed(feedAlias)
+	if err != nil {
+		return nil, err
+	}
+	defer rf.inflight.Done()
+
+	viewer := userDID
+	userDID, err = rf.viewer(feedAlias, userDID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err = enterFeed(ctx, rf.name)
+	if err != nil {
+		return nil, err
+	}
+
+	rf.stats.requests.Add(1)
+	rf.stats.inflight.Add(1)
+	defer rf.stats.inflight.Add(-1)
+	rf.stats.lastRequest.Store(time.Now().UnixMicro())
+
+	skeleton, err := getSkeleton(ctx, rf.feed, feedAlias, userDID, overlay.Limit(limit, cursor), cursor)
+	if err != nil {
+		rf.stats.errors.Add(1)
+		return nil, err
+	}
+
+	skeleton.Feed = overlay.Apply(skeleton.Feed, limit, cursor)
+	rf.stats.posts.Add(int64(len(skeleton.Feed)))
+
+	// Remember who was served what so their interactions make it back to the feed
+	fg.recordServed(rf, feedAlias, viewer, skeleton)
+
+	return skeleton, nil
+}
+
+// GetRawSkeleton gets a page from the feed registered under the given alias for a feed that's built on top of it
+// The pins and removals of the feed aren't applied, and the request isn't counted in its stats or served posts,
+// those belong to the feed that serves the page to the viewer
+// Like GetSkeleton, replacing or removing the feed waits for the request to finish and its auth mode applies
+func (fg *FeedRouter) GetRawSkeleton(ctx context.Context, feedAlias string, userDID string, limit int64, cursor string) (*Skeleton, error) {
+	rf, _, err := fg.acquireFeed(feedAlias)
+	if err != nil {
+		return nil, err
+	}
+	defer rf.inflight.Done()
+
+	userDID, err = rf.viewer(feedAlias, userDID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err = enterFeed(ctx, rf.name)
+	if err != nil {
+		return nil, err
+	}
+
+	return getSkeleton(ctx, rf.feed, feedAlias, userDID, limit, cursor)
+}
+
+// MaxFeedDepth is how deep feeds built on other feeds can nest, i.e. a composite of a pinned keyword feed is 3 deep
+const MaxFeedDepth = 8
+
+// servingKey is the context key of the names of the feeds a request is being served through, outermost first
+type servingKey struct{}
+
+// enterFeed returns ctx with the feed added to the feeds the request is being served through
+// It fails if the feed is already being served further up, i.e. a composite whose child alias was pointed back at it,
+// which would otherwise recurse until the stack overflows
+func enterFeed(ctx context.Context, name string) (context.Context, error) {
+	chain, _ := ctx.Value(servingKey{}).([]string)
+
+	for _, serving := range chain {
+		if serving == name {
+			return nil, fmt.Errorf("feed %s includes itself: %s -> %s", name, strings.Join(chain, " -> "), name)
+		}
+	}
+
+	if len(chain) >= MaxFeedDepth {
+		return nil, fmt.Errorf("feed %s is nested more than %d feeds deep", name, MaxFeedDepth)
+	}
+
+	next := make([]string, len(chain), len(chain)+1)
+	copy(next, chain)
+
+	return context.WithValue(ctx, servingKey{}, append(next, name)), nil
+}
+
+// acquireFeed returns the feed registered under the given alias with a copy of its overrides
+// The request is counted against the feed, callers must call rf.inflight.Done once it's finished
+func (fg *FeedRouter) acquireFeed(feedAlias string) (*registeredFeed, Overlay, error) {
+	fg.lk.RLock()
+	defer fg.lk.RUnlock()
+
+	rf, ok := fg.feedMap[feedAlias]
+	if !ok {
+		return nil, Overlay{}, NotFoundError{fmt.Errorf("feed %s not found", feedAlias)}
+	}
+	rf.inflight.Add(1)
+
+	overlay := Overlay{}
+	if overrides, ok := fg.overrides[rf.name]; ok {
+		overlay.Pinned = overrides.pinned
+		overlay.Removed = make(map[string]struct{}, len(overrides.removed))
+		for uri := range overrides.removed {
+			overlay.Removed[uri] = struct{}{}
+		}
+	}
+
+	return rf, overlay, nil
+}
+
+// viewer returns the viewer to pass to the feed given its auth mode
+// Feeds that require auth get an AuthRequiredError for anonymous viewers, feeds that ignore it aren't given the viewer
+func (rf *registeredFeed) viewer(feedAlias string, userDID string) (string, error) {
+	switch rf.authMode {
+	case AuthRequired:
+		if userDID == "" {
+			return "", NewAuthRequiredError(fmt.Sprintf("feed %s requires an authenticated viewer", feedAlias))
+		}
+	case AuthIgnored:
+		return "", nil
 	}
 
-	fg.Feeds = append(fg.Feeds, feed)
+	return userDID, nil
 }
@@ -0,0 +1,257 @@
+package feedrouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+const testFeedActorDID = "did:plc:feedactor"
+
+func init() {
+	RegisterFeedType("test", newTestFeedFromConfig)
+}
+
+// testFeed pages through a fixed list of posts
+type testFeed struct {
+	name       string
+	generation int // generation of the config the feed was built from
+	posts      []string
+	ctx        context.Context // cancelled once the FeedRouter stops the feed
+
+	// GetPage sends on started and waits for release to be closed if release is set
+	started chan struct{}
+	release chan struct{}
+}
+
+func (tf *testFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	if tf.release != nil {
+		tf.started <- struct{}{}
+		<-tf.release
+	}
+
+	offset := 0
+	if cursor != "" {
+		var err error
+		if offset, err = strconv.Atoi(cursor); err != nil {
+			return nil, nil, NewInvalidRequestError("cursor is not an integer: %w", err)
+		}
+	}
+
+	posts := []*appbsky.FeedDefs_SkeletonFeedPost{}
+	for i := offset; i < len(tf.posts) && int64(len(posts)) < limit; i++ {
+		posts = append(posts, &appbsky.FeedDefs_SkeletonFeedPost{Post: tf.posts[i]})
+	}
+
+	var next *string
+	if end := offset + len(posts); end < len(tf.posts) {
+		next = new(string)
+		*next = strconv.Itoa(end)
+	}
+
+	return posts, next, nil
+}
+
+func (tf *testFeed) Describe(ctx context.Context) ([]appbsky.FeedDescribeFeedGenerator_Feed, error) {
+	return []appbsky.FeedDescribeFeedGenerator_Feed{{Uri: "at://" + testFeedActorDID + "/app.bsky.feed.generator/" + tf.name}}, nil
+}
+
+func (tf *testFeed) stopped() bool {
+	return tf.ctx != nil && tf.ctx.Err() != nil
+}
+
+// testFeedParams are the params of the test feed type
+type testFeedParams struct {
+	Posts      []string `yaml:"posts"`
+	Generation int      `yaml:"generation"`
+	Fail       string   `yaml:"fail"` // returned as a FieldError for params.fail if set
+}
+
+// builtTestFeeds are the test feeds built from configs, by router and name, the latest build last
+var builtTestFeeds = struct {
+	sync.Mutex
+	feeds map[*FeedRouter]map[string][]*testFeed
+}{feeds: map[*FeedRouter]map[string][]*testFeed{}}
+
+func newTestFeedFromConfig(ctx context.Context, env *FeedEnv, def *FeedDefinition) (Feed, []string, error) {
+	p := testFeedParams{}
+	if err := def.DecodeParams(&p); err != nil {
+		return nil, nil, err
+	}
+
+	if p.Fail != "" {
+		return nil, nil, NewFieldError("params.fail", "%s", p.Fail)
+	}
+
+	tf := &testFeed{name: def.Name, generation: p.Generation, posts: p.Posts, ctx: ctx}
+
+	builtTestFeeds.Lock()
+	if builtTestFeeds.feeds[env.Router] == nil {
+		builtTestFeeds.feeds[env.Router] = map[string][]*testFeed{}
+	}
+	builtTestFeeds.feeds[env.Router][def.Name] = append(builtTestFeeds.feeds[env.Router][def.Name], tf)
+	builtTestFeeds.Unlock()
+
+	return tf, []string{def.Name}, nil
+}
+
+// testFeedsBuilt returns the test feeds built for the given router and name, the latest build last
+func testFeedsBuilt(router *FeedRouter, name string) []*testFeed {
+	builtTestFeeds.Lock()
+	defer builtTestFeeds.Unlock()
+
+	return append([]*testFeed{}, builtTestFeeds.feeds[router][name]...)
+}
+
+// latestTestFeed returns the test feed most recently built for the given router and name
+func latestTestFeed(t *testing.T, router *FeedRouter, name string) *testFeed {
+	feeds := testFeedsBuilt(router, name)
+	if len(feeds) == 0 {
+		t.Fatalf("no test feed was built for %s", name)
+	}
+
+	return feeds[len(feeds)-1]
+}
+
+func newTestRouter(t *testing.T) *FeedRouter {
+	router, err := NewFeedRouter(context.Background(), testFeedActorDID, "did:web:feedgen.example.com", []string{testFeedActorDID}, "https://feedgen.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return router
+}
+
+// testPosts returns n post URIs with the given prefix in their record keys
+func testPosts(prefix string, n int) []string {
+	posts := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		posts = append(posts, fmt.Sprintf("at://did:plc:author/app.bsky.feed.post/%s%d", prefix, i))
+	}
+	return posts
+}
+
+// newBlockingFeed returns a test feed whose requests are held until release is closed
+func newBlockingFeed(name string, posts ...string) *testFeed {
+	return &testFeed{name: name, posts: posts, started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+// holdRequest starts a request to the feed served under alias and waits for it to reach the blocking feed
+func holdRequest(t *testing.T, router *FeedRouter, tf *testFeed, alias string) <-chan error {
+	inFlight := make(chan error, 1)
+	go func() {
+		_, err := router.GetSkeleton(context.Background(), alias, "", 10, "")
+		inFlight <- err
+	}()
+
+	select {
+	case <-tf.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never reached the feed")
+	}
+
+	return inFlight
+}
+
+func TestSetFeedDrainsInFlightRequests(t *testing.T) {
+	router := newTestRouter(t)
+
+	old := newBlockingFeed("a", "old")
+	stopped := make(chan struct{})
+	router.SetFeed(context.Background(), "a", []string{"a"}, old, func() { close(stopped) })
+
+	inFlight := holdRequest(t, router, old, "a")
+
+	replaced := make(chan struct{})
+	go func() {
+		router.SetFeed(context.Background(), "a", []string{"a"}, &testFeed{name: "a", posts: []string{"new"}}, nil)
+		close(replaced)
+	}()
+
+	select {
+	case <-replaced:
+		t.Fatal("SetFeed returned before the in-flight request finished")
+	case <-stopped:
+		t.Fatal("replaced feed was stopped with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// New requests are served by the new feed while the old one drains
+	skeleton, err := router.GetSkeleton(context.Background(), "a", "", 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := served(skeleton.Feed); len(got) != 1 || got[0] != "new" {
+		t.Errorf("got posts %v while the old feed drains, expected the new feed's", got)
+	}
+
+	close(old.release)
+	if err := <-inFlight; err != nil {
+		t.Fatalf("in-flight request failed: %v", err)
+	}
+	<-replaced
+	<-stopped
+}
+
+func TestDrainTimeout(t *testing.T) {
+	router := newTestRouter(t)
+	router.DrainTimeout = 50 * time.Millisecond
+
+	old := newBlockingFeed("a", "old")
+	defer close(old.release)
+
+	stopped := make(chan struct{})
+	router.SetFeed(context.Background(), "a", []string{"a"}, old, func() { close(stopped) })
+
+	holdRequest(t, router, old, "a")
+
+	start := time.Now()
+	if !router.RemoveFeed(context.Background(), "a") {
+		t.Fatal("feed a wasn't removed")
+	}
+
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("RemoveFeed returned without stopping the feed")
+	}
+	if elapsed := time.Since(start); elapsed < router.DrainTimeout || elapsed > 5*time.Second {
+		t.Errorf("RemoveFeed took %s with a DrainTimeout of %s", elapsed, router.DrainTimeout)
+	}
+
+	if _, err := router.GetSkeleton(context.Background(), "a", "", 10, ""); !errors.As(err, &NotFoundError{}) {
+		t.Errorf("got error %v for a removed feed, expected a NotFoundError", err)
+	}
+}
+
+func TestDrainGivesUpWithContext(t *testing.T) {
+	router := newTestRouter(t)
+
+	old := newBlockingFeed("a", "old")
+	defer close(old.release)
+
+	stopped := make(chan struct{})
+	router.SetFeed(context.Background(), "a", []string{"a"}, old, func() { close(stopped) })
+
+	holdRequest(t, router, old, "a")
+
+	// The default DrainTimeout is far longer than the test, so only the cancelled context can end the drain
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if !router.RemoveFeed(ctx, "a") {
+		t.Fatal("feed a wasn't removed")
+	}
+
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("RemoveFeed returned without stopping the feed")
+	}
+}
@@ -0,0 +1,137 @@
+package feedrouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/store"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// InteractionHandler is implemented by feeds that want the interactions viewers send about the posts the feed served them
+// feed is the alias the posts were served under, like the feed argument of GetPage
+type InteractionHandler interface {
+	HandleInteractions(ctx context.Context, feed string, userDID string, interactions []*store.Interaction) error
+}
+
+// servedPostsSize is how many (viewer, post) pairs the FeedRouter remembers to route interactions to feeds
+const servedPostsSize = 100_000
+
+// servedFeed is a feed under one of its aliases
+type servedFeed struct {
+	name  string // name of the registered feed
+	alias string // alias the feed served the post under
+}
+
+// servedPost is the feed that served a post to a viewer, and what it attached to the post
+type servedPost struct {
+	servedFeed
+	feedContext string
+	reqID       string
+}
+
+func servedKey(userDID string, uri string) string {
+	return userDID + " " + uri
+}
+
+// recordServed remembers which feed served posts to a viewer, if the feed wants interactions
+func (fg *FeedRouter) recordServed(rf *registeredFeed, feedAlias string, userDID string, skeleton *Skeleton) {
+	if _, ok := rf.feed.(InteractionHandler); !ok || userDID == "" {
+		return
+	}
+
+	for _, post := range skeleton.Feed {
+		fg.servedPosts.Add(servedKey(userDID, post.Post), servedPost{
+			servedFeed:  servedFeed{name: rf.name, alias: feedAlias},
+			feedContext: post.FeedContext,
+			reqID:       skeleton.ReqID,
+		})
+	}
+}
+
+// HandleInteractions sets the Feed of each interaction to the alias of the feed that served the viewer its post,
+// and delivers the interactions to the feeds that implement InteractionHandler
+// Interactions that come back without the feedContext or reqId the post was served with get them filled in
+// Interactions with posts the FeedRouter doesn't remember serving the viewer are left without a Feed
+func (fg *FeedRouter) HandleInteractions(ctx context.Context, userDID string, interactions []*store.Interaction) error {
+	tracer := otel.Tracer("feedrouter")
+	ctx, span := tracer.Start(ctx, "FeedRouter:HandleInteractions")
+	defer span.End()
+
+	byFeed := map[servedFeed][]*store.Interaction{}
+	for _, interaction := range interactions {
+		entry, ok := fg.servedPosts.Get(servedKey(userDID, interaction.Item))
+		if !ok {
+			continue
+		}
+
+		served := entry.(servedPost)
+		interaction.Feed = served.alias
+		if interaction.FeedContext == "" {
+			interaction.FeedContext = served.feedContext
+		}
+		if interaction.ReqID == "" {
+			interaction.ReqID = served.reqID
+		}
+		byFeed[served.servedFeed] = append(byFeed[served.servedFeed], interaction)
+	}
+
+	span.SetAttributes(attribute.Int("interactions.length", len(interactions)), attribute.Int("interactions.feeds", len(byFeed)))
+
+	errs := []error{}
+	for served, batch := range byFeed {
+		if err := fg.deliverInteractions(ctx, served, userDID, batch); err != nil {
+			span.RecordError(err)
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// deliverInteractions hands a feed the interactions with posts it served, counting the call against the feed
+// so replacing or removing it waits for the call to finish
+func (fg *FeedRouter) deliverInteractions(ctx context.Context, served servedFeed, userDID string, interactions []*store.Interaction) error {
+	fg.lk.RLock()
+	var rf *registeredFeed
+	for _, candidate := range fg.feeds {
+		if candidate.name == served.name {
+			rf = candidate
+			rf.inflight.Add(1)
+			break
+		}
+	}
+	fg.lk.RUnlock()
+
+	// The feed was removed since it served the posts
+	if rf == nil {
+		return nil
+	}
+	defer rf.inflight.Done()
+
+	// A reloaded feed may have become a type that doesn't take interactions
+	handler, ok := rf.feed.(InteractionHandler)
+	if !ok {
+		return nil
+	}
+
+	// Feeds that ignore auth aren't told who the viewer is
+	if rf.authMode == AuthIgnored {
+		userDID = ""
+		anonymous := make([]*store.Interaction, 0, len(interactions))
+		for _, interaction := range interactions {
+			copied := *interaction
+			copied.Viewer = ""
+			anonymous = append(anonymous, &copied)
+		}
+		interactions = anonymous
+	}
+
+	if err := handler.HandleInteractions(ctx, served.alias, userDID, interactions); err != nil {
+		return fmt.Errorf("feed %s failed to handle interactions: %w", served.name, err)
+	}
+
+	return nil
+}
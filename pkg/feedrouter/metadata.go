@@ -0,0 +1,150 @@
+package feedrouter
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// ContentMode tells clients what kind of posts a feed serves so they can pick how to show it
+type ContentMode string
+
+const (
+	ContentModeUnspecified ContentMode = "unspecified" // Any kind of post, the default
+	ContentModeVideo       ContentMode = "video"       // Video posts, shown in a full screen player
+)
+
+// ContentModes are the valid ContentModes
+var ContentModes = []ContentMode{ContentModeUnspecified, ContentModeVideo}
+
+// contentModeTokens maps ContentModes to their app.bsky.feed.defs tokens
+var contentModeTokens = map[ContentMode]string{
+	ContentModeUnspecified: "app.bsky.feed.defs#contentModeUnspecified",
+	ContentModeVideo:       "app.bsky.feed.defs#contentModeVideo",
+}
+
+// Token returns the app.bsky.feed.defs token of the ContentMode, an empty ContentMode is unspecified
+func (m ContentMode) Token() string {
+	if m == "" {
+		m = ContentModeUnspecified
+	}
+	return contentModeTokens[m]
+}
+
+// Limits the lexicon puts on a feed generator record, graphemes are approximated by runes
+const (
+	MaxDisplayNameLength = 24
+	MaxDescriptionLength = 300
+)
+
+// FeedMetadata is how a feed is presented to clients, the app.bsky.feed.generator record it's published with
+type FeedMetadata struct {
+	DisplayName         string      `json:"display_name,omitempty"` // Falls back to the feed's name
+	Description         string      `json:"description,omitempty"`
+	Avatar              string      `json:"avatar,omitempty"` // Path to a PNG or JPEG image
+	ContentMode         ContentMode `json:"content_mode,omitempty"`
+	AcceptsInteractions bool        `json:"accepts_interactions"` // Set by the FeedRouter for feeds that implement InteractionHandler
+}
+
+// Validate returns a FieldError for the first field that can't be published
+func (md *FeedMetadata) Validate() error {
+	if n := utf8.RuneCountInString(md.DisplayName); n > MaxDisplayNameLength {
+		return NewFieldError("display_name", "must be at most %d characters, got %d", MaxDisplayNameLength, n)
+	}
+
+	if n := utf8.RuneCountInString(md.Description); n > MaxDescriptionLength {
+		return NewFieldError("description", "must be at most %d characters, got %d", MaxDescriptionLength, n)
+	}
+
+	if md.Avatar != "" {
+		ext := strings.ToLower(md.Avatar[strings.LastIndex(md.Avatar, ".")+1:])
+		if ext != "png" && ext != "jpg" && ext != "jpeg" {
+			return NewFieldError("avatar", "must be a .png or .jpeg image")
+		}
+	}
+
+	if md.ContentMode != "" && contentModeTokens[md.ContentMode] == "" {
+		return NewFieldError("content_mode", "unknown content mode %q, expected one of %s", md.ContentMode, joinContentModes())
+	}
+
+	return nil
+}
+
+func joinContentModes() string {
+	modes := make([]string, 0, len(ContentModes))
+	for _, mode := range ContentModes {
+		modes = append(modes, string(mode))
+	}
+	return strings.Join(modes, ", ")
+}
+
+// Links are the policies of the feed generator, advertised by describeFeedGenerator
+type Links struct {
+	PrivacyPolicy  string `yaml:"privacy_policy" json:"privacy_policy,omitempty"`
+	TermsOfService string `yaml:"terms_of_service" json:"terms_of_service,omitempty"`
+}
+
+// Validate returns a FieldError for the first link that isn't an http(s) URL
+func (l *Links) Validate() error {
+	// Checked in the order they're declared so the same config always reports the same error
+	links := []struct{ field, link string }{
+		{"links.privacy_policy", l.PrivacyPolicy},
+		{"links.terms_of_service", l.TermsOfService},
+	}
+
+	for _, link := range links {
+		if link.link == "" {
+			continue
+		}
+
+		u, err := url.Parse(link.link)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return NewFieldError(link.field, "%q is not an http(s) URL", link.link)
+		}
+	}
+
+	return nil
+}
+
+// SetLinks sets the policies the feed generator advertises, LoadFeeds replaces them with the config's
+func (fg *FeedRouter) SetLinks(links Links) {
+	fg.lk.Lock()
+	defer fg.lk.Unlock()
+
+	fg.links = links
+}
+
+// Links returns the policies the feed generator advertises
+func (fg *FeedRouter) Links() Links {
+	fg.lk.RLock()
+	defer fg.lk.RUnlock()
+
+	return fg.links
+}
+
+// SetFeedMetadata sets the metadata of the feed registered under the given name
+// Feeds loaded from a config get theirs from their definition, so it's replaced when they're reloaded
+func (fg *FeedRouter) SetFeedMetadata(name string, metadata FeedMetadata) error {
+	if err := metadata.Validate(); err != nil {
+		return fmt.Errorf("invalid metadata for feed %s: %w", name, err)
+	}
+
+	fg.lk.Lock()
+	defer fg.lk.Unlock()
+
+	rf := fg.findFeed(name)
+	if rf == nil {
+		return feedNotFound(name)
+	}
+
+	rf.metadata = metadata
+	return nil
+}
+
+// feedMetadata returns the metadata of a registered feed, with what the FeedRouter knows about it filled in
+func feedMetadata(rf *registeredFeed) FeedMetadata {
+	metadata := rf.metadata
+	_, metadata.AcceptsInteractions = rf.feed.(InteractionHandler)
+	return metadata
+}
@@ -0,0 +1,168 @@
+package feedrouter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+// Limits the lexicon puts on what feeds attach to a skeleton
+const (
+	MaxFeedContextLength = 2000
+	MaxReqIDLength       = 100
+)
+
+// SkeletonPost is a post in a page of a feed
+// FeedContext is sent back by clients with interactions about the post, so feeds can tell why they served it
+type SkeletonPost struct {
+	Post        string          `json:"post"`
+	Reason      *SkeletonReason `json:"reason,omitempty"`
+	FeedContext string          `json:"feedContext,omitempty"`
+}
+
+// Lexicon types of the reasons a post can be in a feed
+const (
+	ReasonRepostType = "app.bsky.feed.defs#skeletonReasonRepost"
+	ReasonPinType    = "app.bsky.feed.defs#skeletonReasonPin"
+)
+
+// SkeletonReason is why a post is in a feed, either a repost or a pin
+type SkeletonReason struct {
+	Repost string // AT-URI of the repost that put the post in the feed
+	Pin    bool   // The post is pinned to the top of the feed
+}
+
+// NewRepostReason returns the reason for a post served because of the given repost
+func NewRepostReason(repostURI string) *SkeletonReason {
+	return &SkeletonReason{Repost: repostURI}
+}
+
+// NewPinReason returns the reason for a post pinned to the top of a feed
+func NewPinReason() *SkeletonReason {
+	return &SkeletonReason{Pin: true}
+}
+
+// skeletonReasonJSON is the union of the skeletonReasonRepost and skeletonReasonPin lexicon objects
+type skeletonReasonJSON struct {
+	Type   string `json:"$type"`
+	Repost string `json:"repost,omitempty"`
+}
+
+func (r *SkeletonReason) MarshalJSON() ([]byte, error) {
+	switch {
+	case r.Repost != "":
+		return json.Marshal(skeletonReasonJSON{Type: ReasonRepostType, Repost: r.Repost})
+	case r.Pin:
+		return json.Marshal(skeletonReasonJSON{Type: ReasonPinType})
+	}
+	return nil, fmt.Errorf("cannot marshal empty skeleton reason")
+}
+
+func (r *SkeletonReason) UnmarshalJSON(b []byte) error {
+	raw := skeletonReasonJSON{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	switch raw.Type {
+	case ReasonRepostType:
+		*r = SkeletonReason{Repost: raw.Repost}
+	case ReasonPinType:
+		*r = SkeletonReason{Pin: true}
+	}
+
+	return nil
+}
+
+// reasonFromFeedDefs converts the reason of a post from Feed.GetPage
+func reasonFromFeedDefs(reason *appbsky.FeedDefs_SkeletonFeedPost_Reason) *SkeletonReason {
+	if reason == nil || reason.FeedDefs_SkeletonReasonRepost == nil {
+		return nil
+	}
+
+	return NewRepostReason(reason.FeedDefs_SkeletonReasonRepost.Repost)
+}
+
+// feedDefsReason converts a reason for Feed.GetPage, which can't carry pins
+func feedDefsReason(reason *SkeletonReason) *appbsky.FeedDefs_SkeletonFeedPost_Reason {
+	if reason == nil || reason.Repost == "" {
+		return nil
+	}
+
+	return &appbsky.FeedDefs_SkeletonFeedPost_Reason{
+		FeedDefs_SkeletonReasonRepost: &appbsky.FeedDefs_SkeletonReasonRepost{Repost: reason.Repost},
+	}
+}
+
+// Skeleton is a page of a feed, the output of app.bsky.feed.getFeedSkeleton
+// ReqID identifies the response, and is sent back by clients with interactions about its posts
+type Skeleton struct {
+	Feed   []*SkeletonPost `json:"feed"`
+	Cursor *string         `json:"cursor,omitempty"`
+	ReqID  string          `json:"reqId,omitempty"`
+}
+
+// SkeletonFeed is implemented by feeds that attach a feedContext to their posts or a reqId to their pages
+// The FeedRouter serves them with GetSkeleton instead of GetPage
+type SkeletonFeed interface {
+	GetSkeleton(ctx context.Context, feed string, userDID string, limit int64, cursor string) (*Skeleton, error)
+}
+
+// NewSkeleton returns the Skeleton for a page of posts from Feed.GetPage
+func NewSkeleton(posts []*appbsky.FeedDefs_SkeletonFeedPost, cursor *string) *Skeleton {
+	skeleton := &Skeleton{
+		Feed:   make([]*SkeletonPost, 0, len(posts)),
+		Cursor: cursor,
+	}
+
+	for _, post := range posts {
+		skeleton.Feed = append(skeleton.Feed, &SkeletonPost{Post: post.Post, Reason: reasonFromFeedDefs(post.Reason)})
+	}
+
+	return skeleton
+}
+
+// FeedPosts returns the posts of the Skeleton without their feedContext or pin reasons, for Feed.GetPage
+func (s *Skeleton) FeedPosts() []*appbsky.FeedDefs_SkeletonFeedPost {
+	posts := make([]*appbsky.FeedDefs_SkeletonFeedPost, 0, len(s.Feed))
+	for _, post := range s.Feed {
+		posts = append(posts, &appbsky.FeedDefs_SkeletonFeedPost{Post: post.Post, Reason: feedDefsReason(post.Reason)})
+	}
+
+	return posts
+}
+
+// getSkeleton gets a page from a feed, wrapping GetPage for feeds that don't implement SkeletonFeed
+func getSkeleton(ctx context.Context, feed Feed, feedAlias string, userDID string, limit int64, cursor string) (*Skeleton, error) {
+	var skeleton *Skeleton
+	if skeletonFeed, ok := feed.(SkeletonFeed); ok {
+		var err error
+		skeleton, err = skeletonFeed.GetSkeleton(ctx, feedAlias, userDID, limit, cursor)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		posts, newCursor, err := feed.GetPage(ctx, feedAlias, userDID, limit, cursor)
+		if err != nil {
+			return nil, err
+		}
+		skeleton = NewSkeleton(posts, newCursor)
+	}
+
+	// Clients would reject the whole page over one of these, so drop them instead
+	if len(skeleton.ReqID) > MaxReqIDLength {
+		log.Printf("feed %s returned a reqId longer than %d characters, dropping it", feedAlias, MaxReqIDLength)
+		skeleton.ReqID = ""
+	}
+	for _, post := range skeleton.Feed {
+		if len(post.FeedContext) > MaxFeedContextLength {
+			log.Printf("feed %s returned a feedContext longer than %d characters for %s, dropping it", feedAlias, MaxFeedContextLength, post.Post)
+			post.FeedContext = ""
+		}
+	}
+
+	return skeleton, nil
+}
@@ -0,0 +1,142 @@
+package feedrouter
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+// repostFeed serves one post reposted into the feed, through GetPage only
+type repostFeed struct {
+	testFeed
+}
+
+func (rf *repostFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	next := "next"
+	return []*appbsky.FeedDefs_SkeletonFeedPost{
+		{Post: "at://did:plc:author/app.bsky.feed.post/1"},
+		{
+			Post: "at://did:plc:author/app.bsky.feed.post/2",
+			Reason: &appbsky.FeedDefs_SkeletonFeedPost_Reason{
+				FeedDefs_SkeletonReasonRepost: &appbsky.FeedDefs_SkeletonReasonRepost{
+					LexiconTypeID: ReasonRepostType,
+					Repost:        "at://did:plc:reposter/app.bsky.feed.repost/1",
+				},
+			},
+		},
+	}, &next, nil
+}
+
+// contextFeed attaches whatever it's given to its page
+type contextFeed struct {
+	testFeed
+	skeleton *Skeleton
+}
+
+func (cf *contextFeed) GetSkeleton(ctx context.Context, feed string, userDID string, limit int64, cursor string) (*Skeleton, error) {
+	copied := *cf.skeleton
+	copied.Feed = []*SkeletonPost{}
+	for _, post := range cf.skeleton.Feed {
+		p := *post
+		copied.Feed = append(copied.Feed, &p)
+	}
+	return &copied, nil
+}
+
+func TestGetPageShim(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(t)
+	feed := &repostFeed{}
+	router.AddFeed([]string{"reposts"}, feed)
+
+	posts, cursor, err := feed.GetPage(ctx, "reposts", "", 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	skeleton, err := router.GetSkeleton(ctx, "reposts", "", 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wrapped GetPage feeds serve exactly what they served before feeds could attach context
+	expectSameJSON(t, skeleton, &appbsky.FeedGetFeedSkeleton_Output{Feed: posts, Cursor: cursor})
+
+	// And the posts convert back unchanged, for feeds built on top of them
+	expectSameJSON(t, skeleton.FeedPosts(), posts)
+}
+
+// expectSameJSON checks got and expected marshal to the same JSON value
+func expectSameJSON(t *testing.T, got any, expected any) {
+	t.Helper()
+
+	values := []any{}
+	for _, v := range []any{got, expected} {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var value any
+		if err := json.Unmarshal(raw, &value); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+
+	if !reflect.DeepEqual(values[0], values[1]) {
+		t.Errorf("got %v, expected %v", values[0], values[1])
+	}
+}
+
+func TestSkeletonContext(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(t)
+
+	feed := &contextFeed{skeleton: &Skeleton{
+		Feed: []*SkeletonPost{
+			{Post: "at://did:plc:author/app.bsky.feed.post/1", FeedContext: "rank:1"},
+			{Post: "at://did:plc:author/app.bsky.feed.post/2", FeedContext: strings.Repeat("x", MaxFeedContextLength+1)},
+			{Post: "at://did:plc:author/app.bsky.feed.post/3", Reason: NewRepostReason("at://did:plc:reposter/app.bsky.feed.repost/1")},
+		},
+		ReqID: "req-1",
+	}}
+	router.AddFeed([]string{"context"}, feed)
+
+	skeleton, err := router.GetSkeleton(ctx, "context", "", 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := json.Marshal(skeleton)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Contexts past the lexicon's limit are dropped rather than failing the page
+	expected := `{"feed":[` +
+		`{"post":"at://did:plc:author/app.bsky.feed.post/1","feedContext":"rank:1"},` +
+		`{"post":"at://did:plc:author/app.bsky.feed.post/2"},` +
+		`{"post":"at://did:plc:author/app.bsky.feed.post/3","reason":{"$type":"app.bsky.feed.defs#skeletonReasonRepost","repost":"at://did:plc:reposter/app.bsky.feed.repost/1"}}` +
+		`],"reqId":"req-1"}`
+	if string(raw) != expected {
+		t.Errorf("got skeleton\n%s\nexpected\n%s", raw, expected)
+	}
+
+	decoded := &Skeleton{}
+	if err := json.Unmarshal(raw, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, skeleton) {
+		t.Errorf("got skeleton %+v after a round trip, expected %+v", decoded, skeleton)
+	}
+
+	feed.skeleton.ReqID = strings.Repeat("x", MaxReqIDLength+1)
+	if skeleton, err := router.GetSkeleton(ctx, "context", "", 10, ""); err != nil || skeleton.ReqID != "" {
+		t.Errorf("got reqId %q and error %v for a reqId past the limit, expected it dropped", skeleton.ReqID, err)
+	}
+}
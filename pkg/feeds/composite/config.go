@@ -0,0 +1,61 @@
+package composite
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+)
+
+func init() {
+	feedrouter.RegisterFeedType("composite", newFromConfig)
+}
+
+// params are the config params of a composite feed
+type params struct {
+	Strategy Strategy      `yaml:"strategy"`
+	Dedup    bool          `yaml:"dedup"`
+	Children []childParams `yaml:"children"`
+}
+
+type childParams struct {
+	Alias  string `yaml:"alias"`
+	Weight int    `yaml:"weight"`
+}
+
+// newFromConfig builds a composite feed, its children must be defined earlier in the config
+func newFromConfig(ctx context.Context, env *feedrouter.FeedEnv, def *feedrouter.FeedDefinition) (feedrouter.Feed, []string, error) {
+	p := params{}
+	if err := def.DecodeParams(&p); err != nil {
+		return nil, nil, err
+	}
+
+	switch p.Strategy {
+	case "", StrategyChronological, StrategyInterleave:
+	default:
+		return nil, nil, feedrouter.NewFieldError("params.strategy", "unknown strategy %q, expected %s or %s", p.Strategy, StrategyChronological, StrategyInterleave)
+	}
+
+	if len(p.Children) == 0 {
+		return nil, nil, feedrouter.NewFieldError("params.children", "at least one child is required")
+	}
+
+	children := []Child{}
+	for i, child := range p.Children {
+		field := fmt.Sprintf("params.children[%d]", i)
+		switch {
+		case child.Alias == "":
+			return nil, nil, feedrouter.NewFieldError(field+".alias", "is required")
+		case child.Alias == def.Name:
+			return nil, nil, feedrouter.NewFieldError(field+".alias", "a composite feed can't include itself")
+		case !env.HasFeed(child.Alias):
+			return nil, nil, feedrouter.NewFieldError(field+".alias", "no feed is registered as %q, children must be defined before the composite", child.Alias)
+		case child.Weight < 0:
+			return nil, nil, feedrouter.NewFieldError(field+".weight", "must not be negative")
+		}
+
+		children = append(children, Child{Alias: child.Alias, Weight: child.Weight})
+	}
+
+	return NewCompositeFeed(ctx, env.FeedActorDID, def.Name, env.Router, p.Strategy, p.Dedup, children)
+}
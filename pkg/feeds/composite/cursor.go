@@ -0,0 +1,56 @@
+package composite
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+)
+
+// childState is where a CompositeFeed is in the pages of one child
+type childState struct {
+	Cursor string `json:"c,omitempty"` // Cursor of the child page we're serving from
+	Offset int    `json:"o,omitempty"` // Number of posts of that page already served
+	Done   bool   `json:"d,omitempty"` // The child has no more posts
+}
+
+// compositeCursor is the state of a CompositeFeed between pages, encoded as URL-safe base64 JSON
+type compositeCursor struct {
+	Children []childState `json:"ch"`
+	Round    int          `json:"r,omitempty"` // Position in the interleave schedule
+	Seen     []string     `json:"s,omitempty"` // Hashes of recently served post URIs, for dedup
+}
+
+// decodeCursor decodes a composite cursor, an empty cursor starts every child from the top
+func decodeCursor(cursor string, children int) (*compositeCursor, error) {
+	if cursor == "" {
+		return &compositeCursor{Children: make([]childState, children)}, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, feedrouter.NewInvalidRequestError("malformed cursor: %w", err)
+	}
+
+	cur := &compositeCursor{}
+	if err := json.Unmarshal(raw, cur); err != nil {
+		return nil, feedrouter.NewInvalidRequestError("malformed cursor: %w", err)
+	}
+
+	if len(cur.Children) != children {
+		return nil, feedrouter.NewInvalidRequestError("cursor has %d children but the feed has %d", len(cur.Children), children)
+	}
+
+	return cur, nil
+}
+
+// encode returns the composite cursor as a string
+func (c *compositeCursor) encode() (string, error) {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("error encoding cursor: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
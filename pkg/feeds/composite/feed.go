@@ -0,0 +1,336 @@
+package composite
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/tid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Strategy decides which child feed the next post of a CompositeFeed page comes from
+type Strategy string
+
+const (
+	// StrategyChronological merges children newest first, using the TID in each post's record key
+	StrategyChronological Strategy = "chronological"
+	// StrategyInterleave takes posts from children in a weighted round-robin
+	StrategyInterleave Strategy = "interleave"
+)
+
+// Child is a feed registered in the FeedRouter that a CompositeFeed pulls posts from
+type Child struct {
+	Alias  string // Alias the child feed is registered under in the FeedRouter
+	Weight int    // Number of posts taken from the child per round with StrategyInterleave, defaults to 1
+}
+
+// maxSeen is how many recently served posts a cursor remembers for dedup across pages
+const maxSeen = 100
+
+// CompositeFeed merges the pages of other feeds into a single feed
+// Children are looked up by alias in the FeedRouter on every request, so they can be reloaded independently
+type CompositeFeed struct {
+	FeedActorDID string
+	FeedName     string
+	Router       *feedrouter.FeedRouter
+	Strategy     Strategy
+	Dedup        bool // Skip posts that were already served from another child
+	Children     []Child
+
+	schedule []int // order children are visited in with StrategyInterleave, as indexes into Children
+}
+
+// NewCompositeFeed returns a new CompositeFeed, a list of aliases for the feed, and an error
+// Children don't need to be registered yet, the feed config makes sure they're defined before the composite
+func NewCompositeFeed(
+	ctx context.Context,
+	feedActorDID string,
+	feedName string,
+	router *feedrouter.FeedRouter,
+	strategy Strategy,
+	dedup bool,
+	children []Child,
+) (*CompositeFeed, []string, error) {
+	if len(children) == 0 {
+		return nil, nil, fmt.Errorf("composite feed %s needs at least one child", feedName)
+	}
+
+	switch strategy {
+	case StrategyChronological, StrategyInterleave:
+	case "":
+		strategy = StrategyChronological
+	default:
+		return nil, nil, fmt.Errorf("composite feed %s has unknown strategy %q", feedName, strategy)
+	}
+
+	cf := &CompositeFeed{
+		FeedActorDID: feedActorDID,
+		FeedName:     feedName,
+		Router:       router,
+		Strategy:     strategy,
+		Dedup:        dedup,
+	}
+
+	for _, child := range children {
+		if child.Alias == feedName {
+			return nil, nil, fmt.Errorf("composite feed %s can't include itself", feedName)
+		}
+
+		if child.Weight < 0 {
+			return nil, nil, fmt.Errorf("composite feed %s child %s has a negative weight", feedName, child.Alias)
+		}
+		if child.Weight == 0 {
+			child.Weight = 1
+		}
+
+		cf.Children = append(cf.Children, child)
+	}
+
+	cf.schedule = interleaveSchedule(cf.Children)
+
+	return cf, []string{feedName}, nil
+}
+
+// interleaveSchedule spreads each child across a round in proportion to its weight
+// using smooth weighted round-robin, i.e. weights 2:1 visit children A B A rather than A A B
+func interleaveSchedule(children []Child) []int {
+	total := 0
+	for _, child := range children {
+		total += child.Weight
+	}
+
+	current := make([]int, len(children))
+	schedule := make([]int, 0, total)
+
+	for len(schedule) < total {
+		best := 0
+		for i, child := range children {
+			current[i] += child.Weight
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, best)
+	}
+
+	return schedule
+}
+
+// childPage is the unserved part of a child's current page
+type childPage struct {
+	posts      []*feedrouter.SkeletonPost
+	nextCursor *string
+}
+
+// fetch loads the page of a child at its cursor state, skipping posts that were already served
+// If the page is used up and the child has more, it moves the state on to the next page
+func (cf *CompositeFeed) fetch(ctx context.Context, idx int, userDID string, limit int64, state *childState) (*childPage, error) {
+	alias := cf.Children[idx].Alias
+
+	if _, ok := cf.Router.GetFeed(alias); !ok {
+		return nil, fmt.Errorf("composite feed %s child %s is not registered", cf.FeedName, alias)
+	}
+
+	for {
+		// Ask for enough posts to cover the ones we already served from this page
+		// Pages go through the router so children that are reloaded drain this request first,
+		// raw so the pins and stats of children don't leak into the composite feed
+		skeleton, err := cf.Router.GetRawSkeleton(ctx, alias, userDID, int64(state.Offset)+limit, state.Cursor)
+		if err != nil {
+			return nil, fmt.Errorf("error getting page of child %s: %w", alias, err)
+		}
+		posts, nextCursor := skeleton.Feed, skeleton.Cursor
+
+		if state.Offset < len(posts) {
+			return &childPage{posts: posts[state.Offset:], nextCursor: nextCursor}, nil
+		}
+
+		if nextCursor == nil || *nextCursor == "" || len(posts) == 0 {
+			state.Done = true
+			return &childPage{}, nil
+		}
+
+		state.Cursor = *nextCursor
+		state.Offset = 0
+	}
+}
+
+// GetPage returns a list of FeedDefs_SkeletonFeedPost, a new cursor, and an error
+// The FeedRouter serves CompositeFeeds with GetSkeleton, this is for callers that don't need the feedContext of posts
+func (cf *CompositeFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	skeleton, err := cf.GetSkeleton(ctx, feed, userDID, limit, cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return skeleton.FeedPosts(), skeleton.Cursor, nil
+}
+
+// GetSkeleton returns a page of the composite feed, keeping the feedContext children attached to their posts
+// The composite cursor records each child's cursor and how far into that page we've served,
+// so no posts are skipped when a page only uses part of a child's page
+// CompositeFeed implements feedrouter.SkeletonFeed so the feedContext of children's posts makes it to clients
+func (cf *CompositeFeed) GetSkeleton(ctx context.Context, feed string, userDID string, limit int64, cursor string) (*feedrouter.Skeleton, error) {
+	tracer := otel.Tracer("composite-feed")
+	ctx, span := tracer.Start(ctx, "CompositeFeed:GetSkeleton")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("feed.strategy", string(cf.Strategy)), attribute.Int("feed.children", len(cf.Children)))
+
+	cur, err := decodeCursor(cursor, len(cf.Children))
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	seen := map[string]struct{}{}
+	for _, hash := range cur.Seen {
+		seen[hash] = struct{}{}
+	}
+
+	pages := make([]*childPage, len(cf.Children))
+	for i := range cf.Children {
+		if cur.Children[i].Done {
+			pages[i] = &childPage{}
+			continue
+		}
+
+		pages[i], err = cf.fetch(ctx, i, userDID, limit, &cur.Children[i])
+		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+	}
+
+	// next returns the index of the child to take the next post from, or -1 once every child is used up
+	next := func() (int, error) {
+		// Refill children whose page ran out before picking one
+		for i, page := range pages {
+			if len(page.posts) > 0 || cur.Children[i].Done {
+				continue
+			}
+			if page.nextCursor == nil || *page.nextCursor == "" {
+				cur.Children[i].Done = true
+				continue
+			}
+
+			cur.Children[i] = childState{Cursor: *page.nextCursor}
+			if pages[i], err = cf.fetch(ctx, i, userDID, limit, &cur.Children[i]); err != nil {
+				return -1, err
+			}
+		}
+
+		switch cf.Strategy {
+		case StrategyInterleave:
+			for range cf.schedule {
+				idx := cf.schedule[cur.Round%len(cf.schedule)]
+				cur.Round++
+				if len(pages[idx].posts) > 0 {
+					return idx, nil
+				}
+			}
+		default:
+			best := -1
+			for i, page := range pages {
+				if len(page.posts) == 0 {
+					continue
+				}
+				if best < 0 || newer(page.posts[0].Post, pages[best].posts[0].Post) {
+					best = i
+				}
+			}
+			return best, nil
+		}
+
+		return -1, nil
+	}
+
+	feedPosts := []*feedrouter.SkeletonPost{}
+	for int64(len(feedPosts)) < limit {
+		idx, err := next()
+		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+		if idx < 0 {
+			break
+		}
+
+		post := pages[idx].posts[0]
+		pages[idx].posts = pages[idx].posts[1:]
+		cur.Children[idx].Offset++
+
+		if cf.Dedup {
+			hash := hashURI(post.Post)
+			if _, ok := seen[hash]; ok {
+				continue
+			}
+			seen[hash] = struct{}{}
+			cur.Seen = append(cur.Seen, hash)
+		}
+
+		feedPosts = append(feedPosts, post)
+	}
+
+	span.SetAttributes(attribute.Int("posts.length", len(feedPosts)))
+
+	// We're done once every child is used up
+	more := false
+	for i, page := range pages {
+		if len(page.posts) > 0 || (!cur.Children[i].Done && page.nextCursor != nil && *page.nextCursor != "") {
+			more = true
+			break
+		}
+	}
+	if !more {
+		return &feedrouter.Skeleton{Feed: feedPosts}, nil
+	}
+
+	if len(cur.Seen) > maxSeen {
+		cur.Seen = cur.Seen[len(cur.Seen)-maxSeen:]
+	}
+
+	newCursor, err := cur.encode()
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return &feedrouter.Skeleton{Feed: feedPosts, Cursor: &newCursor}, nil
+}
+
+// newer returns true if post a was created after post b, according to their record keys
+// Posts without a TID record key sort last
+func newer(a, b string) bool {
+	aTime, aOK := tid.FromURI(a)
+	bTime, bOK := tid.FromURI(b)
+
+	if aOK != bOK {
+		return aOK
+	}
+
+	return aTime.After(bTime)
+}
+
+// hashURI returns a short hash of a post URI to keep dedup state in cursors small
+func hashURI(uri string) string {
+	h := fnv.New64a()
+	h.Write([]byte(uri))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// Describe returns a list of FeedDescribeFeedGenerator_Feed, and an error
+// CompositeFeed serves a single feed so it returns a single FeedDescribeFeedGenerator_Feed
+func (cf *CompositeFeed) Describe(ctx context.Context) ([]appbsky.FeedDescribeFeedGenerator_Feed, error) {
+	return []appbsky.FeedDescribeFeedGenerator_Feed{
+		{
+			Uri: "at://" + cf.FeedActorDID + "/app.bsky.feed.generator/" + cf.FeedName,
+		},
+	}, nil
+}
@@ -0,0 +1,270 @@
+package composite
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feeds/static"
+)
+
+const (
+	feedActorDID = "did:plc:feedactor"
+	alphabet     = "234567abcdefghijklmnopqrstuvwxyz"
+)
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// postURI returns the AT-URI of a post with a TID record key for the given number of minutes after epoch
+func postURI(minutes int) string {
+	n := uint64(epoch.Add(time.Duration(minutes)*time.Minute).UnixMicro()) << 10
+
+	rkey := make([]byte, 13)
+	for i := len(rkey) - 1; i >= 0; i-- {
+		rkey[i] = alphabet[n&31]
+		n >>= 5
+	}
+
+	return "at://did:plc:author/app.bsky.feed.post/" + string(rkey)
+}
+
+// newTestRouter registers a static feed for each alias with the given posts
+func newTestRouter(t *testing.T, feeds map[string][]string) *feedrouter.FeedRouter {
+	ctx := context.Background()
+
+	router, err := feedrouter.NewFeedRouter(ctx, feedActorDID, "did:web:feedgen.example.com", []string{feedActorDID}, "https://feedgen.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for alias, posts := range feeds {
+		feed, aliases, err := static.NewStaticFeed(ctx, feedActorDID, alias, posts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		router.AddFeed(aliases, feed)
+	}
+
+	return router
+}
+
+func newTestComposite(t *testing.T, router *feedrouter.FeedRouter, strategy Strategy, dedup bool, children ...Child) {
+	cf, aliases, err := NewCompositeFeed(context.Background(), feedActorDID, "mix", router, strategy, dedup, children)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.AddFeed(aliases, cf)
+}
+
+// pageThrough serves the composite feed page by page until it runs out, returning every post served
+func pageThrough(t *testing.T, router *feedrouter.FeedRouter, limit int64) []string {
+	served := []string{}
+	cursor := ""
+
+	for page := 0; ; page++ {
+		if page > 100 {
+			t.Fatal("composite feed never ran out of pages")
+		}
+
+		skeleton, err := router.GetSkeleton(context.Background(), "mix", "", limit, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(skeleton.Feed)) > limit {
+			t.Fatalf("got %d posts for limit %d", len(skeleton.Feed), limit)
+		}
+
+		for _, post := range skeleton.Feed {
+			served = append(served, post.Post)
+		}
+
+		if skeleton.Cursor == nil {
+			return served
+		}
+		cursor = *skeleton.Cursor
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []*compositeCursor{
+		{Children: []childState{{}}},
+		{Children: []childState{{Cursor: "10", Offset: 3}, {Done: true}}, Round: 7},
+		{Children: []childState{{Cursor: "a:b"}, {}, {Offset: 1}}, Seen: []string{"abc", "def"}},
+	}
+
+	for _, expected := range tests {
+		encoded, err := expected.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := decodeCursor(encoded, len(expected.Children))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(decoded, expected) {
+			t.Errorf("got cursor %+v after a round trip, expected %+v", decoded, expected)
+		}
+	}
+
+	empty, err := decodeCursor("", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(empty, &compositeCursor{Children: make([]childState, 2)}) {
+		t.Errorf("got cursor %+v for the first page, expected every child at the top", empty)
+	}
+}
+
+func TestDecodeCursorErrors(t *testing.T) {
+	wrongChildren, err := (&compositeCursor{Children: []childState{{}}}).encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{name: "not base64", cursor: "not a cursor!"},
+		{name: "not json", cursor: "bm90IGpzb24"},
+		{name: "wrong number of children", cursor: wrongChildren},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decodeCursor(test.cursor, 2)
+			if !errors.As(err, &feedrouter.InvalidRequestError{}) {
+				t.Errorf("got error %v, expected an InvalidRequestError", err)
+			}
+		})
+	}
+}
+
+func TestInterleaveSchedule(t *testing.T) {
+	tests := []struct {
+		weights  []int
+		expected []int
+	}{
+		{weights: []int{1}, expected: []int{0}},
+		{weights: []int{1, 1}, expected: []int{0, 1}},
+		{weights: []int{2, 1}, expected: []int{0, 1, 0}},
+		{weights: []int{3, 1}, expected: []int{0, 0, 1, 0}},
+		{weights: []int{1, 2, 1}, expected: []int{1, 0, 2, 1}},
+	}
+
+	for _, test := range tests {
+		children := []Child{}
+		for _, weight := range test.weights {
+			children = append(children, Child{Weight: weight})
+		}
+
+		if schedule := interleaveSchedule(children); !reflect.DeepEqual(schedule, test.expected) {
+			t.Errorf("got schedule %v for weights %v, expected %v", schedule, test.weights, test.expected)
+		}
+	}
+}
+
+func TestChronologicalMerge(t *testing.T) {
+	router := newTestRouter(t, map[string][]string{
+		"evens": {postURI(10), postURI(8), postURI(6), postURI(4), postURI(2)},
+		"odds":  {postURI(9), postURI(7), postURI(5), postURI(3), postURI(1)},
+	})
+	newTestComposite(t, router, StrategyChronological, false, Child{Alias: "evens"}, Child{Alias: "odds"})
+
+	for _, limit := range []int64{1, 3, 4, 100} {
+		expected := []string{}
+		for minutes := 10; minutes >= 1; minutes-- {
+			expected = append(expected, postURI(minutes))
+		}
+
+		if served := pageThrough(t, router, limit); !reflect.DeepEqual(served, expected) {
+			t.Errorf("got posts %v with limit %d, expected newest first %v", served, limit, expected)
+		}
+	}
+}
+
+func TestWeightedInterleave(t *testing.T) {
+	router := newTestRouter(t, map[string][]string{
+		"a": {"a1", "a2", "a3", "a4", "a5", "a6"},
+		"b": {"b1", "b2", "b3"},
+	})
+	newTestComposite(t, router, StrategyInterleave, false, Child{Alias: "a", Weight: 2}, Child{Alias: "b"})
+
+	expected := []string{"a1", "b1", "a2", "a3", "b2", "a4", "a5", "b3", "a6"}
+	for _, limit := range []int64{1, 2, 4, 100} {
+		if served := pageThrough(t, router, limit); !reflect.DeepEqual(served, expected) {
+			t.Errorf("got posts %v with limit %d, expected %v", served, limit, expected)
+		}
+	}
+}
+
+func TestDedupAcrossPages(t *testing.T) {
+	router := newTestRouter(t, map[string][]string{
+		"a": {"shared", "a1", "a2"},
+		"b": {"b1", "b2", "shared", "b3"},
+	})
+	newTestComposite(t, router, StrategyInterleave, true, Child{Alias: "a"}, Child{Alias: "b"})
+
+	// The shared post comes from a on the first page and would come from b on a later one
+	expected := []string{"shared", "b1", "a1", "b2", "a2", "b3"}
+	for _, limit := range []int64{1, 2, 100} {
+		if served := pageThrough(t, router, limit); !reflect.DeepEqual(served, expected) {
+			t.Errorf("got posts %v with limit %d, expected %v", served, limit, expected)
+		}
+	}
+}
+
+func TestChildRemoved(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(t, map[string][]string{
+		"a": {"a1", "a2"},
+		"b": {"b1", "b2"},
+	})
+	newTestComposite(t, router, StrategyInterleave, false, Child{Alias: "a"}, Child{Alias: "b"})
+
+	first, err := router.GetSkeleton(ctx, "mix", "", 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !router.RemoveFeed(ctx, "b") {
+		t.Fatal("feed b wasn't removed")
+	}
+
+	_, err = router.GetSkeleton(ctx, "mix", "", 2, *first.Cursor)
+	if err == nil || !strings.Contains(err.Error(), "child b") {
+		t.Fatalf("got error %v once child b was removed, expected it to name the child", err)
+	}
+
+	// The composite itself is still served, so it mustn't look like an unknown feed to clients
+	if errors.As(err, &feedrouter.NotFoundError{}) {
+		t.Errorf("got a NotFoundError for a missing child: %v", err)
+	}
+}
+
+func TestChildAliasedToComposite(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(t, map[string][]string{
+		"a": {"a1", "a2"},
+	})
+	newTestComposite(t, router, StrategyChronological, false, Child{Alias: "a"})
+
+	// Point the child's alias back at the composite from the admin API
+	if err := router.RemoveAlias("a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.AddAlias("mix", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := router.GetSkeleton(ctx, "mix", "", 10, "")
+	if err == nil || !strings.Contains(err.Error(), "includes itself") {
+		t.Fatalf("got error %v for a composite that includes itself, expected the loop to be refused", err)
+	}
+}
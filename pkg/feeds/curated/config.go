@@ -0,0 +1,51 @@
+package curated
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+)
+
+func init() {
+	feedrouter.RegisterFeedType("curated", newFromConfig)
+}
+
+// params are the config params of a curated feed
+type params struct {
+	DIDs     []string `yaml:"dids"`      // DIDs that are always members
+	ListURI  string   `yaml:"list_uri"`  // AT-URI of the app.bsky.graph.list that drives membership
+	ListHost string   `yaml:"list_host"` // XRPC host to load the list's items from, defaults to https://bsky.social
+
+	IncludeReposts bool `yaml:"include_reposts"` // Serve members' reposts with a repost reason
+}
+
+func newFromConfig(ctx context.Context, env *feedrouter.FeedEnv, def *feedrouter.FeedDefinition) (feedrouter.Feed, []string, error) {
+	p := params{}
+	if err := def.DecodeParams(&p); err != nil {
+		return nil, nil, err
+	}
+
+	if len(p.DIDs) == 0 && p.ListURI == "" {
+		return nil, nil, feedrouter.NewFieldError("params", "dids or list_uri is required")
+	}
+
+	for i, did := range p.DIDs {
+		if !strings.HasPrefix(did, "did:") {
+			return nil, nil, feedrouter.NewFieldError(fmt.Sprintf("params.dids[%d]", i), "%q is not a DID", did)
+		}
+	}
+
+	if p.ListURI != "" {
+		if _, ok := listOwnerDID(p.ListURI); !ok {
+			return nil, nil, feedrouter.NewFieldError("params.list_uri", "%q is not an AT-URI", p.ListURI)
+		}
+	}
+
+	if p.ListHost == "" {
+		p.ListHost = "https://bsky.social"
+	}
+
+	return NewCuratedFeed(ctx, env.FeedActorDID, def.Name, env.PostStore, p.DIDs, p.ListURI, p.ListHost, p.IncludeReposts)
+}
@@ -0,0 +1,335 @@
+package curated
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/firehose"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/records"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/store"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// CuratedFeed serves the posts of a curated set of accounts, newest first
+// Membership is either a static list of DIDs or the items of an app.bsky.graph.list,
+// which is kept in sync from listitem creates and deletes on the firehose
+type CuratedFeed struct {
+	FeedActorDID string
+	FeedName     string
+	Store        store.PostStore
+	ListURI      string // AT-URI of the app.bsky.graph.list that drives membership, if any
+	ListHost     string // XRPC host the list's items are loaded from
+
+	IncludeReposts bool // Serve members' reposts as well as their posts
+
+	staticDIDs []string
+
+	membersLk sync.RWMutex
+	members   map[string]int    // map of member DID to the number of list items (or static entries) adding them
+	listItems map[string]string // map of listitem AT-URI to member DID
+	changes   []listItemChange  // list item changes handled while a Reindex is reloading the list, nil otherwise
+
+	reindexLk sync.Mutex
+}
+
+// listItemChange is a list item created or deleted on the firehose, ListItem is nil for deletes
+type listItemChange struct {
+	URI      string
+	ListItem *appbsky.GraphListitem
+}
+
+// NewCuratedFeed returns a new CuratedFeed, a list of aliases for the feed, and an error
+// staticDIDs are always members of the feed
+// If listURI is set, the list's current items are loaded from the list owner's repo via the
+// XRPC host at listHost (i.e. https://bsky.social), and kept in sync from the firehose afterwards
+func NewCuratedFeed(
+	ctx context.Context,
+	feedActorDID string,
+	feedName string,
+	postStore store.PostStore,
+	staticDIDs []string,
+	listURI string,
+	listHost string,
+	includeReposts bool,
+) (*CuratedFeed, []string, error) {
+	if len(staticDIDs) == 0 && listURI == "" {
+		return nil, nil, fmt.Errorf("curated feed %s needs a list URI or at least one static DID", feedName)
+	}
+
+	cf := &CuratedFeed{
+		FeedActorDID:   feedActorDID,
+		FeedName:       feedName,
+		Store:          postStore,
+		ListURI:        listURI,
+		ListHost:       listHost,
+		IncludeReposts: includeReposts,
+		staticDIDs:     staticDIDs,
+		members:        map[string]int{},
+		listItems:      map[string]string{},
+	}
+
+	for _, did := range staticDIDs {
+		cf.members[did]++
+	}
+
+	if listURI != "" {
+		if err := cf.loadListItems(ctx, listHost); err != nil {
+			return nil, nil, fmt.Errorf("error loading list items for curated feed %s: %w", feedName, err)
+		}
+	}
+
+	return cf, []string{feedName}, nil
+}
+
+// loadListItems pages through the listitem records in the list owner's repo and adds the ones for our list
+func (cf *CuratedFeed) loadListItems(ctx context.Context, listHost string) error {
+	tracer := otel.Tracer("curated-feed")
+	ctx, span := tracer.Start(ctx, "CuratedFeed:loadListItems")
+	defer span.End()
+
+	listOwner, ok := listOwnerDID(cf.ListURI)
+	if !ok {
+		return fmt.Errorf("invalid list URI %q", cf.ListURI)
+	}
+
+	err := records.List(ctx, records.NewClient(listHost), listOwner, firehose.CollectionListItem, func(record *comatproto.RepoListRecords_Record) error {
+		if listItem, ok := record.Value.Val.(*appbsky.GraphListitem); ok {
+			cf.addListItem(record.Uri, listItem)
+		}
+		return nil
+	})
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	span.SetAttributes(attribute.Int("list.items", len(cf.listItems)))
+
+	return nil
+}
+
+// Reindex reloads the list's items from the list owner's repo, picking up any list changes the firehose missed
+// List items created or deleted while the list is reloading are applied to the reloaded items before they're swapped in
+// CuratedFeed implements feedrouter.Reindexer so it can be reindexed from the admin API
+func (cf *CuratedFeed) Reindex(ctx context.Context) error {
+	if cf.ListURI == "" {
+		return nil
+	}
+
+	cf.reindexLk.Lock()
+	defer cf.reindexLk.Unlock()
+
+	cf.membersLk.Lock()
+	cf.changes = []listItemChange{}
+	cf.membersLk.Unlock()
+
+	fresh := &CuratedFeed{
+		FeedName:  cf.FeedName,
+		ListURI:   cf.ListURI,
+		members:   map[string]int{},
+		listItems: map[string]string{},
+	}
+
+	for _, did := range cf.staticDIDs {
+		fresh.members[did]++
+	}
+
+	err := fresh.loadListItems(ctx, cf.ListHost)
+
+	cf.membersLk.Lock()
+	defer cf.membersLk.Unlock()
+
+	changes := cf.changes
+	cf.changes = nil
+
+	if err != nil {
+		return fmt.Errorf("error reloading list items for curated feed %s: %w", cf.FeedName, err)
+	}
+
+	// Replay in order, so an item deleted after the reload listed it stays deleted
+	for _, change := range changes {
+		if change.ListItem != nil {
+			fresh.addListItem(change.URI, change.ListItem)
+		} else {
+			fresh.removeListItem(change.URI)
+		}
+	}
+
+	cf.members = fresh.members
+	cf.listItems = fresh.listItems
+
+	return nil
+}
+
+// listOwnerDID returns the DID of the repo an AT-URI points into
+func listOwnerDID(uri string) (string, bool) {
+	rest, ok := strings.CutPrefix(uri, "at://")
+	if !ok {
+		return "", false
+	}
+
+	owner, _, _ := strings.Cut(rest, "/")
+	return owner, owner != ""
+}
+
+// addListItem adds the subject of a list item to the members if it belongs to our list
+func (cf *CuratedFeed) addListItem(uri string, listItem *appbsky.GraphListitem) {
+	if listItem.List != cf.ListURI {
+		return
+	}
+
+	cf.membersLk.Lock()
+	defer cf.membersLk.Unlock()
+
+	if cf.changes != nil {
+		cf.changes = append(cf.changes, listItemChange{URI: uri, ListItem: listItem})
+	}
+
+	if _, ok := cf.listItems[uri]; ok {
+		return
+	}
+
+	cf.listItems[uri] = listItem.Subject
+	cf.members[listItem.Subject]++
+}
+
+// removeListItem removes the subject of a list item from the members if no other item adds them
+func (cf *CuratedFeed) removeListItem(uri string) {
+	cf.membersLk.Lock()
+	defer cf.membersLk.Unlock()
+
+	if cf.changes != nil {
+		cf.changes = append(cf.changes, listItemChange{URI: uri})
+	}
+
+	subject, ok := cf.listItems[uri]
+	if !ok {
+		return
+	}
+
+	delete(cf.listItems, uri)
+
+	cf.members[subject]--
+	if cf.members[subject] <= 0 {
+		delete(cf.members, subject)
+	}
+}
+
+// IsMember returns true if the DID is currently a member of the feed
+func (cf *CuratedFeed) IsMember(did string) bool {
+	cf.membersLk.RLock()
+	defer cf.membersLk.RUnlock()
+
+	_, ok := cf.members[did]
+	return ok
+}
+
+// Members returns the DIDs currently in the feed
+func (cf *CuratedFeed) Members() []string {
+	cf.membersLk.RLock()
+	defer cf.membersLk.RUnlock()
+
+	members := make([]string, 0, len(cf.members))
+	for did := range cf.members {
+		members = append(members, did)
+	}
+
+	return members
+}
+
+// HandleEvent keeps membership in sync with the list and indexes posts by members, and their reposts if IncludeReposts is set
+// Deleted posts are removed by the store.DeleteHandler registered on the firehose
+// CuratedFeed implements firehose.Handler so it can be added to the Firehose
+func (cf *CuratedFeed) HandleEvent(ctx context.Context, evt *firehose.Event) error {
+	switch evt.Collection {
+	case firehose.CollectionListItem:
+		if cf.ListURI == "" {
+			return nil
+		}
+
+		// List items live in the list owner's repo, so skip everyone else's
+		if owner, _ := listOwnerDID(cf.ListURI); owner != evt.Repo {
+			return nil
+		}
+
+		switch evt.Action {
+		case firehose.ActionCreate:
+			cf.addListItem(evt.URI, evt.ListItem)
+		case firehose.ActionDelete:
+			cf.removeListItem(evt.URI)
+		}
+	case firehose.CollectionPost, firehose.CollectionRepost:
+		if !cf.IsMember(evt.Repo) {
+			return nil
+		}
+
+		if evt.Collection == firehose.CollectionRepost && !cf.IncludeReposts {
+			return nil
+		}
+
+		post := store.PostFromEvent(evt)
+		if evt.Collection == firehose.CollectionRepost {
+			post = store.RepostFromEvent(evt)
+		}
+		if post == nil {
+			return nil
+		}
+
+		post.Feeds = []string{cf.FeedName}
+
+		return cf.Store.InsertPost(ctx, post)
+	}
+
+	return nil
+}
+
+// GetPage returns a list of FeedDefs_SkeletonFeedPost, a new cursor, and an error
+// Only posts by current members are returned, so removing someone from the list removes their posts from the feed
+func (cf *CuratedFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	tracer := otel.Tracer("curated-feed")
+	ctx, span := tracer.Start(ctx, "CuratedFeed:GetPage")
+	defer span.End()
+
+	members := cf.Members()
+	span.SetAttributes(attribute.Int("feed.members", len(members)))
+
+	if len(members) == 0 {
+		return []*appbsky.FeedDefs_SkeletonFeedPost{}, nil, nil
+	}
+
+	posts, newCursor, err := cf.Store.QueryPosts(ctx, store.PostQuery{
+		Feed:           cf.FeedName,
+		Authors:        members,
+		ExcludeReposts: !cf.IncludeReposts,
+		Limit:          limit,
+		Cursor:         cursor,
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, nil, fmt.Errorf("error querying posts: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("posts.length", len(posts)))
+
+	feedPosts := []*appbsky.FeedDefs_SkeletonFeedPost{}
+	for _, post := range posts {
+		feedPosts = append(feedPosts, store.SkeletonFeedPost(post))
+	}
+
+	return feedPosts, newCursor, nil
+}
+
+// Describe returns a list of FeedDescribeFeedGenerator_Feed, and an error
+// CuratedFeed serves a single feed so it returns a single FeedDescribeFeedGenerator_Feed
+func (cf *CuratedFeed) Describe(ctx context.Context) ([]appbsky.FeedDescribeFeedGenerator_Feed, error) {
+	return []appbsky.FeedDescribeFeedGenerator_Feed{
+		{
+			Uri: "at://" + cf.FeedActorDID + "/app.bsky.feed.generator/" + cf.FeedName,
+		},
+	}, nil
+}
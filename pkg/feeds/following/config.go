@@ -0,0 +1,35 @@
+package following
+
+import (
+	"context"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+)
+
+func init() {
+	feedrouter.RegisterFeedType("following", newFromConfig)
+}
+
+// params are the config params of a following feed
+type params struct {
+	FollowsHost    string `yaml:"follows_host"` // XRPC host to backfill viewers' follows from, defaults to https://bsky.social
+	IncludeReplies bool   `yaml:"include_replies"`
+	IncludeReposts bool   `yaml:"include_reposts"`
+}
+
+func newFromConfig(ctx context.Context, env *feedrouter.FeedEnv, def *feedrouter.FeedDefinition) (feedrouter.Feed, []string, error) {
+	p := params{}
+	if err := def.DecodeParams(&p); err != nil {
+		return nil, nil, err
+	}
+
+	if env.FollowStore == nil {
+		return nil, nil, feedrouter.NewFieldError("type", "following feeds need a store that supports follows")
+	}
+
+	if p.FollowsHost == "" {
+		p.FollowsHost = "https://bsky.social"
+	}
+
+	return NewFollowingFeed(ctx, env.FeedActorDID, def.Name, env.PostStore, env.FollowStore, p.FollowsHost, p.IncludeReplies, p.IncludeReposts)
+}
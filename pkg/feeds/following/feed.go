@@ -0,0 +1,413 @@
+package following
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/firehose"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/records"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/store"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// backfillTimeout is how long a viewer's follows can take to backfill before it's given up on
+const backfillTimeout = 5 * time.Minute
+
+// FollowingFeed serves each viewer the posts of the accounts they follow, newest first
+// A viewer's follows are backfilled from their repo the first time they load the feed and kept
+// in sync from the firehose afterwards, and only posts by accounts some viewer follows are indexed
+// Follows are indexed under the feed's name, so following feeds sharing a FollowStore keep separate graphs
+type FollowingFeed struct {
+	FeedActorDID   string
+	FeedName       string
+	Store          store.PostStore
+	Follows        store.FollowStore
+	FollowsHost    string // XRPC host to backfill viewers' follows from, i.e. https://bsky.social
+	IncludeReplies bool
+	IncludeReposts bool
+
+	graphLk   sync.RWMutex
+	viewers   map[string]struct{}  // DIDs of viewers whose follows are indexed
+	watched   map[string]int       // map of DID to the number of viewers following them
+	backfills map[string]*backfill // map of viewer DID to their in-flight backfill
+
+	// Backfills hold this for reading so Reindex doesn't reload the graph out from under them
+	reindexLk sync.RWMutex
+
+	// Backfills run on the feed's context rather than the request that started them
+	ctx context.Context
+}
+
+// backfill is an in-flight backfill of a viewer's follows that requests wait on, done is closed once err is set
+// Follow events for the viewer that arrive while their follows are listed are buffered in pending
+type backfill struct {
+	done    chan struct{}
+	err     error
+	pending []*firehose.Event
+}
+
+// NewFollowingFeed returns a new FollowingFeed, a list of aliases for the feed, and an error
+// The follow graphs of viewers seen before a restart are reloaded from the FollowStore
+// Backfills run until they finish or ctx is cancelled, even if the request that started them gives up
+func NewFollowingFeed(
+	ctx context.Context,
+	feedActorDID string,
+	feedName string,
+	postStore store.PostStore,
+	followStore store.FollowStore,
+	followsHost string,
+	includeReplies bool,
+	includeReposts bool,
+) (*FollowingFeed, []string, error) {
+	ff := &FollowingFeed{
+		FeedActorDID:   feedActorDID,
+		FeedName:       feedName,
+		Store:          postStore,
+		Follows:        followStore,
+		FollowsHost:    followsHost,
+		IncludeReplies: includeReplies,
+		IncludeReposts: includeReposts,
+		viewers:        map[string]struct{}{},
+		watched:        map[string]int{},
+		backfills:      map[string]*backfill{},
+		ctx:            ctx,
+	}
+
+	if err := ff.loadGraph(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	return ff, []string{feedName}, nil
+}
+
+// loadGraph loads the follow graphs of every viewer from the FollowStore, replacing the graphs in memory
+func (ff *FollowingFeed) loadGraph(ctx context.Context) error {
+	viewers := map[string]struct{}{}
+	watched := map[string]int{}
+
+	actors, err := ff.Follows.GetFollowActors(ctx, ff.FeedName)
+	if err != nil {
+		return fmt.Errorf("error loading viewers for following feed %s: %w", ff.FeedName, err)
+	}
+
+	for _, viewer := range actors {
+		following, err := ff.Follows.GetFollowing(ctx, ff.FeedName, viewer)
+		if err != nil {
+			return fmt.Errorf("error loading follows for following feed %s: %w", ff.FeedName, err)
+		}
+
+		viewers[viewer] = struct{}{}
+		for _, subject := range following {
+			watched[subject]++
+		}
+	}
+
+	ff.graphLk.Lock()
+	defer ff.graphLk.Unlock()
+
+	ff.viewers = viewers
+	ff.watched = watched
+
+	return nil
+}
+
+// Reindex reloads viewers' follow graphs from the FollowStore, dropping any drift in the graphs held in memory
+// FollowingFeed implements feedrouter.Reindexer so it can be reindexed from the admin API
+func (ff *FollowingFeed) Reindex(ctx context.Context) error {
+	// Hold off backfills so a viewer backfilled mid-reload isn't dropped
+	ff.reindexLk.Lock()
+	defer ff.reindexLk.Unlock()
+
+	return ff.loadGraph(ctx)
+}
+
+// isWatched returns true if any viewer follows the DID
+func (ff *FollowingFeed) isWatched(did string) bool {
+	ff.graphLk.RLock()
+	defer ff.graphLk.RUnlock()
+
+	return ff.watched[did] > 0
+}
+
+// watch adjusts the number of viewers following the DID by delta
+func (ff *FollowingFeed) watch(did string, delta int) {
+	ff.graphLk.Lock()
+	defer ff.graphLk.Unlock()
+
+	ff.watched[did] += delta
+	if ff.watched[did] <= 0 {
+		delete(ff.watched, did)
+	}
+}
+
+// ensureViewer backfills the follows of a viewer we haven't seen before from their repo
+// Concurrent requests from the same new viewer wait on a single backfill, other viewers aren't held up by it
+// The backfill runs detached from the request, so a client that gives up doesn't leave it half done
+func (ff *FollowingFeed) ensureViewer(ctx context.Context, viewer string) error {
+	ff.graphLk.Lock()
+	if _, ok := ff.viewers[viewer]; ok {
+		ff.graphLk.Unlock()
+		return nil
+	}
+
+	bf, inflight := ff.backfills[viewer]
+	if !inflight {
+		bf = &backfill{done: make(chan struct{})}
+		ff.backfills[viewer] = bf
+	}
+	ff.graphLk.Unlock()
+
+	if !inflight {
+		// Keep the request's trace so the backfill shows up under the request that started it
+		backfillCtx, cancel := context.WithTimeout(trace.ContextWithSpanContext(ff.ctx, trace.SpanContextFromContext(ctx)), backfillTimeout)
+		go func() {
+			defer cancel()
+
+			err := ff.backfill(backfillCtx, viewer, bf)
+			if err != nil {
+				// Drop the buffered events, the next request backfills from scratch
+				ff.graphLk.Lock()
+				delete(ff.backfills, viewer)
+				ff.graphLk.Unlock()
+			}
+			bf.err = err
+			close(bf.done)
+		}()
+	}
+
+	select {
+	case <-bf.done:
+		return bf.err
+	case <-ctx.Done():
+		return fmt.Errorf("gave up waiting for follows backfill: %w", ctx.Err())
+	}
+}
+
+// backfill lists a viewer's follows from their repo, then applies the follow events buffered while
+// they were listed before the viewer's follows are kept in sync from the firehose directly
+func (ff *FollowingFeed) backfill(ctx context.Context, viewer string, bf *backfill) error {
+	tracer := otel.Tracer("following-feed")
+	ctx, span := tracer.Start(ctx, "FollowingFeed:backfill")
+	defer span.End()
+
+	ff.reindexLk.RLock()
+	defer ff.reindexLk.RUnlock()
+
+	listed := map[string]string{} // map of follow URI to subject
+	err := records.List(ctx, records.NewClient(ff.FollowsHost), viewer, firehose.CollectionFollow, func(record *comatproto.RepoListRecords_Record) error {
+		follow, ok := record.Value.Val.(*appbsky.GraphFollow)
+		if !ok {
+			return nil
+		}
+
+		createdAt, err := time.Parse(time.RFC3339, follow.CreatedAt)
+		if err != nil {
+			createdAt = time.Now()
+		}
+
+		if err := ff.Follows.InsertFollow(ctx, &store.Follow{
+			Feed:      ff.FeedName,
+			URI:       record.Uri,
+			Actor:     viewer,
+			Subject:   follow.Subject,
+			CreatedAt: createdAt,
+		}); err != nil {
+			return err
+		}
+
+		listed[record.Uri] = follow.Subject
+		return nil
+	})
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("error backfilling follows for %s: %w", viewer, err)
+	}
+
+	span.SetAttributes(attribute.Int("follows.length", len(listed)))
+
+	ff.graphLk.Lock()
+	for _, subject := range listed {
+		ff.watched[subject]++
+	}
+	ff.graphLk.Unlock()
+
+	// Apply the buffered events in order until there are none left, then start applying events directly
+	for {
+		ff.graphLk.Lock()
+		pending := bf.pending
+		bf.pending = nil
+		if len(pending) == 0 {
+			ff.viewers[viewer] = struct{}{}
+			delete(ff.backfills, viewer)
+			ff.graphLk.Unlock()
+			break
+		}
+		ff.graphLk.Unlock()
+
+		for _, evt := range pending {
+			// Creates the listing already picked up were counted above
+			if _, ok := listed[evt.URI]; ok && evt.Action == firehose.ActionCreate {
+				continue
+			}
+			if err := ff.applyFollow(ctx, evt); err != nil {
+				span.RecordError(err)
+				return fmt.Errorf("error applying follows for %s: %w", viewer, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyFollow indexes a follow create or delete by a viewer and adjusts who's watched
+func (ff *FollowingFeed) applyFollow(ctx context.Context, evt *firehose.Event) error {
+	switch evt.Action {
+	case firehose.ActionCreate:
+		follow := store.FollowFromEvent(evt)
+		if follow == nil {
+			return nil
+		}
+		follow.Feed = ff.FeedName
+		if err := ff.Follows.InsertFollow(ctx, follow); err != nil {
+			return err
+		}
+		ff.watch(follow.Subject, 1)
+	case firehose.ActionDelete:
+		follow, err := ff.Follows.DeleteFollow(ctx, ff.FeedName, evt.URI)
+		if err != nil {
+			return err
+		}
+		if follow != nil {
+			ff.watch(follow.Subject, -1)
+		}
+	}
+
+	return nil
+}
+
+// takeFollow returns true if the follow event is by a viewer whose follows are indexed and should be applied
+// Events by viewers whose backfill is in flight are buffered, checking both under one lock so
+// an event can't slip in between a backfill applying its buffer and the viewer being tracked
+func (ff *FollowingFeed) takeFollow(evt *firehose.Event) bool {
+	ff.graphLk.Lock()
+	defer ff.graphLk.Unlock()
+
+	if _, ok := ff.viewers[evt.Repo]; ok {
+		return true
+	}
+
+	if bf, ok := ff.backfills[evt.Repo]; ok {
+		bf.pending = append(bf.pending, evt)
+	}
+
+	return false
+}
+
+// HandleEvent keeps viewers' follow graphs in sync and indexes posts and reposts by followed accounts
+// Deleted posts are removed by the store.DeleteHandler registered on the firehose
+// FollowingFeed implements firehose.Handler so it can be added to the Firehose
+func (ff *FollowingFeed) HandleEvent(ctx context.Context, evt *firehose.Event) error {
+	switch evt.Collection {
+	case firehose.CollectionFollow:
+		if !ff.takeFollow(evt) {
+			return nil
+		}
+
+		return ff.applyFollow(ctx, evt)
+	case firehose.CollectionPost, firehose.CollectionRepost:
+		if !ff.isWatched(evt.Repo) {
+			return nil
+		}
+
+		if evt.Collection == firehose.CollectionRepost && !ff.IncludeReposts {
+			return nil
+		}
+
+		post := store.PostFromEvent(evt)
+		if evt.Collection == firehose.CollectionRepost {
+			post = store.RepostFromEvent(evt)
+		}
+		if post == nil {
+			return nil
+		}
+
+		post.Feeds = []string{ff.FeedName}
+
+		return ff.Store.InsertPost(ctx, post)
+	}
+
+	return nil
+}
+
+// AuthMode tells the FeedRouter the feed only serves authenticated viewers
+func (ff *FollowingFeed) AuthMode() feedrouter.AuthMode {
+	return feedrouter.AuthRequired
+}
+
+// GetPage returns a list of FeedDefs_SkeletonFeedPost, a new cursor, and an error
+// The feed is personalized, so requests without a viewer DID get an AuthRequiredError
+func (ff *FollowingFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	tracer := otel.Tracer("following-feed")
+	ctx, span := tracer.Start(ctx, "FollowingFeed:GetPage")
+	defer span.End()
+
+	if userDID == "" {
+		return nil, nil, feedrouter.NewAuthRequiredError("this feed is personalized and requires an authenticated viewer")
+	}
+
+	if err := ff.ensureViewer(ctx, userDID); err != nil {
+		span.RecordError(err)
+		return nil, nil, err
+	}
+
+	following, err := ff.Follows.GetFollowing(ctx, ff.FeedName, userDID)
+	if err != nil {
+		span.RecordError(err)
+		return nil, nil, fmt.Errorf("error getting follows: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("viewer.following", len(following)))
+
+	if len(following) == 0 {
+		return []*appbsky.FeedDefs_SkeletonFeedPost{}, nil, nil
+	}
+
+	posts, newCursor, err := ff.Store.QueryPosts(ctx, store.PostQuery{
+		Feed:           ff.FeedName,
+		Authors:        following,
+		ExcludeReplies: !ff.IncludeReplies,
+		ExcludeReposts: !ff.IncludeReposts,
+		Limit:          limit,
+		Cursor:         cursor,
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, nil, fmt.Errorf("error querying posts: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("posts.length", len(posts)))
+
+	feedPosts := []*appbsky.FeedDefs_SkeletonFeedPost{}
+	for _, post := range posts {
+		feedPosts = append(feedPosts, store.SkeletonFeedPost(post))
+	}
+
+	return feedPosts, newCursor, nil
+}
+
+// Describe returns a list of FeedDescribeFeedGenerator_Feed, and an error
+// FollowingFeed serves a single feed so it returns a single FeedDescribeFeedGenerator_Feed
+func (ff *FollowingFeed) Describe(ctx context.Context) ([]appbsky.FeedDescribeFeedGenerator_Feed, error) {
+	return []appbsky.FeedDescribeFeedGenerator_Feed{
+		{
+			Uri: "at://" + ff.FeedActorDID + "/app.bsky.feed.generator/" + ff.FeedName,
+		},
+	}, nil
+}
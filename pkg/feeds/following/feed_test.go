@@ -0,0 +1,214 @@
+package following
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/firehose"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/store"
+)
+
+const (
+	feedActorDID = "did:plc:feedactor"
+	viewer       = "did:plc:viewer"
+	followed     = "did:plc:followed"
+	followURI    = "at://" + viewer + "/app.bsky.graph.follow/1"
+)
+
+// newFollowsHost serves the viewer's follow of the followed account from com.atproto.repo.listRecords
+// Requests wait for release to be closed if it's set
+func newFollowsHost(t *testing.T, release chan struct{}) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if release != nil {
+			<-release
+		}
+
+		records := []map[string]any{}
+		if r.URL.Query().Get("repo") == viewer {
+			records = append(records, map[string]any{
+				"uri": followURI,
+				"cid": "bafyreib2rxk3rh6kzwq",
+				"value": map[string]any{
+					"$type":     "app.bsky.graph.follow",
+					"subject":   followed,
+					"createdAt": time.Now().Format(time.RFC3339),
+				},
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"records": records})
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+func newTestStore(t *testing.T) *store.SQLStore {
+	ctx := context.Background()
+
+	s, err := store.NewSQLiteStore(ctx, filepath.Join(t.TempDir(), "feedgen.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func newTestFeed(t *testing.T, s *store.SQLStore, name string, followsHost string) *FollowingFeed {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	ff, _, err := NewFollowingFeed(ctx, feedActorDID, name, s, s, followsHost, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ff
+}
+
+func handle(t *testing.T, evt *firehose.Event, feeds ...*FollowingFeed) {
+	for _, ff := range feeds {
+		if err := ff.HandleEvent(context.Background(), evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFollowingFeedsKeepSeparateGraphs(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	host := newFollowsHost(t, nil)
+
+	first := newTestFeed(t, s, "following", host)
+	second := newTestFeed(t, s, "following-replies", host)
+
+	for _, ff := range []*FollowingFeed{first, second} {
+		if _, _, err := ff.GetPage(ctx, ff.FeedName, viewer, 10, ""); err != nil {
+			t.Fatal(err)
+		}
+		if !ff.isWatched(followed) {
+			t.Fatalf("feed %s isn't watching %s after backfilling %s", ff.FeedName, followed, viewer)
+		}
+	}
+
+	// Viewers of one feed aren't viewers of another after a restart
+	other := newTestFeed(t, s, "other", host)
+	if len(other.viewers) != 0 || len(other.watched) != 0 {
+		t.Errorf("got viewers %v and watched %v for a feed nobody has loaded", other.viewers, other.watched)
+	}
+
+	restarted := newTestFeed(t, s, "following", host)
+	if _, ok := restarted.viewers[viewer]; !ok || !restarted.isWatched(followed) {
+		t.Errorf("got viewers %v and watched %v after a restart, expected the backfilled graph", restarted.viewers, restarted.watched)
+	}
+
+	// Unfollowing is seen by every feed, not just the first to handle it
+	handle(t, &firehose.Event{
+		Action:     firehose.ActionDelete,
+		Collection: firehose.CollectionFollow,
+		Repo:       viewer,
+		URI:        followURI,
+	}, first, second)
+
+	for _, ff := range []*FollowingFeed{first, second} {
+		if ff.isWatched(followed) {
+			t.Errorf("feed %s still watches %s after the follow was deleted", ff.FeedName, followed)
+		}
+	}
+
+	handle(t, &firehose.Event{
+		Action:     firehose.ActionCreate,
+		Collection: firehose.CollectionPost,
+		Repo:       followed,
+		URI:        "at://" + followed + "/app.bsky.feed.post/1",
+		CID:        "bafyreib2rxk3rh6kzwq",
+		Post:       &appbsky.FeedPost{Text: "hello", CreatedAt: time.Now().Format(time.RFC3339)},
+	}, first, second)
+
+	posts, _, err := s.QueryPosts(ctx, store.PostQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 0 {
+		t.Errorf("got %d posts indexed from an account nobody follows", len(posts))
+	}
+}
+
+func TestFollowingFeedRequiresAuth(t *testing.T) {
+	ctx := context.Background()
+	ff := newTestFeed(t, newTestStore(t), "following", newFollowsHost(t, nil))
+
+	router, err := feedrouter.NewFeedRouter(ctx, feedActorDID, "did:web:feedgen.example.com", []string{feedActorDID}, "https://feedgen.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.AddFeed([]string{ff.FeedName}, ff)
+
+	_, err = router.GetSkeleton(ctx, ff.FeedName, "", 10, "")
+	authErr := feedrouter.AuthRequiredError{}
+	if !errors.As(err, &authErr) {
+		t.Fatalf("got error %v for an anonymous viewer, expected an AuthRequiredError", err)
+	}
+
+	// The feed refuses anonymous viewers on its own too, i.e. when wrapped by another feed
+	_, _, err = ff.GetPage(ctx, ff.FeedName, "", 10, "")
+	if !errors.As(err, &authErr) {
+		t.Fatalf("got error %v from GetPage for an anonymous viewer, expected an AuthRequiredError", err)
+	}
+
+	if _, err := router.GetSkeleton(ctx, ff.FeedName, viewer, 10, ""); err != nil {
+		t.Fatalf("got error %v for an authenticated viewer", err)
+	}
+}
+
+func TestFollowingFeedBackfillOutlivesRequest(t *testing.T) {
+	release := make(chan struct{})
+	ff := newTestFeed(t, newTestStore(t), "following", newFollowsHost(t, release))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := ff.GetPage(ctx, ff.FeedName, viewer, 10, "")
+		errs <- err
+	}()
+
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v for a cancelled request, expected it to give up", err)
+	}
+
+	close(release)
+
+	isViewer := func() bool {
+		ff.graphLk.RLock()
+		defer ff.graphLk.RUnlock()
+		_, ok := ff.viewers[viewer]
+		return ok
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !isViewer() {
+		if time.Now().After(deadline) {
+			t.Fatal("backfill didn't finish after the request that started it gave up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !ff.isWatched(followed) {
+		t.Errorf("viewer's follow of %s wasn't indexed by the backfill", followed)
+	}
+}
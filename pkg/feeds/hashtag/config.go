@@ -0,0 +1,49 @@
+package hashtag
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+)
+
+func init() {
+	feedrouter.RegisterFeedType("hashtag", newFromConfig)
+}
+
+// params are the config params of a hashtag feed
+type params struct {
+	TagSets []tagSetParams `yaml:"tag_sets"`
+}
+
+type tagSetParams struct {
+	Name       string   `yaml:"name"`
+	Tags       []string `yaml:"tags"`
+	RequireAll bool     `yaml:"require_all"`
+}
+
+// newFromConfig builds a hashtag feed, each tag set is served under its own name
+func newFromConfig(ctx context.Context, env *feedrouter.FeedEnv, def *feedrouter.FeedDefinition) (feedrouter.Feed, []string, error) {
+	p := params{}
+	if err := def.DecodeParams(&p); err != nil {
+		return nil, nil, err
+	}
+
+	if len(p.TagSets) == 0 {
+		return nil, nil, feedrouter.NewFieldError("params.tag_sets", "at least one tag set is required")
+	}
+
+	tagSets := []TagSet{}
+	for i, tagSet := range p.TagSets {
+		if tagSet.Name == "" {
+			return nil, nil, feedrouter.NewFieldError(fmt.Sprintf("params.tag_sets[%d].name", i), "is required")
+		}
+		if len(tagSet.Tags) == 0 {
+			return nil, nil, feedrouter.NewFieldError(fmt.Sprintf("params.tag_sets[%d].tags", i), "at least one tag is required")
+		}
+
+		tagSets = append(tagSets, TagSet{Name: tagSet.Name, Tags: tagSet.Tags, RequireAll: tagSet.RequireAll})
+	}
+
+	return NewHashtagFeed(ctx, env.FeedActorDID, env.PostStore, tagSets)
+}
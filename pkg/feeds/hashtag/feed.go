@@ -0,0 +1,143 @@
+package hashtag
+
+import (
+	"context"
+	"fmt"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/firehose"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/store"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// TagSet is a feed of posts carrying a set of hashtags, served under its own alias
+type TagSet struct {
+	Name       string   // Alias the feed is served under
+	Tags       []string // Hashtags, with or without the leading #
+	RequireAll bool     // Require posts to have every tag instead of any of them
+}
+
+type HashtagFeed struct {
+	FeedActorDID string
+	Store        store.PostStore
+	TagSets      map[string]TagSet // map of alias to TagSet
+
+	tagSetNames []string            // TagSet names in the order they were configured
+	indexedTags map[string]struct{} // union of the tags of every TagSet
+}
+
+// NewHashtagFeed returns a new HashtagFeed, a list of aliases for the feed, and an error
+// Each TagSet is served as its own feed under its Name, so the aliases are the TagSet names
+func NewHashtagFeed(ctx context.Context, feedActorDID string, postStore store.PostStore, tagSets []TagSet) (*HashtagFeed, []string, error) {
+	if len(tagSets) == 0 {
+		return nil, nil, fmt.Errorf("hashtag feed needs at least one tag set")
+	}
+
+	hf := &HashtagFeed{
+		FeedActorDID: feedActorDID,
+		Store:        postStore,
+		TagSets:      map[string]TagSet{},
+		indexedTags:  map[string]struct{}{},
+	}
+
+	for _, tagSet := range tagSets {
+		if tagSet.Name == "" {
+			return nil, nil, fmt.Errorf("hashtag feed tag set is missing a name")
+		}
+
+		if _, ok := hf.TagSets[tagSet.Name]; ok {
+			return nil, nil, fmt.Errorf("hashtag feed tag set %s is defined more than once", tagSet.Name)
+		}
+
+		tagSet.Tags = firehose.NormalizeTags(tagSet.Tags)
+		if len(tagSet.Tags) == 0 {
+			return nil, nil, fmt.Errorf("hashtag feed tag set %s needs at least one tag", tagSet.Name)
+		}
+
+		for _, tag := range tagSet.Tags {
+			hf.indexedTags[tag] = struct{}{}
+		}
+
+		hf.TagSets[tagSet.Name] = tagSet
+		hf.tagSetNames = append(hf.tagSetNames, tagSet.Name)
+	}
+
+	return hf, hf.tagSetNames, nil
+}
+
+// HandleEvent indexes posts carrying any of the feed's tags
+// Deleted posts are removed by the store.DeleteHandler registered on the firehose
+// HashtagFeed implements firehose.Handler so it can be added to the Firehose
+func (hf *HashtagFeed) HandleEvent(ctx context.Context, evt *firehose.Event) error {
+	if evt.Collection != firehose.CollectionPost {
+		return nil
+	}
+
+	post := store.PostFromEvent(evt)
+	if post == nil {
+		return nil
+	}
+
+	for _, tag := range post.Tags {
+		if _, ok := hf.indexedTags[tag]; ok {
+			return hf.Store.InsertPost(ctx, post)
+		}
+	}
+
+	return nil
+}
+
+// GetPage returns a list of FeedDefs_SkeletonFeedPost, a new cursor, and an error
+// The feed name selects the TagSet to serve, posts are returned newest first
+func (hf *HashtagFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	tracer := otel.Tracer("hashtag-feed")
+	ctx, span := tracer.Start(ctx, "HashtagFeed:GetPage")
+	defer span.End()
+
+	tagSet, ok := hf.TagSets[feed]
+	if !ok {
+		return nil, nil, feedrouter.NewNotFoundError(fmt.Sprintf("hashtag feed has no tag set named %s", feed))
+	}
+
+	span.SetAttributes(attribute.StringSlice("feed.tags", tagSet.Tags), attribute.Bool("feed.require_all", tagSet.RequireAll))
+
+	// Query by tag rather than by feed membership so any post carrying the tags is served,
+	// including ones indexed before this tag set was configured
+	posts, newCursor, err := hf.Store.QueryPosts(ctx, store.PostQuery{
+		Tags:         tagSet.Tags,
+		MatchAllTags: tagSet.RequireAll,
+		Limit:        limit,
+		Cursor:       cursor,
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, nil, fmt.Errorf("error querying posts: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("posts.length", len(posts)))
+
+	feedPosts := []*appbsky.FeedDefs_SkeletonFeedPost{}
+	for _, post := range posts {
+		feedPosts = append(feedPosts, &appbsky.FeedDefs_SkeletonFeedPost{
+			Post: post.URI,
+		})
+	}
+
+	return feedPosts, newCursor, nil
+}
+
+// Describe returns a list of FeedDescribeFeedGenerator_Feed, and an error
+// Every TagSet is advertised as its own feed
+func (hf *HashtagFeed) Describe(ctx context.Context) ([]appbsky.FeedDescribeFeedGenerator_Feed, error) {
+	feeds := []appbsky.FeedDescribeFeedGenerator_Feed{}
+
+	for _, name := range hf.tagSetNames {
+		feeds = append(feeds, appbsky.FeedDescribeFeedGenerator_Feed{
+			Uri: "at://" + hf.FeedActorDID + "/app.bsky.feed.generator/" + name,
+		})
+	}
+
+	return feeds, nil
+}
@@ -0,0 +1,64 @@
+package hot
+
+import (
+	"context"
+	"time"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+)
+
+func init() {
+	feedrouter.RegisterFeedType("hot", newFromConfig)
+}
+
+// params are the config params of a hot feed, unset params fall back to the Config defaults
+// The scoring params are pointers so setting one to 0 turns it off rather than falling back to the default
+type params struct {
+	LikeWeight        *float64      `yaml:"like_weight"`
+	RepostWeight      *float64      `yaml:"repost_weight"`
+	ReplyWeight       *float64      `yaml:"reply_weight"`
+	Gravity           *float64      `yaml:"gravity"`
+	MaxAge            time.Duration `yaml:"max_age"`
+	RecomputeInterval time.Duration `yaml:"recompute_interval"`
+	SnapshotTTL       time.Duration `yaml:"snapshot_ttl"`
+	SnapshotSize      int           `yaml:"snapshot_size"`
+	MinPoints         *float64      `yaml:"min_points"`
+	MaxTrackedPosts   int           `yaml:"max_tracked_posts"`
+}
+
+func newFromConfig(ctx context.Context, env *feedrouter.FeedEnv, def *feedrouter.FeedDefinition) (feedrouter.Feed, []string, error) {
+	p := params{}
+	if err := def.DecodeParams(&p); err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case p.Gravity != nil && *p.Gravity < 0:
+		return nil, nil, feedrouter.NewFieldError("params.gravity", "must not be negative")
+	case p.MinPoints != nil && *p.MinPoints < 0:
+		return nil, nil, feedrouter.NewFieldError("params.min_points", "must not be negative")
+	case p.MaxAge < 0:
+		return nil, nil, feedrouter.NewFieldError("params.max_age", "must not be negative")
+	case p.RecomputeInterval < 0:
+		return nil, nil, feedrouter.NewFieldError("params.recompute_interval", "must not be negative")
+	case p.SnapshotTTL < 0:
+		return nil, nil, feedrouter.NewFieldError("params.snapshot_ttl", "must not be negative")
+	case p.SnapshotSize < 0:
+		return nil, nil, feedrouter.NewFieldError("params.snapshot_size", "must not be negative")
+	case p.MaxTrackedPosts < 0:
+		return nil, nil, feedrouter.NewFieldError("params.max_tracked_posts", "must not be negative")
+	}
+
+	return NewHotFeed(ctx, env.FeedActorDID, def.Name, Config{
+		LikeWeight:        p.LikeWeight,
+		RepostWeight:      p.RepostWeight,
+		ReplyWeight:       p.ReplyWeight,
+		Gravity:           p.Gravity,
+		MaxAge:            p.MaxAge,
+		RecomputeInterval: p.RecomputeInterval,
+		SnapshotTTL:       p.SnapshotTTL,
+		SnapshotSize:      p.SnapshotSize,
+		MinPoints:         p.MinPoints,
+		MaxTrackedPosts:   p.MaxTrackedPosts,
+	})
+}
@@ -0,0 +1,575 @@
+package hot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/firehose"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/store"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/tid"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var trackedPosts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "bsky_hot_feed_tracked_posts",
+	Help: "The number of posts a hot feed is counting engagement for",
+}, []string{"feed"})
+
+var rankedPosts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "bsky_hot_feed_ranked_posts",
+	Help: "The number of posts in the latest ranking snapshot of a hot feed",
+}, []string{"feed"})
+
+var recomputeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "bsky_hot_feed_recompute_duration_seconds",
+	Help:    "The time it takes a hot feed to recompute its ranking snapshot",
+	Buckets: prometheus.DefBuckets,
+}, []string{"feed"})
+
+// Config tunes the scoring and snapshotting of a HotFeed, nil and zero values are replaced with defaults
+// The scoring fields are pointers so they can be set to zero, i.e. a ReplyWeight of Float(0) doesn't count replies
+type Config struct {
+	LikeWeight   *float64 // Points per like, defaults to 1
+	RepostWeight *float64 // Points per repost, defaults to 2
+	ReplyWeight  *float64 // Points per reply, defaults to 1.5
+
+	// Gravity is the exponent of the time decay, higher values make posts fall off faster, defaults to 1.8
+	// A post scores points / (ageHours + 2)^Gravity
+	Gravity *float64
+
+	MaxAge            time.Duration // Posts older than this are no longer ranked or counted, defaults to 48h
+	RecomputeInterval time.Duration // How often the ranking snapshot is recomputed, defaults to 1m
+	SnapshotTTL       time.Duration // How long old snapshots are kept around for cursors that point into them, defaults to 30m
+	SnapshotSize      int           // Maximum number of posts in a snapshot, defaults to 1000
+	MinPoints         *float64      // Posts need at least this many points to be ranked, defaults to 3
+
+	// MaxTrackedPosts caps how many posts engagement is counted for, defaults to 50,000
+	// Once it's reached, the posts that went longest without engagement are forgotten
+	MaxTrackedPosts int
+}
+
+// Float returns a pointer to v, for the scoring fields of Config
+func Float(v float64) *float64 {
+	return &v
+}
+
+func (c *Config) setDefaults() {
+	if c.LikeWeight == nil {
+		c.LikeWeight = Float(1)
+	}
+	if c.RepostWeight == nil {
+		c.RepostWeight = Float(2)
+	}
+	if c.ReplyWeight == nil {
+		c.ReplyWeight = Float(1.5)
+	}
+	if c.Gravity == nil {
+		c.Gravity = Float(1.8)
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = 48 * time.Hour
+	}
+	if c.RecomputeInterval == 0 {
+		c.RecomputeInterval = time.Minute
+	}
+	if c.SnapshotTTL == 0 {
+		c.SnapshotTTL = 30 * time.Minute
+	}
+	if c.SnapshotSize == 0 {
+		c.SnapshotSize = 1000
+	}
+	if c.MinPoints == nil {
+		c.MinPoints = Float(3)
+	}
+	if c.MaxTrackedPosts == 0 {
+		c.MaxTrackedPosts = 50_000
+	}
+}
+
+// postStats is the engagement counted for a single post
+type postStats struct {
+	createdAt time.Time
+	likes     int
+	reposts   int
+	replies   int
+}
+
+// snapshot is a ranking of post URIs frozen at a point in time, so cursors stay stable while scores change
+type snapshot struct {
+	id        int64
+	createdAt time.Time
+	uris      []string
+}
+
+// HotFeed serves posts ranked by engagement with a Hacker News style time decay
+// Likes, reposts, and replies are counted in memory from the firehose, and pages are served
+// from a ranking snapshot that's recomputed every RecomputeInterval
+type HotFeed struct {
+	FeedActorDID string
+	FeedName     string
+	Config       Config
+
+	// Both caches are bounded so counting the engagement of the whole network can't run us out of memory
+	statsLk sync.Mutex
+	stats   *lru.Cache // map of post AT-URI to its *postStats, evicting the posts engaged with least recently
+	subject *lru.Cache // map of like/repost/reply AT-URI to the post AT-URI it engages with, so deletes can be undone
+
+	snapshotsLk sync.RWMutex
+	snapshots   []*snapshot // oldest first, the last one is current
+
+	hiddenLk sync.Mutex
+	hidden   *lru.Cache // map of viewer DID to the set of post AT-URIs they asked to see less of
+}
+
+// hiddenViewers is how many viewers' requestLess interactions a HotFeed remembers
+const hiddenViewers = 10_000
+
+// subjectsPerPost is how many likes, reposts, and replies per tracked post a HotFeed remembers so their deletes can be undone
+const subjectsPerPost = 4
+
+// maxClockSkew is how far ahead of now a post's record key may be, PDSes accept any valid TID
+// so posts dated further ahead would never decay or age out
+const maxClockSkew = 5 * time.Minute
+
+// NewHotFeed returns a new HotFeed, a list of aliases for the feed, and an error
+// The ranking is recomputed in the background until ctx is cancelled
+func NewHotFeed(ctx context.Context, feedActorDID string, feedName string, config Config) (*HotFeed, []string, error) {
+	config.setDefaults()
+
+	if *config.Gravity < 0 {
+		return nil, nil, fmt.Errorf("hot feed %s gravity must not be negative", feedName)
+	}
+
+	if *config.MinPoints < 0 {
+		return nil, nil, fmt.Errorf("hot feed %s min points must not be negative", feedName)
+	}
+
+	if config.MaxTrackedPosts < 0 {
+		return nil, nil, fmt.Errorf("hot feed %s max tracked posts must not be negative", feedName)
+	}
+
+	stats, err := lru.New(config.MaxTrackedPosts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating post stats cache: %w", err)
+	}
+
+	subject, err := lru.New(config.MaxTrackedPosts * subjectsPerPost)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating engagement cache: %w", err)
+	}
+
+	hidden, err := lru.New(hiddenViewers)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating hidden posts cache: %w", err)
+	}
+
+	hf := &HotFeed{
+		FeedActorDID: feedActorDID,
+		FeedName:     feedName,
+		Config:       config,
+		stats:        stats,
+		subject:      subject,
+		hidden:       hidden,
+	}
+
+	hf.recompute(ctx)
+
+	go func() {
+		ticker := time.NewTicker(config.RecomputeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				hf.recompute(ctx)
+			}
+		}
+	}()
+
+	return hf, []string{feedName}, nil
+}
+
+// Reindex recomputes the ranking now rather than waiting for the next RecomputeInterval
+// HotFeed implements feedrouter.Reindexer so it can be reindexed from the admin API
+func (hf *HotFeed) Reindex(ctx context.Context) error {
+	hf.recompute(ctx)
+	return nil
+}
+
+// HandleInteractions hides posts from viewers who asked to see less of them, and shows them again if they ask for more
+// HotFeed implements feedrouter.InteractionHandler so viewers can tune the ranking they're served
+func (hf *HotFeed) HandleInteractions(ctx context.Context, feed string, userDID string, interactions []*store.Interaction) error {
+	if userDID == "" {
+		return nil
+	}
+
+	hf.hiddenLk.Lock()
+	defer hf.hiddenLk.Unlock()
+
+	hidden := map[string]bool{}
+	if entry, ok := hf.hidden.Get(userDID); ok {
+		hidden = entry.(map[string]bool)
+	}
+
+	for _, interaction := range interactions {
+		switch interaction.Event {
+		case store.InteractionRequestLess:
+			hidden[interaction.Item] = true
+		case store.InteractionRequestMore:
+			delete(hidden, interaction.Item)
+		}
+	}
+
+	if len(hidden) == 0 {
+		hf.hidden.Remove(userDID)
+		return nil
+	}
+
+	hf.hidden.Add(userDID, hidden)
+	return nil
+}
+
+// isHidden returns whether a viewer asked to see less of a post
+func (hf *HotFeed) isHidden(userDID string, uri string) bool {
+	if userDID == "" {
+		return false
+	}
+
+	hf.hiddenLk.Lock()
+	defer hf.hiddenLk.Unlock()
+
+	entry, ok := hf.hidden.Peek(userDID)
+	if !ok {
+		return false
+	}
+
+	return entry.(map[string]bool)[uri]
+}
+
+// Points returns the weighted engagement of a post
+func (hf *HotFeed) Points(likes, reposts, replies int) float64 {
+	return *hf.Config.LikeWeight*float64(likes) +
+		*hf.Config.RepostWeight*float64(reposts) +
+		*hf.Config.ReplyWeight*float64(replies)
+}
+
+// Score returns the points of a post decayed by its age
+func (hf *HotFeed) Score(likes, reposts, replies int, age time.Duration) float64 {
+	if age < 0 {
+		age = 0
+	}
+
+	return hf.Points(likes, reposts, replies) / math.Pow(age.Hours()+2, *hf.Config.Gravity)
+}
+
+// engage adjusts the engagement counts of a post, tracking it if we haven't seen it yet
+func (hf *HotFeed) engage(postURI string, likes, reposts, replies int) {
+	// Likes and reposts can also point at feed generators and other records
+	if !strings.Contains(postURI, "/"+firehose.CollectionPost+"/") {
+		return
+	}
+
+	// A post's age comes from its record key, so we can rank posts we never saw created, i.e. ones from before a restart
+	createdAt, ok := tid.FromURI(postURI)
+	if !ok || time.Since(createdAt) > hf.Config.MaxAge || time.Until(createdAt) > maxClockSkew {
+		return
+	}
+
+	hf.statsLk.Lock()
+	defer hf.statsLk.Unlock()
+
+	var stats *postStats
+	if entry, ok := hf.stats.Get(postURI); ok {
+		stats = entry.(*postStats)
+	} else {
+		// Nothing to undo for posts we aren't tracking
+		if likes < 0 || reposts < 0 || replies < 0 {
+			return
+		}
+		stats = &postStats{createdAt: createdAt}
+		hf.stats.Add(postURI, stats)
+	}
+
+	stats.likes += likes
+	stats.reposts += reposts
+	stats.replies += replies
+}
+
+// track remembers the post a like, repost, or reply engages with if the post is tracked, so deleting it can be undone
+func (hf *HotFeed) track(uri string, postURI string) {
+	hf.statsLk.Lock()
+	defer hf.statsLk.Unlock()
+
+	if hf.stats.Contains(postURI) {
+		hf.subject.Add(uri, postURI)
+	}
+}
+
+// untrack forgets the post a like, repost, or reply engages with, returning false if it wasn't tracked
+func (hf *HotFeed) untrack(uri string) (string, bool) {
+	hf.statsLk.Lock()
+	defer hf.statsLk.Unlock()
+
+	entry, ok := hf.subject.Peek(uri)
+	if !ok {
+		return "", false
+	}
+	hf.subject.Remove(uri)
+
+	return entry.(string), true
+}
+
+// HandleEvent counts likes, reposts, and replies and forgets deleted posts
+// HotFeed implements firehose.Handler so it can be added to the Firehose
+func (hf *HotFeed) HandleEvent(ctx context.Context, evt *firehose.Event) error {
+	switch evt.Collection {
+	case firehose.CollectionLike, firehose.CollectionRepost:
+		if evt.Action == firehose.ActionDelete {
+			postURI, ok := hf.untrack(evt.URI)
+			if !ok {
+				return nil
+			}
+
+			if evt.Collection == firehose.CollectionLike {
+				hf.engage(postURI, -1, 0, 0)
+			} else {
+				hf.engage(postURI, 0, -1, 0)
+			}
+			return nil
+		}
+
+		postURI := ""
+		if evt.Like != nil && evt.Like.Subject != nil {
+			postURI = evt.Like.Subject.Uri
+			hf.engage(postURI, 1, 0, 0)
+		} else if evt.Repost != nil && evt.Repost.Subject != nil {
+			postURI = evt.Repost.Subject.Uri
+			hf.engage(postURI, 0, 1, 0)
+		}
+
+		hf.track(evt.URI, postURI)
+	case firehose.CollectionPost:
+		if evt.Action == firehose.ActionDelete {
+			// Deleted replies no longer count towards their parent
+			if parentURI, ok := hf.untrack(evt.URI); ok {
+				hf.engage(parentURI, 0, 0, -1)
+			}
+
+			hf.statsLk.Lock()
+			hf.stats.Remove(evt.URI)
+			hf.statsLk.Unlock()
+			return nil
+		}
+
+		if evt.Post != nil && evt.Post.Reply != nil && evt.Post.Reply.Parent != nil {
+			// Don't let authors bump their own posts by replying to them
+			parentURI := evt.Post.Reply.Parent.Uri
+			if !strings.HasPrefix(parentURI, "at://"+evt.Repo+"/") {
+				hf.engage(parentURI, 0, 0, 1)
+				hf.track(evt.URI, parentURI)
+			}
+		}
+	}
+
+	return nil
+}
+
+// recompute prunes posts that aged out, ranks the rest, and publishes a new snapshot
+func (hf *HotFeed) recompute(ctx context.Context) {
+	tracer := otel.Tracer("hot-feed")
+	_, span := tracer.Start(ctx, "HotFeed:recompute")
+	defer span.End()
+
+	start := time.Now()
+
+	type scoredPost struct {
+		uri   string
+		score float64
+	}
+
+	scored := []scoredPost{}
+
+	hf.statsLk.Lock()
+	for _, key := range hf.stats.Keys() {
+		entry, ok := hf.stats.Peek(key)
+		if !ok {
+			continue
+		}
+		uri, stats := key.(string), entry.(*postStats)
+
+		age := start.Sub(stats.createdAt)
+		if age > hf.Config.MaxAge {
+			hf.stats.Remove(uri)
+			continue
+		}
+
+		if hf.Points(stats.likes, stats.reposts, stats.replies) < *hf.Config.MinPoints {
+			continue
+		}
+
+		scored = append(scored, scoredPost{uri: uri, score: hf.Score(stats.likes, stats.reposts, stats.replies, age)})
+	}
+	for _, key := range hf.subject.Keys() {
+		if postURI, ok := hf.subject.Peek(key); ok && !hf.stats.Contains(postURI) {
+			hf.subject.Remove(key)
+		}
+	}
+	tracked := hf.stats.Len()
+	hf.statsLk.Unlock()
+
+	sort.Slice(scored, func(i, j int) bool {
+		if scored[i].score != scored[j].score {
+			return scored[i].score > scored[j].score
+		}
+		return scored[i].uri > scored[j].uri
+	})
+
+	if len(scored) > hf.Config.SnapshotSize {
+		scored = scored[:hf.Config.SnapshotSize]
+	}
+
+	snap := &snapshot{
+		id:        start.UnixMilli(),
+		createdAt: start,
+		uris:      make([]string, len(scored)),
+	}
+	for i, post := range scored {
+		snap.uris[i] = post.uri
+	}
+
+	hf.snapshotsLk.Lock()
+	// Make sure IDs stay unique if we recompute twice in the same millisecond
+	if n := len(hf.snapshots); n > 0 && hf.snapshots[n-1].id >= snap.id {
+		snap.id = hf.snapshots[n-1].id + 1
+	}
+	kept := []*snapshot{}
+	for _, old := range hf.snapshots {
+		if start.Sub(old.createdAt) <= hf.Config.SnapshotTTL {
+			kept = append(kept, old)
+		}
+	}
+	hf.snapshots = append(kept, snap)
+	hf.snapshotsLk.Unlock()
+
+	trackedPosts.WithLabelValues(hf.FeedName).Set(float64(tracked))
+	rankedPosts.WithLabelValues(hf.FeedName).Set(float64(len(snap.uris)))
+	recomputeDuration.WithLabelValues(hf.FeedName).Observe(time.Since(start).Seconds())
+
+	span.SetAttributes(attribute.Int("posts.tracked", tracked), attribute.Int("posts.ranked", len(snap.uris)))
+}
+
+// getSnapshot returns the snapshot with the given ID, or the current snapshot if it's expired or id is 0
+func (hf *HotFeed) getSnapshot(id int64) *snapshot {
+	hf.snapshotsLk.RLock()
+	defer hf.snapshotsLk.RUnlock()
+
+	if len(hf.snapshots) == 0 {
+		return &snapshot{}
+	}
+
+	for _, snap := range hf.snapshots {
+		if snap.id == id {
+			return snap
+		}
+	}
+
+	if id != 0 {
+		log.Printf("hot feed %s: snapshot %d expired, paging the current snapshot instead", hf.FeedName, id)
+	}
+
+	return hf.snapshots[len(hf.snapshots)-1]
+}
+
+// GetPage returns a list of FeedDefs_SkeletonFeedPost, a new cursor, and an error
+// The FeedRouter serves HotFeeds with GetSkeleton, this is for callers that don't need the feedContext of posts
+func (hf *HotFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	skeleton, err := hf.GetSkeleton(ctx, feed, userDID, limit, cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return skeleton.FeedPosts(), skeleton.Cursor, nil
+}
+
+// GetSkeleton returns a page of the feed with each post's feedContext set to <snapshotID>:<rank>,
+// so interactions can be attributed to the ranking that served the post
+// Cursors look like <snapshotID>:<offset> and keep paging the snapshot the first page was served from
+// If that snapshot has expired, paging continues at the same offset of the current snapshot
+// HotFeed implements feedrouter.SkeletonFeed so the feedContext of posts makes it to clients
+func (hf *HotFeed) GetSkeleton(ctx context.Context, feed string, userDID string, limit int64, cursor string) (*feedrouter.Skeleton, error) {
+	tracer := otel.Tracer("hot-feed")
+	_, span := tracer.Start(ctx, "HotFeed:GetSkeleton")
+	defer span.End()
+
+	snapshotID := int64(0)
+	offset := int64(0)
+
+	if cursor != "" {
+		idPart, offsetPart, ok := strings.Cut(cursor, ":")
+		if !ok {
+			return nil, feedrouter.NewInvalidRequestError("malformed cursor %q", cursor)
+		}
+
+		var err error
+		snapshotID, err = strconv.ParseInt(idPart, 10, 64)
+		if err != nil {
+			return nil, feedrouter.NewInvalidRequestError("cursor snapshot is not an integer: %w", err)
+		}
+
+		offset, err = strconv.ParseInt(offsetPart, 10, 64)
+		if err != nil || offset < 0 {
+			return nil, feedrouter.NewInvalidRequestError("cursor offset is not a positive integer: %q", offsetPart)
+		}
+	}
+
+	snap := hf.getSnapshot(snapshotID)
+	span.SetAttributes(attribute.Int64("snapshot.id", snap.id), attribute.Int("snapshot.length", len(snap.uris)))
+
+	// Posts the viewer asked to see less of are skipped, so the offset counts snapshot positions rather than posts served
+	feedPosts := []*feedrouter.SkeletonPost{}
+	i := offset
+	for ; i < int64(len(snap.uris)) && int64(len(feedPosts)) < limit; i++ {
+		if hf.isHidden(userDID, snap.uris[i]) {
+			continue
+		}
+		feedPosts = append(feedPosts, &feedrouter.SkeletonPost{
+			Post:        snap.uris[i],
+			FeedContext: fmt.Sprintf("%d:%d", snap.id, i),
+		})
+	}
+
+	offset = i
+
+	var newCursor *string
+	if offset < int64(len(snap.uris)) {
+		newCursor = new(string)
+		*newCursor = fmt.Sprintf("%d:%d", snap.id, offset)
+	}
+
+	return &feedrouter.Skeleton{Feed: feedPosts, Cursor: newCursor}, nil
+}
+
+// Describe returns a list of FeedDescribeFeedGenerator_Feed, and an error
+// HotFeed serves a single feed so it returns a single FeedDescribeFeedGenerator_Feed
+func (hf *HotFeed) Describe(ctx context.Context) ([]appbsky.FeedDescribeFeedGenerator_Feed, error) {
+	return []appbsky.FeedDescribeFeedGenerator_Feed{
+		{
+			Uri: "at://" + hf.FeedActorDID + "/app.bsky.feed.generator/" + hf.FeedName,
+		},
+	}, nil
+}
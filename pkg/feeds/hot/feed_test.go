@@ -0,0 +1,232 @@
+package hot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/firehose"
+	"gopkg.in/yaml.v3"
+)
+
+const alphabet = "234567abcdefghijklmnopqrstuvwxyz"
+
+// postURI returns the AT-URI of a post with a TID record key for the given time
+func postURI(repo string, createdAt time.Time) string {
+	n := uint64(createdAt.UnixMicro()) << 10
+
+	rkey := make([]byte, 13)
+	for i := len(rkey) - 1; i >= 0; i-- {
+		rkey[i] = alphabet[n&31]
+		n >>= 5
+	}
+
+	return "at://" + repo + "/" + firehose.CollectionPost + "/" + string(rkey)
+}
+
+func newTestFeed(t *testing.T) *HotFeed {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	hf, _, err := NewHotFeed(ctx, "did:plc:feedactor", "hot", Config{MinPoints: Float(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hf
+}
+
+func like(hf *HotFeed, uri string, subject string) {
+	_ = hf.HandleEvent(context.Background(), &firehose.Event{
+		Action:     firehose.ActionCreate,
+		Collection: firehose.CollectionLike,
+		Repo:       "did:plc:liker",
+		URI:        uri,
+		Like:       &appbsky.FeedLike{Subject: &comatproto.RepoStrongRef{Uri: subject}},
+	})
+}
+
+func ranked(t *testing.T, hf *HotFeed) []string {
+	if err := hf.Reindex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	skeleton, err := hf.GetSkeleton(context.Background(), "hot", "", 100, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uris := []string{}
+	for _, post := range skeleton.Feed {
+		uris = append(uris, post.Post)
+	}
+
+	return uris
+}
+
+func TestHotFeedIgnoresFutureDatedPosts(t *testing.T) {
+	hf := newTestFeed(t)
+
+	now := time.Now()
+	recent := postURI("did:plc:author", now.Add(-time.Hour))
+	skewed := postURI("did:plc:author", now.Add(time.Minute))
+	future := postURI("did:plc:author", now.Add(365*24*time.Hour))
+
+	like(hf, "at://did:plc:liker/app.bsky.feed.like/1", recent)
+	like(hf, "at://did:plc:liker/app.bsky.feed.like/2", skewed)
+	for i := 0; i < 100; i++ {
+		like(hf, "at://did:plc:liker/app.bsky.feed.like/future", future)
+	}
+
+	uris := ranked(t, hf)
+	if len(uris) != 2 {
+		t.Fatalf("got ranking %v, expected the recent post and the one within clock skew", uris)
+	}
+	for _, uri := range uris {
+		if uri == future {
+			t.Fatalf("post dated a year ahead was ranked: %v", uris)
+		}
+	}
+}
+
+func TestHotFeedUndoesDeletedReplies(t *testing.T) {
+	hf := newTestFeed(t)
+
+	parent := postURI("did:plc:author", time.Now().Add(-time.Hour))
+	reply := postURI("did:plc:replier", time.Now())
+
+	replyEvent := &firehose.Event{
+		Action:     firehose.ActionCreate,
+		Collection: firehose.CollectionPost,
+		Repo:       "did:plc:replier",
+		URI:        reply,
+		Post: &appbsky.FeedPost{Reply: &appbsky.FeedPost_ReplyRef{
+			Parent: &comatproto.RepoStrongRef{Uri: parent},
+			Root:   &comatproto.RepoStrongRef{Uri: parent},
+		}},
+	}
+	if err := hf.HandleEvent(context.Background(), replyEvent); err != nil {
+		t.Fatal(err)
+	}
+
+	if uris := ranked(t, hf); len(uris) != 1 || uris[0] != parent {
+		t.Fatalf("got ranking %v, expected the replied to post", uris)
+	}
+
+	err := hf.HandleEvent(context.Background(), &firehose.Event{
+		Action:     firehose.ActionDelete,
+		Collection: firehose.CollectionPost,
+		Repo:       "did:plc:replier",
+		URI:        reply,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry, ok := hf.stats.Peek(parent); !ok || entry.(*postStats).replies != 0 {
+		t.Fatalf("got parent stats %+v after the reply was deleted, expected no replies", entry)
+	}
+
+	if uris := ranked(t, hf); len(uris) != 0 {
+		t.Errorf("got ranking %v, expected nothing once the only reply was deleted", uris)
+	}
+}
+
+func TestHotFeedBoundsTrackedPosts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hf, _, err := NewHotFeed(ctx, "did:plc:feedactor", "hot", Config{MinPoints: Float(1), MaxTrackedPosts: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createdAt := time.Now().Add(-time.Hour)
+	var last string
+	for i := 0; i < 100; i++ {
+		last = postURI(fmt.Sprintf("did:plc:author%d", i), createdAt)
+		for j := 0; j < 10; j++ {
+			like(hf, fmt.Sprintf("at://did:plc:liker/app.bsky.feed.like/%d-%d", i, j), last)
+		}
+	}
+
+	if tracked := hf.stats.Len(); tracked != 10 {
+		t.Errorf("got %d tracked posts, expected the cap of 10", tracked)
+	}
+	if subjects := hf.subject.Len(); subjects > 10*subjectsPerPost {
+		t.Errorf("got %d tracked likes, more than the cap of %d", subjects, 10*subjectsPerPost)
+	}
+
+	// The posts engaged with most recently are the ones kept
+	if !hf.stats.Contains(last) {
+		t.Errorf("latest post %s was evicted", last)
+	}
+}
+
+func TestHotFeedZeroWeights(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hf, _, err := NewHotFeed(ctx, "did:plc:feedactor", "hot", Config{LikeWeight: Float(0), MinPoints: Float(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *hf.Config.LikeWeight != 0 || *hf.Config.RepostWeight != 2 {
+		t.Fatalf("got like weight %v and repost weight %v, expected an explicit 0 and the default", *hf.Config.LikeWeight, *hf.Config.RepostWeight)
+	}
+
+	like(hf, "at://did:plc:liker/app.bsky.feed.like/1", postURI("did:plc:author", time.Now().Add(-time.Hour)))
+	if uris := ranked(t, hf); len(uris) != 0 {
+		t.Errorf("got ranking %v, expected likes not to count", uris)
+	}
+}
+
+func TestHotFeedConfig(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tests := []struct {
+		name        string
+		params      string
+		replyWeight float64
+		field       string // field named by the expected FieldError, empty if the config is valid
+	}{
+		{name: "defaults", params: "{}", replyWeight: 1.5},
+		{name: "zero reply weight", params: "reply_weight: 0", replyWeight: 0},
+		{name: "negative min points", params: "min_points: -1", field: "params.min_points"},
+		{name: "negative gravity", params: "gravity: -0.5", field: "params.gravity"},
+		{name: "negative max tracked posts", params: "max_tracked_posts: -1", field: "params.max_tracked_posts"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			def := &feedrouter.FeedDefinition{Type: "hot", Name: "hot"}
+			if err := yaml.Unmarshal([]byte(test.params), &def.Params); err != nil {
+				t.Fatal(err)
+			}
+			def.Params = *def.Params.Content[0]
+
+			feed, _, err := newFromConfig(ctx, &feedrouter.FeedEnv{FeedActorDID: "did:plc:feedactor"}, def)
+			if test.field == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if replyWeight := *feed.(*HotFeed).Config.ReplyWeight; replyWeight != test.replyWeight {
+					t.Errorf("got reply weight %v, expected %v", replyWeight, test.replyWeight)
+				}
+				return
+			}
+
+			fieldErr := &feedrouter.FieldError{}
+			if !errors.As(err, &fieldErr) || fieldErr.Field != test.field {
+				t.Errorf("got error %v, expected a FieldError for %s", err, test.field)
+			}
+		})
+	}
+}
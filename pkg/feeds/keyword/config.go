@@ -0,0 +1,56 @@
+package keyword
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+)
+
+func init() {
+	feedrouter.RegisterFeedType("keyword", newFromConfig)
+}
+
+// params are the config params of a keyword feed
+type params struct {
+	Include        []string `yaml:"include"`
+	Exclude        []string `yaml:"exclude"`
+	IncludeRegexps []string `yaml:"include_regexps"`
+	ExcludeRegexps []string `yaml:"exclude_regexps"`
+}
+
+func newFromConfig(ctx context.Context, env *feedrouter.FeedEnv, def *feedrouter.FeedDefinition) (feedrouter.Feed, []string, error) {
+	p := params{}
+	if err := def.DecodeParams(&p); err != nil {
+		return nil, nil, err
+	}
+
+	if len(p.Include) == 0 && len(p.IncludeRegexps) == 0 {
+		return nil, nil, feedrouter.NewFieldError("params.include", "at least one include keyword or regexp is required")
+	}
+
+	for i, keyword := range p.Include {
+		if strings.TrimSpace(keyword) == "" {
+			return nil, nil, feedrouter.NewFieldError(fmt.Sprintf("params.include[%d]", i), "must not be empty or whitespace")
+		}
+	}
+	for i, keyword := range p.Exclude {
+		if strings.TrimSpace(keyword) == "" {
+			return nil, nil, feedrouter.NewFieldError(fmt.Sprintf("params.exclude[%d]", i), "must not be empty or whitespace")
+		}
+	}
+	for i, expr := range p.IncludeRegexps {
+		if _, err := regexp.Compile(expr); err != nil {
+			return nil, nil, feedrouter.NewFieldError(fmt.Sprintf("params.include_regexps[%d]", i), "invalid regexp: %w", err)
+		}
+	}
+	for i, expr := range p.ExcludeRegexps {
+		if _, err := regexp.Compile(expr); err != nil {
+			return nil, nil, feedrouter.NewFieldError(fmt.Sprintf("params.exclude_regexps[%d]", i), "invalid regexp: %w", err)
+		}
+	}
+
+	return NewKeywordFeed(ctx, env.FeedActorDID, def.Name, env.PostStore, p.Include, p.Exclude, p.IncludeRegexps, p.ExcludeRegexps)
+}
@@ -0,0 +1,42 @@
+package keyword
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"gopkg.in/yaml.v3"
+)
+
+func TestKeywordFeedConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		params string
+		field  string // field named by the expected FieldError
+	}{
+		{name: "no includes", params: "exclude: [spam]", field: "params.include"},
+		{name: "empty include", params: `include: [golang, ""]`, field: "params.include[1]"},
+		{name: "whitespace include", params: `include: [" "]`, field: "params.include[0]"},
+		{name: "whitespace exclude", params: "include: [golang]\nexclude: [spam, \"\\t\"]", field: "params.exclude[1]"},
+		{name: "invalid regexp", params: `include_regexps: ["(go"]`, field: "params.include_regexps[0]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			def := &feedrouter.FeedDefinition{Type: "keyword", Name: "golang"}
+			node := yaml.Node{}
+			if err := yaml.Unmarshal([]byte(test.params), &node); err != nil {
+				t.Fatal(err)
+			}
+			def.Params = *node.Content[0]
+
+			_, _, err := newFromConfig(context.Background(), &feedrouter.FeedEnv{FeedActorDID: "did:plc:feedactor"}, def)
+
+			fieldErr := &feedrouter.FieldError{}
+			if !errors.As(err, &fieldErr) || fieldErr.Field != test.field {
+				t.Errorf("got error %v, expected a FieldError for %s", err, test.field)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package keyword
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/firehose"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/store"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Keywords must be surrounded by the start or end of the text or a character that can't be part of a word
+// Go's \b only understands ASCII word characters, so we build our own boundaries from Unicode classes
+const (
+	wordStart = `(?:^|[^\p{L}\p{N}_])`
+	wordEnd   = `(?:$|[^\p{L}\p{N}_])`
+)
+
+type KeywordFeed struct {
+	FeedActorDID string
+	FeedName     string
+	Store        store.PostStore
+
+	Include        []string // Keywords, a post matching any of them is included
+	Exclude        []string // Keywords, a post matching any of them is excluded even if it matches an include
+	IncludeRegexps []string // Regular expressions, a post matching any of them is included
+	ExcludeRegexps []string // Regular expressions, a post matching any of them is excluded
+
+	includeMatchers []*regexp.Regexp
+	excludeMatchers []*regexp.Regexp
+}
+
+// NewKeywordFeed returns a new KeywordFeed, a list of aliases for the feed, and an error
+// Keywords are matched on word boundaries against the case folded, NFKC normalized text of a post
+// Regular expressions are matched case insensitively against the NFKC normalized text of a post
+// At least one include keyword or regular expression is required
+func NewKeywordFeed(
+	ctx context.Context,
+	feedActorDID string,
+	feedName string,
+	postStore store.PostStore,
+	include []string,
+	exclude []string,
+	includeRegexps []string,
+	excludeRegexps []string,
+) (*KeywordFeed, []string, error) {
+	if len(include) == 0 && len(includeRegexps) == 0 {
+		return nil, nil, fmt.Errorf("keyword feed %s needs at least one include keyword or regexp", feedName)
+	}
+
+	includeMatchers, err := compileMatchers(include, includeRegexps)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error compiling include matchers for feed %s: %w", feedName, err)
+	}
+
+	excludeMatchers, err := compileMatchers(exclude, excludeRegexps)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error compiling exclude matchers for feed %s: %w", feedName, err)
+	}
+
+	return &KeywordFeed{
+		FeedActorDID:    feedActorDID,
+		FeedName:        feedName,
+		Store:           postStore,
+		Include:         include,
+		Exclude:         exclude,
+		IncludeRegexps:  includeRegexps,
+		ExcludeRegexps:  excludeRegexps,
+		includeMatchers: includeMatchers,
+		excludeMatchers: excludeMatchers,
+	}, []string{feedName}, nil
+}
+
+// compileMatchers turns keywords and regular expressions into a single list of regexps
+func compileMatchers(keywords []string, regexps []string) ([]*regexp.Regexp, error) {
+	matchers := []*regexp.Regexp{}
+
+	for _, keyword := range keywords {
+		folded := foldText(strings.TrimSpace(keyword))
+		if folded == "" {
+			return nil, fmt.Errorf("empty keyword")
+		}
+		matchers = append(matchers, regexp.MustCompile(wordStart+regexp.QuoteMeta(folded)+wordEnd))
+	}
+
+	for _, expr := range regexps {
+		re, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp %q: %w", expr, err)
+		}
+		matchers = append(matchers, re)
+	}
+
+	return matchers, nil
+}
+
+// foldText normalizes text so that visually equivalent strings compare equal
+func foldText(text string) string {
+	return cases.Fold().String(norm.NFKC.String(text))
+}
+
+// Matches returns true if the text matches an include and no exclude
+func (kf *KeywordFeed) Matches(text string) bool {
+	normalized := norm.NFKC.String(text)
+	folded := cases.Fold().String(normalized)
+
+	matchAny := func(matchers []*regexp.Regexp) bool {
+		for _, matcher := range matchers {
+			// Keyword matchers were built from folded keywords, regexps match case insensitively either way
+			if matcher.MatchString(folded) || matcher.MatchString(normalized) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return matchAny(kf.includeMatchers) && !matchAny(kf.excludeMatchers)
+}
+
+// HandleEvent indexes posts that match the feed
+// Deleted posts are removed by the store.DeleteHandler registered on the firehose
+// KeywordFeed implements firehose.Handler so it can be added to the Firehose
+func (kf *KeywordFeed) HandleEvent(ctx context.Context, evt *firehose.Event) error {
+	if evt.Collection != firehose.CollectionPost {
+		return nil
+	}
+
+	post := store.PostFromEvent(evt)
+	if post == nil || !kf.Matches(post.Text) {
+		return nil
+	}
+
+	post.Feeds = []string{kf.FeedName}
+
+	return kf.Store.InsertPost(ctx, post)
+}
+
+// GetPage returns a list of FeedDefs_SkeletonFeedPost, a new cursor, and an error
+// Posts are returned newest first, the cursor is the timestamp and CID of the last post on the page
+func (kf *KeywordFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	tracer := otel.Tracer("keyword-feed")
+	ctx, span := tracer.Start(ctx, "KeywordFeed:GetPage")
+	defer span.End()
+
+	posts, newCursor, err := kf.Store.QueryPosts(ctx, store.PostQuery{
+		Feed:   kf.FeedName,
+		Limit:  limit,
+		Cursor: cursor,
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, nil, fmt.Errorf("error querying posts: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("posts.length", len(posts)))
+
+	feedPosts := []*appbsky.FeedDefs_SkeletonFeedPost{}
+	for _, post := range posts {
+		feedPosts = append(feedPosts, &appbsky.FeedDefs_SkeletonFeedPost{
+			Post: post.URI,
+		})
+	}
+
+	return feedPosts, newCursor, nil
+}
+
+// Describe returns a list of FeedDescribeFeedGenerator_Feed, and an error
+// KeywordFeed serves a single feed so it returns a single FeedDescribeFeedGenerator_Feed
+func (kf *KeywordFeed) Describe(ctx context.Context) ([]appbsky.FeedDescribeFeedGenerator_Feed, error) {
+	return []appbsky.FeedDescribeFeedGenerator_Feed{
+		{
+			Uri: "at://" + kf.FeedActorDID + "/app.bsky.feed.generator/" + kf.FeedName,
+		},
+	}, nil
+}
@@ -0,0 +1,48 @@
+package pinned
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+)
+
+func init() {
+	feedrouter.RegisterFeedType("pinned", newFromConfig)
+}
+
+// params are the config params of a pinned feed
+type params struct {
+	Feed  string   `yaml:"feed"`  // Alias of the feed to pin posts to
+	Posts []string `yaml:"posts"` // AT-URIs of the posts to pin, in order
+}
+
+// newFromConfig builds a pinned feed, the feed it pins to must be defined earlier in the config
+func newFromConfig(ctx context.Context, env *feedrouter.FeedEnv, def *feedrouter.FeedDefinition) (feedrouter.Feed, []string, error) {
+	p := params{}
+	if err := def.DecodeParams(&p); err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case p.Feed == "":
+		return nil, nil, feedrouter.NewFieldError("params.feed", "is required")
+	case p.Feed == def.Name:
+		return nil, nil, feedrouter.NewFieldError("params.feed", "a pinned feed can't pin to itself")
+	case !env.HasFeed(p.Feed):
+		return nil, nil, feedrouter.NewFieldError("params.feed", "no feed is registered as %q, it must be defined before the pinned feed", p.Feed)
+	}
+
+	if len(p.Posts) == 0 {
+		return nil, nil, feedrouter.NewFieldError("params.posts", "at least one post is required")
+	}
+
+	for i, uri := range p.Posts {
+		if !strings.HasPrefix(uri, "at://") {
+			return nil, nil, feedrouter.NewFieldError(fmt.Sprintf("params.posts[%d]", i), "%q is not an AT-URI", uri)
+		}
+	}
+
+	return NewPinnedFeed(ctx, env.FeedActorDID, def.Name, env.Router, p.Feed, p.Posts)
+}
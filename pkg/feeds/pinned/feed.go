@@ -0,0 +1,87 @@
+package pinned
+
+import (
+	"context"
+	"fmt"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// PinnedFeed serves another feed with posts pinned to the top of its first page
+// Pinned posts are served with a pin reason and skipped if the feed serves them again further down
+// The feed is looked up by alias in the FeedRouter on every request, so it can be reloaded independently
+type PinnedFeed struct {
+	FeedActorDID string
+	FeedName     string
+	Router       *feedrouter.FeedRouter
+	Feed         string   // Alias of the feed being pinned to
+	Posts        []string // AT-URIs of the pinned posts, in order
+}
+
+// NewPinnedFeed returns a new PinnedFeed, a list of aliases for the feed, and an error
+// The feed doesn't need to be registered yet, the feed config makes sure it's defined before the PinnedFeed
+func NewPinnedFeed(ctx context.Context, feedActorDID string, feedName string, router *feedrouter.FeedRouter, feed string, posts []string) (*PinnedFeed, []string, error) {
+	if feed == feedName {
+		return nil, nil, fmt.Errorf("pinned feed %s can't pin to itself", feedName)
+	}
+
+	if len(posts) == 0 {
+		return nil, nil, fmt.Errorf("pinned feed %s needs at least one post", feedName)
+	}
+
+	return &PinnedFeed{
+		FeedActorDID: feedActorDID,
+		FeedName:     feedName,
+		Router:       router,
+		Feed:         feed,
+		Posts:        posts,
+	}, []string{feedName}, nil
+}
+
+// GetPage returns a list of FeedDefs_SkeletonFeedPost, a new cursor, and an error
+// The FeedRouter serves PinnedFeeds with GetSkeleton, GetPage drops the pin reasons
+func (pf *PinnedFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	skeleton, err := pf.GetSkeleton(ctx, feed, userDID, limit, cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return skeleton.FeedPosts(), skeleton.Cursor, nil
+}
+
+// GetSkeleton returns a page of the pinned feed, cursors are the cursors of the feed being pinned to
+// PinnedFeed implements feedrouter.SkeletonFeed so the pin reasons make it to clients
+func (pf *PinnedFeed) GetSkeleton(ctx context.Context, feed string, userDID string, limit int64, cursor string) (*feedrouter.Skeleton, error) {
+	tracer := otel.Tracer("pinned-feed")
+	ctx, span := tracer.Start(ctx, "PinnedFeed:GetSkeleton")
+	defer span.End()
+
+	// Pins are overlaid the same way as the pins of operators, which the router applies to this feed on top
+	overlay := feedrouter.Overlay{Pinned: pf.Posts}
+
+	// Pages go through the router so the feed being pinned to can be reloaded
+	skeleton, err := pf.Router.GetRawSkeleton(ctx, pf.Feed, userDID, overlay.Limit(limit, cursor), cursor)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("error getting page of %s: %w", pf.Feed, err)
+	}
+
+	feedPosts := overlay.Apply(skeleton.Feed, limit, cursor)
+
+	span.SetAttributes(attribute.Int("posts.length", len(feedPosts)), attribute.Bool("feed.first_page", cursor == ""))
+
+	return &feedrouter.Skeleton{Feed: feedPosts, Cursor: skeleton.Cursor, ReqID: skeleton.ReqID}, nil
+}
+
+// Describe returns a list of FeedDescribeFeedGenerator_Feed, and an error
+// PinnedFeed serves a single feed so it returns a single FeedDescribeFeedGenerator_Feed
+func (pf *PinnedFeed) Describe(ctx context.Context) ([]appbsky.FeedDescribeFeedGenerator_Feed, error) {
+	return []appbsky.FeedDescribeFeedGenerator_Feed{
+		{
+			Uri: "at://" + pf.FeedActorDID + "/app.bsky.feed.generator/" + pf.FeedName,
+		},
+	}, nil
+}
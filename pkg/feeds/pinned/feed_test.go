@@ -0,0 +1,102 @@
+package pinned
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feeds/static"
+)
+
+const feedActorDID = "did:plc:feedactor"
+
+func postURI(i int) string {
+	return fmt.Sprintf("at://did:plc:author/app.bsky.feed.post/%d", i)
+}
+
+func newTestRouter(t *testing.T, pins []string) *feedrouter.FeedRouter {
+	ctx := context.Background()
+
+	router, err := feedrouter.NewFeedRouter(ctx, feedActorDID, "did:web:feedgen.example.com", []string{feedActorDID}, "https://feedgen.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	posts := []string{}
+	for i := 0; i < 10; i++ {
+		posts = append(posts, postURI(i))
+	}
+
+	staticFeed, aliases, err := static.NewStaticFeed(ctx, feedActorDID, "static", posts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.AddFeed(aliases, staticFeed)
+
+	pinnedFeed, aliases, err := NewPinnedFeed(ctx, feedActorDID, "pinned", router, "static", pins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.AddFeed(aliases, pinnedFeed)
+
+	return router
+}
+
+func TestPinnedFeedStaysWithinLimit(t *testing.T) {
+	router := newTestRouter(t, []string{"at://did:plc:author/app.bsky.feed.post/pin1", "at://did:plc:author/app.bsky.feed.post/pin2"})
+
+	// Operator pins on the pinned feed stack on top of its configured pins
+	for _, uri := range []string{"at://did:plc:author/app.bsky.feed.post/admin1", "at://did:plc:author/app.bsky.feed.post/admin2"} {
+		if err := router.PinPost("pinned", uri); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, limit := range []int64{1, 2, 3, 4, 5, 10} {
+		skeleton, err := router.GetSkeleton(context.Background(), "pinned", "", limit, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(skeleton.Feed)) > limit {
+			t.Errorf("got %d posts for limit %d", len(skeleton.Feed), limit)
+		}
+		if skeleton.Cursor == nil {
+			t.Errorf("got no cursor for limit %d", limit)
+		}
+	}
+
+	skeleton, err := router.GetSkeleton(context.Background(), "pinned", "", 6, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"at://did:plc:author/app.bsky.feed.post/admin1",
+		"at://did:plc:author/app.bsky.feed.post/admin2",
+		"at://did:plc:author/app.bsky.feed.post/pin1",
+		"at://did:plc:author/app.bsky.feed.post/pin2",
+		postURI(0),
+		postURI(1),
+	}
+	if len(skeleton.Feed) != len(expected) {
+		t.Fatalf("got %d posts, expected %d", len(skeleton.Feed), len(expected))
+	}
+	for i, post := range skeleton.Feed {
+		if post.Post != expected[i] {
+			t.Errorf("got post %s at %d, expected %s", post.Post, i, expected[i])
+		}
+		if pinned := post.Reason != nil && post.Reason.Pin; pinned != (i < 4) {
+			t.Errorf("got pin %v for post %s", pinned, post.Post)
+		}
+	}
+
+	// The next page carries on from the feed's posts without skipping any
+	next, err := router.GetSkeleton(context.Background(), "pinned", "", 2, *skeleton.Cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Feed) != 2 || next.Feed[0].Post != postURI(2) {
+		t.Errorf("got next page %v, expected to start at %s", next.Feed, postURI(2))
+	}
+}
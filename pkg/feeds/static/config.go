@@ -0,0 +1,37 @@
+package static
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+)
+
+func init() {
+	feedrouter.RegisterFeedType("static", newFromConfig)
+}
+
+// params are the config params of a static feed
+type params struct {
+	Posts []string `yaml:"posts"` // AT-URIs of the posts to serve, in order
+}
+
+func newFromConfig(ctx context.Context, env *feedrouter.FeedEnv, def *feedrouter.FeedDefinition) (feedrouter.Feed, []string, error) {
+	p := params{}
+	if err := def.DecodeParams(&p); err != nil {
+		return nil, nil, err
+	}
+
+	if len(p.Posts) == 0 {
+		return nil, nil, feedrouter.NewFieldError("params.posts", "at least one post is required")
+	}
+
+	for i, uri := range p.Posts {
+		if !strings.HasPrefix(uri, "at://") {
+			return nil, nil, feedrouter.NewFieldError(fmt.Sprintf("params.posts[%d]", i), "%q is not an AT-URI", uri)
+		}
+	}
+
+	return NewStaticFeed(ctx, env.FeedActorDID, def.Name, p.Posts)
+}
@@ -2,10 +2,10 @@ package static
 
 import (
 	"context"
-	"fmt"
 	"strconv"
 
 	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
 )
 
 type StaticFeed struct {
@@ -34,7 +34,7 @@ func (sf *StaticFeed) GetPage(ctx context.Context, feed string, userDID string,
 	if cursor != "" {
 		cursorAsInt, err = strconv.ParseInt(cursor, 10, 64)
 		if err != nil {
-			return nil, nil, fmt.Errorf("cursor is not an integer: %w", err)
+			return nil, nil, feedrouter.NewInvalidRequestError("cursor is not an integer: %w", err)
 		}
 	}
 
@@ -0,0 +1,124 @@
+package firehose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CursorStore persists the sequence number of the last commit the Firehose handled
+// so the stream can be resumed after a restart
+// GetCursor returns -1 if no cursor has been stored yet
+type CursorStore interface {
+	GetCursor(ctx context.Context) (int64, error)
+	SetCursor(ctx context.Context, seq int64) error
+}
+
+// FileCursorStore stores the cursor as a decimal string in a file
+type FileCursorStore struct {
+	Path string
+}
+
+// NewFileCursorStore returns a new FileCursorStore at the given path, creating its directory if needed
+func NewFileCursorStore(path string) (*FileCursorStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("error creating cursor directory: %w", err)
+	}
+
+	return &FileCursorStore{Path: path}, nil
+}
+
+// GetCursor reads the cursor from the file, returning -1 if the file doesn't exist
+func (fcs *FileCursorStore) GetCursor(ctx context.Context) (int64, error) {
+	data, err := os.ReadFile(fcs.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return -1, nil
+		}
+		return -1, fmt.Errorf("error reading cursor file: %w", err)
+	}
+
+	seq, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return -1, fmt.Errorf("cursor file does not contain an integer: %w", err)
+	}
+
+	return seq, nil
+}
+
+// SetCursor writes the cursor to a temporary file and renames it over the old one
+// so a crash mid-write never leaves a truncated cursor behind
+func (fcs *FileCursorStore) SetCursor(ctx context.Context, seq int64) error {
+	tmpPath := fcs.Path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(strconv.FormatInt(seq, 10)), 0o644); err != nil {
+		return fmt.Errorf("error writing cursor file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, fcs.Path); err != nil {
+		return fmt.Errorf("error replacing cursor file: %w", err)
+	}
+
+	return nil
+}
+
+// FirehoseCursor is the row SQLCursorStore keeps for each named cursor
+type FirehoseCursor struct {
+	Name      string `gorm:"primaryKey"`
+	Seq       int64
+	UpdatedAt time.Time
+}
+
+// SQLCursorStore stores the cursor in a SQL database under a name,
+// so multiple consumers can share a database
+type SQLCursorStore struct {
+	DB   *gorm.DB
+	Name string
+}
+
+// NewSQLCursorStore returns a new SQLCursorStore, migrating the cursor table if needed
+func NewSQLCursorStore(ctx context.Context, db *gorm.DB, name string) (*SQLCursorStore, error) {
+	if err := db.WithContext(ctx).AutoMigrate(&FirehoseCursor{}); err != nil {
+		return nil, fmt.Errorf("error migrating cursor table: %w", err)
+	}
+
+	return &SQLCursorStore{DB: db, Name: name}, nil
+}
+
+// GetCursor reads the named cursor, returning -1 if it hasn't been stored yet
+func (scs *SQLCursorStore) GetCursor(ctx context.Context) (int64, error) {
+	var cursor FirehoseCursor
+	err := scs.DB.WithContext(ctx).Where("name = ?", scs.Name).Take(&cursor).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return -1, nil
+		}
+		return -1, fmt.Errorf("error reading cursor: %w", err)
+	}
+
+	return cursor.Seq, nil
+}
+
+// SetCursor upserts the named cursor
+func (scs *SQLCursorStore) SetCursor(ctx context.Context, seq int64) error {
+	err := scs.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"seq", "updated_at"}),
+	}).Create(&FirehoseCursor{
+		Name:      scs.Name,
+		Seq:       seq,
+		UpdatedAt: time.Now(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("error writing cursor: %w", err)
+	}
+
+	return nil
+}
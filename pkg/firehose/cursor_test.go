@@ -0,0 +1,93 @@
+package firehose
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testCursorStore checks a CursorStore starts empty and round-trips cursors
+func testCursorStore(t *testing.T, cs CursorStore) {
+	ctx := context.Background()
+
+	seq, err := cs.GetCursor(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != -1 {
+		t.Fatalf("got cursor %d from an empty store, expected -1", seq)
+	}
+
+	for _, expected := range []int64{42, 1_000_000_000_000, 0} {
+		if err := cs.SetCursor(ctx, expected); err != nil {
+			t.Fatal(err)
+		}
+
+		seq, err := cs.GetCursor(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != expected {
+			t.Errorf("got cursor %d, expected %d", seq, expected)
+		}
+	}
+}
+
+func TestFileCursorStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "cursor")
+
+	cs, err := NewFileCursorStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCursorStore(t, cs)
+
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary cursor file was left behind: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("not a cursor"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.GetCursor(context.Background()); err == nil {
+		t.Error("expected a corrupt cursor file to be an error")
+	}
+}
+
+func TestSQLCursorStore(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "cursors.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := NewSQLCursorStore(ctx, db, "firehose")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCursorStore(t, cs)
+
+	// Named cursors sharing a database don't see each other
+	other, err := NewSQLCursorStore(ctx, db, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seq, err := other.GetCursor(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != -1 {
+		t.Errorf("got cursor %d for a cursor that was never stored, expected -1", seq)
+	}
+}
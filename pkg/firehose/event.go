@@ -0,0 +1,62 @@
+package firehose
+
+import (
+	"context"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+// Action is the kind of change a firehose Event describes
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionDelete Action = "delete"
+)
+
+// Collections emitted by the firehose consumer, all other collections are skipped
+const (
+	CollectionPost     = "app.bsky.feed.post"
+	CollectionLike     = "app.bsky.feed.like"
+	CollectionRepost   = "app.bsky.feed.repost"
+	CollectionFollow   = "app.bsky.graph.follow"
+	CollectionListItem = "app.bsky.graph.listitem"
+)
+
+// Event is a single record create or delete decoded from a repo commit
+// Exactly one of Post, Like, Repost, Follow, or ListItem is set for creates, deletes only carry the record URI
+type Event struct {
+	Seq        int64     // Sequence number of the commit on the relay
+	Time       time.Time // Time the commit was emitted by the relay
+	Action     Action
+	Repo       string // DID of the repo the record lives in
+	Collection string
+	RKey       string
+	URI        string // AT-URI of the record
+	CID        string // CID of the record, empty for deletes
+
+	Post     *appbsky.FeedPost
+	Like     *appbsky.FeedLike
+	Repost   *appbsky.FeedRepost
+	Follow   *appbsky.GraphFollow
+	ListItem *appbsky.GraphListitem
+
+	// RawRecord is the raw CBOR of the record for creates, for fields
+	// the generated lexicon types don't know about yet
+	RawRecord []byte
+}
+
+// Handler receives events from the Firehose
+// Handlers are called sequentially in the order they were added, errors are logged and don't stop the stream
+type Handler interface {
+	HandleEvent(ctx context.Context, evt *Event) error
+}
+
+// HandlerFunc adapts a plain function to the Handler interface
+type HandlerFunc func(ctx context.Context, evt *Event) error
+
+// HandleEvent calls f(ctx, evt)
+func (f HandlerFunc) HandleEvent(ctx context.Context, evt *Event) error {
+	return f(ctx, evt)
+}
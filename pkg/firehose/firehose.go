@@ -0,0 +1,423 @@
+// Package firehose describes the Firehose type, which consumes a relay's com.atproto.sync.subscribeRepos
+// event stream and emits typed record events to registered Handlers.
+package firehose
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Initialize Prometheus Metrics for firehose consumption
+var eventsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "bsky_firehose_events_processed_total",
+	Help: "The total number of record events emitted by the firehose consumer",
+}, []string{"collection", "action"})
+
+var handlerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "bsky_firehose_handler_errors_total",
+	Help: "The total number of errors returned by firehose event handlers",
+}, []string{"collection"})
+
+var reconnects = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "bsky_firehose_reconnects_total",
+	Help: "The total number of times the firehose consumer reconnected to the relay",
+})
+
+var storedCursor = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "bsky_firehose_stored_cursor",
+	Help: "The sequence number most recently checkpointed to the cursor store",
+})
+
+var lastSeq = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "bsky_firehose_last_seq",
+	Help: "The sequence number of the last commit handled by the firehose consumer",
+})
+
+var lag = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "bsky_firehose_lag_seconds",
+	Help: "The time between a commit being emitted by the relay and being handled by the firehose consumer",
+})
+
+const subscribeReposPath = "/xrpc/com.atproto.sync.subscribeRepos"
+
+type Firehose struct {
+	RelayURL   *url.URL          // Base URL of the relay, i.e. wss://bsky.social
+	Dialer     *websocket.Dialer // Dialer used to connect to the relay
+	MaxBackoff time.Duration     // Maximum time to wait between reconnection attempts
+
+	CursorStore        CursorStore   // Optional store used to checkpoint and resume the stream
+	CheckpointInterval time.Duration // How often the cursor is written to the CursorStore
+	Rewind             int64         // Number of sequence numbers to rewind the stored cursor by on startup
+
+	handlersLk sync.RWMutex
+	handlers   []Handler
+
+	seq   int64 // Sequence number of the last commit handled
+	floor int64 // Cursor loaded from the CursorStore by Run, checkpoints never move the stored cursor behind it
+}
+
+// NewFirehose returns a new Firehose for the given relay URL
+// The relay URL may use the ws, wss, http, or https scheme, http(s) is rewritten to ws(s)
+func NewFirehose(ctx context.Context, relayURL string) (*Firehose, error) {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing relay URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "ws", "wss":
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("unsupported relay URL scheme %q", u.Scheme)
+	}
+
+	return &Firehose{
+		RelayURL:           u,
+		Dialer:             websocket.DefaultDialer,
+		MaxBackoff:         time.Second * 30,
+		CheckpointInterval: time.Second * 10,
+		seq:                -1,
+		floor:              -1,
+	}, nil
+}
+
+// AddHandler registers a Handler to receive events from the Firehose
+func (fh *Firehose) AddHandler(handler Handler) {
+	fh.handlersLk.Lock()
+	defer fh.handlersLk.Unlock()
+
+	fh.handlers = append(fh.handlers, handler)
+}
+
+// RemoveHandler unregisters a Handler, waiting for any event it's handling to finish
+// Handlers are matched by equality, so only comparable handlers (i.e. pointers) can be removed
+// Returns false if the handler isn't registered
+func (fh *Firehose) RemoveHandler(handler Handler) bool {
+	if !reflect.TypeOf(handler).Comparable() {
+		return false
+	}
+
+	fh.handlersLk.Lock()
+	defer fh.handlersLk.Unlock()
+
+	for i, existing := range fh.handlers {
+		if reflect.TypeOf(existing) == reflect.TypeOf(handler) && existing == handler {
+			fh.handlers = append(fh.handlers[:i], fh.handlers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Seq returns the sequence number of the last commit handled, or -1 if none has been handled yet
+func (fh *Firehose) Seq() int64 {
+	return atomic.LoadInt64(&fh.seq)
+}
+
+// Run connects to the relay and handles events until the context is cancelled
+// If cursor is non-negative, the stream is resumed from that sequence number, otherwise
+// it is resumed from the CursorStore (minus the Rewind window) if one is configured
+// Dropped connections are retried with exponential backoff, resuming from the last handled commit
+// The cursor is checkpointed every CheckpointInterval and once more when Run returns
+func (fh *Firehose) Run(ctx context.Context, cursor int64) error {
+	if cursor < 0 && fh.CursorStore != nil {
+		stored, err := fh.CursorStore.GetCursor(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to load firehose cursor: %w", err)
+		}
+
+		if stored >= 0 {
+			storedCursor.Set(float64(stored))
+			atomic.StoreInt64(&fh.floor, stored)
+			cursor = stored - fh.Rewind
+			if cursor < 0 {
+				cursor = 0
+			}
+			log.Printf("resuming firehose from stored cursor %d (rewound to %d)", stored, cursor)
+		}
+	}
+
+	if cursor >= 0 {
+		atomic.StoreInt64(&fh.seq, cursor)
+	}
+
+	if fh.CursorStore != nil {
+		checkpointDone := make(chan struct{})
+		go func() {
+			defer close(checkpointDone)
+			fh.checkpointLoop(ctx)
+		}()
+		defer func() { <-checkpointDone }()
+	}
+
+	backoff := time.Second
+	for {
+		connectedAt := time.Now()
+
+		err := fh.subscribe(ctx, fh.Seq())
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		// Reset the backoff if we stayed connected for a while
+		if time.Since(connectedAt) > fh.MaxBackoff {
+			backoff = time.Second
+		}
+
+		log.Printf("firehose connection to %s dropped, reconnecting in %s: %v", fh.RelayURL.Host, backoff, err)
+		reconnects.Inc()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > fh.MaxBackoff {
+			backoff = fh.MaxBackoff
+		}
+	}
+}
+
+// checkpointLoop writes the cursor to the CursorStore periodically and once more when the context is cancelled
+func (fh *Firehose) checkpointLoop(ctx context.Context) {
+	ticker := time.NewTicker(fh.CheckpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := fh.Checkpoint(ctx); err != nil {
+				log.Printf("failed to checkpoint firehose cursor: %v", err)
+			}
+		case <-ctx.Done():
+			// Use a fresh context so the final checkpoint isn't cancelled along with the stream
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			if err := fh.Checkpoint(shutdownCtx); err != nil {
+				log.Printf("failed to checkpoint firehose cursor on shutdown: %v", err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// Checkpoint writes the sequence number of the last handled commit to the CursorStore
+// While the Rewind window is being replayed the last handled commit is behind the stored cursor,
+// so nothing is written until the stream passes it, otherwise every restart would rewind it further
+func (fh *Firehose) Checkpoint(ctx context.Context) error {
+	if fh.CursorStore == nil {
+		return nil
+	}
+
+	seq := fh.Seq()
+	if seq < 0 || seq <= atomic.LoadInt64(&fh.floor) {
+		return nil
+	}
+
+	if err := fh.CursorStore.SetCursor(ctx, seq); err != nil {
+		return err
+	}
+
+	storedCursor.Set(float64(seq))
+
+	return nil
+}
+
+// subscribe opens a single websocket connection to the relay and handles events until it fails
+func (fh *Firehose) subscribe(ctx context.Context, cursor int64) error {
+	u := *fh.RelayURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + subscribeReposPath
+	if cursor >= 0 {
+		u.RawQuery = url.Values{"cursor": {strconv.FormatInt(cursor, 10)}}.Encode()
+	}
+
+	con, _, err := fh.Dialer.DialContext(ctx, u.String(), http.Header{})
+	if err != nil {
+		return fmt.Errorf("failed to dial relay: %w", err)
+	}
+	defer con.Close()
+
+	// Close the connection when the context is cancelled to unblock reads
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			con.Close()
+		case <-done:
+		}
+	}()
+
+	log.Printf("connected to firehose at %s", u.String())
+
+	callbacks := &events.RepoStreamCallbacks{
+		RepoCommit: func(evt *comatproto.SyncSubscribeRepos_Commit) error {
+			return fh.HandleCommit(ctx, evt)
+		},
+		RepoInfo: func(evt *comatproto.SyncSubscribeRepos_Info) error {
+			log.Printf("firehose info: %s", evt.Name)
+			return nil
+		},
+		Error: func(evt *events.ErrorFrame) error {
+			return fmt.Errorf("firehose error frame: %s: %s", evt.Error, evt.Message)
+		},
+	}
+
+	return events.HandleRepoStream(ctx, con, &events.SequentialScheduler{Do: callbacks.EventHandler})
+}
+
+// HandleCommit decodes a commit frame and its CAR blocks and emits an Event to every Handler
+// for each post, like, repost, follow, and list item created or deleted in the commit
+func (fh *Firehose) HandleCommit(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Commit) error {
+	tracer := otel.Tracer("firehose")
+	ctx, span := tracer.Start(ctx, "Firehose:HandleCommit")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int64("commit.seq", evt.Seq), attribute.String("commit.repo", evt.Repo))
+
+	defer atomic.StoreInt64(&fh.seq, evt.Seq)
+
+	lastSeq.Set(float64(evt.Seq))
+
+	if evt.TooBig {
+		span.SetAttributes(attribute.Bool("commit.too_big", true))
+		return nil
+	}
+
+	commitTime, err := time.Parse(time.RFC3339, evt.Time)
+	if err != nil {
+		commitTime = time.Now()
+	}
+	lag.Set(time.Since(commitTime).Seconds())
+
+	var rr *repo.Repo
+
+	for _, op := range evt.Ops {
+		collection, rkey, ok := strings.Cut(op.Path, "/")
+		if !ok {
+			continue
+		}
+
+		switch collection {
+		case CollectionPost, CollectionLike, CollectionRepost, CollectionFollow, CollectionListItem:
+		default:
+			continue
+		}
+
+		recordEvent := &Event{
+			Seq:        evt.Seq,
+			Time:       commitTime,
+			Repo:       evt.Repo,
+			Collection: collection,
+			RKey:       rkey,
+			URI:        "at://" + evt.Repo + "/" + op.Path,
+		}
+
+		switch op.Action {
+		case "create":
+			if op.Cid == nil {
+				continue
+			}
+
+			// Only read the CAR blocks once we know the commit has something we care about
+			if rr == nil {
+				rr, err = repo.ReadRepoFromCar(ctx, bytes.NewReader(evt.Blocks))
+				if err != nil {
+					span.RecordError(err)
+					return fmt.Errorf("failed to read repo from CAR for commit %d: %w", evt.Seq, err)
+				}
+			}
+
+			recordEvent.Action = ActionCreate
+			if err := decodeRecord(ctx, rr, cid.Cid(*op.Cid), recordEvent); err != nil {
+				span.RecordError(err)
+				log.Printf("failed to decode record %s: %v", recordEvent.URI, err)
+				continue
+			}
+		case "delete":
+			recordEvent.Action = ActionDelete
+		default:
+			continue
+		}
+
+		fh.emit(ctx, recordEvent)
+	}
+
+	return nil
+}
+
+// decodeRecord reads the record block from the repo and sets the typed record on the event
+func decodeRecord(ctx context.Context, rr *repo.Repo, recordCID cid.Cid, evt *Event) error {
+	blk, err := rr.Blockstore().Get(ctx, recordCID)
+	if err != nil {
+		return fmt.Errorf("failed to get record block: %w", err)
+	}
+
+	rec, err := lexutil.CborDecodeValue(blk.RawData())
+	if err != nil {
+		return fmt.Errorf("failed to decode record: %w", err)
+	}
+
+	evt.CID = recordCID.String()
+	evt.RawRecord = blk.RawData()
+
+	switch record := rec.(type) {
+	case *appbsky.FeedPost:
+		evt.Post = record
+	case *appbsky.FeedLike:
+		evt.Like = record
+	case *appbsky.FeedRepost:
+		evt.Repost = record
+	case *appbsky.GraphFollow:
+		evt.Follow = record
+	case *appbsky.GraphListitem:
+		evt.ListItem = record
+	default:
+		return fmt.Errorf("unexpected record type %T in collection %s", rec, evt.Collection)
+	}
+
+	return nil
+}
+
+// emit passes the event to every registered Handler
+func (fh *Firehose) emit(ctx context.Context, evt *Event) {
+	fh.handlersLk.RLock()
+	defer fh.handlersLk.RUnlock()
+
+	eventsProcessed.WithLabelValues(evt.Collection, string(evt.Action)).Inc()
+
+	for _, handler := range fh.handlers {
+		if err := handler.HandleEvent(ctx, evt); err != nil {
+			handlerErrors.WithLabelValues(evt.Collection).Inc()
+			log.Printf("firehose handler failed on %s: %v", evt.URI, err)
+		}
+	}
+}
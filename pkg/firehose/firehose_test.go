@@ -0,0 +1,415 @@
+package firehose
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+)
+
+var update = flag.Bool("update", false, "re-record the commit frames in testdata")
+
+// framesPath holds the recorded subscribeRepos frames, each prefixed with its uvarint length
+const framesPath = "testdata/commits.frames"
+
+const testRepo = "did:plc:firehosetest"
+
+// recordedFrame is a frame replayed by the stand-in relay
+type recordedFrame struct {
+	seq  int64
+	data []byte
+}
+
+// recordFrames builds the #commit frames of a repo that creates a post, likes it along
+// with a record in a collection the firehose skips, then deletes the post
+func recordFrames(t *testing.T) [][]byte {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	r := repo.NewRepo(ctx, testRepo, bs)
+	createdAt := "2023-06-01T00:00:00.000Z"
+
+	// The consumer doesn't verify signatures, so any bytes will do
+	signer := func(ctx context.Context, did string, data []byte) ([]byte, error) {
+		return []byte("signature"), nil
+	}
+
+	commit := func(seq int64, ops []*comatproto.SyncSubscribeRepos_RepoOp) []byte {
+		root, err := r.Commit(ctx, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		blocks := &bytes.Buffer{}
+		if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, blocks); err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := bs.AllKeysChan(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := range keys {
+			blk, err := bs.Get(ctx, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := carutil.LdWrite(blocks, k.Bytes(), blk.RawData()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		frame := &bytes.Buffer{}
+		header := events.EventHeader{Op: events.EvtKindMessage, MsgType: "#commit"}
+		if err := header.MarshalCBOR(frame); err != nil {
+			t.Fatal(err)
+		}
+
+		evt := comatproto.SyncSubscribeRepos_Commit{
+			Blobs:  []lexutil.LexLink{},
+			Blocks: blocks.Bytes(),
+			Commit: lexutil.LexLink(root),
+			Ops:    ops,
+			Repo:   testRepo,
+			Seq:    seq,
+			Time:   createdAt,
+		}
+		if err := evt.MarshalCBOR(frame); err != nil {
+			t.Fatal(err)
+		}
+
+		return frame.Bytes()
+	}
+
+	create := func(collection string, record repo.CborMarshaler) (*comatproto.SyncSubscribeRepos_RepoOp, string) {
+		recordCID, rkey, err := r.CreateRecord(ctx, collection, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		link := lexutil.LexLink(recordCID)
+		return &comatproto.SyncSubscribeRepos_RepoOp{Action: "create", Path: collection + "/" + rkey, Cid: &link}, rkey
+	}
+
+	postOp, postRKey := create(CollectionPost, &appbsky.FeedPost{
+		LexiconTypeID: CollectionPost,
+		Text:          "hello firehose",
+		CreatedAt:     createdAt,
+	})
+	frames := [][]byte{commit(101, []*comatproto.SyncSubscribeRepos_RepoOp{postOp})}
+
+	postURI := "at://" + testRepo + "/" + CollectionPost + "/" + postRKey
+	likeOp, _ := create(CollectionLike, &appbsky.FeedLike{
+		LexiconTypeID: CollectionLike,
+		Subject:       &comatproto.RepoStrongRef{Uri: postURI, Cid: postOp.Cid.String()},
+		CreatedAt:     createdAt,
+	})
+	profileOp, _ := create("app.bsky.actor.profile", &appbsky.ActorProfile{
+		LexiconTypeID: "app.bsky.actor.profile",
+	})
+	frames = append(frames, commit(102, []*comatproto.SyncSubscribeRepos_RepoOp{likeOp, profileOp}))
+
+	if err := r.DeleteRecord(ctx, CollectionPost+"/"+postRKey); err != nil {
+		t.Fatal(err)
+	}
+	frames = append(frames, commit(103, []*comatproto.SyncSubscribeRepos_RepoOp{
+		{Action: "delete", Path: CollectionPost + "/" + postRKey},
+	}))
+
+	return frames
+}
+
+// loadFrames reads the recorded frames, re-recording them first with -update
+func loadFrames(t *testing.T) []recordedFrame {
+	if *update {
+		out := &bytes.Buffer{}
+		for _, frame := range recordFrames(t) {
+			out.Write(binary.AppendUvarint(nil, uint64(len(frame))))
+			out.Write(frame)
+		}
+		if err := os.MkdirAll(filepath.Dir(framesPath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(framesPath, out.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(framesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := []recordedFrame{}
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			t.Fatal(err)
+		}
+
+		// Decode the sequence number so the relay can honor cursors
+		body := bytes.NewReader(frame)
+		var header events.EventHeader
+		if err := header.UnmarshalCBOR(body); err != nil {
+			t.Fatal(err)
+		}
+		var evt comatproto.SyncSubscribeRepos_Commit
+		if err := evt.UnmarshalCBOR(body); err != nil {
+			t.Fatal(err)
+		}
+
+		frames = append(frames, recordedFrame{seq: evt.Seq, data: frame})
+	}
+
+	return frames
+}
+
+// standInRelay is a websocket server that replays recorded frames after the requested cursor
+type standInRelay struct {
+	frames []recordedFrame
+
+	lk      sync.Mutex
+	cursors []string // cursor query param of every connection
+}
+
+func (relay *standInRelay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != subscribeReposPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	cursor := r.URL.Query().Get("cursor")
+	relay.lk.Lock()
+	relay.cursors = append(relay.cursors, cursor)
+	relay.lk.Unlock()
+
+	after := int64(-1)
+	if cursor != "" {
+		after, _ = strconv.ParseInt(cursor, 10, 64)
+	}
+
+	con, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer con.Close()
+
+	for _, frame := range relay.frames {
+		if frame.seq <= after {
+			continue
+		}
+		if err := con.WriteMessage(websocket.BinaryMessage, frame.data); err != nil {
+			return
+		}
+	}
+
+	// Hold the connection open like a live relay until the consumer goes away
+	for {
+		if _, _, err := con.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func (relay *standInRelay) connections() []string {
+	relay.lk.Lock()
+	defer relay.lk.Unlock()
+	return append([]string{}, relay.cursors...)
+}
+
+// eventRecorder is a Handler that keeps every event it receives
+type eventRecorder struct {
+	lk     sync.Mutex
+	events []*Event
+}
+
+func (er *eventRecorder) HandleEvent(ctx context.Context, evt *Event) error {
+	er.lk.Lock()
+	defer er.lk.Unlock()
+	er.events = append(er.events, evt)
+	return nil
+}
+
+func (er *eventRecorder) received() []*Event {
+	er.lk.Lock()
+	defer er.lk.Unlock()
+	return append([]*Event{}, er.events...)
+}
+
+// runFirehose runs the firehose against the relay until stop returns true
+func runFirehose(t *testing.T, fh *Firehose, cursor int64, stop func() bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 1)
+	go func() { errs <- fh.Run(ctx, cursor) }()
+
+	deadline := time.Now().Add(time.Second * 10)
+	for !stop() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the firehose")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	cancel()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestFirehose(t *testing.T, relay *standInRelay) *Firehose {
+	server := httptest.NewServer(relay)
+	t.Cleanup(server.Close)
+
+	fh, err := NewFirehose(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.CheckpointInterval = time.Millisecond * 10
+
+	return fh
+}
+
+func TestFirehoseReplay(t *testing.T) {
+	relay := &standInRelay{frames: loadFrames(t)}
+	fh := newTestFirehose(t, relay)
+
+	recorder := &eventRecorder{}
+	fh.AddHandler(recorder)
+
+	if fh.Seq() != -1 {
+		t.Fatalf("got seq %d before handling any commits, expected -1", fh.Seq())
+	}
+
+	runFirehose(t, fh, -1, func() bool { return fh.Seq() == 103 })
+
+	received := recorder.received()
+	if len(received) != 3 {
+		t.Fatalf("got %d events, expected a post, a like, and a delete: %+v", len(received), received)
+	}
+
+	post, like, deleted := received[0], received[1], received[2]
+
+	if post.Seq != 101 || post.Action != ActionCreate || post.Collection != CollectionPost || post.Repo != testRepo {
+		t.Errorf("unexpected post event %+v", post)
+	}
+	if post.Post == nil || post.Post.Text != "hello firehose" || post.CID == "" || len(post.RawRecord) == 0 {
+		t.Errorf("post event wasn't decoded: %+v", post)
+	}
+
+	if like.Seq != 102 || like.Action != ActionCreate || like.Like == nil || like.Like.Subject.Uri != post.URI {
+		t.Errorf("unexpected like event %+v", like)
+	}
+
+	if deleted.Seq != 103 || deleted.Action != ActionDelete || deleted.URI != post.URI || deleted.Post != nil {
+		t.Errorf("unexpected delete event %+v", deleted)
+	}
+
+	if cursors := relay.connections(); len(cursors) != 1 || cursors[0] != "" {
+		t.Errorf("got connections with cursors %q, expected one without a cursor", cursors)
+	}
+}
+
+func TestFirehoseResumesFromCursor(t *testing.T) {
+	relay := &standInRelay{frames: loadFrames(t)}
+	fh := newTestFirehose(t, relay)
+
+	recorder := &eventRecorder{}
+	fh.AddHandler(recorder)
+
+	runFirehose(t, fh, 102, func() bool { return fh.Seq() == 103 })
+
+	if received := recorder.received(); len(received) != 1 || received[0].Seq != 103 {
+		t.Errorf("got %d events, expected only the commit after the cursor", len(received))
+	}
+
+	if cursors := relay.connections(); len(cursors) != 1 || cursors[0] != "102" {
+		t.Errorf("got connections with cursors %q, expected 102", cursors)
+	}
+}
+
+func TestFirehoseRewindDoesNotMoveCursorBack(t *testing.T) {
+	cursors, err := NewFileCursorStore(filepath.Join(t.TempDir(), "cursor"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cursors.SetCursor(context.Background(), 103); err != nil {
+		t.Fatal(err)
+	}
+
+	// A relay with nothing to replay, so restarts handle no commits
+	for restart := 0; restart < 3; restart++ {
+		fh := newTestFirehose(t, &standInRelay{})
+		fh.CursorStore = cursors
+		fh.Rewind = 2
+
+		// Let a few checkpoints tick by before shutting down
+		started := time.Now()
+		runFirehose(t, fh, -1, func() bool { return time.Since(started) > time.Millisecond*50 })
+
+		stored, err := cursors.GetCursor(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored != 103 {
+			t.Fatalf("restart %d moved the stored cursor from 103 to %d", restart, stored)
+		}
+	}
+
+	// Replaying the rewind window re-handles the recent commits without moving the cursor back
+	relay := &standInRelay{frames: loadFrames(t)}
+	fh := newTestFirehose(t, relay)
+	fh.CursorStore = cursors
+	fh.Rewind = 2
+
+	recorder := &eventRecorder{}
+	fh.AddHandler(recorder)
+
+	runFirehose(t, fh, -1, func() bool { return fh.Seq() == 103 })
+
+	if got := relay.connections(); len(got) != 1 || got[0] != "101" {
+		t.Errorf("got connections with cursors %q, expected the stored cursor rewound to 101", got)
+	}
+	if received := recorder.received(); len(received) != 2 {
+		t.Errorf("got %d events, expected the like and the delete to be replayed", len(received))
+	}
+
+	stored, err := cursors.GetCursor(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != 103 {
+		t.Errorf("got stored cursor %d after replaying the rewind window, expected 103", stored)
+	}
+}
@@ -0,0 +1,109 @@
+package firehose
+
+import (
+	"regexp"
+	"strings"
+
+	cbornode "github.com/ipfs/go-ipld-cbor"
+)
+
+// hashtagRegex matches #words in post text, a tag needs at least one non-digit character
+var hashtagRegex = regexp.MustCompile(`(?:^|\s)#([\p{L}\p{N}_]*[\p{L}_][\p{L}\p{N}_]*)`)
+
+// rawFields decodes the raw CBOR of the record into a generic map
+// The generated lexicon types silently drop fields they don't know about,
+// so newer record fields have to be read from the raw record
+func (evt *Event) rawFields() map[string]interface{} {
+	if len(evt.RawRecord) == 0 {
+		return nil
+	}
+
+	fields := map[string]interface{}{}
+	if err := cbornode.DecodeInto(evt.RawRecord, &fields); err != nil {
+		return nil
+	}
+
+	return fields
+}
+
+// PostLangs returns the languages declared on a post record, if any
+func (evt *Event) PostLangs() []string {
+	if evt.Post == nil {
+		return nil
+	}
+
+	return stringSlice(evt.rawFields()["langs"])
+}
+
+// PostTags returns the lowercased hashtags of a post record without the leading #
+// Tags are read from app.bsky.richtext.facet#tag facets and the record's tags field,
+// falling back to #words parsed from the text for posts made by clients that don't emit tag facets
+func (evt *Event) PostTags() []string {
+	if evt.Post == nil {
+		return nil
+	}
+
+	fields := evt.rawFields()
+
+	tags := stringSlice(fields["tags"])
+
+	facets, _ := fields["facets"].([]interface{})
+	for _, facet := range facets {
+		facetFields, _ := facet.(map[string]interface{})
+		features, _ := facetFields["features"].([]interface{})
+		for _, feature := range features {
+			featureFields, _ := feature.(map[string]interface{})
+			if featureFields["$type"] != "app.bsky.richtext.facet#tag" {
+				continue
+			}
+			if tag, ok := featureFields["tag"].(string); ok {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	if len(tags) == 0 {
+		for _, match := range hashtagRegex.FindAllStringSubmatch(evt.Post.Text, -1) {
+			tags = append(tags, match[1])
+		}
+	}
+
+	return NormalizeTags(tags)
+}
+
+// NormalizeTags lowercases tags, strips any leading #, and removes empty and duplicate tags
+func NormalizeTags(tags []string) []string {
+	seen := map[string]struct{}{}
+	normalized := []string{}
+
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+		if tag == "" {
+			continue
+		}
+		if _, ok := seen[tag]; ok {
+			continue
+		}
+		seen[tag] = struct{}{}
+		normalized = append(normalized, tag)
+	}
+
+	return normalized
+}
+
+// stringSlice converts a decoded CBOR array into a slice of its string elements
+func stringSlice(v interface{}) []string {
+	elems, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	strs := []string{}
+	for _, elem := range elems {
+		if str, ok := elem.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+
+	return strs
+}
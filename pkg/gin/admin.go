@@ -0,0 +1,225 @@
+package gin
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/xrpc"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The admin API lets operators inspect and manage the feeds of a running generator
+// Its routes expect the admin_actor set by auth.AdminAuth, and every mutation is audit-logged
+
+type aliasesRequest struct {
+	Aliases []string `json:"aliases"`
+}
+
+type aliasRequest struct {
+	Alias string `json:"alias"`
+}
+
+type postRequest struct {
+	URI string `json:"uri"`
+}
+
+// ListFeeds lists every registered feed with its aliases and stats
+func (ep *Endpoints) ListFeeds(c *gin.Context) {
+	tracer := otel.Tracer("admin")
+	_, span := tracer.Start(c.Request.Context(), "Admin:ListFeeds")
+	defer span.End()
+
+	feeds := ep.FeedRouter.ListFeedInfo()
+	span.SetAttributes(attribute.Int("feeds.length", len(feeds)))
+
+	c.JSON(http.StatusOK, gin.H{"feeds": feeds})
+}
+
+// GetFeed shows a registered feed with its aliases and stats
+func (ep *Endpoints) GetFeed(c *gin.Context) {
+	tracer := otel.Tracer("admin")
+	_, span := tracer.Start(c.Request.Context(), "Admin:GetFeed")
+	defer span.End()
+
+	info, err := ep.FeedRouter.GetFeedInfo(c.Param("name"))
+	if err != nil {
+		adminError(c, span, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, info)
+}
+
+// SetFeedAliases replaces the aliases of a feed, which also reorders them
+func (ep *Endpoints) SetFeedAliases(c *gin.Context) {
+	tracer := otel.Tracer("admin")
+	_, span := tracer.Start(c.Request.Context(), "Admin:SetFeedAliases")
+	defer span.End()
+
+	req := aliasesRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.InvalidRequest, "expected a JSON body with aliases")
+		return
+	}
+
+	err := ep.FeedRouter.SetAliases(c.Param("name"), req.Aliases)
+	ep.audit(c, "set_aliases", strings.Join(req.Aliases, ","), err)
+	if err != nil {
+		adminError(c, span, err)
+		return
+	}
+
+	ep.GetFeed(c)
+}
+
+// AddFeedAlias adds an alias to a feed
+func (ep *Endpoints) AddFeedAlias(c *gin.Context) {
+	tracer := otel.Tracer("admin")
+	_, span := tracer.Start(c.Request.Context(), "Admin:AddFeedAlias")
+	defer span.End()
+
+	req := aliasRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Alias == "" {
+		xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.InvalidRequest, "expected a JSON body with an alias")
+		return
+	}
+
+	err := ep.FeedRouter.AddAlias(c.Param("name"), req.Alias)
+	ep.audit(c, "add_alias", req.Alias, err)
+	if err != nil {
+		adminError(c, span, err)
+		return
+	}
+
+	ep.GetFeed(c)
+}
+
+// RemoveFeedAlias removes an alias from a feed
+func (ep *Endpoints) RemoveFeedAlias(c *gin.Context) {
+	tracer := otel.Tracer("admin")
+	_, span := tracer.Start(c.Request.Context(), "Admin:RemoveFeedAlias")
+	defer span.End()
+
+	alias := c.Param("alias")
+
+	err := ep.FeedRouter.RemoveAlias(c.Param("name"), alias)
+	ep.audit(c, "remove_alias", alias, err)
+	if err != nil {
+		adminError(c, span, err)
+		return
+	}
+
+	ep.GetFeed(c)
+}
+
+// PinFeedPost pins a post to the top of a feed
+func (ep *Endpoints) PinFeedPost(c *gin.Context) {
+	ep.changeFeedPost(c, "Admin:PinFeedPost", "pin_post", ep.FeedRouter.PinPost)
+}
+
+// UnpinFeedPost unpins a post from a feed, the post URI is given in the uri query parameter
+func (ep *Endpoints) UnpinFeedPost(c *gin.Context) {
+	ep.changeFeedPost(c, "Admin:UnpinFeedPost", "unpin_post", ep.FeedRouter.UnpinPost)
+}
+
+// RemoveFeedPost stops a feed from serving a post
+func (ep *Endpoints) RemoveFeedPost(c *gin.Context) {
+	ep.changeFeedPost(c, "Admin:RemoveFeedPost", "remove_post", ep.FeedRouter.RemovePost)
+}
+
+// RestoreFeedPost lets a feed serve a removed post again, the post URI is given in the uri query parameter
+func (ep *Endpoints) RestoreFeedPost(c *gin.Context) {
+	ep.changeFeedPost(c, "Admin:RestoreFeedPost", "restore_post", ep.FeedRouter.RestorePost)
+}
+
+// changeFeedPost applies a post override to a feed
+// The post URI comes from the JSON body, or the uri query parameter since AT-URIs don't fit in a path segment
+func (ep *Endpoints) changeFeedPost(c *gin.Context, spanName string, action string, change func(name string, uri string) error) {
+	tracer := otel.Tracer("admin")
+	_, span := tracer.Start(c.Request.Context(), spanName)
+	defer span.End()
+
+	uri := c.Query("uri")
+	if uri == "" {
+		req := postRequest{}
+		if err := c.ShouldBindJSON(&req); err == nil {
+			uri = req.URI
+		}
+	}
+
+	if !strings.HasPrefix(uri, "at://") {
+		xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.InvalidRequest, "expected a post AT-URI in the uri query parameter or JSON body")
+		return
+	}
+
+	span.SetAttributes(attribute.String("post.uri", uri))
+
+	err := change(c.Param("name"), uri)
+	ep.audit(c, action, uri, err)
+	if err != nil {
+		adminError(c, span, err)
+		return
+	}
+
+	ep.GetFeed(c)
+}
+
+// ReindexFeed asks a feed to rebuild its index
+func (ep *Endpoints) ReindexFeed(c *gin.Context) {
+	tracer := otel.Tracer("admin")
+	ctx, span := tracer.Start(c.Request.Context(), "Admin:ReindexFeed")
+	defer span.End()
+
+	name := c.Param("name")
+
+	info, err := ep.FeedRouter.GetFeedInfo(name)
+	if err != nil {
+		adminError(c, span, err)
+		return
+	}
+
+	if !info.Reindexable {
+		xrpc.AbortWithError(c, http.StatusConflict, xrpc.InvalidRequest, "feed "+name+" doesn't support reindexing")
+		return
+	}
+
+	err = ep.FeedRouter.Reindex(ctx, name)
+	ep.audit(c, "reindex", "", err)
+	if err != nil {
+		span.RecordError(err)
+		xrpc.AbortWithError(c, http.StatusInternalServerError, xrpc.InternalServerError, err.Error())
+		return
+	}
+
+	ep.GetFeed(c)
+}
+
+// audit logs an admin mutation along with who made it and whether it succeeded
+// Everything but the action comes from the caller, so it's quoted to keep it from forging audit lines
+func (ep *Endpoints) audit(c *gin.Context, action string, target string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error: " + err.Error()
+	}
+
+	log.Printf("admin audit: actor=%q action=%s feed=%q target=%q result=%q remote=%q",
+		c.GetString("admin_actor"), action, c.Param("name"), target, result, c.ClientIP())
+}
+
+// adminError responds with 404 for unknown feeds and 400 for everything else
+func adminError(c *gin.Context, span trace.Span, err error) {
+	var notFoundErr feedrouter.NotFoundError
+	if errors.As(err, &notFoundErr) {
+		xrpc.AbortWithError(c, http.StatusNotFound, xrpc.NotFound, err.Error())
+		return
+	}
+
+	span.RecordError(err)
+	xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.InvalidRequest, err.Error())
+}
@@ -0,0 +1,311 @@
+package gin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/auth"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feeds/static"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/xrpc"
+)
+
+const tokenAuth = "Bearer " + adminToken
+
+// reindexFeed is a static feed that counts its reindexes
+type reindexFeed struct {
+	*static.StaticFeed
+	reindexes int
+	err       error // returned by Reindex if set
+}
+
+func (rf *reindexFeed) Reindex(ctx context.Context) error {
+	rf.reindexes++
+	return rf.err
+}
+
+// addStaticFeed registers a static feed serving the posts under the given name
+func addStaticFeed(t *testing.T, ts *testServer, name string, posts ...string) *static.StaticFeed {
+	feed, aliases, err := static.NewStaticFeed(context.Background(), feedActorDID, name, posts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.router.AddFeed(aliases, feed)
+
+	return feed
+}
+
+// getFeedInfo serves an admin request and decodes the FeedInfo it responds with
+func getFeedInfo(t *testing.T, ts *testServer, method string, target string, body any) feedrouter.FeedInfo {
+	t.Helper()
+
+	w := ts.do(t, method, target, tokenAuth, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s %s: got status %d: %s", method, target, w.Code, w.Body.String())
+	}
+
+	info := feedrouter.FeedInfo{}
+	decode(t, w, &info)
+
+	return info
+}
+
+// auditLine returns the audit line for an admin mutation made with the admin token
+func auditLine(action string, feed string, target string, result string) string {
+	return fmt.Sprintf(`admin audit: actor="token" action=%s feed=%q target=%q result=%q remote="192.0.2.1"`, action, feed, target, result)
+}
+
+func expectAudit(t *testing.T, logs fmt.Stringer, expected ...string) {
+	t.Helper()
+
+	lines := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if _, audit, ok := strings.Cut(line, "admin audit: "); ok {
+			lines = append(lines, "admin audit: "+audit)
+		}
+	}
+
+	if got, want := strings.Join(lines, "\n"), strings.Join(expected, "\n"); got != want {
+		t.Errorf("got audit lines\n%s\nexpected\n%s", got, want)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	ts := newTestServer(t)
+	addStaticFeed(t, ts, "a")
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+		errName       string
+	}{
+		{name: "no credentials", status: http.StatusUnauthorized, errName: xrpc.AuthRequired},
+		{name: "not a bearer token", authorization: "Basic " + adminToken, status: http.StatusUnauthorized, errName: xrpc.AuthRequired},
+		{name: "wrong token", authorization: "Bearer not-the-token", status: http.StatusUnauthorized, errName: xrpc.AuthRequired},
+		{name: "viewer's feed token", authorization: ts.bearer(t, adminDID, "app.bsky.feed.getFeedSkeleton"), status: http.StatusUnauthorized, errName: xrpc.AuthRequired},
+		{name: "not an admin", authorization: ts.bearer(t, viewerDID, auth.AdminLexiconMethod), status: http.StatusForbidden, errName: xrpc.Forbidden},
+		{name: "admin token", authorization: tokenAuth, status: http.StatusOK},
+		{name: "admin JWT", authorization: ts.bearer(t, adminDID, auth.AdminLexiconMethod), status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logs := captureLog(t)
+
+			// A mutation, so refused requests can be checked for never reaching the handler
+			w := ts.do(t, http.MethodPost, "/admin/feeds/a/aliases", test.authorization, map[string]string{"alias": "b"})
+			if test.status != http.StatusOK {
+				expectError(t, w, test.status, test.errName)
+				expectAudit(t, logs)
+				return
+			}
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+			}
+			if !strings.Contains(logs.String(), "action=add_alias") {
+				t.Errorf("got logs %q, expected the change to be audited", logs)
+			}
+
+			if err := ts.router.RemoveAlias("a", "b"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	// The audit line names the admin that made the change
+	logs := captureLog(t)
+	ts.do(t, http.MethodPost, "/admin/feeds/a/aliases", ts.bearer(t, adminDID, auth.AdminLexiconMethod), map[string]string{"alias": "c"})
+	if expected := fmt.Sprintf("actor=%q action=add_alias", adminDID); !strings.Contains(logs.String(), expected) {
+		t.Errorf("got logs %q, expected %s", logs, expected)
+	}
+}
+
+func TestAdminListAndStats(t *testing.T) {
+	ts := newTestServer(t)
+	addStaticFeed(t, ts, "a", "at://did:plc:author/app.bsky.feed.post/1", "at://did:plc:author/app.bsky.feed.post/2")
+	addStaticFeed(t, ts, "b")
+
+	for _, limit := range []int{1, 10} {
+		w := ts.do(t, http.MethodGet, fmt.Sprintf("/xrpc/app.bsky.feed.getFeedSkeleton?feed=%sa&limit=%d", feedPrefix, limit), "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+	}
+	ts.do(t, http.MethodGet, "/xrpc/app.bsky.feed.getFeedSkeleton?feed="+feedPrefix+"a&cursor=nope", "", nil)
+
+	w := ts.do(t, http.MethodGet, "/admin/feeds", tokenAuth, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+
+	list := struct {
+		Feeds []feedrouter.FeedInfo `json:"feeds"`
+	}{}
+	decode(t, w, &list)
+
+	if len(list.Feeds) != 2 || list.Feeds[0].Name != "a" || list.Feeds[1].Name != "b" {
+		t.Fatalf("got feeds %+v, expected a and b in order", list.Feeds)
+	}
+
+	a := list.Feeds[0]
+	if a.Type != "*static.StaticFeed" || !reflect.DeepEqual(a.Aliases, []string{"a"}) || a.Reindexable {
+		t.Errorf("got feed %+v", a)
+	}
+
+	stats := a.Stats
+	if stats.Requests != 3 || stats.Errors != 1 || stats.PostsServed != 3 || stats.InFlight != 0 || stats.LastRequest == nil {
+		t.Errorf("got stats %+v, expected 3 requests, 1 error, and 3 posts served", stats)
+	}
+	if b := list.Feeds[1].Stats; b.Requests != 0 || b.LastRequest != nil {
+		t.Errorf("got stats %+v for a feed that was never requested", b)
+	}
+
+	if info := getFeedInfo(t, ts, http.MethodGet, "/admin/feeds/a", nil); info.Stats.Requests != 3 {
+		t.Errorf("got feed %+v, expected the stats of feed a", info)
+	}
+	expectError(t, ts.do(t, http.MethodGet, "/admin/feeds/missing", tokenAuth, nil), http.StatusNotFound, xrpc.NotFound)
+}
+
+func TestAdminAliases(t *testing.T) {
+	ts := newTestServer(t)
+	addStaticFeed(t, ts, "a")
+	addStaticFeed(t, ts, "b")
+	logs := captureLog(t)
+
+	info := getFeedInfo(t, ts, http.MethodPost, "/admin/feeds/a/aliases", map[string]string{"alias": "x"})
+	if !reflect.DeepEqual(info.Aliases, []string{"a", "x"}) {
+		t.Errorf("got aliases %v after adding x", info.Aliases)
+	}
+
+	info = getFeedInfo(t, ts, http.MethodPut, "/admin/feeds/a/aliases", map[string][]string{"aliases": {"x", "a", "y"}})
+	if !reflect.DeepEqual(info.Aliases, []string{"x", "a", "y"}) {
+		t.Errorf("got aliases %v after reordering", info.Aliases)
+	}
+
+	info = getFeedInfo(t, ts, http.MethodDelete, "/admin/feeds/a/aliases/y", nil)
+	if !reflect.DeepEqual(info.Aliases, []string{"x", "a"}) {
+		t.Errorf("got aliases %v after removing y", info.Aliases)
+	}
+
+	// The new alias is served
+	if w := ts.do(t, http.MethodGet, "/xrpc/app.bsky.feed.getFeedSkeleton?feed="+feedPrefix+"x", "", nil); w.Code != http.StatusOK {
+		t.Errorf("got status %d for the added alias: %s", w.Code, w.Body.String())
+	}
+
+	// Failed changes are refused and audited with their error
+	expectError(t, ts.do(t, http.MethodPost, "/admin/feeds/missing/aliases", tokenAuth, map[string]string{"alias": "z"}), http.StatusNotFound, xrpc.NotFound)
+	expectError(t, ts.do(t, http.MethodPut, "/admin/feeds/b/aliases", tokenAuth, map[string][]string{"aliases": {"b", "b"}}), http.StatusBadRequest, xrpc.InvalidRequest)
+
+	// Malformed requests never reach the router, so they aren't audited
+	expectError(t, ts.do(t, http.MethodPost, "/admin/feeds/a/aliases", tokenAuth, map[string]string{}), http.StatusBadRequest, xrpc.InvalidRequest)
+
+	expectAudit(t, logs,
+		auditLine("add_alias", "a", "x", "ok"),
+		auditLine("set_aliases", "a", "x,a,y", "ok"),
+		auditLine("remove_alias", "a", "y", "ok"),
+		auditLine("add_alias", "missing", "z", "error: no feed is registered as missing"),
+		auditLine("set_aliases", "b", "b,b", "error: alias b is listed more than once"),
+	)
+}
+
+func TestAdminPosts(t *testing.T) {
+	const (
+		first  = "at://did:plc:author/app.bsky.feed.post/1"
+		second = "at://did:plc:author/app.bsky.feed.post/2"
+		pinned = "at://did:plc:author/app.bsky.feed.post/pinned"
+	)
+
+	ts := newTestServer(t)
+	addStaticFeed(t, ts, "a", first, second)
+	logs := captureLog(t)
+
+	skeleton := func() []string {
+		w := ts.do(t, http.MethodGet, "/xrpc/app.bsky.feed.getFeedSkeleton?feed="+feedPrefix+"a", "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+
+		resp := feedrouter.Skeleton{}
+		decode(t, w, &resp)
+
+		posts := []string{}
+		for _, post := range resp.Feed {
+			if post.Reason != nil && post.Reason.Pin {
+				posts = append(posts, "pin:"+post.Post)
+				continue
+			}
+			posts = append(posts, post.Post)
+		}
+		return posts
+	}
+
+	info := getFeedInfo(t, ts, http.MethodPost, "/admin/feeds/a/pinned", map[string]string{"uri": pinned})
+	if !reflect.DeepEqual(info.PinnedPosts, []string{pinned}) {
+		t.Errorf("got pinned posts %v", info.PinnedPosts)
+	}
+
+	info = getFeedInfo(t, ts, http.MethodPost, "/admin/feeds/a/removed?uri="+url.QueryEscape(first), nil)
+	if !reflect.DeepEqual(info.RemovedPosts, []string{first}) {
+		t.Errorf("got removed posts %v", info.RemovedPosts)
+	}
+
+	if posts := skeleton(); !reflect.DeepEqual(posts, []string{"pin:" + pinned, second}) {
+		t.Errorf("got posts %v with a pinned and a removed post", posts)
+	}
+
+	getFeedInfo(t, ts, http.MethodDelete, "/admin/feeds/a/pinned?uri="+url.QueryEscape(pinned), nil)
+	getFeedInfo(t, ts, http.MethodDelete, "/admin/feeds/a/removed?uri="+url.QueryEscape(first), nil)
+
+	if posts := skeleton(); !reflect.DeepEqual(posts, []string{first, second}) {
+		t.Errorf("got posts %v after unpinning and restoring", posts)
+	}
+
+	expectError(t, ts.do(t, http.MethodPost, "/admin/feeds/a/pinned", tokenAuth, map[string]string{"uri": "not an AT-URI"}), http.StatusBadRequest, xrpc.InvalidRequest)
+	expectError(t, ts.do(t, http.MethodPost, "/admin/feeds/missing/removed", tokenAuth, map[string]string{"uri": first}), http.StatusNotFound, xrpc.NotFound)
+
+	expectAudit(t, logs,
+		auditLine("pin_post", "a", pinned, "ok"),
+		auditLine("remove_post", "a", first, "ok"),
+		auditLine("unpin_post", "a", pinned, "ok"),
+		auditLine("restore_post", "a", first, "ok"),
+		auditLine("remove_post", "missing", first, "error: no feed is registered as missing"),
+	)
+}
+
+func TestAdminReindex(t *testing.T) {
+	ts := newTestServer(t)
+	addStaticFeed(t, ts, "plain")
+
+	feed, _, err := static.NewStaticFeed(context.Background(), feedActorDID, "indexed", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexed := &reindexFeed{StaticFeed: feed}
+	ts.router.AddFeed([]string{"indexed"}, indexed)
+
+	logs := captureLog(t)
+
+	info := getFeedInfo(t, ts, http.MethodPost, "/admin/feeds/indexed/reindex", nil)
+	if !info.Reindexable || indexed.reindexes != 1 {
+		t.Errorf("got feed %+v after %d reindexes, expected one", info, indexed.reindexes)
+	}
+
+	indexed.err = errors.New("list is gone")
+	expectError(t, ts.do(t, http.MethodPost, "/admin/feeds/indexed/reindex", tokenAuth, nil), http.StatusInternalServerError, xrpc.InternalServerError)
+
+	expectError(t, ts.do(t, http.MethodPost, "/admin/feeds/plain/reindex", tokenAuth, nil), http.StatusConflict, xrpc.InvalidRequest)
+	expectError(t, ts.do(t, http.MethodPost, "/admin/feeds/missing/reindex", tokenAuth, nil), http.StatusNotFound, xrpc.NotFound)
+
+	expectAudit(t, logs,
+		auditLine("reindex", "indexed", "", "ok"),
+		auditLine("reindex", "indexed", "", "error: list is gone"),
+	)
+}
@@ -1,21 +1,28 @@
 package gin
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	appbsky "github.com/bluesky-social/indigo/api/bsky"
 	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/store"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/xrpc"
 	"github.com/gin-gonic/gin"
 	"github.com/whyrusleeping/go-did"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Endpoints struct {
-	FeedRouter *feedrouter.FeedRouter
+	FeedRouter       *feedrouter.FeedRouter
+	InteractionStore store.InteractionStore // Stores interactions viewers send, they aren't stored if nil
 }
 
 type DidResponse struct {
@@ -52,11 +59,11 @@ func (ep *Endpoints) DescribeFeeds(c *gin.Context) {
 
 	feedDescriptions := []*appbsky.FeedDescribeFeedGenerator_Feed{}
 
-	for _, feed := range ep.FeedRouter.Feeds {
+	for _, feed := range ep.FeedRouter.ListFeeds() {
 		newDescriptions, err := feed.Describe(ctx)
 		if err != nil {
 			span.RecordError(err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			xrpc.AbortWithError(c, http.StatusInternalServerError, xrpc.InternalServerError, err.Error())
 			return
 		}
 
@@ -73,6 +80,16 @@ func (ep *Endpoints) DescribeFeeds(c *gin.Context) {
 		Feeds: feedDescriptions,
 	}
 
+	if links := ep.FeedRouter.Links(); links.PrivacyPolicy != "" || links.TermsOfService != "" {
+		feedGeneratorDescription.Links = &appbsky.FeedDescribeFeedGenerator_Links{}
+		if links.PrivacyPolicy != "" {
+			feedGeneratorDescription.Links.PrivacyPolicy = &links.PrivacyPolicy
+		}
+		if links.TermsOfService != "" {
+			feedGeneratorDescription.Links.TermsOfService = &links.TermsOfService
+		}
+	}
+
 	c.JSON(http.StatusOK, feedGeneratorDescription)
 }
 
@@ -91,7 +108,7 @@ func (ep *Endpoints) GetFeedSkeleton(c *gin.Context) {
 
 	feedQuery := c.Query("feed")
 	if feedQuery == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "feed query parameter is required"})
+		xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.InvalidRequest, "feed query parameter is required")
 		return
 	}
 
@@ -107,21 +124,21 @@ func (ep *Endpoints) GetFeedSkeleton(c *gin.Context) {
 	}
 
 	if feedPrefix == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "this feed generator does not serve feeds for the given DID"})
+		xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.UnknownFeed, "this feed generator does not serve feeds for the given DID")
 		return
 	}
 
 	// Get the feed name from the query
 	feedName := strings.TrimPrefix(feedQuery, feedPrefix)
 	if feedName == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "feed name is required"})
+		xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.InvalidRequest, "feed name is required")
 		return
 	}
 
 	span.SetAttributes(attribute.String("feed.name", feedName))
 	c.Set("feedName", feedName)
 
-	// Get the limit from the query, default to 50, maximum of 250
+	// Get the limit from the query, default to 50, clamped between 1 and 250
 	limit := int64(50)
 	limitQuery := c.Query("limit")
 	span.SetAttributes(attribute.String("feed.limit.raw", limitQuery))
@@ -136,6 +153,10 @@ func (ep *Endpoints) GetFeedSkeleton(c *gin.Context) {
 				span.SetAttributes(attribute.Bool("feed.limit.clamped", true))
 				limit = 250
 			}
+			if limit < 1 {
+				span.SetAttributes(attribute.Bool("feed.limit.clamped", true))
+				limit = 1
+			}
 		}
 	}
 
@@ -145,29 +166,153 @@ func (ep *Endpoints) GetFeedSkeleton(c *gin.Context) {
 	cursor := c.Query("cursor")
 	c.Set("cursor", cursor)
 
-	if ep.FeedRouter.FeedMap == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "feed generator has no feeds configured"})
+	// Get the feed items, going through the router so feeds being replaced finish this request first
+	skeleton, err := ep.FeedRouter.GetSkeleton(ctx, feedName, userDID, limit, cursor)
+	if err != nil {
+		feedError(c, span, err)
 		return
 	}
 
-	feed, ok := ep.FeedRouter.FeedMap[feedName]
-	if !ok {
-		c.JSON(http.StatusNotFound, gin.H{"error": "feed not found"})
+	span.SetAttributes(attribute.Int("feed.items.length", len(skeleton.Feed)), attribute.String("feed.req_id", skeleton.ReqID))
+
+	c.JSON(http.StatusOK, skeleton)
+}
+
+// Limits on the interactions a viewer can send in one request
+const (
+	maxInteractions       = 1000
+	maxInteractionItemLen = 8192
+
+	// Room for maxInteractions of the longest valid interactions, so the body is never decoded past what could pass
+	maxInteractionsBodySize = maxInteractions * (maxInteractionItemLen + feedrouter.MaxFeedContextLength + feedrouter.MaxReqIDLength + 256)
+)
+
+// SendInteractionsInput is the body of app.bsky.feed.sendInteractions
+type SendInteractionsInput struct {
+	Interactions []SendInteractionsInteraction `json:"interactions"`
+}
+
+// SendInteractionsInteraction is an app.bsky.feed.defs#interaction
+type SendInteractionsInteraction struct {
+	Item        string `json:"item"`
+	Event       string `json:"event"`
+	FeedContext string `json:"feedContext,omitempty"`
+	ReqID       string `json:"reqId,omitempty"`
+}
+
+func (ep *Endpoints) SendInteractions(c *gin.Context) {
+	tracer := otel.Tracer("feed-generator")
+	ctx, span := tracer.Start(c.Request.Context(), "FeedGenerator:SendInteractions")
+	defer span.End()
+
+	// Interactions only mean something for a known viewer
+	userDID := c.GetString("user_did")
+	if userDID == "" {
+		xrpc.AbortWithError(c, http.StatusUnauthorized, xrpc.AuthRequired, "authentication is required to send interactions")
 		return
 	}
 
-	// Get the feed items
-	feedItems, newCursor, err := feed.GetPage(ctx, feedName, userDID, limit, cursor)
-	if err != nil {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxInteractionsBodySize)
+
+	var input SendInteractionsInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			xrpc.AbortWithError(c, http.StatusRequestEntityTooLarge, xrpc.InvalidRequest, fmt.Sprintf("request body must be at most %d bytes", maxBytesErr.Limit))
+			return
+		}
+		xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.InvalidRequest, fmt.Sprintf("invalid request body: %s", err.Error()))
+		return
+	}
+
+	if len(input.Interactions) > maxInteractions {
+		xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.InvalidRequest, fmt.Sprintf("at most %d interactions can be sent at once", maxInteractions))
+		return
+	}
+
+	now := time.Now()
+	interactions := []*store.Interaction{}
+	for i, interaction := range input.Interactions {
+		if !strings.HasPrefix(interaction.Item, "at://") || len(interaction.Item) > maxInteractionItemLen {
+			xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.InvalidRequest, fmt.Sprintf("interactions[%d].item must be an AT-URI", i))
+			return
+		}
+		if interaction.Event == "" {
+			xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.InvalidRequest, fmt.Sprintf("interactions[%d].event is required", i))
+			return
+		}
+		if len(interaction.FeedContext) > feedrouter.MaxFeedContextLength {
+			xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.InvalidRequest, fmt.Sprintf("interactions[%d].feedContext must be at most %d characters", i, feedrouter.MaxFeedContextLength))
+			return
+		}
+		if len(interaction.ReqID) > feedrouter.MaxReqIDLength {
+			xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.InvalidRequest, fmt.Sprintf("interactions[%d].reqId must be at most %d characters", i, feedrouter.MaxReqIDLength))
+			return
+		}
+
+		// The lexicon's event list is open, skip events from newer clients we don't understand
+		if !store.KnownInteractionEvents[interaction.Event] {
+			continue
+		}
+
+		interactions = append(interactions, &store.Interaction{
+			Viewer:      userDID,
+			Item:        interaction.Item,
+			Event:       interaction.Event,
+			FeedContext: interaction.FeedContext,
+			ReqID:       interaction.ReqID,
+			CreatedAt:   now,
+		})
+	}
+
+	span.SetAttributes(attribute.Int("interactions.received", len(input.Interactions)), attribute.Int("interactions.accepted", len(interactions)))
+
+	// A feed failing to handle interactions isn't the viewer's problem, so it's only logged
+	if err := ep.FeedRouter.HandleInteractions(ctx, userDID, interactions); err != nil {
 		span.RecordError(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to get feed items: %s", err.Error())})
+		log.Printf("error handling interactions from %s: %+v", userDID, err)
+	}
+
+	if ep.InteractionStore != nil {
+		if err := ep.InteractionStore.InsertInteractions(ctx, interactions); err != nil {
+			span.RecordError(err)
+			xrpc.AbortWithError(c, http.StatusInternalServerError, xrpc.InternalServerError, fmt.Sprintf("failed to store interactions: %s", err.Error()))
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// NoRoute responds to requests for routes the service doesn't have, XRPC methods it doesn't implement get a 501
+func (ep *Endpoints) NoRoute(c *gin.Context) {
+	if strings.HasPrefix(c.Request.URL.Path, "/xrpc/") {
+		xrpc.AbortWithError(c, http.StatusNotImplemented, xrpc.MethodNotImplemented, "method not implemented")
 		return
 	}
 
-	span.SetAttributes(attribute.Int("feed.items.length", len(feedItems)))
+	xrpc.AbortWithError(c, http.StatusNotFound, xrpc.NotFound, "not found")
+}
 
-	c.JSON(http.StatusOK, appbsky.FeedGetFeedSkeleton_Output{
-		Feed:   feedItems,
-		Cursor: newCursor,
-	})
+// feedError responds with the XRPC error for an error from a Feed
+// Feeds return typed errors from the feedrouter package for anything that isn't the service's fault
+func feedError(c *gin.Context, span trace.Span, err error) {
+	var notFoundErr feedrouter.NotFoundError
+	var authRequiredErr feedrouter.AuthRequiredError
+	var invalidRequestErr feedrouter.InvalidRequestError
+	var invalidCursorErr store.InvalidCursorError
+
+	switch {
+	case errors.As(err, &notFoundErr):
+		xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.UnknownFeed, notFoundErr.Error())
+	case errors.As(err, &authRequiredErr):
+		xrpc.AbortWithError(c, http.StatusUnauthorized, xrpc.AuthRequired, authRequiredErr.Error())
+	case errors.As(err, &invalidRequestErr):
+		xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.InvalidRequest, invalidRequestErr.Error())
+	case errors.As(err, &invalidCursorErr):
+		xrpc.AbortWithError(c, http.StatusBadRequest, xrpc.InvalidRequest, invalidCursorErr.Error())
+	default:
+		span.RecordError(err)
+		xrpc.AbortWithError(c, http.StatusInternalServerError, xrpc.InternalServerError, fmt.Sprintf("failed to get feed items: %s", err.Error()))
+	}
 }
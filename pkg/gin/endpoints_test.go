@@ -0,0 +1,660 @@
+package gin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/store"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/xrpc"
+)
+
+const skeletonPath = "/xrpc/app.bsky.feed.getFeedSkeleton?feed=" + feedPrefix
+
+// viewerFeed serves one post and remembers the viewer of its last request
+type viewerFeed struct {
+	authMode feedrouter.AuthMode
+	requests int
+	viewer   string
+}
+
+func (vf *viewerFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	vf.requests++
+	vf.viewer = userDID
+	return []*appbsky.FeedDefs_SkeletonFeedPost{{Post: "at://did:plc:author/app.bsky.feed.post/1"}}, nil, nil
+}
+
+func (vf *viewerFeed) Describe(ctx context.Context) ([]appbsky.FeedDescribeFeedGenerator_Feed, error) {
+	return nil, nil
+}
+
+func (vf *viewerFeed) AuthMode() feedrouter.AuthMode {
+	return vf.authMode
+}
+
+func TestGetFeedSkeletonAuthModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     feedrouter.AuthMode
+		viewer   string // viewer the request is authenticated as, anonymous if empty
+		status   int
+		expected string // viewer the feed is given
+	}{
+		{name: "preferred anonymous", mode: feedrouter.AuthPreferred, status: http.StatusOK},
+		{name: "preferred authenticated", mode: feedrouter.AuthPreferred, viewer: viewerDID, status: http.StatusOK, expected: viewerDID},
+		{name: "required anonymous", mode: feedrouter.AuthRequired, status: http.StatusUnauthorized},
+		{name: "required authenticated", mode: feedrouter.AuthRequired, viewer: viewerDID, status: http.StatusOK, expected: viewerDID},
+		{name: "ignored anonymous", mode: feedrouter.AuthIgnored, status: http.StatusOK},
+		{name: "ignored authenticated", mode: feedrouter.AuthIgnored, viewer: viewerDID, status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			feed := &viewerFeed{authMode: test.mode, viewer: "unset"}
+			ts.router.AddFeed([]string{"feed"}, feed)
+
+			authorization := ""
+			if test.viewer != "" {
+				authorization = ts.bearer(t, test.viewer, "app.bsky.feed.getFeedSkeleton")
+			}
+
+			w := ts.do(t, http.MethodGet, skeletonPath+"feed", authorization, nil)
+			if test.status != http.StatusOK {
+				expectError(t, w, test.status, xrpc.AuthRequired)
+				if feed.requests != 0 {
+					t.Errorf("feed was asked for a page %d times for a refused viewer", feed.requests)
+				}
+				return
+			}
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+			}
+			if feed.requests != 1 || feed.viewer != test.expected {
+				t.Errorf("got viewer %q after %d requests, expected %q", feed.viewer, feed.requests, test.expected)
+			}
+		})
+	}
+}
+
+func TestGetFeedSkeletonRequireAuth(t *testing.T) {
+	ts := newTestServer(t)
+	feed := &viewerFeed{authMode: feedrouter.AuthIgnored}
+	ts.router.AddFeed([]string{"feed"}, feed)
+
+	// Feeds serve anonymous viewers until RequireAuth is switched on, even feeds that ignore auth
+	if w := ts.do(t, http.MethodGet, skeletonPath+"feed", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("got status %d for an anonymous viewer: %s", w.Code, w.Body.String())
+	}
+
+	ts.auth.RequireAuth = true
+
+	expectError(t, ts.do(t, http.MethodGet, skeletonPath+"feed", "", nil), http.StatusUnauthorized, xrpc.AuthRequired)
+	if feed.requests != 1 {
+		t.Errorf("feed was asked for %d pages, expected the anonymous request to be refused before reaching it", feed.requests)
+	}
+
+	if w := ts.do(t, http.MethodGet, skeletonPath+"feed", ts.bearer(t, viewerDID, "app.bsky.feed.getFeedSkeleton"), nil); w.Code != http.StatusOK {
+		t.Fatalf("got status %d for an authenticated viewer: %s", w.Code, w.Body.String())
+	}
+
+	// Invalid tokens are refused whether or not auth is required, rather than served anonymously
+	ts.auth.RequireAuth = false
+	for _, authorization := range []string{
+		"Bearer not-a-jwt",
+		ts.bearer(t, viewerDID, "app.bsky.feed.sendInteractions"),
+	} {
+		expectError(t, ts.do(t, http.MethodGet, skeletonPath+"feed", authorization, nil), http.StatusUnauthorized, xrpc.AuthRequired)
+	}
+	if feed.requests != 2 {
+		t.Errorf("feed was asked for %d pages, expected requests with invalid tokens to be refused", feed.requests)
+	}
+}
+
+func TestGetFeedSkeletonConfigAuthOverride(t *testing.T) {
+	ts := newTestServer(t)
+
+	config, err := feedrouter.ParseConfig([]byte("feeds:\n  - {type: static, name: feed, auth: required, params: {posts: [at://did:plc:author/app.bsky.feed.post/1]}}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.router.LoadFeeds(context.Background(), &feedrouter.FeedEnv{FeedActorDID: feedActorDID, Router: ts.router}, config); err != nil {
+		t.Fatal(err)
+	}
+
+	// Static feeds are preferred on their own, the config makes this one required
+	expectError(t, ts.do(t, http.MethodGet, skeletonPath+"feed", "", nil), http.StatusUnauthorized, xrpc.AuthRequired)
+
+	if w := ts.do(t, http.MethodGet, skeletonPath+"feed", ts.bearer(t, viewerDID, "app.bsky.feed.getFeedSkeleton"), nil); w.Code != http.StatusOK {
+		t.Fatalf("got status %d for an authenticated viewer: %s", w.Code, w.Body.String())
+	}
+}
+
+// errorFeed fails every request with its error
+type errorFeed struct {
+	err error
+}
+
+func (ef *errorFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	return nil, nil, ef.err
+}
+
+func (ef *errorFeed) Describe(ctx context.Context) ([]appbsky.FeedDescribeFeedGenerator_Feed, error) {
+	return nil, nil
+}
+
+func TestFeedErrors(t *testing.T) {
+	_, _, cursorErr := store.DecodeCursor("nope")
+	if !errors.As(cursorErr, &store.InvalidCursorError{}) {
+		t.Fatalf("got error %v decoding a malformed cursor, expected an InvalidCursorError", cursorErr)
+	}
+
+	tests := []struct {
+		name    string
+		err     error
+		status  int
+		errName string
+		message string
+	}{
+		{
+			name:    "not found",
+			err:     feedrouter.NewNotFoundError("list is gone"),
+			status:  http.StatusBadRequest,
+			errName: xrpc.UnknownFeed,
+			message: "list is gone",
+		},
+		{
+			name:    "wrapped not found",
+			err:     fmt.Errorf("error loading child: %w", feedrouter.NewNotFoundError("list is gone")),
+			status:  http.StatusBadRequest,
+			errName: xrpc.UnknownFeed,
+			message: "list is gone",
+		},
+		{
+			name:    "auth required",
+			err:     feedrouter.NewAuthRequiredError("who are you"),
+			status:  http.StatusUnauthorized,
+			errName: xrpc.AuthRequired,
+			message: "who are you",
+		},
+		{
+			name:    "invalid request",
+			err:     feedrouter.NewInvalidRequestError("cursor is not an integer: %w", errors.New("nope")),
+			status:  http.StatusBadRequest,
+			errName: xrpc.InvalidRequest,
+			message: "cursor is not an integer: nope",
+		},
+		{
+			name:    "invalid cursor",
+			err:     fmt.Errorf("error querying posts: %w", cursorErr),
+			status:  http.StatusBadRequest,
+			errName: xrpc.InvalidRequest,
+			message: `malformed cursor "nope"`,
+		},
+		{
+			name:    "anything else",
+			err:     errors.New("database is down"),
+			status:  http.StatusInternalServerError,
+			errName: xrpc.InternalServerError,
+			message: "failed to get feed items: database is down",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.router.AddFeed([]string{"feed"}, &errorFeed{err: test.err})
+
+			w := ts.do(t, http.MethodGet, skeletonPath+"feed", "", nil)
+			if w.Code != test.status {
+				t.Fatalf("got status %d, expected %d: %s", w.Code, test.status, w.Body.String())
+			}
+
+			// The envelope is the error name and a message, nothing else
+			envelope := map[string]any{}
+			decode(t, w, &envelope)
+
+			expected := map[string]any{"error": test.errName, "message": test.message}
+			if !reflect.DeepEqual(envelope, expected) {
+				t.Errorf("got envelope %v, expected %v", envelope, expected)
+			}
+		})
+	}
+}
+
+func TestGetFeedSkeletonRequestErrors(t *testing.T) {
+	ts := newTestServer(t)
+	ts.router.AddFeed([]string{"feed"}, &viewerFeed{})
+
+	tests := []struct {
+		name    string
+		target  string
+		status  int
+		errName string
+	}{
+		{name: "unknown feed", target: skeletonPath + "missing", status: http.StatusBadRequest, errName: xrpc.UnknownFeed},
+		{name: "another generator's feed", target: "/xrpc/app.bsky.feed.getFeedSkeleton?feed=at://did:plc:other/app.bsky.feed.generator/feed", status: http.StatusBadRequest, errName: xrpc.UnknownFeed},
+		{name: "no feed", target: "/xrpc/app.bsky.feed.getFeedSkeleton", status: http.StatusBadRequest, errName: xrpc.InvalidRequest},
+		{name: "no feed name", target: skeletonPath, status: http.StatusBadRequest, errName: xrpc.InvalidRequest},
+		{name: "unimplemented method", target: "/xrpc/app.bsky.feed.getFeed", status: http.StatusNotImplemented, errName: xrpc.MethodNotImplemented},
+		{name: "unknown route", target: "/nope", status: http.StatusNotFound, errName: xrpc.NotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expectError(t, ts.do(t, http.MethodGet, test.target, "", nil), test.status, test.errName)
+		})
+	}
+}
+
+const interactionsPath = "/xrpc/app.bsky.feed.sendInteractions"
+
+// interactionFeed serves its posts to anyone and remembers the interactions it's sent
+type interactionFeed struct {
+	posts     []string
+	delivered []delivery
+}
+
+// delivery is a call to HandleInteractions
+type delivery struct {
+	feed         string
+	viewer       string
+	interactions []store.Interaction
+}
+
+func (inf *interactionFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	posts := []*appbsky.FeedDefs_SkeletonFeedPost{}
+	for _, uri := range inf.posts {
+		posts = append(posts, &appbsky.FeedDefs_SkeletonFeedPost{Post: uri})
+	}
+	return posts, nil, nil
+}
+
+func (inf *interactionFeed) Describe(ctx context.Context) ([]appbsky.FeedDescribeFeedGenerator_Feed, error) {
+	return nil, nil
+}
+
+func (inf *interactionFeed) HandleInteractions(ctx context.Context, feed string, userDID string, interactions []*store.Interaction) error {
+	d := delivery{feed: feed, viewer: userDID}
+	for _, interaction := range interactions {
+		d.interactions = append(d.interactions, *interaction)
+	}
+	inf.delivered = append(inf.delivered, d)
+	return nil
+}
+
+func newTestStore(t *testing.T) *store.SQLStore {
+	ctx := context.Background()
+
+	s, err := store.NewSQLiteStore(ctx, filepath.Join(t.TempDir(), "feedgen.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// interactions returns a sendInteractions body with an interaction for each item and event pair
+func interactions(pairs ...string) SendInteractionsInput {
+	input := SendInteractionsInput{Interactions: []SendInteractionsInteraction{}}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		input.Interactions = append(input.Interactions, SendInteractionsInteraction{Item: pairs[i], Event: pairs[i+1]})
+	}
+	return input
+}
+
+func TestSendInteractionsValidation(t *testing.T) {
+	const post = "at://did:plc:author/app.bsky.feed.post/1"
+
+	tooMany := SendInteractionsInput{}
+	for i := 0; i <= maxInteractions; i++ {
+		tooMany.Interactions = append(tooMany.Interactions, SendInteractionsInteraction{Item: post, Event: store.InteractionSeen})
+	}
+
+	tests := []struct {
+		name    string
+		body    any
+		status  int
+		message string
+	}{
+		{
+			name:    "too many interactions",
+			body:    tooMany,
+			status:  http.StatusBadRequest,
+			message: "at most 1000 interactions can be sent at once",
+		},
+		{
+			name:    "not an AT-URI",
+			body:    interactions(post, store.InteractionSeen, "https://bsky.app/post", store.InteractionSeen),
+			status:  http.StatusBadRequest,
+			message: "interactions[1].item must be an AT-URI",
+		},
+		{
+			name:    "item too long",
+			body:    interactions("at://"+strings.Repeat("x", maxInteractionItemLen), store.InteractionSeen),
+			status:  http.StatusBadRequest,
+			message: "interactions[0].item must be an AT-URI",
+		},
+		{
+			name:    "no event",
+			body:    interactions(post, ""),
+			status:  http.StatusBadRequest,
+			message: "interactions[0].event is required",
+		},
+		{
+			name: "feed context too long",
+			body: SendInteractionsInput{Interactions: []SendInteractionsInteraction{
+				{Item: post, Event: store.InteractionSeen, FeedContext: strings.Repeat("x", feedrouter.MaxFeedContextLength+1)},
+			}},
+			status:  http.StatusBadRequest,
+			message: "interactions[0].feedContext must be at most 2000 characters",
+		},
+		{
+			name: "request ID too long",
+			body: SendInteractionsInput{Interactions: []SendInteractionsInteraction{
+				{Item: post, Event: store.InteractionSeen, ReqID: strings.Repeat("x", feedrouter.MaxReqIDLength+1)},
+			}},
+			status:  http.StatusBadRequest,
+			message: "interactions[0].reqId must be at most 100 characters",
+		},
+		{
+			name:    "not JSON",
+			body:    []byte("interactions"),
+			status:  http.StatusBadRequest,
+			message: "invalid request body: invalid character 'i' looking for beginning of value",
+		},
+		{
+			name:    "body too large",
+			body:    []byte(`{"interactions": [], "padding": "` + strings.Repeat("x", maxInteractionsBodySize) + `"}`),
+			status:  http.StatusRequestEntityTooLarge,
+			message: fmt.Sprintf("request body must be at most %d bytes", maxInteractionsBodySize),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			s := newTestStore(t)
+			ts.endpoints.InteractionStore = s
+
+			w := ts.do(t, http.MethodPost, interactionsPath, ts.bearer(t, viewerDID, "app.bsky.feed.sendInteractions"), test.body)
+			if w.Code != test.status {
+				t.Fatalf("got status %d, expected %d: %s", w.Code, test.status, w.Body.String())
+			}
+
+			resp := xrpc.ErrorResponse{}
+			decode(t, w, &resp)
+			if resp.Error != xrpc.InvalidRequest || resp.Message != test.message {
+				t.Errorf("got error %+v, expected InvalidRequest: %s", resp, test.message)
+			}
+
+			// Nothing from a refused request is stored
+			stored, err := s.GetInteractions(context.Background(), viewerDID, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stored) != 0 {
+				t.Errorf("got %d interactions stored from a refused request", len(stored))
+			}
+		})
+	}
+
+	// Interactions only come from authenticated viewers
+	ts := newTestServer(t)
+	expectError(t, ts.do(t, http.MethodPost, interactionsPath, "", interactions(post, store.InteractionSeen)), http.StatusUnauthorized, xrpc.AuthRequired)
+	expectError(t, ts.do(t, http.MethodPost, interactionsPath, ts.bearer(t, viewerDID, "app.bsky.feed.getFeedSkeleton"), interactions(post, store.InteractionSeen)), http.StatusUnauthorized, xrpc.AuthRequired)
+}
+
+func TestSendInteractionsStoresPerViewer(t *testing.T) {
+	const (
+		first  = "at://did:plc:author/app.bsky.feed.post/1"
+		second = "at://did:plc:author/app.bsky.feed.post/2"
+	)
+
+	ctx := context.Background()
+	ts := newTestServer(t)
+	s := newTestStore(t)
+	ts.endpoints.InteractionStore = s
+
+	send := func(viewer string, body SendInteractionsInput) {
+		w := ts.do(t, http.MethodPost, interactionsPath, ts.bearer(t, viewer, "app.bsky.feed.sendInteractions"), body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	// Events the lexicon may add later are skipped rather than refused
+	send(viewerDID, interactions(first, store.InteractionRequestLess, second, "app.bsky.feed.defs#somethingNew", second, store.InteractionLike))
+	send(otherDID, interactions(second, store.InteractionSeen))
+
+	tests := []struct {
+		viewer   string
+		expected []string // item and event of each stored interaction, sorted
+	}{
+		{viewer: viewerDID, expected: []string{first + " " + store.InteractionRequestLess, second + " " + store.InteractionLike}},
+		{viewer: otherDID, expected: []string{second + " " + store.InteractionSeen}},
+	}
+
+	for _, test := range tests {
+		stored, err := s.GetInteractions(ctx, test.viewer, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := []string{}
+		for _, interaction := range stored {
+			if interaction.Viewer != test.viewer {
+				t.Errorf("got interaction from %s stored for %s", interaction.Viewer, test.viewer)
+			}
+			got = append(got, interaction.Item+" "+interaction.Event)
+		}
+		sort.Strings(got)
+
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("got interactions %v stored for %s, expected %v", got, test.viewer, test.expected)
+		}
+	}
+}
+
+func TestSendInteractionsRoutesToServingFeed(t *testing.T) {
+	const (
+		served   = "at://did:plc:author/app.bsky.feed.post/served"
+		other    = "at://did:plc:author/app.bsky.feed.post/other"
+		unserved = "at://did:plc:author/app.bsky.feed.post/unserved"
+	)
+
+	ts := newTestServer(t)
+	s := newTestStore(t)
+	ts.endpoints.InteractionStore = s
+
+	handler := &interactionFeed{posts: []string{served}}
+	ts.router.AddFeed([]string{"handler", "handler-alias"}, handler)
+	ts.router.AddFeed([]string{"plain"}, &viewerFeed{})
+	idle := &interactionFeed{}
+	ts.router.AddFeed([]string{"idle"}, idle)
+
+	viewerAuth := ts.bearer(t, viewerDID, "app.bsky.feed.getFeedSkeleton")
+	for _, target := range []string{skeletonPath + "handler-alias", skeletonPath + "plain"} {
+		if w := ts.do(t, http.MethodGet, target, viewerAuth, nil); w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	// Anonymous requests aren't remembered, there'd be no viewer to match their interactions to
+	ts.do(t, http.MethodGet, skeletonPath+"idle", "", nil)
+
+	body := interactions(served, store.InteractionRequestMore, other, store.InteractionSeen, unserved, store.InteractionLike)
+	for _, viewer := range []string{viewerDID, otherDID} {
+		if w := ts.do(t, http.MethodPost, interactionsPath, ts.bearer(t, viewer, "app.bsky.feed.sendInteractions"), body); w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	// Only the viewer that was served the post by the handler's feed is routed to it, under the alias it was served as
+	if len(handler.delivered) != 1 {
+		t.Fatalf("got %d deliveries to the feed that served the post, expected 1: %+v", len(handler.delivered), handler.delivered)
+	}
+
+	d := handler.delivered[0]
+	if d.feed != "handler-alias" || d.viewer != viewerDID || len(d.interactions) != 1 {
+		t.Fatalf("got delivery %+v, expected one interaction from %s under handler-alias", d, viewerDID)
+	}
+	if got := d.interactions[0]; got.Item != served || got.Event != store.InteractionRequestMore || got.Feed != "handler-alias" {
+		t.Errorf("got interaction %+v delivered", got)
+	}
+
+	if len(idle.delivered) != 0 {
+		t.Errorf("got deliveries %+v to a feed that never served the viewer", idle.delivered)
+	}
+
+	// The stored interaction records the feed that served it
+	stored, err := s.GetInteractions(context.Background(), viewerDID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, interaction := range stored {
+		expected := ""
+		if interaction.Item == served {
+			expected = "handler-alias"
+		}
+		if interaction.Feed != expected {
+			t.Errorf("got feed %q stored for %s, expected %q", interaction.Feed, interaction.Item, expected)
+		}
+	}
+}
+
+// contextFeed is an interactionFeed that attaches a feedContext to each post and a reqId to its page
+type contextFeed struct {
+	interactionFeed
+}
+
+func (cf *contextFeed) GetSkeleton(ctx context.Context, feed string, userDID string, limit int64, cursor string) (*feedrouter.Skeleton, error) {
+	skeleton := &feedrouter.Skeleton{Feed: []*feedrouter.SkeletonPost{}, ReqID: "req-1"}
+	for i, uri := range cf.posts {
+		skeleton.Feed = append(skeleton.Feed, &feedrouter.SkeletonPost{Post: uri, FeedContext: fmt.Sprintf("rank:%d", i)})
+	}
+	return skeleton, nil
+}
+
+func TestFeedContextRoundTrip(t *testing.T) {
+	const (
+		first  = "at://did:plc:author/app.bsky.feed.post/1"
+		second = "at://did:plc:author/app.bsky.feed.post/2"
+	)
+
+	ts := newTestServer(t)
+	s := newTestStore(t)
+	ts.endpoints.InteractionStore = s
+
+	feed := &contextFeed{interactionFeed{posts: []string{first, second}}}
+	ts.router.AddFeed([]string{"ranked"}, feed)
+
+	w := ts.do(t, http.MethodGet, skeletonPath+"ranked", ts.bearer(t, viewerDID, "app.bsky.feed.getFeedSkeleton"), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+
+	// The page carries the lexicon's feedContext and reqId fields
+	page := struct {
+		Feed []struct {
+			Post        string `json:"post"`
+			FeedContext string `json:"feedContext"`
+		} `json:"feed"`
+		ReqID string `json:"reqId"`
+	}{}
+	decode(t, w, &page)
+
+	if page.ReqID != "req-1" || len(page.Feed) != 2 || page.Feed[0].FeedContext != "rank:0" || page.Feed[1].FeedContext != "rank:1" {
+		t.Fatalf("got page %s, expected a feedContext on each post and a reqId", w.Body.String())
+	}
+
+	// The client echoes them for the first post, and leaves them off for the second
+	body := SendInteractionsInput{Interactions: []SendInteractionsInteraction{
+		{Item: first, Event: store.InteractionRequestLess, FeedContext: page.Feed[0].FeedContext, ReqID: page.ReqID},
+		{Item: second, Event: store.InteractionSeen},
+	}}
+	if w := ts.do(t, http.MethodPost, interactionsPath, ts.bearer(t, viewerDID, "app.bsky.feed.sendInteractions"), body); w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+
+	expected := map[string]string{
+		first:  "rank:0 req-1",
+		second: "rank:1 req-1",
+	}
+
+	if len(feed.delivered) != 1 || feed.delivered[0].feed != "ranked" || feed.delivered[0].viewer != viewerDID {
+		t.Fatalf("got deliveries %+v, expected one to ranked for %s", feed.delivered, viewerDID)
+	}
+	for _, interaction := range feed.delivered[0].interactions {
+		if got := interaction.FeedContext + " " + interaction.ReqID; got != expected[interaction.Item] {
+			t.Errorf("got feedContext and reqId %q delivered for %s, expected %q", got, interaction.Item, expected[interaction.Item])
+		}
+	}
+
+	stored, err := s.GetInteractions(context.Background(), viewerDID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("got %d interactions stored, expected 2", len(stored))
+	}
+	for _, interaction := range stored {
+		if got := interaction.FeedContext + " " + interaction.ReqID; got != expected[interaction.Item] || interaction.Feed != "ranked" {
+			t.Errorf("got feedContext and reqId %q from feed %q stored for %s, expected %q from ranked", got, interaction.Feed, interaction.Item, expected[interaction.Item])
+		}
+	}
+}
+
+func TestGetFeedSkeletonStaticFeed(t *testing.T) {
+	posts := []string{"at://did:plc:author/app.bsky.feed.post/1", "at://did:plc:author/app.bsky.feed.post/2", "at://did:plc:author/app.bsky.feed.post/3"}
+
+	ts := newTestServer(t)
+	feed := addStaticFeed(t, ts, "static", posts...)
+
+	// Pages of a GetPage feed come through the shim as the feed serves them, without a feedContext or reqId
+	cursor := ""
+	for page := 0; page < 2; page++ {
+		expectedPosts, expectedCursor, err := feed.GetPage(context.Background(), "static", "", 2, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := json.Marshal(&appbsky.FeedGetFeedSkeleton_Output{Feed: expectedPosts, Cursor: expectedCursor})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := ts.do(t, http.MethodGet, skeletonPath+"static&limit=2&cursor="+cursor, "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+
+		got, want := map[string]any{}, map[string]any{}
+		decode(t, w, &got)
+		if err := json.Unmarshal(expected, &want); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got page %s, expected what GetPage serves %s", w.Body.String(), expected)
+		}
+
+		if expectedCursor == nil {
+			break
+		}
+		cursor = *expectedCursor
+	}
+}
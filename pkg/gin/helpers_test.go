@@ -0,0 +1,169 @@
+package gin
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/auth"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/xrpc"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	feedActorDID = "did:plc:feedactor"
+	serviceDID   = "did:web:feedgen.example.com"
+	feedPrefix   = "at://" + feedActorDID + "/app.bsky.feed.generator/"
+	adminToken   = "admin-secret"
+	adminDID     = "did:plc:admin"
+	viewerDID    = "did:plc:viewer"
+	otherDID     = "did:plc:other"
+)
+
+// testServer serves the endpoints with the same routes and middleware as cmd/main.go
+type testServer struct {
+	router    *feedrouter.FeedRouter
+	auth      *auth.Auth
+	endpoints *Endpoints
+	engine    *gin.Engine
+	key       *ecdsa.PrivateKey // signs the JWTs of the admin, viewer, and other DIDs
+}
+
+func newTestServer(t *testing.T) *testServer {
+	gin.SetMode(gin.TestMode)
+
+	router, err := feedrouter.NewFeedRouter(context.Background(), feedActorDID, serviceDID, []string{feedActorDID}, "https://feedgen.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auther, err := auth.NewAuth(10, time.Hour, "https://plc.directory", 100, serviceDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the DIDs' key so their JWTs verify without resolving them
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, did := range []string{adminDID, viewerDID, otherDID} {
+		auther.KeyCache.Add(did, auth.KeyCacheEntry{UserDID: did, Key: &key.PublicKey, ExpiresAt: time.Now().Add(time.Hour)})
+	}
+
+	adminAuth, err := auth.NewAdminAuth(adminToken, []string{adminDID}, auther)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ep := NewEndpoints(router)
+	engine := gin.New()
+
+	admin := engine.Group("/admin", adminAuth.AuthenticateGinRequest)
+	admin.GET("/feeds", ep.ListFeeds)
+	admin.GET("/feeds/:name", ep.GetFeed)
+	admin.PUT("/feeds/:name/aliases", ep.SetFeedAliases)
+	admin.POST("/feeds/:name/aliases", ep.AddFeedAlias)
+	admin.DELETE("/feeds/:name/aliases/:alias", ep.RemoveFeedAlias)
+	admin.POST("/feeds/:name/pinned", ep.PinFeedPost)
+	admin.DELETE("/feeds/:name/pinned", ep.UnpinFeedPost)
+	admin.POST("/feeds/:name/removed", ep.RemoveFeedPost)
+	admin.DELETE("/feeds/:name/removed", ep.RestoreFeedPost)
+	admin.POST("/feeds/:name/reindex", ep.ReindexFeed)
+
+	engine.Use(auther.AuthenticateGinRequestViaJWT)
+	engine.GET("/xrpc/app.bsky.feed.getFeedSkeleton", ep.GetFeedSkeleton)
+	engine.POST("/xrpc/app.bsky.feed.sendInteractions", ep.SendInteractions)
+	engine.NoRoute(ep.NoRoute)
+
+	return &testServer{router: router, auth: auther, endpoints: ep, engine: engine, key: key}
+}
+
+// bearer returns the Authorization header of a JWT from the issuer for this service, scoped to lxm
+func (ts *testServer) bearer(t *testing.T, issuer string, lxm string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, &auth.ServiceAuthClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    issuer,
+			Audience:  serviceDID,
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		},
+		LexiconMethod: lxm,
+	})
+
+	signed, err := token.SignedString(ts.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "Bearer " + signed
+}
+
+// do serves a request with a JSON body, unless body is nil, and the given Authorization header, unless it's empty
+// A []byte body is sent as it is
+func (ts *testServer) do(t *testing.T, method string, target string, authorization string, body any) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if raw, ok := body.([]byte); ok {
+		reader = bytes.NewReader(raw)
+	} else if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+
+	req := httptest.NewRequest(method, target, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	w := httptest.NewRecorder()
+	ts.engine.ServeHTTP(w, req)
+
+	return w
+}
+
+// decode decodes a JSON response body into v
+func decode(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("got invalid JSON body %q: %v", w.Body.String(), err)
+	}
+}
+
+// expectError checks a response is an XRPC error with the given status and name
+func expectError(t *testing.T, w *httptest.ResponseRecorder, status int, name string) {
+	t.Helper()
+
+	if w.Code != status {
+		t.Fatalf("got status %d, expected %d: %s", w.Code, status, w.Body.String())
+	}
+
+	resp := xrpc.ErrorResponse{}
+	decode(t, w, &resp)
+	if resp.Error != name || resp.Message == "" {
+		t.Errorf("got error %+v, expected %s with a message", resp, name)
+	}
+}
+
+// captureLog sends the log to a buffer for the rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	return buf
+}
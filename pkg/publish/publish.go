@@ -0,0 +1,280 @@
+// Package publish creates, updates, and deletes the app.bsky.feed.generator records that make feeds
+// discoverable in clients, from the metadata of the feeds registered in a FeedRouter.
+package publish
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/records"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// CollectionGenerator is the collection feed generator records are written to
+const CollectionGenerator = "app.bsky.feed.generator"
+
+// maxAvatarSize is the largest avatar the lexicon accepts
+const maxAvatarSize = 1_000_000
+
+// Feed is a feed to publish under a record key
+type Feed struct {
+	RecordKey string // Alias the feed is served under, the record key of its generator record
+	Metadata  feedrouter.FeedMetadata
+}
+
+// FeedsFromRouter returns a Feed for every alias served by the feeds registered in the router
+func FeedsFromRouter(router *feedrouter.FeedRouter) []Feed {
+	feeds := []Feed{}
+	for _, info := range router.ListFeedInfo() {
+		for _, alias := range info.ServedAliases {
+			feeds = append(feeds, Feed{RecordKey: alias, Metadata: info.Metadata})
+		}
+	}
+
+	return feeds
+}
+
+// generatorRecord is an app.bsky.feed.generator record, with the fields our lexicon types predate
+type generatorRecord struct {
+	LexiconTypeID       string        `json:"$type"`
+	Did                 string        `json:"did"`
+	DisplayName         string        `json:"displayName"`
+	Description         string        `json:"description,omitempty"`
+	Avatar              *util.LexBlob `json:"avatar,omitempty"`
+	AcceptsInteractions bool          `json:"acceptsInteractions,omitempty"`
+	ContentMode         string        `json:"contentMode,omitempty"`
+	CreatedAt           string        `json:"createdAt"`
+}
+
+// putRecordInput is the input of com.atproto.repo.putRecord for records our lexicon types can't hold
+type putRecordInput struct {
+	Repo       string  `json:"repo"`
+	Collection string  `json:"collection"`
+	Rkey       string  `json:"rkey"`
+	Record     any     `json:"record"`
+	SwapRecord *string `json:"swapRecord,omitempty"`
+}
+
+// existingRecord is a generator record already in the repo
+type existingRecord struct {
+	cid       string
+	createdAt string
+}
+
+// Publisher writes the generator records of feeds to the repo of the account it's logged in as
+type Publisher struct {
+	Client     *xrpc.Client
+	ServiceDID string // DID of the feed generator service the records point at, i.e. did:web:feedsky.jazco.io
+	DID        string // DID of the account the records are written to, set by Login
+
+	existing map[string]existingRecord // map of record key to the record in the repo, loaded on first use
+}
+
+// NewPublisher returns a new Publisher for the PDS at host (i.e. https://bsky.social)
+func NewPublisher(host string, serviceDID string) *Publisher {
+	return &Publisher{
+		Client:     records.NewClient(host),
+		ServiceDID: serviceDID,
+	}
+}
+
+// Login creates a session on the PDS with an app password
+func (p *Publisher) Login(ctx context.Context, identifier string, password string) error {
+	session, err := comatproto.ServerCreateSession(ctx, p.Client, &comatproto.ServerCreateSession_Input{
+		Identifier: identifier,
+		Password:   password,
+	})
+	if err != nil {
+		return fmt.Errorf("error logging in as %s: %w", identifier, err)
+	}
+
+	p.Client.Auth = &xrpc.AuthInfo{
+		AccessJwt:  session.AccessJwt,
+		RefreshJwt: session.RefreshJwt,
+		Handle:     session.Handle,
+		Did:        session.Did,
+	}
+	p.DID = session.Did
+
+	return nil
+}
+
+// URI returns the AT-URI a feed is published at
+func (p *Publisher) URI(recordKey string) string {
+	return "at://" + p.DID + "/" + CollectionGenerator + "/" + recordKey
+}
+
+// loadExisting lists the generator records already in the repo
+func (p *Publisher) loadExisting(ctx context.Context) error {
+	if p.existing != nil {
+		return nil
+	}
+
+	existing := map[string]existingRecord{}
+	err := records.List(ctx, p.Client, p.DID, CollectionGenerator, func(record *comatproto.RepoListRecords_Record) error {
+		rkey := record.Uri[strings.LastIndex(record.Uri, "/")+1:]
+		createdAt := ""
+		if generator, ok := record.Value.Val.(*appbsky.FeedGenerator); ok {
+			createdAt = generator.CreatedAt
+		}
+		existing[rkey] = existingRecord{cid: record.Cid, createdAt: createdAt}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	p.existing = existing
+	return nil
+}
+
+// Publish creates the generator record of a feed, or updates it if the feed was published before
+// Updated records keep their createdAt, and are swapped by CID so concurrent edits aren't overwritten
+// Returns the AT-URI of the record
+func (p *Publisher) Publish(ctx context.Context, feed Feed) (string, error) {
+	tracer := otel.Tracer("publish")
+	ctx, span := tracer.Start(ctx, "Publisher:Publish")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("feed.rkey", feed.RecordKey))
+
+	if p.DID == "" {
+		return "", fmt.Errorf("publisher is not logged in")
+	}
+
+	if err := feed.Metadata.Validate(); err != nil {
+		return "", fmt.Errorf("invalid metadata for feed %s: %w", feed.RecordKey, err)
+	}
+
+	if err := p.loadExisting(ctx); err != nil {
+		span.RecordError(err)
+		return "", err
+	}
+
+	existing, update := p.existing[feed.RecordKey]
+
+	record := generatorRecord{
+		LexiconTypeID:       CollectionGenerator,
+		Did:                 p.ServiceDID,
+		DisplayName:         feed.Metadata.DisplayName,
+		Description:         feed.Metadata.Description,
+		AcceptsInteractions: feed.Metadata.AcceptsInteractions,
+		CreatedAt:           existing.createdAt,
+	}
+
+	if record.CreatedAt == "" {
+		record.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	if record.DisplayName == "" {
+		record.DisplayName = feed.RecordKey
+	}
+
+	if feed.Metadata.ContentMode != "" {
+		record.ContentMode = feed.Metadata.ContentMode.Token()
+	}
+
+	if feed.Metadata.Avatar != "" {
+		avatar, err := p.uploadAvatar(ctx, feed.Metadata.Avatar)
+		if err != nil {
+			span.RecordError(err)
+			return "", err
+		}
+		record.Avatar = avatar
+	}
+
+	input := putRecordInput{
+		Repo:       p.DID,
+		Collection: CollectionGenerator,
+		Rkey:       feed.RecordKey,
+		Record:     record,
+	}
+
+	if update {
+		input.SwapRecord = &existing.cid
+	}
+
+	var out comatproto.RepoPutRecord_Output
+	if err := p.Client.Do(ctx, xrpc.Procedure, "application/json", "com.atproto.repo.putRecord", nil, input, &out); err != nil {
+		span.RecordError(err)
+		return "", fmt.Errorf("error publishing feed %s: %w", feed.RecordKey, err)
+	}
+
+	p.existing[feed.RecordKey] = existingRecord{cid: out.Cid, createdAt: record.CreatedAt}
+	span.SetAttributes(attribute.Bool("feed.updated", update))
+
+	return out.Uri, nil
+}
+
+// uploadAvatar uploads an avatar image and returns the blob to reference it with
+func (p *Publisher) uploadAvatar(ctx context.Context, path string) (*util.LexBlob, error) {
+	image, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading avatar: %w", err)
+	}
+
+	if len(image) > maxAvatarSize {
+		return nil, fmt.Errorf("avatar %s is %d bytes, the limit is %d", path, len(image), maxAvatarSize)
+	}
+
+	mimeType := http.DetectContentType(image)
+	if mimeType != "image/png" && mimeType != "image/jpeg" {
+		return nil, fmt.Errorf("avatar %s is %s, expected a PNG or JPEG image", path, mimeType)
+	}
+
+	var out comatproto.RepoUploadBlob_Output
+	if err := p.Client.Do(ctx, xrpc.Procedure, mimeType, "com.atproto.repo.uploadBlob", nil, bytes.NewReader(image), &out); err != nil {
+		return nil, fmt.Errorf("error uploading avatar %s: %w", path, err)
+	}
+
+	return out.Blob, nil
+}
+
+// Unpublish deletes the generator record of a feed, returning false if it wasn't published
+func (p *Publisher) Unpublish(ctx context.Context, recordKey string) (bool, error) {
+	tracer := otel.Tracer("publish")
+	ctx, span := tracer.Start(ctx, "Publisher:Unpublish")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("feed.rkey", recordKey))
+
+	if p.DID == "" {
+		return false, fmt.Errorf("publisher is not logged in")
+	}
+
+	if err := p.loadExisting(ctx); err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+
+	existing, ok := p.existing[recordKey]
+	if !ok {
+		return false, nil
+	}
+
+	err := comatproto.RepoDeleteRecord(ctx, p.Client, &comatproto.RepoDeleteRecord_Input{
+		Repo:       p.DID,
+		Collection: CollectionGenerator,
+		Rkey:       recordKey,
+		SwapRecord: &existing.cid,
+	})
+	if err != nil {
+		span.RecordError(err)
+		return false, fmt.Errorf("error unpublishing feed %s: %w", recordKey, err)
+	}
+
+	delete(p.existing, recordKey)
+
+	return true, nil
+}
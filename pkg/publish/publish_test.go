@@ -0,0 +1,256 @@
+package publish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/feedrouter"
+	"github.com/ipfs/go-cid"
+)
+
+// fakePDS is just enough of a PDS's XRPC API to publish feed generator records to
+type fakePDS struct {
+	t   *testing.T
+	did string
+
+	lk      sync.Mutex
+	records map[string]map[string]any // map of record key to record
+	cids    map[string]string         // map of record key to the CID of its latest version
+	blobs   int
+	writes  int
+}
+
+func newFakePDS(t *testing.T, did string) *fakePDS {
+	return &fakePDS{t: t, did: did, records: map[string]map[string]any{}, cids: map[string]string{}}
+}
+
+// testCID returns a CID for data, the PDS checks swaps against them
+func testCID(t *testing.T, data []byte) string {
+	// 0x12 is sha2-256
+	c, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: 0x12, MhLength: -1}.Sum(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.String()
+}
+
+func (pds *fakePDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pds.lk.Lock()
+	defer pds.lk.Unlock()
+
+	method := strings.TrimPrefix(r.URL.Path, "/xrpc/")
+	if method != "com.atproto.server.createSession" && r.Header.Get("Authorization") != "Bearer access-jwt" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	input := map[string]any{}
+	if r.Header.Get("Content-Type") == "application/json" {
+		if err := json.Unmarshal(body, &input); err != nil {
+			pds.t.Errorf("%s: invalid JSON body: %v", method, err)
+		}
+	}
+
+	reply := func(v any) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v)
+	}
+
+	switch method {
+	case "com.atproto.server.createSession":
+		if input["identifier"] != "feeds.example.com" || input["password"] != "app-password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		reply(map[string]any{"accessJwt": "access-jwt", "refreshJwt": "refresh-jwt", "handle": "feeds.example.com", "did": pds.did})
+	case "com.atproto.repo.listRecords":
+		out := []map[string]any{}
+		for rkey, record := range pds.records {
+			out = append(out, map[string]any{"uri": "at://" + pds.did + "/" + CollectionGenerator + "/" + rkey, "cid": pds.cids[rkey], "value": record})
+		}
+		reply(map[string]any{"records": out})
+	case "com.atproto.repo.uploadBlob":
+		if ct := r.Header.Get("Content-Type"); ct != "image/png" {
+			pds.t.Errorf("uploadBlob: got content type %q, expected image/png", ct)
+		}
+		pds.blobs++
+		reply(map[string]any{"blob": map[string]any{
+			"$type":    "blob",
+			"ref":      map[string]any{"$link": testCID(pds.t, body)},
+			"mimeType": "image/png",
+			"size":     len(body),
+		}})
+	case "com.atproto.repo.putRecord":
+		rkey := input["rkey"].(string)
+		if swap, ok := input["swapRecord"]; ok && swap != pds.cids[rkey] {
+			w.WriteHeader(http.StatusBadRequest)
+			reply(map[string]any{"error": "InvalidSwap"})
+			return
+		}
+		pds.writes++
+		pds.records[rkey] = input["record"].(map[string]any)
+		pds.cids[rkey] = testCID(pds.t, []byte(fmt.Sprintf("%s-%d", rkey, pds.writes)))
+		reply(map[string]any{"uri": "at://" + pds.did + "/" + CollectionGenerator + "/" + rkey, "cid": pds.cids[rkey]})
+	case "com.atproto.repo.deleteRecord":
+		rkey := input["rkey"].(string)
+		if input["swapRecord"] != pds.cids[rkey] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(pds.records, rkey)
+		delete(pds.cids, rkey)
+		reply(map[string]any{})
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	ctx := context.Background()
+
+	pds := newFakePDS(t, "did:plc:feedsexample")
+	server := httptest.NewServer(pds)
+	defer server.Close()
+
+	avatar := filepath.Join(t.TempDir(), "avatar.png")
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	if err := os.WriteFile(avatar, png, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := NewPublisher(server.URL, "did:web:feeds.example.com")
+
+	if err := publisher.Login(ctx, "feeds.example.com", "wrong-password"); err == nil {
+		t.Fatal("expected login with the wrong password to fail")
+	}
+
+	if err := publisher.Login(ctx, "feeds.example.com", "app-password"); err != nil {
+		t.Fatal(err)
+	}
+
+	feed := Feed{
+		RecordKey: "golang",
+		Metadata: feedrouter.FeedMetadata{
+			DisplayName:         "Golang",
+			Description:         "Posts about Go",
+			Avatar:              avatar,
+			ContentMode:         feedrouter.ContentModeVideo,
+			AcceptsInteractions: true,
+		},
+	}
+
+	uri, err := publisher.Publish(ctx, feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uri != "at://did:plc:feedsexample/app.bsky.feed.generator/golang" {
+		t.Errorf("got URI %s", uri)
+	}
+
+	record := pds.records["golang"]
+	for field, expected := range map[string]any{
+		"$type":               CollectionGenerator,
+		"did":                 "did:web:feeds.example.com",
+		"displayName":         "Golang",
+		"description":         "Posts about Go",
+		"contentMode":         "app.bsky.feed.defs#contentModeVideo",
+		"acceptsInteractions": true,
+	} {
+		if record[field] != expected {
+			t.Errorf("record %s is %v, expected %v", field, record[field], expected)
+		}
+	}
+
+	if blob, ok := record["avatar"].(map[string]any); !ok || blob["mimeType"] != "image/png" {
+		t.Errorf("record avatar is %v, expected a PNG blob", record["avatar"])
+	}
+
+	// Backdate the record so we can tell whether an update keeps createdAt
+	createdAt := "2023-06-01T00:00:00Z"
+	record["createdAt"] = createdAt
+
+	// A new publisher updates the record in place, keeping when it was created
+	publisher = NewPublisher(server.URL, "did:web:feeds.example.com")
+	if err := publisher.Login(ctx, "feeds.example.com", "app-password"); err != nil {
+		t.Fatal(err)
+	}
+
+	feed.Metadata.Description = "Posts about the Go programming language"
+	feed.Metadata.Avatar = ""
+	if _, err := publisher.Publish(ctx, feed); err != nil {
+		t.Fatal(err)
+	}
+
+	record = pds.records["golang"]
+	if record["description"] != "Posts about the Go programming language" {
+		t.Errorf("record wasn't updated: %v", record)
+	}
+	if record["createdAt"] != createdAt {
+		t.Errorf("update changed createdAt from %v to %v", createdAt, record["createdAt"])
+	}
+
+	// Feeds without a display name are published under their record key
+	if _, err := publisher.Publish(ctx, Feed{RecordKey: "gophers"}); err != nil {
+		t.Fatal(err)
+	}
+	if pds.records["gophers"]["displayName"] != "gophers" {
+		t.Errorf("got display name %v, expected the record key", pds.records["gophers"]["displayName"])
+	}
+
+	if pds.blobs != 1 || pds.writes != 3 {
+		t.Errorf("got %d blobs and %d writes, expected 1 and 3", pds.blobs, pds.writes)
+	}
+
+	deleted, err := publisher.Unpublish(ctx, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted {
+		t.Error("expected golang to be unpublished")
+	}
+	if _, ok := pds.records["golang"]; ok {
+		t.Error("record is still in the repo")
+	}
+
+	deleted, err = publisher.Unpublish(ctx, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted {
+		t.Error("expected unpublishing a feed twice to be a no-op")
+	}
+}
+
+func TestPublisherRejectsInvalidMetadata(t *testing.T) {
+	pds := newFakePDS(t, "did:plc:feedsexample")
+	server := httptest.NewServer(pds)
+	defer server.Close()
+
+	publisher := NewPublisher(server.URL, "did:web:feeds.example.com")
+	if err := publisher.Login(context.Background(), "feeds.example.com", "app-password"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := publisher.Publish(context.Background(), Feed{
+		RecordKey: "golang",
+		Metadata:  feedrouter.FeedMetadata{DisplayName: strings.Repeat("a", feedrouter.MaxDisplayNameLength+1)},
+	})
+	if err == nil {
+		t.Fatal("expected a display name over the limit to be rejected")
+	}
+
+	if pds.writes != 0 {
+		t.Errorf("got %d writes, expected none", pds.writes)
+	}
+}
@@ -0,0 +1,72 @@
+// Package records lists the records of a collection in a repo over XRPC,
+// which feeds use to load state that predates what they've seen on the firehose.
+package records
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/xrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// NewClient returns an XRPC client for the given host (i.e. https://bsky.social) with OpenTelemetry instrumentation
+func NewClient(host string) *xrpc.Client {
+	return &xrpc.Client{
+		Client: &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)},
+		Host:   host,
+	}
+}
+
+// List pages through every record of a collection in a repo and calls cb with each of them
+// Record values are decoded into their lexicon types, i.e. *appbsky.GraphFollow
+func List(ctx context.Context, client *xrpc.Client, repo string, collection string, cb func(record *comatproto.RepoListRecords_Record) error) error {
+	tracer := otel.Tracer("records")
+	ctx, span := tracer.Start(ctx, "Records:List")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("repo", repo), attribute.String("collection", collection))
+
+	cursor := ""
+	count := 0
+	for {
+		// Build params by hand so we don't send empty rkeyStart/rkeyEnd filters
+		params := map[string]interface{}{
+			"repo":       repo,
+			"collection": collection,
+			"limit":      100,
+		}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+
+		var out comatproto.RepoListRecords_Output
+		if err := client.Do(ctx, xrpc.Query, "", "com.atproto.repo.listRecords", params, nil, &out); err != nil {
+			span.RecordError(err)
+			return fmt.Errorf("error listing %s records in %s: %w", collection, repo, err)
+		}
+
+		for _, record := range out.Records {
+			if record.Value == nil {
+				continue
+			}
+			if err := cb(record); err != nil {
+				return err
+			}
+			count++
+		}
+
+		if out.Cursor == nil || *out.Cursor == "" || len(out.Records) == 0 {
+			break
+		}
+		cursor = *out.Cursor
+	}
+
+	span.SetAttributes(attribute.Int("records.length", count))
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/ericvolp12/go-bsky-feed-generator/pkg/firehose"
+)
+
+// PostFromEvent converts a post create event from the firehose into a Post ready to be inserted
+// Returns nil if the event is not a post create
+func PostFromEvent(evt *firehose.Event) *Post {
+	if evt.Action != firehose.ActionCreate || evt.Post == nil {
+		return nil
+	}
+
+	post := &Post{
+		URI:       evt.URI,
+		CID:       evt.CID,
+		Author:    evt.Repo,
+		Text:      evt.Post.Text,
+		Langs:     evt.PostLangs(),
+		Tags:      evt.PostTags(),
+		IndexedAt: time.Now(),
+	}
+
+	// Fall back to the commit time if the record has a bogus createdAt
+	createdAt, err := time.Parse(time.RFC3339, evt.Post.CreatedAt)
+	if err != nil {
+		createdAt = evt.Time
+	}
+	post.CreatedAt = createdAt
+
+	if evt.Post.Reply != nil {
+		if evt.Post.Reply.Parent != nil {
+			post.ReplyParent = evt.Post.Reply.Parent.Uri
+		}
+		if evt.Post.Reply.Root != nil {
+			post.ReplyRoot = evt.Post.Reply.Root.Uri
+		}
+	}
+
+	return post
+}
+
+// RepostFromEvent converts a repost create event from the firehose into a Post ready to be inserted
+// Returns nil if the event is not a repost create
+func RepostFromEvent(evt *firehose.Event) *Post {
+	if evt.Action != firehose.ActionCreate || evt.Repost == nil || evt.Repost.Subject == nil {
+		return nil
+	}
+
+	createdAt, err := time.Parse(time.RFC3339, evt.Repost.CreatedAt)
+	if err != nil {
+		createdAt = evt.Time
+	}
+
+	return &Post{
+		URI:       evt.URI,
+		CID:       evt.CID,
+		Author:    evt.Repo,
+		RepostOf:  evt.Repost.Subject.Uri,
+		CreatedAt: createdAt,
+		IndexedAt: time.Now(),
+	}
+}
+
+// SkeletonFeedPost returns how a post is served in a feed skeleton
+// Reposts are served as the post they repost, with the repost as the reason
+func SkeletonFeedPost(post *Post) *appbsky.FeedDefs_SkeletonFeedPost {
+	if post.RepostOf == "" {
+		return &appbsky.FeedDefs_SkeletonFeedPost{Post: post.URI}
+	}
+
+	return &appbsky.FeedDefs_SkeletonFeedPost{
+		Post: post.RepostOf,
+		Reason: &appbsky.FeedDefs_SkeletonFeedPost_Reason{
+			FeedDefs_SkeletonReasonRepost: &appbsky.FeedDefs_SkeletonReasonRepost{Repost: post.URI},
+		},
+	}
+}
+
+// FollowFromEvent converts a follow create event from the firehose into a Follow ready to be inserted
+// Returns nil if the event is not a follow create
+func FollowFromEvent(evt *firehose.Event) *Follow {
+	if evt.Action != firehose.ActionCreate || evt.Follow == nil {
+		return nil
+	}
+
+	createdAt, err := time.Parse(time.RFC3339, evt.Follow.CreatedAt)
+	if err != nil {
+		createdAt = evt.Time
+	}
+
+	return &Follow{
+		URI:       evt.URI,
+		Actor:     evt.Repo,
+		Subject:   evt.Follow.Subject,
+		CreatedAt: createdAt,
+	}
+}
+
+// DeleteHandler removes posts and reposts deleted on the firehose from a PostStore
+// Deletes for the whole network pass through it, so it's registered on the firehose once
+// rather than having every feed that indexes into the store delete on its own
+type DeleteHandler struct {
+	Store PostStore
+}
+
+// NewDeleteHandler returns a new DeleteHandler for the PostStore
+func NewDeleteHandler(store PostStore) *DeleteHandler {
+	return &DeleteHandler{Store: store}
+}
+
+// HandleEvent deletes the post or repost the event deletes
+// DeleteHandler implements firehose.Handler so it can be added to the Firehose
+func (dh *DeleteHandler) HandleEvent(ctx context.Context, evt *firehose.Event) error {
+	if evt.Action != firehose.ActionDelete {
+		return nil
+	}
+
+	if evt.Collection != firehose.CollectionPost && evt.Collection != firehose.CollectionRepost {
+		return nil
+	}
+
+	return dh.Store.DeletePost(ctx, evt.URI)
+}
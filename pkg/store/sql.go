@@ -0,0 +1,470 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+// postRow is the posts table, timestamps are stored as unix microseconds
+// so cursor comparisons behave the same on every database
+type postRow struct {
+	URI         string `gorm:"primaryKey"`
+	CID         string `gorm:"column:cid"`
+	Author      string `gorm:"index"`
+	Text        string
+	ReplyParent string
+	ReplyRoot   string
+	RepostOf    string
+	CreatedAt   int64
+	IndexedAt   int64 `gorm:"index"`
+}
+
+func (postRow) TableName() string { return "posts" }
+
+type postTagRow struct {
+	PostURI string `gorm:"primaryKey"`
+	Tag     string `gorm:"primaryKey;index"`
+}
+
+func (postTagRow) TableName() string { return "post_tags" }
+
+type postLangRow struct {
+	PostURI string `gorm:"primaryKey"`
+	Lang    string `gorm:"primaryKey;index"`
+}
+
+func (postLangRow) TableName() string { return "post_langs" }
+
+type feedPostRow struct {
+	Feed    string `gorm:"primaryKey"`
+	PostURI string `gorm:"primaryKey;index"`
+}
+
+func (feedPostRow) TableName() string { return "feed_posts" }
+
+type followRow struct {
+	Feed      string `gorm:"primaryKey;index:idx_follows_feed_actor,priority:1"`
+	URI       string `gorm:"primaryKey"`
+	Actor     string `gorm:"index:idx_follows_feed_actor,priority:2"`
+	Subject   string
+	CreatedAt int64
+}
+
+func (followRow) TableName() string { return "follows" }
+
+type interactionRow struct {
+	ID          uint   `gorm:"primaryKey"`
+	Viewer      string `gorm:"index:idx_interactions_viewer_created_at"`
+	Item        string `gorm:"index"`
+	Event       string
+	FeedContext string
+	ReqID       string `gorm:"column:req_id"`
+	Feed        string
+	CreatedAt   int64 `gorm:"index:idx_interactions_viewer_created_at"`
+}
+
+func (interactionRow) TableName() string { return "interactions" }
+
+// SQLStore is a PostStore backed by a SQL database through gorm
+type SQLStore struct {
+	DB *gorm.DB
+}
+
+// NewSQLiteStore returns a new SQLStore backed by an embedded SQLite database at the given path
+func NewSQLiteStore(ctx context.Context, path string) (*SQLStore, error) {
+	// Use WAL mode so readers serving feeds don't block the firehose indexer
+	db, err := gorm.Open(sqlite.Open(path+"?_journal_mode=WAL&_busy_timeout=5000"), gormConfig())
+	if err != nil {
+		return nil, fmt.Errorf("error opening SQLite database: %w", err)
+	}
+
+	return &SQLStore{DB: db}, nil
+}
+
+// NewPostgresStore returns a new SQLStore backed by the PostgreSQL database at the given DSN
+func NewPostgresStore(ctx context.Context, dsn string) (*SQLStore, error) {
+	db, err := gorm.Open(postgres.Open(dsn), gormConfig())
+	if err != nil {
+		return nil, fmt.Errorf("error opening PostgreSQL database: %w", err)
+	}
+
+	return &SQLStore{DB: db}, nil
+}
+
+func gormConfig() *gorm.Config {
+	return &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Warn),
+	}
+}
+
+// Migrate creates or updates the tables used by the store
+func (s *SQLStore) Migrate(ctx context.Context) error {
+	err := s.DB.WithContext(ctx).AutoMigrate(
+		&postRow{},
+		&postTagRow{},
+		&postLangRow{},
+		&feedPostRow{},
+		&followRow{},
+		&interactionRow{},
+	)
+	if err != nil {
+		return fmt.Errorf("error migrating post store: %w", err)
+	}
+
+	return nil
+}
+
+// InsertPost indexes a post along with its tags, languages, and feed memberships
+func (s *SQLStore) InsertPost(ctx context.Context, post *Post) error {
+	tracer := otel.Tracer("store")
+	ctx, span := tracer.Start(ctx, "SQLStore:InsertPost")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("post.uri", post.URI))
+
+	indexedAt := post.IndexedAt
+	if indexedAt.IsZero() {
+		indexedAt = time.Now()
+	}
+
+	row := postRow{
+		URI:         post.URI,
+		CID:         post.CID,
+		Author:      post.Author,
+		Text:        post.Text,
+		ReplyParent: post.ReplyParent,
+		ReplyRoot:   post.ReplyRoot,
+		RepostOf:    post.RepostOf,
+		CreatedAt:   post.CreatedAt.UnixMicro(),
+		IndexedAt:   indexedAt.UnixMicro(),
+	}
+
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		doNothing := clause.OnConflict{DoNothing: true}
+
+		if err := tx.Clauses(doNothing).Create(&row).Error; err != nil {
+			return err
+		}
+
+		for _, tag := range post.Tags {
+			if err := tx.Clauses(doNothing).Create(&postTagRow{PostURI: post.URI, Tag: tag}).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, lang := range post.Langs {
+			if err := tx.Clauses(doNothing).Create(&postLangRow{PostURI: post.URI, Lang: lang}).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, feed := range post.Feeds {
+			if err := tx.Clauses(doNothing).Create(&feedPostRow{Feed: feed, PostURI: post.URI}).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("error inserting post: %w", err)
+	}
+
+	return nil
+}
+
+// DeletePost removes a post and everything indexed for it
+func (s *SQLStore) DeletePost(ctx context.Context, uri string) error {
+	tracer := otel.Tracer("store")
+	ctx, span := tracer.Start(ctx, "SQLStore:DeletePost")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("post.uri", uri))
+
+	// Most deletes on the firehose are for posts we never indexed, skip the transaction for those
+	var indexed []postRow
+	if err := s.DB.WithContext(ctx).Select("uri").Where("uri = ?", uri).Limit(1).Find(&indexed).Error; err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("error looking up post: %w", err)
+	}
+
+	if len(indexed) == 0 {
+		return nil
+	}
+
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("post_uri = ?", uri).Delete(&feedPostRow{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("post_uri = ?", uri).Delete(&postTagRow{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("post_uri = ?", uri).Delete(&postLangRow{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("uri = ?", uri).Delete(&postRow{}).Error
+	})
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("error deleting post: %w", err)
+	}
+
+	return nil
+}
+
+// QueryPosts returns a page of posts matching the query, newest first
+func (s *SQLStore) QueryPosts(ctx context.Context, query PostQuery) ([]*Post, *string, error) {
+	tracer := otel.Tracer("store")
+	ctx, span := tracer.Start(ctx, "SQLStore:QueryPosts")
+	defer span.End()
+
+	db := s.DB.WithContext(ctx)
+
+	// Queries always get a page, an unset limit would otherwise return every matching post
+	if query.Limit <= 0 {
+		query.Limit = DefaultLimit
+	}
+
+	q := db.Model(&postRow{}).Order("indexed_at DESC, cid DESC").Limit(int(query.Limit))
+
+	if query.Feed != "" {
+		q = q.Where("uri IN (?)", db.Model(&feedPostRow{}).Select("post_uri").Where("feed = ?", query.Feed))
+	}
+
+	if len(query.Authors) > 0 {
+		q = q.Where("author IN ?", query.Authors)
+	}
+
+	if len(query.Tags) > 0 {
+		if query.MatchAllTags {
+			for _, tag := range query.Tags {
+				q = q.Where("uri IN (?)", db.Model(&postTagRow{}).Select("post_uri").Where("tag = ?", tag))
+			}
+		} else {
+			q = q.Where("uri IN (?)", db.Model(&postTagRow{}).Select("post_uri").Where("tag IN ?", query.Tags))
+		}
+	}
+
+	if len(query.Langs) > 0 {
+		q = q.Where("uri IN (?)", db.Model(&postLangRow{}).Select("post_uri").Where("lang IN ?", query.Langs))
+	}
+
+	if query.ExcludeReplies {
+		q = q.Where("reply_parent = ?", "")
+	}
+
+	if query.ExcludeReposts {
+		q = q.Where("repost_of = ?", "")
+	}
+
+	if !query.Since.IsZero() {
+		q = q.Where("indexed_at >= ?", query.Since.UnixMicro())
+	}
+
+	if !query.Until.IsZero() {
+		q = q.Where("indexed_at < ?", query.Until.UnixMicro())
+	}
+
+	if query.Cursor != "" {
+		cursorTime, cursorCID, err := DecodeCursor(query.Cursor)
+		if err != nil {
+			return nil, nil, err
+		}
+		micros := cursorTime.UnixMicro()
+		q = q.Where("(indexed_at < ? OR (indexed_at = ? AND cid < ?))", micros, micros, cursorCID)
+	}
+
+	rows := []postRow{}
+	if err := q.Find(&rows).Error; err != nil {
+		span.RecordError(err)
+		return nil, nil, fmt.Errorf("error querying posts: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("posts.length", len(rows)))
+
+	posts := make([]*Post, 0, len(rows))
+	postsByURI := make(map[string]*Post, len(rows))
+	uris := make([]string, 0, len(rows))
+	for _, row := range rows {
+		post := &Post{
+			URI:         row.URI,
+			CID:         row.CID,
+			Author:      row.Author,
+			Text:        row.Text,
+			ReplyParent: row.ReplyParent,
+			ReplyRoot:   row.ReplyRoot,
+			RepostOf:    row.RepostOf,
+			CreatedAt:   time.UnixMicro(row.CreatedAt),
+			IndexedAt:   time.UnixMicro(row.IndexedAt),
+		}
+		posts = append(posts, post)
+		postsByURI[row.URI] = post
+		uris = append(uris, row.URI)
+	}
+
+	if len(uris) > 0 {
+		tagRows := []postTagRow{}
+		if err := db.Where("post_uri IN ?", uris).Find(&tagRows).Error; err != nil {
+			return nil, nil, fmt.Errorf("error querying post tags: %w", err)
+		}
+		for _, tagRow := range tagRows {
+			postsByURI[tagRow.PostURI].Tags = append(postsByURI[tagRow.PostURI].Tags, tagRow.Tag)
+		}
+
+		langRows := []postLangRow{}
+		if err := db.Where("post_uri IN ?", uris).Find(&langRows).Error; err != nil {
+			return nil, nil, fmt.Errorf("error querying post langs: %w", err)
+		}
+		for _, langRow := range langRows {
+			postsByURI[langRow.PostURI].Langs = append(postsByURI[langRow.PostURI].Langs, langRow.Lang)
+		}
+	}
+
+	var newCursor *string
+	if int64(len(posts)) == query.Limit {
+		last := posts[len(posts)-1]
+		newCursor = new(string)
+		*newCursor = EncodeCursor(last.IndexedAt, last.CID)
+	}
+
+	return posts, newCursor, nil
+}
+
+// InsertFollow indexes a follow
+func (s *SQLStore) InsertFollow(ctx context.Context, follow *Follow) error {
+	err := s.DB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&followRow{
+		Feed:      follow.Feed,
+		URI:       follow.URI,
+		Actor:     follow.Actor,
+		Subject:   follow.Subject,
+		CreatedAt: follow.CreatedAt.UnixMicro(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("error inserting follow: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteFollow removes a follow from a feed and returns it, or returns nil if it wasn't indexed for the feed
+func (s *SQLStore) DeleteFollow(ctx context.Context, feed string, uri string) (*Follow, error) {
+	var deleted *Follow
+
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		rows := []followRow{}
+		if err := tx.Where("feed = ? AND uri = ?", feed, uri).Limit(1).Find(&rows).Error; err != nil {
+			return err
+		}
+
+		if len(rows) == 0 {
+			return nil
+		}
+
+		deleted = &Follow{
+			Feed:      rows[0].Feed,
+			URI:       rows[0].URI,
+			Actor:     rows[0].Actor,
+			Subject:   rows[0].Subject,
+			CreatedAt: time.UnixMicro(rows[0].CreatedAt),
+		}
+
+		return tx.Where("feed = ? AND uri = ?", feed, uri).Delete(&followRow{}).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error deleting follow: %w", err)
+	}
+
+	return deleted, nil
+}
+
+// GetFollowing returns the DIDs of every account the actor follows in a feed
+func (s *SQLStore) GetFollowing(ctx context.Context, feed string, actor string) ([]string, error) {
+	following := []string{}
+	err := s.DB.WithContext(ctx).Model(&followRow{}).Where("feed = ? AND actor = ?", feed, actor).Distinct().Pluck("subject", &following).Error
+	if err != nil {
+		return nil, fmt.Errorf("error querying follows: %w", err)
+	}
+
+	return following, nil
+}
+
+// GetFollowActors returns the DIDs of every actor that has follows indexed for a feed
+func (s *SQLStore) GetFollowActors(ctx context.Context, feed string) ([]string, error) {
+	actors := []string{}
+	err := s.DB.WithContext(ctx).Model(&followRow{}).Where("feed = ?", feed).Distinct().Pluck("actor", &actors).Error
+	if err != nil {
+		return nil, fmt.Errorf("error querying follow actors: %w", err)
+	}
+
+	return actors, nil
+}
+
+// InsertInteractions stores a batch of interactions
+func (s *SQLStore) InsertInteractions(ctx context.Context, interactions []*Interaction) error {
+	if len(interactions) == 0 {
+		return nil
+	}
+
+	rows := make([]interactionRow, 0, len(interactions))
+	for _, interaction := range interactions {
+		rows = append(rows, interactionRow{
+			Viewer:      interaction.Viewer,
+			Item:        interaction.Item,
+			Event:       interaction.Event,
+			FeedContext: interaction.FeedContext,
+			ReqID:       interaction.ReqID,
+			Feed:        interaction.Feed,
+			CreatedAt:   interaction.CreatedAt.UnixMicro(),
+		})
+	}
+
+	if err := s.DB.WithContext(ctx).Create(&rows).Error; err != nil {
+		return fmt.Errorf("error inserting interactions: %w", err)
+	}
+
+	return nil
+}
+
+// GetInteractions returns up to limit of a viewer's interactions, newest first
+func (s *SQLStore) GetInteractions(ctx context.Context, viewer string, limit int) ([]*Interaction, error) {
+	rows := []interactionRow{}
+	err := s.DB.WithContext(ctx).Where("viewer = ?", viewer).Order("created_at DESC, id DESC").Limit(limit).Find(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("error querying interactions: %w", err)
+	}
+
+	interactions := make([]*Interaction, 0, len(rows))
+	for _, row := range rows {
+		interactions = append(interactions, &Interaction{
+			Viewer:      row.Viewer,
+			Item:        row.Item,
+			Event:       row.Event,
+			FeedContext: row.FeedContext,
+			ReqID:       row.ReqID,
+			Feed:        row.Feed,
+			CreatedAt:   time.UnixMicro(row.CreatedAt),
+		})
+	}
+
+	return interactions, nil
+}
+
+// Close closes the underlying database connection
+func (s *SQLStore) Close() error {
+	sqlDB, err := s.DB.DB()
+	if err != nil {
+		return err
+	}
+
+	return sqlDB.Close()
+}
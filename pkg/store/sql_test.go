@@ -0,0 +1,57 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *SQLStore {
+	ctx := context.Background()
+
+	s, err := NewSQLiteStore(ctx, filepath.Join(t.TempDir(), "feedgen.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestQueryPostsDefaultsNonPositiveLimits(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	indexedAt := time.Now()
+	for i := 0; i < DefaultLimit+10; i++ {
+		err := s.InsertPost(ctx, &Post{
+			URI:       fmt.Sprintf("at://did:plc:author/app.bsky.feed.post/%d", i),
+			CID:       fmt.Sprintf("cid%d", i),
+			Author:    "did:plc:author",
+			CreatedAt: indexedAt,
+			IndexedAt: indexedAt.Add(time.Duration(i) * time.Second),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, limit := range []int64{0, -1} {
+		posts, cursor, err := s.QueryPosts(ctx, PostQuery{Limit: limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(posts) != DefaultLimit {
+			t.Errorf("got %d posts for limit %d, expected a default page of %d", len(posts), limit, DefaultLimit)
+		}
+		if cursor == nil {
+			t.Errorf("got no cursor for limit %d with more posts to serve", limit)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Package store describes the PostStore interface, which feeds use to index and query posts,
+// and the SQL-backed implementations of it (embedded SQLite and PostgreSQL).
+package store
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Post is a post indexed in a PostStore
+// Reposts are indexed as Posts too, with the URI, CID, and Author of the repost record
+// and RepostOf set to the AT-URI of the reposted post
+type Post struct {
+	URI         string
+	CID         string
+	Author      string // DID of the post author
+	Text        string
+	Langs       []string
+	Tags        []string
+	ReplyParent string // AT-URI of the parent post if the post is a reply
+	ReplyRoot   string // AT-URI of the root post if the post is a reply
+	RepostOf    string // AT-URI of the reposted post if this is a repost
+	CreatedAt   time.Time
+	IndexedAt   time.Time
+
+	// Feeds are the names of the feeds the post is indexed for
+	// A post inserted again with different Feeds is added to those feeds as well
+	// Feeds is only read on insert and is not populated by QueryPosts
+	Feeds []string
+}
+
+// DefaultLimit is the page size of queries that don't set a positive Limit
+const DefaultLimit = 50
+
+// PostQuery filters the posts returned by QueryPosts
+// Empty fields are not filtered on, posts are returned newest (by IndexedAt) first
+type PostQuery struct {
+	Feed    string    // Only posts indexed for this feed
+	Authors []string  // Only posts by any of these DIDs
+	Tags    []string  // Only posts with any of these tags (or all of them if MatchAllTags is set)
+	Langs   []string  // Only posts in any of these languages
+	Since   time.Time // Only posts indexed at or after this time
+	Until   time.Time // Only posts indexed before this time
+	Limit   int64     // Posts per page, DefaultLimit if it isn't positive
+	Cursor  string    // Cursor returned by a previous QueryPosts call
+
+	MatchAllTags   bool // Require posts to have every tag in Tags instead of any of them
+	ExcludeReplies bool // Skip posts that are replies
+	ExcludeReposts bool // Skip reposts
+}
+
+// PostStore indexes posts for feeds to serve
+type PostStore interface {
+	// InsertPost indexes a post, it's a no-op if the post is already indexed for the same feeds
+	InsertPost(ctx context.Context, post *Post) error
+	// DeletePost removes a post from the index, and from every feed it was indexed for, by its AT-URI
+	DeletePost(ctx context.Context, uri string) error
+	// QueryPosts returns a page of posts matching the query and a cursor for the next page
+	// The cursor is nil when there are no more posts
+	QueryPosts(ctx context.Context, query PostQuery) ([]*Post, *string, error)
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// Follow is an app.bsky.graph.follow record indexed in a FollowStore
+// Follows are indexed per feed, so feeds that track different viewers don't share or delete each other's follows
+type Follow struct {
+	Feed      string // Name of the feed the follow is indexed for
+	URI       string
+	Actor     string // DID of the account doing the following
+	Subject   string // DID of the account being followed
+	CreatedAt time.Time
+}
+
+// FollowStore indexes follow records so feeds can build follow graphs
+type FollowStore interface {
+	// InsertFollow indexes a follow for its feed, it's a no-op if the follow is already indexed for the feed
+	InsertFollow(ctx context.Context, follow *Follow) error
+	// DeleteFollow removes a follow from a feed by its AT-URI and returns it, or returns nil if it wasn't indexed for the feed
+	DeleteFollow(ctx context.Context, feed string, uri string) (*Follow, error)
+	// GetFollowing returns the DIDs of every account the actor follows in a feed
+	GetFollowing(ctx context.Context, feed string, actor string) ([]string, error)
+	// GetFollowActors returns the DIDs of every actor that has follows indexed for a feed
+	GetFollowActors(ctx context.Context, feed string) ([]string, error)
+}
+
+// Interaction events viewers send with app.bsky.feed.sendInteractions, from app.bsky.feed.defs
+const (
+	InteractionRequestLess          = "app.bsky.feed.defs#requestLess"
+	InteractionRequestMore          = "app.bsky.feed.defs#requestMore"
+	InteractionClickthroughItem     = "app.bsky.feed.defs#clickthroughItem"
+	InteractionClickthroughAuthor   = "app.bsky.feed.defs#clickthroughAuthor"
+	InteractionClickthroughReposter = "app.bsky.feed.defs#clickthroughReposter"
+	InteractionClickthroughEmbed    = "app.bsky.feed.defs#clickthroughEmbed"
+	InteractionSeen                 = "app.bsky.feed.defs#interactionSeen"
+	InteractionLike                 = "app.bsky.feed.defs#interactionLike"
+	InteractionRepost               = "app.bsky.feed.defs#interactionRepost"
+	InteractionReply                = "app.bsky.feed.defs#interactionReply"
+	InteractionQuote                = "app.bsky.feed.defs#interactionQuote"
+	InteractionShare                = "app.bsky.feed.defs#interactionShare"
+)
+
+// KnownInteractionEvents are the interaction events the lexicon defines
+var KnownInteractionEvents = map[string]bool{
+	InteractionRequestLess:          true,
+	InteractionRequestMore:          true,
+	InteractionClickthroughItem:     true,
+	InteractionClickthroughAuthor:   true,
+	InteractionClickthroughReposter: true,
+	InteractionClickthroughEmbed:    true,
+	InteractionSeen:                 true,
+	InteractionLike:                 true,
+	InteractionRepost:               true,
+	InteractionReply:                true,
+	InteractionQuote:                true,
+	InteractionShare:                true,
+}
+
+// Interaction is a viewer's interaction with a post served by a feed, i.e. asking to see less like it
+type Interaction struct {
+	Viewer      string // DID of the viewer who sent the interaction
+	Item        string // AT-URI of the post
+	Event       string // One of the Interaction events, i.e. InteractionRequestLess
+	FeedContext string // Context the feed attached to the post when it served it, if any
+	ReqID       string // ID of the feed response that served the post, if any
+	Feed        string // Alias of the feed that served the post, if known
+	CreatedAt   time.Time
+}
+
+// InteractionStore keeps the interactions viewers send
+type InteractionStore interface {
+	// InsertInteractions stores a batch of interactions
+	InsertInteractions(ctx context.Context, interactions []*Interaction) error
+	// GetInteractions returns up to limit of a viewer's interactions, newest first
+	GetInteractions(ctx context.Context, viewer string, limit int) ([]*Interaction, error)
+}
+
+// InvalidCursorError is returned by QueryPosts when the cursor can't be parsed
+type InvalidCursorError struct {
+	error
+}
+
+// EncodeCursor encodes a timestamp and CID into a cursor string
+// Posts are ordered by time then CID, so the pair is a stable position in the index
+func EncodeCursor(t time.Time, cid string) string {
+	return strconv.FormatInt(t.UnixMicro(), 10) + "::" + cid
+}
+
+// DecodeCursor decodes a cursor string produced by EncodeCursor
+func DecodeCursor(cursor string) (time.Time, string, error) {
+	tsPart, cid, ok := strings.Cut(cursor, "::")
+	if !ok || cid == "" {
+		return time.Time{}, "", InvalidCursorError{fmt.Errorf("malformed cursor %q", cursor)}
+	}
+
+	micros, err := strconv.ParseInt(tsPart, 10, 64)
+	if err != nil {
+		return time.Time{}, "", InvalidCursorError{fmt.Errorf("cursor timestamp is not an integer: %w", err)}
+	}
+
+	return time.UnixMicro(micros), cid, nil
+}
@@ -0,0 +1,44 @@
+// Package tid decodes the timestamps of TIDs, the record keys of posts and most other records,
+// which lets feeds order and age posts from their AT-URI alone.
+package tid
+
+import (
+	"strings"
+	"time"
+)
+
+const alphabet = "234567abcdefghijklmnopqrstuvwxyz"
+
+// FromURI returns the time encoded in the TID record key of an AT-URI
+func FromURI(uri string) (time.Time, bool) {
+	idx := strings.LastIndex(uri, "/")
+	if idx < 0 {
+		return time.Time{}, false
+	}
+
+	return Parse(uri[idx+1:])
+}
+
+// Parse decodes the timestamp of a TID, a 13 character base32-sortable encoding of
+// 53 bits of microseconds since the UNIX epoch followed by a 10 bit clock ID
+func Parse(tid string) (time.Time, bool) {
+	if len(tid) != 13 {
+		return time.Time{}, false
+	}
+
+	var n uint64
+	for _, c := range tid {
+		v := strings.IndexRune(alphabet, c)
+		if v < 0 {
+			return time.Time{}, false
+		}
+		n = n<<5 | uint64(v)
+	}
+
+	// The top bit is always 0, so TIDs over 63 bits are invalid
+	if n>>63 != 0 {
+		return time.Time{}, false
+	}
+
+	return time.UnixMicro(int64(n >> 10)), true
+}
@@ -0,0 +1,30 @@
+// Package xrpc writes error responses in the envelope XRPC clients and the AppView expect
+package xrpc
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// Error names, i.e. the error field of an ErrorResponse
+// InvalidRequest, AuthRequired, Forbidden, InternalServerError, and MethodNotImplemented are generic XRPC errors,
+// UnknownFeed is declared by app.bsky.feed.getFeedSkeleton
+const (
+	InvalidRequest       = "InvalidRequest"
+	AuthRequired         = "AuthRequired"
+	Forbidden            = "Forbidden"
+	NotFound             = "NotFound"
+	UnknownFeed          = "UnknownFeed"
+	InternalServerError  = "InternalServerError"
+	MethodNotImplemented = "MethodNotImplemented"
+)
+
+// ErrorResponse is the body of an XRPC error, Error is a machine-readable name and Message is for humans
+type ErrorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message,omitempty"`
+}
+
+// AbortWithError writes an XRPC error response and stops the rest of the handlers from running
+func AbortWithError(c *gin.Context, status int, name string, message string) {
+	c.AbortWithStatusJSON(status, ErrorResponse{Error: name, Message: message})
+}